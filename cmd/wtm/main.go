@@ -5,25 +5,84 @@ import (
 	"os"
 
 	"github.com/aayushgautam/wtm/internal/build"
+	"github.com/aayushgautam/wtm/internal/hooks"
 	"github.com/aayushgautam/wtm/internal/sync"
 )
 
 func main() {
 	if len(os.Args) < 2 {
-		fmt.Fprintln(os.Stderr, "usage: wtm <sync|push|version> [options]")
+		fmt.Fprintln(os.Stderr, "usage: wtm <sync|push|status|diff|watch|doctor|history|restore|worktree|relink|prune|store|keygen|recipients|rekey|config|hooks|version> [options]")
 		os.Exit(2)
 	}
 
 	switch os.Args[1] {
 	case "sync":
 		if err := sync.Run(os.Args[2:]); err != nil {
-			fmt.Fprintln(os.Stderr, err.Error())
-			os.Exit(1)
+			fail(err)
 		}
 	case "push":
 		if err := sync.Push(os.Args[2:]); err != nil {
-			fmt.Fprintln(os.Stderr, err.Error())
-			os.Exit(1)
+			fail(err)
+		}
+	case "status":
+		if err := sync.Status(os.Args[2:]); err != nil {
+			fail(err)
+		}
+	case "diff":
+		if err := sync.Diff(os.Args[2:]); err != nil {
+			fail(err)
+		}
+	case "watch":
+		if err := sync.Watch(os.Args[2:]); err != nil {
+			fail(err)
+		}
+	case "doctor":
+		if err := sync.Doctor(os.Args[2:]); err != nil {
+			fail(err)
+		}
+	case "history":
+		if err := sync.History(os.Args[2:]); err != nil {
+			fail(err)
+		}
+	case "restore":
+		if err := sync.Restore(os.Args[2:]); err != nil {
+			fail(err)
+		}
+	case "worktree":
+		if err := sync.Worktree(os.Args[2:]); err != nil {
+			fail(err)
+		}
+	case "relink":
+		if err := sync.Relink(os.Args[2:]); err != nil {
+			fail(err)
+		}
+	case "prune":
+		if err := sync.Prune(os.Args[2:]); err != nil {
+			fail(err)
+		}
+	case "store":
+		if err := sync.Store(os.Args[2:]); err != nil {
+			fail(err)
+		}
+	case "keygen":
+		if err := sync.Keygen(os.Args[2:]); err != nil {
+			fail(err)
+		}
+	case "recipients":
+		if err := sync.Recipients(os.Args[2:]); err != nil {
+			fail(err)
+		}
+	case "rekey":
+		if err := sync.Rekey(os.Args[2:]); err != nil {
+			fail(err)
+		}
+	case "config":
+		if err := sync.Config(os.Args[2:]); err != nil {
+			fail(err)
+		}
+	case "hooks":
+		if err := hooks.Run(os.Args[2:]); err != nil {
+			fail(err)
 		}
 	case "version":
 		fmt.Println(build.Version)
@@ -32,3 +91,12 @@ func main() {
 		os.Exit(2)
 	}
 }
+
+// fail prints err, unless it has no message, and exits with the code the
+// command chose for its outcome.
+func fail(err error) {
+	if msg := err.Error(); msg != "" {
+		fmt.Fprintln(os.Stderr, msg)
+	}
+	os.Exit(sync.ExitCode(err))
+}
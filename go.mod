@@ -3,7 +3,10 @@ module github.com/aayushgautam/wtm
 go 1.22
 
 require (
+	c2sp.org/CCTV/age v0.0.0-20240306222714-3ec4d716e805
 	github.com/bmatcuk/doublestar/v4 v4.10.0
+	golang.org/x/crypto v0.33.0
 	gopkg.in/yaml.v3 v3.0.1
 )
 
+require golang.org/x/sys v0.30.0 // indirect
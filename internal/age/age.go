@@ -0,0 +1,420 @@
+// Package age implements the X25519 recipient type of the age v1 file
+// format (https://age-encryption.org/v1).
+package age
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	intro         = "age-encryption.org/v1\n"
+	x25519Label   = "age-encryption.org/v1/X25519"
+	recipientHRP  = "age"
+	identityHRP   = "age-secret-key-"
+	fileKeySize   = 16
+	streamNonce   = 16
+	chunkSize     = 64 * 1024
+	columnsPerRow = 64
+)
+
+var b64 = base64.RawStdEncoding.Strict()
+
+// ErrNoIdentity is returned by Decrypt when none of the identities is a
+// recipient of the file.
+var ErrNoIdentity = errors.New("no identity matched any of the file's recipients")
+
+// Recipient is an X25519 public key ("age1...").
+type Recipient struct {
+	key *ecdh.PublicKey
+}
+
+// ParseRecipient parses an "age1..." public key.
+func ParseRecipient(s string) (*Recipient, error) {
+	hrp, data, err := bech32Decode(s)
+	if err != nil {
+		return nil, fmt.Errorf("malformed recipient %q: %v", s, err)
+	}
+	if hrp != recipientHRP {
+		return nil, fmt.Errorf("malformed recipient %q: not an age X25519 public key", s)
+	}
+	key, err := ecdh.X25519().NewPublicKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("malformed recipient %q: %v", s, err)
+	}
+	return &Recipient{key: key}, nil
+}
+
+func (r *Recipient) String() string {
+	s, _ := bech32Encode(recipientHRP, r.key.Bytes())
+	return s
+}
+
+// Identity is an X25519 private key ("AGE-SECRET-KEY-1...").
+type Identity struct {
+	key *ecdh.PrivateKey
+}
+
+// GenerateIdentity creates a new random identity.
+func GenerateIdentity() (*Identity, error) {
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return &Identity{key: key}, nil
+}
+
+// ParseIdentity parses an "AGE-SECRET-KEY-1..." private key.
+func ParseIdentity(s string) (*Identity, error) {
+	hrp, data, err := bech32Decode(s)
+	if err != nil {
+		return nil, fmt.Errorf("malformed secret key: %v", err)
+	}
+	if hrp != identityHRP {
+		return nil, fmt.Errorf("malformed secret key: unknown type %q", hrp)
+	}
+	key, err := ecdh.X25519().NewPrivateKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("malformed secret key: %v", err)
+	}
+	return &Identity{key: key}, nil
+}
+
+// ParseIdentities reads an identity file as written by age-keygen: one key
+// per line, with blank lines and "#" comments ignored.
+func ParseIdentities(r io.Reader) ([]*Identity, error) {
+	var ids []*Identity
+	sc := bufio.NewScanner(r)
+	n := 0
+	for sc.Scan() {
+		n++
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		id, err := ParseIdentity(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", n, err)
+		}
+		ids = append(ids, id)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	if len(ids) == 0 {
+		return nil, fmt.Errorf("no secret keys found")
+	}
+	return ids, nil
+}
+
+func (i *Identity) String() string {
+	s, _ := bech32Encode(identityHRP, i.key.Bytes())
+	return strings.ToUpper(s)
+}
+
+// Recipient returns the public key matching i.
+func (i *Identity) Recipient() *Recipient {
+	return &Recipient{key: i.key.PublicKey()}
+}
+
+// IsEncrypted reports whether b starts with an age v1 header.
+func IsEncrypted(b []byte) bool {
+	return bytes.HasPrefix(b, []byte(intro))
+}
+
+type stanza struct {
+	typ  string
+	args []string
+	body []byte
+}
+
+// Encrypt encrypts plaintext to every recipient.
+func Encrypt(plaintext []byte, recipients ...*Recipient) ([]byte, error) {
+	if len(recipients) == 0 {
+		return nil, errors.New("no recipients")
+	}
+	fileKey := make([]byte, fileKeySize)
+	if _, err := rand.Read(fileKey); err != nil {
+		return nil, err
+	}
+
+	var hdr bytes.Buffer
+	hdr.WriteString(intro)
+	for _, r := range recipients {
+		s, err := r.wrap(fileKey)
+		if err != nil {
+			return nil, err
+		}
+		writeStanza(&hdr, s)
+	}
+	hdr.WriteString("---")
+	mac := headerMAC(fileKey, hdr.Bytes())
+	hdr.WriteString(" " + b64.EncodeToString(mac) + "\n")
+
+	nonce := make([]byte, streamNonce)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	hdr.Write(nonce)
+	payload, err := streamSeal(hkdfSHA256(fileKey, nonce, "payload"), plaintext)
+	if err != nil {
+		return nil, err
+	}
+	return append(hdr.Bytes(), payload...), nil
+}
+
+// Decrypt decrypts an age file with the first identity that unwraps it.
+func Decrypt(ciphertext []byte, identities ...*Identity) ([]byte, error) {
+	stanzas, macInput, mac, payload, err := parseHeader(ciphertext)
+	if err != nil {
+		return nil, err
+	}
+	var fileKey []byte
+	for _, id := range identities {
+		for _, s := range stanzas {
+			if k, ok := id.unwrap(s); ok {
+				fileKey = k
+				break
+			}
+		}
+		if fileKey != nil {
+			break
+		}
+	}
+	if fileKey == nil {
+		return nil, ErrNoIdentity
+	}
+	if !hmac.Equal(headerMAC(fileKey, macInput), mac) {
+		return nil, errors.New("bad header MAC")
+	}
+	if len(payload) < streamNonce {
+		return nil, errors.New("truncated payload")
+	}
+	key := hkdfSHA256(fileKey, payload[:streamNonce], "payload")
+	return streamOpen(key, payload[streamNonce:])
+}
+
+func (r *Recipient) wrap(fileKey []byte) (stanza, error) {
+	eph, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return stanza{}, err
+	}
+	shared, err := eph.ECDH(r.key)
+	if err != nil {
+		return stanza{}, err
+	}
+	share := eph.PublicKey().Bytes()
+	salt := append(append([]byte(nil), share...), r.key.Bytes()...)
+	aead, err := chacha20poly1305.New(hkdfSHA256(shared, salt, x25519Label))
+	if err != nil {
+		return stanza{}, err
+	}
+	return stanza{
+		typ:  "X25519",
+		args: []string{b64.EncodeToString(share)},
+		body: aead.Seal(nil, make([]byte, chacha20poly1305.NonceSize), fileKey, nil),
+	}, nil
+}
+
+func (i *Identity) unwrap(s stanza) ([]byte, bool) {
+	if s.typ != "X25519" || len(s.args) != 1 {
+		return nil, false
+	}
+	share, err := b64.DecodeString(s.args[0])
+	if err != nil {
+		return nil, false
+	}
+	pub, err := ecdh.X25519().NewPublicKey(share)
+	if err != nil {
+		return nil, false
+	}
+	shared, err := i.key.ECDH(pub)
+	if err != nil {
+		return nil, false
+	}
+	salt := append(append([]byte(nil), share...), i.key.PublicKey().Bytes()...)
+	aead, err := chacha20poly1305.New(hkdfSHA256(shared, salt, x25519Label))
+	if err != nil {
+		return nil, false
+	}
+	fileKey, err := aead.Open(nil, make([]byte, chacha20poly1305.NonceSize), s.body, nil)
+	if err != nil || len(fileKey) != fileKeySize {
+		return nil, false
+	}
+	return fileKey, true
+}
+
+func writeStanza(w *bytes.Buffer, s stanza) {
+	w.WriteString("-> " + s.typ)
+	for _, a := range s.args {
+		w.WriteString(" " + a)
+	}
+	w.WriteByte('\n')
+	body := b64.EncodeToString(s.body)
+	for len(body) >= columnsPerRow {
+		w.WriteString(body[:columnsPerRow] + "\n")
+		body = body[columnsPerRow:]
+	}
+	// The last line is always shorter than a full row, even if empty.
+	w.WriteString(body + "\n")
+}
+
+// parseHeader splits an age file into its stanzas, the bytes covered by the
+// header MAC, the MAC and the payload.
+func parseHeader(b []byte) (stanzas []stanza, macInput, mac, payload []byte, err error) {
+	if !IsEncrypted(b) {
+		return nil, nil, nil, nil, errors.New("not an age file")
+	}
+	pos := len(intro)
+	nextLine := func() (string, bool) {
+		i := bytes.IndexByte(b[pos:], '\n')
+		if i < 0 {
+			return "", false
+		}
+		line := string(b[pos : pos+i])
+		pos += i + 1
+		return line, true
+	}
+	for {
+		start := pos
+		line, ok := nextLine()
+		if !ok {
+			return nil, nil, nil, nil, errors.New("truncated header")
+		}
+		if rest, ok := strings.CutPrefix(line, "--- "); ok {
+			mac, err := b64.DecodeString(rest)
+			if err != nil {
+				return nil, nil, nil, nil, fmt.Errorf("malformed header MAC: %v", err)
+			}
+			return stanzas, b[:start+len("---")], mac, b[pos:], nil
+		}
+		fields, ok := strings.CutPrefix(line, "-> ")
+		if !ok {
+			return nil, nil, nil, nil, fmt.Errorf("malformed header line %q", line)
+		}
+		parts := strings.Split(fields, " ")
+		for _, part := range parts {
+			if !isArbitraryString(part) {
+				return nil, nil, nil, nil, fmt.Errorf("malformed stanza line %q", line)
+			}
+		}
+		s := stanza{typ: parts[0], args: parts[1:]}
+		var body strings.Builder
+		for {
+			l, ok := nextLine()
+			if !ok || len(l) > columnsPerRow {
+				return nil, nil, nil, nil, errors.New("malformed stanza body")
+			}
+			body.WriteString(l)
+			if len(l) < columnsPerRow {
+				break
+			}
+		}
+		if s.body, err = b64.DecodeString(body.String()); err != nil {
+			return nil, nil, nil, nil, fmt.Errorf("malformed stanza body: %v", err)
+		}
+		stanzas = append(stanzas, s)
+	}
+}
+
+// isArbitraryString reports whether s is a non-empty run of printable ASCII
+// characters other than space, as stanza types and arguments must be.
+func isArbitraryString(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if s[i] < 0x21 || s[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+func headerMAC(fileKey, header []byte) []byte {
+	h := hmac.New(sha256.New, hkdfSHA256(fileKey, nil, "header"))
+	h.Write(header)
+	return h.Sum(nil)
+}
+
+// streamSeal encrypts plaintext in 64 KiB STREAM chunks.
+func streamSeal(key, plaintext []byte) ([]byte, error) {
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return nil, err
+	}
+	var out []byte
+	var counter uint64
+	for {
+		n := min(len(plaintext), chunkSize)
+		last := n == len(plaintext)
+		nonce := streamChunkNonce(counter, last)
+		out = aead.Seal(out, nonce, plaintext[:n], nil)
+		if last {
+			return out, nil
+		}
+		plaintext = plaintext[n:]
+		counter++
+	}
+}
+
+func streamOpen(key, ciphertext []byte) ([]byte, error) {
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return nil, err
+	}
+	const sealedChunk = chunkSize + chacha20poly1305.Overhead
+	var out []byte
+	var counter uint64
+	for {
+		n := min(len(ciphertext), sealedChunk)
+		last := n == len(ciphertext)
+		nonce := streamChunkNonce(counter, last)
+		chunk, err := aead.Open(nil, nonce, ciphertext[:n], nil)
+		if err != nil {
+			return nil, fmt.Errorf("payload chunk %d: %w", counter, err)
+		}
+		if len(chunk) == 0 && counter > 0 {
+			return nil, errors.New("payload ends with an empty chunk")
+		}
+		out = append(out, chunk...)
+		if last {
+			return out, nil
+		}
+		ciphertext = ciphertext[n:]
+		counter++
+	}
+}
+
+func streamChunkNonce(counter uint64, last bool) []byte {
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	for i := 10; i >= 3; i-- {
+		nonce[i] = byte(counter)
+		counter >>= 8
+	}
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+// hkdfSHA256 derives a 32-byte key with HKDF-SHA256 (RFC 5869).
+func hkdfSHA256(secret, salt []byte, info string) []byte {
+	key := make([]byte, chacha20poly1305.KeySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, secret, salt, []byte(info)), key); err != nil {
+		panic("age: hkdf: " + err.Error())
+	}
+	return key
+}
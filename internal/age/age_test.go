@@ -0,0 +1,213 @@
+package age
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	agetest "c2sp.org/CCTV/age"
+)
+
+// TestVectors decrypts the X25519 vectors of the age test suite, which were
+// generated with the reference implementation. Vectors for armor,
+// compression or other recipient types are skipped.
+func TestVectors(t *testing.T) {
+	names, err := fs.Glob(agetest.Vectors, "*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ran := 0
+	for _, name := range names {
+		b, err := fs.ReadFile(agetest.Vectors, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		header, file, _ := bytes.Cut(b, []byte("\n\n"))
+		var expect, payload string
+		var ids []*Identity
+		supported := true
+		for _, line := range strings.Split(string(header), "\n") {
+			key, value, _ := strings.Cut(line, ": ")
+			switch key {
+			case "expect":
+				expect = value
+			case "payload":
+				payload = value
+			case "identity":
+				id, err := ParseIdentity(value)
+				if err != nil {
+					supported = false
+				}
+				ids = append(ids, id)
+			case "armored", "compressed", "passphrase":
+				supported = false
+			}
+		}
+		if !supported || len(ids) == 0 {
+			continue
+		}
+		ran++
+		t.Run(name, func(t *testing.T) {
+			got, err := Decrypt(file, ids...)
+			if expect != "success" {
+				if err == nil {
+					t.Fatalf("expected %s, decrypted %d bytes", expect, len(got))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("decrypt: %v", err)
+			}
+			if sum := sha256.Sum256(got); hex.EncodeToString(sum[:]) != payload {
+				t.Fatalf("payload hash %x, want %s", sum, payload)
+			}
+		})
+	}
+	if ran == 0 {
+		t.Fatal("no vectors found")
+	}
+}
+
+const (
+	helloPlaintext = "DATABASE_URL=postgres://localhost/app\nSECRET=hunter2\n"
+	helloRecipient = "age1nkm472n8hck9hvcmu7nw2w4dmxnsztu5kqa4kzhaxtra384j8vnsl2lglp"
+)
+
+// TestDecryptAgeCLIFile decrypts testdata/hello.age, written by
+// "age -r $(age-keygen -y testdata/hello_key.txt) -o testdata/hello.age".
+func TestDecryptAgeCLIFile(t *testing.T) {
+	keys, err := os.Open(filepath.Join("testdata", "hello_key.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer keys.Close()
+	ids, err := ParseIdentities(keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// age-keygen's own encoding of the public key checks ours.
+	if r := ids[0].Recipient().String(); r != helloRecipient {
+		t.Fatalf("recipient %s, want %s", r, helloRecipient)
+	}
+	ct, err := os.ReadFile(filepath.Join("testdata", "hello.age"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := Decrypt(ct, ids...)
+	if err != nil {
+		t.Fatalf("decrypt: %v", err)
+	}
+	if string(got) != helloPlaintext {
+		t.Fatalf("unexpected plaintext %q", got)
+	}
+}
+
+func TestBech32(t *testing.T) {
+	for _, s := range []string{"A12UEL5L", "a12uel5l", "abcdef1qpzry9x8gf2tvdw0s3jn54khce6mua7lmqqqxw"} {
+		if _, _, err := bech32Decode(s); err != nil {
+			t.Errorf("%s: %v", s, err)
+		}
+	}
+	for _, s := range []string{"A12uEL5L", "a12uel5m", "pzry9x0s0muk"} {
+		if _, _, err := bech32Decode(s); err == nil {
+			t.Errorf("%s: expected error", s)
+		}
+	}
+	enc, err := bech32Encode("age", []byte{0, 1, 2, 0xff})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hrp, data, err := bech32Decode(enc)
+	if err != nil || hrp != "age" || !bytes.Equal(data, []byte{0, 1, 2, 0xff}) {
+		t.Fatalf("round trip of %s: %q %x %v", enc, hrp, data, err)
+	}
+}
+
+func TestKeysRoundTrip(t *testing.T) {
+	id, err := GenerateIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := id.String()
+	if !strings.HasPrefix(s, "AGE-SECRET-KEY-1") {
+		t.Fatalf("unexpected identity %s", s)
+	}
+	parsed, err := ParseIdentity(s)
+	if err != nil || parsed.String() != s {
+		t.Fatalf("identity round trip: %v", err)
+	}
+	r := id.Recipient().String()
+	if !strings.HasPrefix(r, "age1") || len(r) != 62 {
+		t.Fatalf("unexpected recipient %s", r)
+	}
+	if pr, err := ParseRecipient(r); err != nil || pr.String() != r {
+		t.Fatalf("recipient round trip: %v", err)
+	}
+	if _, err := ParseRecipient(strings.ToLower(s)); err == nil {
+		t.Fatalf("expected a secret key to be rejected as recipient")
+	}
+
+	ids, err := ParseIdentities(strings.NewReader("# created: now\n# public key: " + r + "\n\n" + s + "\n"))
+	if err != nil || len(ids) != 1 {
+		t.Fatalf("ParseIdentities: %v", err)
+	}
+}
+
+func TestEncryptDecrypt(t *testing.T) {
+	alice, _ := GenerateIdentity()
+	bob, _ := GenerateIdentity()
+	eve, _ := GenerateIdentity()
+
+	for _, n := range []int{0, 10, chunkSize, chunkSize + 1, 2*chunkSize + 5} {
+		pt := bytes.Repeat([]byte("S"), n)
+		ct, err := Encrypt(pt, alice.Recipient(), bob.Recipient())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !IsEncrypted(ct) {
+			t.Fatalf("%d: missing header", n)
+		}
+		for _, id := range []*Identity{alice, bob} {
+			got, err := Decrypt(ct, eve, id)
+			if err != nil || !bytes.Equal(got, pt) {
+				t.Fatalf("%d: decrypt: %v", n, err)
+			}
+		}
+		if _, err := Decrypt(ct, eve); !errors.Is(err, ErrNoIdentity) {
+			t.Fatalf("%d: expected ErrNoIdentity, got %v", n, err)
+		}
+		if n > 0 {
+			if _, err := Decrypt(ct[:len(ct)-1], alice); err == nil {
+				t.Fatalf("%d: expected truncated file to fail", n)
+			}
+		}
+	}
+}
+
+func TestDecryptRejectsTamperedHeader(t *testing.T) {
+	id, _ := GenerateIdentity()
+	other, _ := GenerateIdentity()
+	ct, err := Encrypt([]byte("A=1\n"), id.Recipient())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Swapping in a stanza for another recipient keeps the file key
+	// unwrappable only by other, and breaks the MAC for id.
+	extra, err := Encrypt([]byte("x"), other.Recipient())
+	if err != nil {
+		t.Fatal(err)
+	}
+	stanzaEnd := bytes.Index(extra, []byte("\n---"))
+	tampered := append([]byte(nil), ct[:len(intro)]...)
+	tampered = append(tampered, extra[len(intro):stanzaEnd+1]...)
+	tampered = append(tampered, ct[len(intro):]...)
+	if _, err := Decrypt(tampered, id); err == nil || errors.Is(err, ErrNoIdentity) {
+		t.Fatalf("expected MAC failure, got %v", err)
+	}
+}
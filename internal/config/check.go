@@ -0,0 +1,120 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Problem is one error found by Check.
+type Problem struct {
+	File    string // empty when Message already names the file
+	Line    int    // 0 when unknown
+	Message string
+}
+
+func (p Problem) String() string {
+	switch {
+	case p.File == "":
+		return p.Message
+	case p.Line == 0:
+		return p.File + ": " + p.Message
+	}
+	return fmt.Sprintf("%s:%d: %s", p.File, p.Line, p.Message)
+}
+
+// Check is a strict Load: it reports every unknown key and invalid glob
+// instead of stopping at the first error.
+func Check(repoRoot string) ([]Problem, error) {
+	userPath, err := UserConfigPath()
+	if err != nil {
+		return nil, err
+	}
+	var user UserConfig
+	problems := checkFile(userPath, &user)
+	problems = append(problems, checkGlobs(userPath, "defaults.", user.Defaults)...)
+	for i, r := range user.Repos {
+		problems = append(problems, checkGlobs(userPath, fmt.Sprintf("repos[%d].", i), r.Config)...)
+	}
+
+	repoPath := filepath.Join(repoRoot, DefaultConfigFileName)
+	var c Config
+	problems = append(problems, checkFile(repoPath, &c)...)
+	problems = append(problems, checkGlobs(repoPath, "", c)...)
+
+	if len(problems) == 0 {
+		if _, err := Load(repoRoot); err != nil {
+			problems = append(problems, Problem{Message: err.Error()})
+		}
+	}
+	return problems, nil
+}
+
+var (
+	typeErrorLine = regexp.MustCompile(`^line (\d+): (.*)$`)
+	unknownField  = regexp.MustCompile(`^field (\S+) not found in type \S+$`)
+)
+
+// checkFile decodes path into v, rejecting unknown keys. A missing file is
+// fine.
+func checkFile(path string, v interface{}) []Problem {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return []Problem{{File: path, Message: err.Error()}}
+	}
+	dec := yaml.NewDecoder(bytes.NewReader(b))
+	dec.KnownFields(true)
+	err = dec.Decode(v)
+	var typeErr *yaml.TypeError
+	switch {
+	case err == nil, errors.Is(err, io.EOF):
+		return nil
+	case errors.As(err, &typeErr):
+		var problems []Problem
+		for _, e := range typeErr.Errors {
+			p := Problem{File: path, Message: e}
+			if m := typeErrorLine.FindStringSubmatch(e); m != nil {
+				p.Line, _ = strconv.Atoi(m[1])
+				p.Message = m[2]
+			}
+			if m := unknownField.FindStringSubmatch(p.Message); m != nil {
+				p.Message = fmt.Sprintf("unknown key %q", m[1])
+			}
+			problems = append(problems, p)
+		}
+		return problems
+	default:
+		return []Problem{{File: path, Message: strings.TrimPrefix(err.Error(), "yaml: ")}}
+	}
+}
+
+func checkGlobs(path, prefix string, c Config) []Problem {
+	var problems []Problem
+	for _, set := range []struct {
+		key      string
+		patterns []string
+	}{{"include", c.Include}, {"exclude", c.Exclude}} {
+		for i, p := range set.patterns {
+			if !validGlob(p) {
+				problems = append(problems, Problem{File: path, Message: fmt.Sprintf("%s%s[%d]: invalid glob %q", prefix, set.key, i, p)})
+			}
+		}
+	}
+	for i, r := range c.Link.Rules {
+		if r.Pattern != "" && !validGlob(r.Pattern) {
+			problems = append(problems, Problem{File: path, Message: fmt.Sprintf("%slink.rules[%d]: invalid glob %q", prefix, i, r.Pattern)})
+		}
+	}
+	return problems
+}
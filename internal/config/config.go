@@ -1,56 +1,369 @@
 package config
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 
+	"github.com/aayushgautam/wtm/internal/age"
+	"github.com/bmatcuk/doublestar/v4"
 	"gopkg.in/yaml.v3"
 )
 
 const DefaultConfigFileName = ".worktree-manager.yml"
 
+// Store modes control how worktrees map onto store directories.
+const (
+	StoreModePerWorktree = "per-worktree" // each worktree links to its own copy
+	StoreModeShared      = "shared"       // every worktree links to one copy
+	StoreModeLayered     = "layered"      // shared base plus a per-worktree overlay
+)
+
+// Link modes control what sync places in a worktree for each store file.
+const (
+	LinkSymlink  = "symlink"  // a symlink to the store file
+	LinkHardlink = "hardlink" // a hard link to the store file
+	LinkCopy     = "copy"     // a regular file kept in step with the store by hash
+)
+
+// Symlink forms control how the target of a worktree symlink is written.
+const (
+	SymlinksAbsolute = "absolute" // the absolute store path
+	SymlinksRelative = "relative" // the store path relative to the link
+)
+
 type Config struct {
-	Include []string `yaml:"include"`
-	Exclude []string `yaml:"exclude"`
+	Include    []string         `yaml:"include"`
+	Exclude    []string         `yaml:"exclude"`
+	Store      StoreConfig      `yaml:"store"`
+	Link       LinkConfig       `yaml:"link"`
+	Symlinks   string           `yaml:"symlinks"`
+	Encryption EncryptionConfig `yaml:"encryption,omitempty"`
+	History    HistoryConfig    `yaml:"history,omitempty"`
+	Templates  TemplateConfig   `yaml:"templates,omitempty"`
+}
+
+type StoreConfig struct {
+	Mode string `yaml:"mode"`
+}
+
+// LinkConfig chooses the link mode per file: the first matching rule, else
+// Mode.
+type LinkConfig struct {
+	Mode  string     `yaml:"mode"`
+	Rules []LinkRule `yaml:"rules,omitempty"`
+}
+
+type LinkRule struct {
+	Pattern string `yaml:"pattern"`
+	Mode    string `yaml:"mode"`
+}
+
+func (l *LinkConfig) UnmarshalYAML(n *yaml.Node) error {
+	if n.Kind == yaml.ScalarNode {
+		return n.Decode(&l.Mode)
+	}
+	type plain LinkConfig
+	return n.Decode((*plain)(l))
+}
+
+// EncryptionConfig lists the age X25519 public keys ("age1...") store files
+// are encrypted to. The store is kept in plain text when it is empty.
+type EncryptionConfig struct {
+	Recipients []string `yaml:"recipients,omitempty"`
+}
+
+// Enabled reports whether store files are encrypted.
+func (e EncryptionConfig) Enabled() bool {
+	return len(e.Recipients) > 0
+}
+
+// DefaultHistoryKeep is how many snapshots of each store file are kept
+// unless history.keep says otherwise.
+const DefaultHistoryKeep = 20
+
+// HistoryConfig sets how many snapshots of each store file the store keeps;
+// older ones are dropped as new ones are taken.
+type HistoryConfig struct {
+	Keep int `yaml:"keep,omitempty"`
+}
+
+// Default port range templates allocate from.
+const (
+	DefaultPortFrom = 10000
+	DefaultPortTo   = 19999
+)
+
+// TemplateConfig sets the variables templates can use besides the built-in
+// ones, and the range "port" allocates from.
+type TemplateConfig struct {
+	Vars  map[string]string `yaml:"vars,omitempty"`
+	Ports PortRange         `yaml:"ports,omitempty"`
+}
+
+// PortRange is an inclusive range of TCP ports.
+type PortRange struct {
+	From int `yaml:"from,omitempty"`
+	To   int `yaml:"to,omitempty"`
 }
 
 func Default() Config {
 	return Config{
-		Include: []string{".env", ".env.*", "**/.env", "**/.env.*"},
-		Exclude: []string{"**/*.example*", "**/node_modules/**", "**/.git/**"},
+		Include:  []string{".env", ".env.*", "**/.env", "**/.env.*"},
+		Exclude:  []string{"**/*.example*", "**/node_modules/**", "**/.git/**"},
+		Store:    StoreConfig{Mode: StoreModePerWorktree},
+		Link:     LinkConfig{Mode: LinkSymlink},
+		Symlinks: SymlinksAbsolute,
+		History:  HistoryConfig{Keep: DefaultHistoryKeep},
+		Templates: TemplateConfig{
+			Ports: PortRange{From: DefaultPortFrom, To: DefaultPortTo},
+		},
 	}
 }
 
 type Loaded struct {
 	Config Config
-	Source string // "defaults" or absolute file path
+	Source string // "defaults", or the files that contributed, highest precedence first
+	// Layers lists where settings were read from, lowest precedence first:
+	// "defaults", then user config layers, then the repo's config file.
+	Layers []string
+	// Origins maps each setting (see Keys) to the layer its value came from.
+	Origins map[string]string
+}
+
+// Keys lists the settings Origins reports on, in file order.
+var Keys = []string{"include", "exclude", "store.mode", "link.mode", "link.rules", "symlinks", "encryption.recipients", "history.keep", "templates.vars", "templates.ports"}
+
+type layer struct {
+	source string // how Origins names the layer
+	file   string // the file it was read from; empty for the built-in defaults
+	config Config
 }
 
+// Load merges the built-in defaults, the user config and the repo's
+// .worktree-manager.yml, later layers replacing earlier settings.
 func Load(repoRoot string) (Loaded, error) {
-	path := filepath.Join(repoRoot, DefaultConfigFileName)
-	b, err := os.ReadFile(path)
+	layers := []layer{{source: "defaults", config: Default()}}
+
+	user, userPath, err := LoadUser()
 	if err != nil {
-		if errors.Is(err, os.ErrNotExist) {
-			return Loaded{Config: Default(), Source: "defaults"}, nil
+		return Loaded{}, err
+	}
+	if userPath != "defaults" {
+		layers = append(layers, layer{source: userPath + " (defaults)", file: userPath, config: user.Defaults})
+		matched, err := user.matchingRepos(repoRoot)
+		if err != nil {
+			return Loaded{}, err
+		}
+		for _, i := range matched {
+			layers = append(layers, layer{source: fmt.Sprintf("%s (repos[%d])", userPath, i), file: userPath, config: user.Repos[i].Config})
 		}
+	}
+
+	path := filepath.Join(repoRoot, DefaultConfigFileName)
+	b, err := os.ReadFile(path)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+	case err != nil:
 		return Loaded{}, fmt.Errorf("failed to read config %s: %w", path, err)
+	default:
+		var c Config
+		if err := yaml.Unmarshal(b, &c); err != nil {
+			return Loaded{}, fmt.Errorf("failed to parse %s: %w", path, err)
+		}
+		layers = append(layers, layer{source: path, file: path, config: c})
+	}
+
+	c, origins := merge(layers)
+	if err := validate(c, origins); err != nil {
+		return Loaded{}, err
 	}
 
+	loaded := Loaded{Config: c, Source: "defaults", Origins: origins}
+	var files []string
+	for _, l := range layers {
+		loaded.Layers = append(loaded.Layers, l.source)
+		if l.file != "" && (len(files) == 0 || files[0] != l.file) {
+			files = append([]string{l.file}, files...)
+		}
+	}
+	if len(files) > 0 {
+		loaded.Source = strings.Join(files, ", ")
+	}
+	return loaded, nil
+}
+
+// merge applies layers in order. Empty values leave the value of earlier
+// layers in place, which keeps an empty config file behaving like defaults.
+func merge(layers []layer) (Config, map[string]string) {
 	var c Config
-	if err := yaml.Unmarshal(b, &c); err != nil {
-		return Loaded{}, fmt.Errorf("failed to parse %s: %w", path, err)
+	origins := make(map[string]string)
+	for _, l := range layers {
+		lc := l.config
+		if len(lc.Include) > 0 {
+			c.Include, origins["include"] = lc.Include, l.source
+		}
+		if len(lc.Exclude) > 0 {
+			c.Exclude, origins["exclude"] = lc.Exclude, l.source
+		}
+		if lc.Store.Mode != "" {
+			c.Store.Mode, origins["store.mode"] = lc.Store.Mode, l.source
+		}
+		if lc.Link.Mode != "" {
+			c.Link.Mode, origins["link.mode"] = lc.Link.Mode, l.source
+		}
+		if len(lc.Link.Rules) > 0 {
+			c.Link.Rules, origins["link.rules"] = lc.Link.Rules, l.source
+		}
+		if lc.Symlinks != "" {
+			c.Symlinks, origins["symlinks"] = lc.Symlinks, l.source
+		}
+		if len(lc.Encryption.Recipients) > 0 {
+			c.Encryption.Recipients, origins["encryption.recipients"] = lc.Encryption.Recipients, l.source
+		}
+		if lc.History.Keep != 0 {
+			c.History.Keep, origins["history.keep"] = lc.History.Keep, l.source
+		}
+		if len(lc.Templates.Vars) > 0 {
+			c.Templates.Vars, origins["templates.vars"] = lc.Templates.Vars, l.source
+		}
+		if lc.Templates.Ports.From != 0 {
+			c.Templates.Ports.From, origins["templates.ports"] = lc.Templates.Ports.From, l.source
+		}
+		if lc.Templates.Ports.To != 0 {
+			c.Templates.Ports.To, origins["templates.ports"] = lc.Templates.Ports.To, l.source
+		}
+	}
+	return c, origins
+}
+
+// validate checks the merged config, naming the layer each bad value came
+// from.
+func validate(c Config, origins map[string]string) error {
+	for _, set := range []struct {
+		key      string
+		patterns []string
+	}{{"include", c.Include}, {"exclude", c.Exclude}} {
+		for _, p := range set.patterns {
+			if !validGlob(p) {
+				return fmt.Errorf("%s: %s: invalid glob %q", origins[set.key], set.key, p)
+			}
+		}
+	}
+
+	switch c.Store.Mode {
+	case StoreModePerWorktree, StoreModeShared, StoreModeLayered:
+	default:
+		return fmt.Errorf("%s: unknown store.mode %q (want %q, %q or %q)", origins["store.mode"], c.Store.Mode, StoreModePerWorktree, StoreModeShared, StoreModeLayered)
+	}
+
+	if err := validLinkMode(c.Link.Mode); err != nil {
+		return fmt.Errorf("%s: link.mode: %w", origins["link.mode"], err)
+	}
+	for i, r := range c.Link.Rules {
+		if r.Pattern == "" {
+			return fmt.Errorf("%s: link.rules[%d]: missing pattern", origins["link.rules"], i)
+		}
+		if !validGlob(r.Pattern) {
+			return fmt.Errorf("%s: link.rules[%d]: invalid glob %q", origins["link.rules"], i, r.Pattern)
+		}
+		if err := validLinkMode(r.Mode); err != nil {
+			return fmt.Errorf("%s: link.rules[%d]: %w", origins["link.rules"], i, err)
+		}
+	}
+
+	switch c.Symlinks {
+	case SymlinksAbsolute, SymlinksRelative:
+	default:
+		return fmt.Errorf("%s: unknown symlinks %q (want %q or %q)", origins["symlinks"], c.Symlinks, SymlinksAbsolute, SymlinksRelative)
 	}
 
-	// If user provides an empty config file, keep behavior sane.
-	if len(c.Include) == 0 {
-		c.Include = Default().Include
+	for _, r := range c.Encryption.Recipients {
+		if _, err := age.ParseRecipient(r); err != nil {
+			return fmt.Errorf("%s: encryption.recipients: %w", origins["encryption.recipients"], err)
+		}
+	}
+	if c.Encryption.Enabled() && c.Store.Mode == StoreModeLayered {
+		return fmt.Errorf("%s: encryption is not supported with store.mode %q", origins["encryption.recipients"], StoreModeLayered)
+	}
+	if c.History.Keep < 1 {
+		return fmt.Errorf("%s: history.keep must be at least 1, got %d", origins["history.keep"], c.History.Keep)
+	}
+	for name := range c.Templates.Vars {
+		if !validVarName(name) {
+			return fmt.Errorf("%s: templates.vars: invalid name %q (want letters, digits and _)", origins["templates.vars"], name)
+		}
+		if strings.HasPrefix(name, "WTM_") {
+			return fmt.Errorf("%s: templates.vars: %s: names starting with WTM_ are reserved", origins["templates.vars"], name)
+		}
+	}
+	if p := c.Templates.Ports; p.From < 1 || p.To > 65535 || p.From > p.To {
+		return fmt.Errorf("%s: templates.ports: invalid range %d-%d", origins["templates.ports"], p.From, p.To)
+	}
+	return nil
+}
+
+// validVarName reports whether name can be used in a template: letters,
+// digits and underscores, not starting with a digit.
+func validVarName(name string) bool {
+	for i, r := range name {
+		switch {
+		case r == '_', r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z':
+		case r >= '0' && r <= '9' && i > 0:
+		default:
+			return false
+		}
+	}
+	return name != ""
+}
+
+// validGlob reports whether pattern is valid doublestar syntax once
+// normalized the way sync matches it.
+func validGlob(pattern string) bool {
+	return doublestar.ValidatePattern(filepath.ToSlash(strings.TrimSpace(pattern)))
+}
+
+func validLinkMode(mode string) error {
+	switch mode {
+	case LinkSymlink, LinkHardlink, LinkCopy:
+		return nil
 	}
-	if len(c.Exclude) == 0 {
-		c.Exclude = Default().Exclude
+	return fmt.Errorf("unknown link mode %q (want %q, %q or %q)", mode, LinkSymlink, LinkHardlink, LinkCopy)
+}
+
+// Resolved renders the effective config as YAML, with a comment on every
+// setting naming the layer it came from.
+func (l Loaded) Resolved() ([]byte, error) {
+	var doc yaml.Node
+	if err := doc.Encode(l.Config); err != nil {
+		return nil, err
 	}
+	annotateOrigins(&doc, "", l.Origins)
+	doc.HeadComment = "layers, lowest precedence first:\n" + strings.Join(l.Layers, "\n")
 
-	return Loaded{Config: c, Source: path}, nil
+	var out bytes.Buffer
+	e := yaml.NewEncoder(&out)
+	e.SetIndent(2)
+	if err := e.Encode(&doc); err != nil {
+		return nil, err
+	}
+	if err := e.Close(); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
 }
 
+func annotateOrigins(m *yaml.Node, prefix string, origins map[string]string) {
+	for i := 0; i+1 < len(m.Content); i += 2 {
+		key, value := m.Content[i], m.Content[i+1]
+		if origin, ok := origins[prefix+key.Value]; ok {
+			key.LineComment = origin
+		}
+		if value.Kind == yaml.MappingNode {
+			annotateOrigins(value, prefix+key.Value+".", origins)
+		}
+	}
+}
@@ -3,9 +3,23 @@ package config
 import (
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 )
 
+// TestMain points the user config at an empty directory so a config on the
+// machine running the tests does not leak into them.
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "wtm-config-test")
+	if err != nil {
+		panic(err)
+	}
+	os.Setenv("XDG_CONFIG_HOME", dir)
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
 func TestLoadDefaultsWhenMissing(t *testing.T) {
 	dir := t.TempDir()
 	loaded, err := Load(dir)
@@ -38,3 +52,345 @@ func TestLoadParsesYaml(t *testing.T) {
 	}
 }
 
+func TestLoadStoreMode(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, DefaultConfigFileName)
+	if err := os.WriteFile(path, []byte("store:\n  mode: shared\n"), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	loaded, err := Load(dir)
+	if err != nil {
+		t.Fatalf("expected nil err, got %v", err)
+	}
+	if loaded.Config.Store.Mode != StoreModeShared {
+		t.Fatalf("expected shared mode, got %q", loaded.Config.Store.Mode)
+	}
+
+	if err := os.WriteFile(path, []byte("store:\n  mode: bogus\n"), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if _, err := Load(dir); err == nil {
+		t.Fatalf("expected error for unknown store mode")
+	}
+}
+
+func TestSetRecipientsKeepsRestOfFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, DefaultConfigFileName)
+	src := "# team config\ninclude:\n  - apps/*/.env # api only\nstore:\n  mode: shared\n"
+	if err := os.WriteFile(path, []byte(src), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	r := "age1ql3z7hjy54pw3hyww5ayyfg7zqgvc7w3j2elw8zmrj2kg5sfn9aqmcac8p"
+	if _, err := SetRecipients(dir, []string{r}); err != nil {
+		t.Fatalf("SetRecipients: %v", err)
+	}
+	b, _ := os.ReadFile(path)
+	for _, want := range []string{"# team config", "# api only", "mode: shared", "encryption:\n  recipients:\n    - " + r} {
+		if !strings.Contains(string(b), want) {
+			t.Fatalf("expected %q in:\n%s", want, b)
+		}
+	}
+	loaded, err := Load(dir)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if !loaded.Config.Encryption.Enabled() || loaded.Config.Encryption.Recipients[0] != r {
+		t.Fatalf("unexpected encryption config %#v", loaded.Config.Encryption)
+	}
+
+	if _, err := SetRecipients(dir, nil); err != nil {
+		t.Fatalf("SetRecipients: %v", err)
+	}
+	loaded, err = Load(dir)
+	if err != nil || loaded.Config.Encryption.Enabled() {
+		t.Fatalf("expected encryption off, got %#v, %v", loaded.Config.Encryption, err)
+	}
+}
+
+func TestLoadRejectsBadRecipient(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, DefaultConfigFileName)
+	if err := os.WriteFile(path, []byte("encryption:\n  recipients: [age1nope]\n"), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if _, err := Load(dir); err == nil {
+		t.Fatalf("expected error for malformed recipient")
+	}
+}
+
+func TestLoadLinkModes(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, DefaultConfigFileName)
+	if err := os.WriteFile(path, []byte("link: copy\n"), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	loaded, err := Load(dir)
+	if err != nil {
+		t.Fatalf("expected nil err, got %v", err)
+	}
+	if loaded.Config.Link.Mode != LinkCopy {
+		t.Fatalf("expected copy mode, got %q", loaded.Config.Link.Mode)
+	}
+
+	src := "link:\n  rules:\n    - pattern: apps/web/.env*\n      mode: hardlink\n"
+	if err := os.WriteFile(path, []byte(src), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	loaded, err = Load(dir)
+	if err != nil {
+		t.Fatalf("expected nil err, got %v", err)
+	}
+	if loaded.Config.Link.Mode != LinkSymlink || len(loaded.Config.Link.Rules) != 1 || loaded.Config.Link.Rules[0].Mode != LinkHardlink {
+		t.Fatalf("unexpected link config %#v", loaded.Config.Link)
+	}
+
+	if err := os.WriteFile(path, []byte("link:\n  rules:\n    - pattern: .env\n      mode: bogus\n"), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if _, err := Load(dir); err == nil {
+		t.Fatalf("expected error for unknown link mode")
+	}
+}
+
+func TestLoadSymlinks(t *testing.T) {
+	dir := t.TempDir()
+	loaded, err := Load(dir)
+	if err != nil || loaded.Config.Symlinks != SymlinksAbsolute {
+		t.Fatalf("expected absolute default, got %q, %v", loaded.Config.Symlinks, err)
+	}
+	path := filepath.Join(dir, DefaultConfigFileName)
+	if err := os.WriteFile(path, []byte("symlinks: relative\n"), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	loaded, err = Load(dir)
+	if err != nil || loaded.Config.Symlinks != SymlinksRelative {
+		t.Fatalf("expected relative, got %q, %v", loaded.Config.Symlinks, err)
+	}
+	if err := os.WriteFile(path, []byte("symlinks: sideways\n"), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if _, err := Load(dir); err == nil {
+		t.Fatalf("expected error for unknown symlinks form")
+	}
+}
+
+func TestLoadHistoryKeep(t *testing.T) {
+	dir := t.TempDir()
+	loaded, err := Load(dir)
+	if err != nil || loaded.Config.History.Keep != DefaultHistoryKeep {
+		t.Fatalf("expected the default keep, got %d, %v", loaded.Config.History.Keep, err)
+	}
+	path := filepath.Join(dir, DefaultConfigFileName)
+	if err := os.WriteFile(path, []byte("history:\n  keep: 5\n"), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	loaded, err = Load(dir)
+	if err != nil || loaded.Config.History.Keep != 5 || loaded.Origins["history.keep"] != path {
+		t.Fatalf("expected keep 5 from %s, got %d from %q, %v", path, loaded.Config.History.Keep, loaded.Origins["history.keep"], err)
+	}
+	if err := os.WriteFile(path, []byte("history:\n  keep: -1\n"), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if _, err := Load(dir); err == nil {
+		t.Fatalf("expected error for a negative keep")
+	}
+}
+
+func TestLoadTemplates(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, DefaultConfigFileName)
+	if err := os.WriteFile(path, []byte("templates:\n  vars:\n    DB_USER: app\n  ports:\n    from: 4000\n"), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	loaded, err := Load(dir)
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	tc := loaded.Config.Templates
+	if tc.Vars["DB_USER"] != "app" || tc.Ports != (PortRange{From: 4000, To: DefaultPortTo}) {
+		t.Fatalf("unexpected templates config %+v", tc)
+	}
+	for _, bad := range []string{
+		"templates:\n  vars:\n    DB-USER: app\n",
+		"templates:\n  vars:\n    WTM_BRANCH: main\n",
+		"templates:\n  ports:\n    from: 20000\n",
+		"templates:\n  ports:\n    to: 70000\n",
+	} {
+		if err := os.WriteFile(path, []byte(bad), 0o644); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		if _, err := Load(dir); err == nil {
+			t.Fatalf("%q: expected an error", bad)
+		}
+	}
+}
+
+func TestUserStoreRoot(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("XDG_CONFIG_HOME", "")
+
+	user, source, err := LoadUser()
+	if err != nil || source != "defaults" || user.Store.Root != "" {
+		t.Fatalf("expected empty defaults, got %#v %q %v", user, source, err)
+	}
+
+	path, err := SetUserStoreRoot("~/vault/wtm")
+	if err != nil {
+		t.Fatalf("SetUserStoreRoot: %v", err)
+	}
+	if want := filepath.Join(home, ".config", "wtm", "config.yml"); path != want {
+		t.Fatalf("expected %s, got %s", want, path)
+	}
+	user, source, err = LoadUser()
+	if err != nil || source != path {
+		t.Fatalf("LoadUser: %q %v", source, err)
+	}
+	if want := filepath.Join(home, "vault", "wtm"); user.Store.Root != want {
+		t.Fatalf("expected %s, got %s", want, user.Store.Root)
+	}
+
+	if err := os.WriteFile(path, []byte("store:\n  root: relative/dir\n"), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if _, _, err := LoadUser(); err == nil {
+		t.Fatalf("expected error for relative store.root")
+	}
+}
+
+func TestLoadMergesUserConfig(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	userPath, err := UserConfigPath()
+	if err != nil {
+		t.Fatalf("UserConfigPath: %v", err)
+	}
+	repo := t.TempDir()
+	user := "defaults:\n  exclude: [\"**/*.bak\"]\n  symlinks: relative\nrepos:\n  - path: " + repo + "\n    include: [apps/*/.env]\n    link: copy\n  - path: /elsewhere/**\n    link: hardlink\n"
+	if err := os.MkdirAll(filepath.Dir(userPath), 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	if err := os.WriteFile(userPath, []byte(user), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	repoPath := filepath.Join(repo, DefaultConfigFileName)
+	if err := os.WriteFile(repoPath, []byte("link: symlink\n"), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	loaded, err := Load(repo)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	c := loaded.Config
+	if len(c.Include) != 1 || c.Include[0] != "apps/*/.env" || len(c.Exclude) != 1 || c.Exclude[0] != "**/*.bak" {
+		t.Fatalf("unexpected include/exclude %#v %#v", c.Include, c.Exclude)
+	}
+	if c.Symlinks != SymlinksRelative || c.Link.Mode != LinkSymlink || c.Store.Mode != StoreModePerWorktree {
+		t.Fatalf("unexpected config %#v", c)
+	}
+	want := map[string]string{
+		"include":    userPath + " (repos[0])",
+		"exclude":    userPath + " (defaults)",
+		"symlinks":   userPath + " (defaults)",
+		"link.mode":  repoPath,
+		"store.mode": "defaults",
+	}
+	for k, v := range want {
+		if loaded.Origins[k] != v {
+			t.Fatalf("origin of %s: expected %q, got %q", k, v, loaded.Origins[k])
+		}
+	}
+	if loaded.Source != repoPath+", "+userPath {
+		t.Fatalf("unexpected source %q", loaded.Source)
+	}
+	out, err := loaded.Resolved()
+	if err != nil {
+		t.Fatalf("Resolved: %v", err)
+	}
+	if !strings.Contains(string(out), "mode: symlink # "+repoPath) {
+		t.Fatalf("expected annotated link.mode in:\n%s", out)
+	}
+
+	if err := os.WriteFile(userPath, []byte("defaults:\n  store:\n    mode: bogus\n"), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if _, err := Load(repo); err == nil || !strings.Contains(err.Error(), userPath) {
+		t.Fatalf("expected error naming the user config, got %v", err)
+	}
+	if err := os.WriteFile(userPath, []byte("repos:\n  - include: [.env]\n"), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if _, err := Load(repo); err == nil {
+		t.Fatalf("expected error for repos entry without remote or path")
+	}
+}
+
+func TestNormalizeRemote(t *testing.T) {
+	for in, want := range map[string]string{
+		"git@github.com:acme/api.git":            "github.com/acme/api",
+		"https://github.com/acme/api":            "github.com/acme/api",
+		"ssh://git@github.com:22/acme/api.git":   "github.com/acme/api",
+		"https://user:pw@gitlab.example/a/b.git": "gitlab.example/a/b",
+		"/srv/git/api.git/":                      "/srv/git/api.git",
+	} {
+		if got := NormalizeRemote(in); got != want {
+			t.Fatalf("NormalizeRemote(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestCheckReportsEveryProblem(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, DefaultConfigFileName)
+	src := "include:\n  - apps/[api/.env\nexclud:\n  - x\nlink:\n  rules:\n    - pattern: \"{a\"\n      mode: copy\n"
+	if err := os.WriteFile(path, []byte(src), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	problems, err := Check(dir)
+	if err != nil {
+		t.Fatalf("Check: %v", err)
+	}
+	var got []string
+	for _, p := range problems {
+		got = append(got, p.String())
+	}
+	want := []string{
+		path + ":3: unknown key \"exclud\"",
+		path + ": include[0]: invalid glob \"apps/[api/.env\"",
+		path + ": link.rules[0]: invalid glob \"{a\"",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("expected:\n%s\ngot:\n%s", strings.Join(want, "\n"), strings.Join(got, "\n"))
+	}
+	if _, err := Load(dir); err == nil {
+		t.Fatalf("expected Load to reject the invalid glob")
+	}
+
+	if err := os.WriteFile(path, []byte("symlinks: sideways\n"), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	problems, err = Check(dir)
+	if err != nil || len(problems) != 1 || !strings.Contains(problems[0].String(), "unknown symlinks") {
+		t.Fatalf("expected the Load error, got %v, %v", problems, err)
+	}
+}
+
+func TestTemplateIsValid(t *testing.T) {
+	dir := t.TempDir()
+	include := []string{".env", "config/local.json"}
+	if err := os.WriteFile(filepath.Join(dir, DefaultConfigFileName), Template(include), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	problems, err := Check(dir)
+	if err != nil || len(problems) != 0 {
+		t.Fatalf("expected no problems, got %v, %v", problems, err)
+	}
+	loaded, err := Load(dir)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if strings.Join(loaded.Config.Include, ",") != ".env,config/local.json" {
+		t.Fatalf("unexpected include %v", loaded.Config.Include)
+	}
+}
@@ -0,0 +1,67 @@
+package config
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Template returns a commented .worktree-manager.yml listing include.
+func Template(include []string) []byte {
+	if len(include) == 0 {
+		include = Default().Include
+	}
+	var b strings.Builder
+	b.WriteString(`# wtm config: which repo files "wtm sync" keeps in the store and links into
+# worktrees. Settings left out come from the user config
+# (~/.config/wtm/config.yml) or wtm's defaults; run
+# "wtm config show --resolved" to see the result.
+
+# Repo-relative globs; "**" matches any number of directories.
+include:
+`)
+	writeList(&b, include)
+	b.WriteString("exclude:\n")
+	writeList(&b, Default().Exclude)
+	b.WriteString(`
+# per-worktree (default), shared or layered.
+# store:
+#   mode: per-worktree
+
+# What sync puts into worktrees: symlink (default), hardlink or copy, with
+# optional per-pattern rules (first match wins).
+# link:
+#   mode: symlink
+#   rules:
+#     - pattern: "docker/.env"
+#       mode: copy
+
+# Write symlink targets as absolute (default) or relative paths.
+# symlinks: absolute
+
+# age public keys to encrypt the store to; see "wtm keygen".
+# encryption:
+#   recipients:
+#     - age1...
+
+# How many snapshots of each store file "wtm history" and "wtm restore" can
+# go back to.
+# history:
+#   keep: 20
+
+# Variables for template files (e.g. .env.wtmtpl), and the range their
+# "{{ port NAME }}" placeholders allocate ports from.
+# templates:
+#   vars:
+#     DB_USER: app
+#   ports:
+#     from: 10000
+#     to: 19999
+`)
+	return []byte(b.String())
+}
+
+func writeList(b *strings.Builder, items []string) {
+	for _, it := range items {
+		b.WriteString("  - " + strconv.Quote(it) + "\n")
+	}
+}
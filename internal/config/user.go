@@ -0,0 +1,200 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/aayushgautam/wtm/internal/gitx"
+	"github.com/bmatcuk/doublestar/v4"
+	"gopkg.in/yaml.v3"
+)
+
+const userConfigFileName = "config.yml"
+
+// UserConfig is the per-user config file, shared by every repo.
+type UserConfig struct {
+	Store UserStoreConfig `yaml:"store"`
+	// Defaults apply to every repo, below the repo's own config file.
+	Defaults Config `yaml:"defaults"`
+	// Repos override Defaults for the repos they match.
+	Repos []RepoOverride `yaml:"repos"`
+}
+
+type UserStoreConfig struct {
+	// Root is the directory holding the stores of every repo. A leading
+	// "~/" is expanded.
+	Root string `yaml:"root"`
+}
+
+// RepoOverride holds settings for the repos matching Remote or Path, written
+// inline next to the match keys.
+type RepoOverride struct {
+	// Remote is a glob matched against each remote URL in host/path form,
+	// e.g. "github.com/acme/*" for git@github.com:acme/api.git.
+	Remote string `yaml:"remote"`
+	// Path is a glob matched against the repo root. A leading "~/" is
+	// expanded.
+	Path   string `yaml:"path"`
+	Config `yaml:",inline"`
+}
+
+// UserConfigPath returns the user config file:
+// $XDG_CONFIG_HOME/wtm/config.yml, or ~/.config/wtm/config.yml.
+func UserConfigPath() (string, error) {
+	dir := os.Getenv("XDG_CONFIG_HOME")
+	if dir == "" || !filepath.IsAbs(dir) {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", fmt.Errorf("home dir: %w", err)
+		}
+		dir = filepath.Join(home, ".config")
+	}
+	return filepath.Join(dir, "wtm", userConfigFileName), nil
+}
+
+// LoadUser reads the user config file. A missing file yields an empty
+// config and source "defaults", like Load.
+func LoadUser() (UserConfig, string, error) {
+	path, err := UserConfigPath()
+	if err != nil {
+		return UserConfig{}, "", err
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return UserConfig{}, "defaults", nil
+		}
+		return UserConfig{}, "", fmt.Errorf("failed to read config %s: %w", path, err)
+	}
+
+	var c UserConfig
+	if err := yaml.Unmarshal(b, &c); err != nil {
+		return UserConfig{}, "", fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	if c.Store.Root != "" {
+		root, err := ExpandHome(c.Store.Root)
+		if err != nil {
+			return UserConfig{}, "", err
+		}
+		if !filepath.IsAbs(root) {
+			return UserConfig{}, "", fmt.Errorf("%s: store.root must be an absolute path, got %q", path, c.Store.Root)
+		}
+		c.Store.Root = filepath.Clean(root)
+	}
+	for i := range c.Repos {
+		r := &c.Repos[i]
+		if r.Remote == "" && r.Path == "" {
+			return UserConfig{}, "", fmt.Errorf("%s: repos[%d]: needs remote or path", path, i)
+		}
+		if r.Path != "" {
+			p, err := ExpandHome(r.Path)
+			if err != nil {
+				return UserConfig{}, "", err
+			}
+			r.Path = p
+		}
+		for _, pattern := range []string{r.Remote, r.Path} {
+			if pattern != "" && !doublestar.ValidatePattern(pattern) {
+				return UserConfig{}, "", fmt.Errorf("%s: repos[%d]: invalid glob %q", path, i, pattern)
+			}
+		}
+	}
+	return c, path, nil
+}
+
+// matchingRepos returns the indexes of the Repos entries that apply to
+// repoRoot.
+func (c UserConfig) matchingRepos(repoRoot string) ([]int, error) {
+	var remotes []string
+	looked := false
+	var matched []int
+	for i, r := range c.Repos {
+		if r.Path != "" {
+			if ok, _ := doublestar.Match(r.Path, filepath.ToSlash(repoRoot)); !ok {
+				continue
+			}
+		}
+		if r.Remote != "" {
+			if !looked {
+				urls, err := gitx.RemoteURLs(repoRoot)
+				if err != nil {
+					return nil, err
+				}
+				for _, u := range urls {
+					remotes = append(remotes, NormalizeRemote(u))
+				}
+				looked = true
+			}
+			ok := false
+			for _, u := range remotes {
+				if m, _ := doublestar.Match(r.Remote, u); m {
+					ok = true
+					break
+				}
+			}
+			if !ok {
+				continue
+			}
+		}
+		matched = append(matched, i)
+	}
+	return matched, nil
+}
+
+// NormalizeRemote turns a remote URL into host/path form, e.g.
+// "github.com/acme/api".
+func NormalizeRemote(url string) string {
+	u := url
+	if i := strings.Index(u, "://"); i >= 0 {
+		u = u[i+3:]
+	} else if i := strings.Index(u, ":"); i > 1 && !strings.Contains(u[:i], "/") {
+		// scp-like syntax: [user@]host:path
+		u = u[:i] + "/" + strings.TrimPrefix(u[i+1:], "/")
+	} else {
+		return filepath.Clean(u)
+	}
+	if at := strings.Index(u, "@"); at >= 0 && at < strings.Index(u+"/", "/") {
+		u = u[at+1:]
+	}
+	if slash := strings.Index(u, "/"); slash >= 0 {
+		host := u[:slash]
+		if colon := strings.Index(host, ":"); colon >= 0 {
+			host = host[:colon]
+		}
+		u = host + u[slash:]
+	}
+	return strings.TrimSuffix(strings.TrimSuffix(u, "/"), ".git")
+}
+
+// ExpandHome replaces a leading "~/" in path with the user's home directory.
+func ExpandHome(path string) (string, error) {
+	if path != "~" && !strings.HasPrefix(path, "~/") {
+		return path, nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("home dir: %w", err)
+	}
+	return filepath.Join(home, strings.TrimPrefix(path, "~")), nil
+}
+
+// SetUserStoreRoot writes store.root into the user config file, creating it
+// if needed, and returns the path written.
+func SetUserStoreRoot(root string) (string, error) {
+	path, err := UserConfigPath()
+	if err != nil {
+		return "", err
+	}
+	err = editYAML(path, func(top *yaml.Node) {
+		store := mappingValue(top, "store", yaml.MappingNode)
+		v := mappingValue(store, "root", yaml.ScalarNode)
+		*v = yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: root}
+	})
+	if err != nil {
+		return "", err
+	}
+	return path, nil
+}
@@ -0,0 +1,49 @@
+package dotenv
+
+type ChangeKind int
+
+const (
+	Added ChangeKind = iota
+	Removed
+	Changed
+)
+
+func (k ChangeKind) String() string {
+	switch k {
+	case Added:
+		return "added"
+	case Removed:
+		return "removed"
+	default:
+		return "changed"
+	}
+}
+
+// Change is a key whose value differs between two files.
+type Change struct {
+	Key  string
+	Kind ChangeKind
+	Old  string // empty for Added
+	New  string // empty for Removed
+}
+
+// Diff lists the keys whose decoded values differ between from and to.
+func Diff(from, to *File) []Change {
+	oldVals, newVals := from.Values(), to.Values()
+	var changes []Change
+	for _, key := range from.Keys() {
+		nv, ok := newVals[key]
+		switch {
+		case !ok:
+			changes = append(changes, Change{Key: key, Kind: Removed, Old: oldVals[key]})
+		case nv != oldVals[key]:
+			changes = append(changes, Change{Key: key, Kind: Changed, Old: oldVals[key], New: nv})
+		}
+	}
+	for _, key := range to.Keys() {
+		if _, ok := oldVals[key]; !ok {
+			changes = append(changes, Change{Key: key, Kind: Added, New: newVals[key]})
+		}
+	}
+	return changes
+}
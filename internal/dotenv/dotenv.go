@@ -0,0 +1,382 @@
+// Package dotenv parses and edits .env files without losing formatting.
+package dotenv
+
+import (
+	"fmt"
+	"strings"
+)
+
+type Kind int
+
+const (
+	Blank      Kind = iota // empty or whitespace-only line
+	Comment                // line starting with #
+	Assignment             // KEY=VALUE, optionally prefixed with "export"
+)
+
+// Entry is one logical line of a dotenv file. Assignments with quoted
+// values may span several physical lines.
+type Entry struct {
+	Kind    Kind
+	Key     string
+	Value   string // decoded value, before interpolation
+	Export  bool   // line starts with "export "
+	Quote   byte   // 0, '\'', '"' or '`'
+	Comment string // for Comment entries the whole line; for assignments a trailing "# ..."
+	Line    int    // 1-based line the entry starts on; 0 for entries added by Set
+
+	raw      string // exact source text including the line terminator
+	rawValue string // value text as written between the quotes
+}
+
+// Raw returns the source text of the entry, including its line terminator.
+func (e Entry) Raw() string {
+	return e.raw
+}
+
+// File is a parsed dotenv document.
+type File struct {
+	entries []Entry
+}
+
+// Parse reads a dotenv document. Lines that are neither blank, comments nor
+// assignments are rejected so that callers never silently drop content.
+func Parse(b []byte) (*File, error) {
+	src := string(b)
+	f := &File{}
+	line := 1
+	for pos := 0; pos < len(src); {
+		e, n, err := parseEntry(src[pos:])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		e.raw = src[pos : pos+n]
+		e.Line = line
+		line += strings.Count(e.raw, "\n")
+		f.entries = append(f.entries, e)
+		pos += n
+	}
+	return f, nil
+}
+
+// Bytes serializes the file.
+func (f *File) Bytes() []byte {
+	var b strings.Builder
+	for _, e := range f.entries {
+		b.WriteString(e.raw)
+	}
+	return []byte(b.String())
+}
+
+// Entries returns every entry in file order.
+func (f *File) Entries() []Entry {
+	return append([]Entry(nil), f.entries...)
+}
+
+// Keys returns the assigned keys in order of first appearance.
+func (f *File) Keys() []string {
+	seen := make(map[string]bool)
+	var keys []string
+	for _, e := range f.entries {
+		if e.Kind == Assignment && !seen[e.Key] {
+			seen[e.Key] = true
+			keys = append(keys, e.Key)
+		}
+	}
+	return keys
+}
+
+// Lookup returns the entry that determines key's value. As in a shell, the
+// last assignment wins.
+func (f *File) Lookup(key string) (Entry, bool) {
+	if i := f.index(key); i >= 0 {
+		return f.entries[i], true
+	}
+	return Entry{}, false
+}
+
+// Get returns key's decoded (uninterpolated) value.
+func (f *File) Get(key string) (string, bool) {
+	e, ok := f.Lookup(key)
+	return e.Value, ok
+}
+
+// Values returns the decoded (uninterpolated) value of every key.
+func (f *File) Values() map[string]string {
+	out := make(map[string]string)
+	for _, e := range f.entries {
+		if e.Kind == Assignment {
+			out[e.Key] = e.Value
+		}
+	}
+	return out
+}
+
+// Set assigns value to key, re-rendering an existing assignment in place.
+func (f *File) Set(key, value string) {
+	e := Entry{Kind: Assignment, Key: key}
+	if old, ok := f.Lookup(key); ok {
+		e.Export = old.Export
+		e.Quote = old.Quote
+		e.Comment = old.Comment
+	}
+	e.Value = value
+	e.Quote, e.rawValue = encodeValue(value, e.Quote)
+	e.raw = render(e)
+	f.Put(e)
+}
+
+// Put stores an entry as-is, typically one taken from another File. It
+// replaces the last assignment of the same key or is appended.
+func (f *File) Put(e Entry) {
+	e.raw = strings.TrimRight(e.raw, "\r\n")
+	if e.raw == "" {
+		e.raw = render(e)
+	}
+	e.Line = 0
+	nl := f.newline()
+	if i := f.index(e.Key); i >= 0 {
+		old := f.entries[i].raw
+		e.raw += old[len(strings.TrimRight(old, "\r\n")):]
+		f.entries[i] = e
+		return
+	}
+	if n := len(f.entries); n > 0 && !strings.HasSuffix(f.entries[n-1].raw, "\n") {
+		f.entries[n-1].raw += nl
+	}
+	e.raw += nl
+	f.entries = append(f.entries, e)
+}
+
+// Delete removes every assignment of key and reports whether there was one.
+func (f *File) Delete(key string) bool {
+	kept := f.entries[:0]
+	found := false
+	for _, e := range f.entries {
+		if e.Kind == Assignment && e.Key == key {
+			found = true
+			continue
+		}
+		kept = append(kept, e)
+	}
+	f.entries = kept
+	return found
+}
+
+func (f *File) index(key string) int {
+	for i := len(f.entries) - 1; i >= 0; i-- {
+		if f.entries[i].Kind == Assignment && f.entries[i].Key == key {
+			return i
+		}
+	}
+	return -1
+}
+
+func (f *File) newline() string {
+	for _, e := range f.entries {
+		if strings.HasSuffix(e.raw, "\r\n") {
+			return "\r\n"
+		}
+		if strings.HasSuffix(e.raw, "\n") {
+			return "\n"
+		}
+	}
+	return "\n"
+}
+
+func parseEntry(s string) (Entry, int, error) {
+	end := lineEnd(s, 0)
+	text := strings.TrimRight(s[:end], "\r\n")
+	trimmed := strings.TrimLeft(text, " \t")
+	if trimmed == "" {
+		return Entry{Kind: Blank}, end, nil
+	}
+	if trimmed[0] == '#' {
+		return Entry{Kind: Comment, Comment: trimmed}, end, nil
+	}
+
+	e := Entry{Kind: Assignment}
+	i := len(text) - len(trimmed)
+	if rest, ok := strings.CutPrefix(trimmed, "export"); ok && rest != "" && (rest[0] == ' ' || rest[0] == '\t') {
+		e.Export = true
+		i = skipBlanks(s, i+len("export"))
+	}
+	k := i
+	for k < len(s) && isKeyByte(s[k], k == i) {
+		k++
+	}
+	if k == i {
+		return Entry{}, 0, fmt.Errorf("expected KEY=VALUE")
+	}
+	e.Key = s[i:k]
+	j := skipBlanks(s, k)
+	if j >= len(s) || s[j] != '=' {
+		return Entry{}, 0, fmt.Errorf("expected = after %s", e.Key)
+	}
+	j = skipBlanks(s, j+1)
+
+	if j < len(s) && (s[j] == '"' || s[j] == '\'' || s[j] == '`') {
+		e.Quote = s[j]
+		closing := strings.IndexByte(s[j+1:], e.Quote)
+		if e.Quote == '"' {
+			closing = closingDoubleQuote(s[j+1:])
+		}
+		if closing < 0 {
+			return Entry{}, 0, fmt.Errorf("unterminated %c quote in value of %s", e.Quote, e.Key)
+		}
+		closing += j + 1
+		e.rawValue = s[j+1 : closing]
+		e.Value = e.rawValue
+		if e.Quote == '"' {
+			e.Value = unescape(e.rawValue)
+		}
+		end = lineEnd(s, closing+1)
+		tail := strings.TrimLeft(strings.TrimRight(s[closing+1:end], "\r\n"), " \t")
+		if tail != "" {
+			if tail[0] != '#' {
+				return Entry{}, 0, fmt.Errorf("unexpected text after quoted value of %s", e.Key)
+			}
+			e.Comment = tail
+		}
+		return e, end, nil
+	}
+
+	value := strings.TrimRight(s[j:end], "\r\n")
+	if c := inlineComment(value); c >= 0 {
+		e.Comment = strings.TrimLeft(value[c:], " \t")
+		value = value[:c]
+	}
+	e.rawValue = strings.TrimRight(value, " \t")
+	e.Value = e.rawValue
+	return e, end, nil
+}
+
+func lineEnd(s string, from int) int {
+	if i := strings.IndexByte(s[from:], '\n'); i >= 0 {
+		return from + i + 1
+	}
+	return len(s)
+}
+
+func skipBlanks(s string, i int) int {
+	for i < len(s) && (s[i] == ' ' || s[i] == '\t') {
+		i++
+	}
+	return i
+}
+
+func isKeyByte(c byte, first bool) bool {
+	switch {
+	case c == '_' || (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z'):
+		return true
+	case first:
+		return false
+	default:
+		return (c >= '0' && c <= '9') || c == '.' || c == '-'
+	}
+}
+
+// closingDoubleQuote returns the index of the first unescaped '"' in s.
+func closingDoubleQuote(s string) int {
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '"':
+			return i
+		}
+	}
+	return -1
+}
+
+// inlineComment returns where a " # comment" starts in an unquoted value,
+// including the whitespace before the '#', or -1.
+func inlineComment(v string) int {
+	for i := 1; i < len(v); i++ {
+		if v[i] == '#' && (v[i-1] == ' ' || v[i-1] == '\t') {
+			j := i - 1
+			for j > 0 && (v[j-1] == ' ' || v[j-1] == '\t') {
+				j--
+			}
+			return j
+		}
+	}
+	return -1
+}
+
+func unescape(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' || i+1 == len(s) {
+			b.WriteByte(s[i])
+			continue
+		}
+		i++
+		switch s[i] {
+		case 'n':
+			b.WriteByte('\n')
+		case 'r':
+			b.WriteByte('\r')
+		case 't':
+			b.WriteByte('\t')
+		case '"', '\\', '$':
+			b.WriteByte(s[i])
+		default:
+			b.WriteByte('\\')
+			b.WriteByte(s[i])
+		}
+	}
+	return b.String()
+}
+
+// encodeValue picks how value is written, preferring quote if it can
+// represent the value.
+func encodeValue(value string, prefer byte) (byte, string) {
+	plain := !strings.ContainsAny(value, " \t#\"'`\\$\n\r")
+	canSingle := !strings.Contains(value, "'")
+	canBacktick := !strings.Contains(value, "`")
+	switch {
+	case prefer == 0 && plain:
+		return 0, value
+	case prefer == '\'' && canSingle:
+		return '\'', value
+	case prefer == '`' && canBacktick:
+		return '`', value
+	case prefer == '"':
+		return '"', escapeDouble(value)
+	case canSingle:
+		return '\'', value
+	default:
+		return '"', escapeDouble(value)
+	}
+}
+
+func escapeDouble(s string) string {
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "\r", `\r`, "$", `\$`)
+	return r.Replace(s)
+}
+
+// render formats an assignment without a line terminator.
+func render(e Entry) string {
+	var b strings.Builder
+	if e.Export {
+		b.WriteString("export ")
+	}
+	b.WriteString(e.Key)
+	b.WriteByte('=')
+	if e.Quote != 0 {
+		b.WriteByte(e.Quote)
+	}
+	b.WriteString(e.rawValue)
+	if e.Quote != 0 {
+		b.WriteByte(e.Quote)
+	}
+	if e.Comment != "" {
+		b.WriteByte(' ')
+		b.WriteString(e.Comment)
+	}
+	return b.String()
+}
@@ -0,0 +1,222 @@
+package dotenv
+
+import (
+	"strings"
+	"testing"
+)
+
+const sample = `# Database settings
+export DATABASE_URL=postgres://localhost/app   # local only
+PORT = 3000
+
+EMPTY=
+SINGLE='literal $HOME'
+DOUBLE="line1\nline2 \"quoted\" \$NOT"
+MULTI="first
+second"
+BACKTICK=` + "`a 'b' \"c\"`" + `
+  INDENTED=value
+URL=${DATABASE_URL}/extra
+DEFAULTED=${MISSING:-fallback}
+LAST=no-newline`
+
+func TestRoundTripIsByteIdentical(t *testing.T) {
+	inputs := []string{
+		sample,
+		sample + "\n",
+		strings.ReplaceAll(sample, "\n", "\r\n"),
+		"",
+		"\n\n",
+		"# only a comment",
+	}
+	for _, in := range inputs {
+		f, err := Parse([]byte(in))
+		if err != nil {
+			t.Fatalf("parse %q: %v", in, err)
+		}
+		if got := string(f.Bytes()); got != in {
+			t.Fatalf("round trip mismatch:\nwant %q\ngot  %q", in, got)
+		}
+	}
+}
+
+func TestParseValues(t *testing.T) {
+	f, err := Parse([]byte(sample))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	cases := map[string]string{
+		"DATABASE_URL": "postgres://localhost/app",
+		"PORT":         "3000",
+		"EMPTY":        "",
+		"SINGLE":       "literal $HOME",
+		"DOUBLE":       "line1\nline2 \"quoted\" $NOT",
+		"MULTI":        "first\nsecond",
+		"BACKTICK":     `a 'b' "c"`,
+		"INDENTED":     "value",
+		"LAST":         "no-newline",
+	}
+	for key, want := range cases {
+		got, ok := f.Get(key)
+		if !ok || got != want {
+			t.Fatalf("%s: want %q, got %q (found=%v)", key, want, got, ok)
+		}
+	}
+	e, _ := f.Lookup("DATABASE_URL")
+	if !e.Export || e.Comment != "# local only" || e.Line != 2 {
+		t.Fatalf("unexpected entry: %#v", e)
+	}
+	e, _ = f.Lookup("BACKTICK")
+	if e.Line != 10 {
+		t.Fatalf("expected BACKTICK on line 10, got %d", e.Line)
+	}
+}
+
+func TestParseRejectsGarbage(t *testing.T) {
+	for _, in := range []string{"not an assignment\n", "A=\"unterminated\n", "A='x' trailing\n"} {
+		if _, err := Parse([]byte(in)); err == nil {
+			t.Fatalf("expected error for %q", in)
+		}
+	}
+}
+
+func TestSetPreservesFormatting(t *testing.T) {
+	in := "# header\nexport A=1 # keep\nB='two'\n\nC=3"
+	f, err := Parse([]byte(in))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	f.Set("A", "10")
+	f.Set("B", "has space")
+	f.Set("D", "new value")
+	want := "# header\nexport A=10 # keep\nB='has space'\n\nC=3\nD='new value'\n"
+	if got := string(f.Bytes()); got != want {
+		t.Fatalf("want %q\ngot  %q", want, got)
+	}
+
+	f2, err := Parse(f.Bytes())
+	if err != nil {
+		t.Fatalf("reparse: %v", err)
+	}
+	if v, _ := f2.Get("D"); v != "new value" {
+		t.Fatalf("unexpected D: %q", v)
+	}
+}
+
+func TestSetEncodesTrickyValues(t *testing.T) {
+	f, _ := Parse(nil)
+	values := []string{"it's $HOME", "a\nb", `back\slash`, "plain"}
+	for i, v := range values {
+		f.Set(string(rune('A'+i)), v)
+	}
+	f2, err := Parse(f.Bytes())
+	if err != nil {
+		t.Fatalf("reparse %q: %v", f.Bytes(), err)
+	}
+	resolved := f2.Resolve(nil)
+	for i, v := range values {
+		key := string(rune('A' + i))
+		if got, _ := f2.Get(key); got != v {
+			t.Fatalf("%s: want %q, got %q", key, v, got)
+		}
+		if resolved[key] != v {
+			t.Fatalf("%s resolved: want %q, got %q", key, v, resolved[key])
+		}
+	}
+}
+
+func TestPutAndDelete(t *testing.T) {
+	base, _ := Parse([]byte("A=1\r\nB=2"))
+	overlay, _ := Parse([]byte("B=\"two\" # overlay\nC=3\n"))
+	for _, e := range overlay.Entries() {
+		if e.Kind == Assignment {
+			base.Put(e)
+		}
+	}
+	want := "A=1\r\nB=\"two\" # overlay\r\nC=3\r\n"
+	if got := string(base.Bytes()); got != want {
+		t.Fatalf("want %q, got %q", want, got)
+	}
+	if !base.Delete("A") || base.Delete("A") {
+		t.Fatalf("unexpected delete result")
+	}
+	if keys := base.Keys(); len(keys) != 2 || keys[0] != "B" || keys[1] != "C" {
+		t.Fatalf("unexpected keys: %v", keys)
+	}
+}
+
+func TestResolveInterpolation(t *testing.T) {
+	f, err := Parse([]byte(sample))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	env := map[string]string{"HOME": "/home/me"}
+	got := f.Resolve(func(k string) (string, bool) {
+		v, ok := env[k]
+		return v, ok
+	})
+	if got["URL"] != "postgres://localhost/app/extra" {
+		t.Fatalf("unexpected URL: %q", got["URL"])
+	}
+	if got["DEFAULTED"] != "fallback" {
+		t.Fatalf("unexpected DEFAULTED: %q", got["DEFAULTED"])
+	}
+	if got["DOUBLE"] != "line1\nline2 \"quoted\" $NOT" {
+		t.Fatalf("unexpected DOUBLE: %q", got["DOUBLE"])
+	}
+	e, _ := f.Lookup("URL")
+	if refs := e.References(); len(refs) != 1 || refs[0] != "DATABASE_URL" {
+		t.Fatalf("unexpected references: %v", refs)
+	}
+}
+
+func TestDiff(t *testing.T) {
+	from, _ := Parse([]byte("A=1\nB=2\nC=3\n"))
+	to, _ := Parse([]byte("# reordered\nC=3\nB='22'\nD=4\n"))
+	got := Diff(from, to)
+	want := []Change{
+		{Key: "A", Kind: Removed, Old: "1"},
+		{Key: "B", Kind: Changed, Old: "2", New: "22"},
+		{Key: "D", Kind: Added, New: "4"},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("want %v, got %v", want, got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("change %d: want %#v, got %#v", i, want[i], got[i])
+		}
+	}
+}
+
+func TestMerge3(t *testing.T) {
+	base, _ := Parse([]byte("A=1\nB=2\nC=3\nD=4\n"))
+	ours, _ := Parse([]byte("A=10\nB=2\nD=40\nE=5\n"))
+	theirs, _ := Parse([]byte("# repo\nA=1\nB=20\nC=3\nD=41\nF=6\n"))
+	merged, conflicts := Merge3(base, ours, theirs)
+
+	want := "# repo\nA=10\nB=20\nD=41\nF=6\nE=5\n"
+	if got := string(merged.Bytes()); got != want {
+		t.Fatalf("want %q, got %q", want, got)
+	}
+	if len(conflicts) != 1 {
+		t.Fatalf("want 1 conflict, got %v", conflicts)
+	}
+	c := conflicts[0]
+	if c.Key != "D" || c.Base.Value != "4" || c.Ours.Value != "40" || c.Theirs.Value != "41" {
+		t.Fatalf("unexpected conflict %+v", c)
+	}
+	if string(theirs.Bytes()) != "# repo\nA=1\nB=20\nC=3\nD=41\nF=6\n" {
+		t.Fatalf("theirs was modified: %q", theirs.Bytes())
+	}
+}
+
+func TestMerge3DeleteModifyConflict(t *testing.T) {
+	base, _ := Parse([]byte("A=1\n"))
+	ours, _ := Parse(nil)
+	theirs, _ := Parse([]byte("A=2\n"))
+	_, conflicts := Merge3(base, ours, theirs)
+	if len(conflicts) != 1 || conflicts[0].Ours != nil || conflicts[0].Theirs.Value != "2" {
+		t.Fatalf("unexpected conflicts %+v", conflicts)
+	}
+}
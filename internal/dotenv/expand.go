@@ -0,0 +1,109 @@
+package dotenv
+
+import "strings"
+
+// Resolve returns the final value of each key, expanding $VAR references
+// in unquoted and double-quoted values.
+func (f *File) Resolve(lookup func(string) (string, bool)) map[string]string {
+	vars := make(map[string]string)
+	get := func(name string) (string, bool) {
+		if v, ok := vars[name]; ok {
+			return v, true
+		}
+		if lookup != nil {
+			return lookup(name)
+		}
+		return "", false
+	}
+	for _, e := range f.entries {
+		if e.Kind != Assignment {
+			continue
+		}
+		switch e.Quote {
+		case '\'', '`':
+			vars[e.Key] = e.rawValue
+		case '"':
+			vars[e.Key] = expand(e.rawValue, true, get)
+		default:
+			vars[e.Key] = expand(e.rawValue, false, get)
+		}
+	}
+	return vars
+}
+
+// References returns the variable names an assignment interpolates, in
+// order of appearance.
+func (e Entry) References() []string {
+	if e.Kind != Assignment || e.Quote == '\'' || e.Quote == '`' {
+		return nil
+	}
+	var refs []string
+	expand(e.rawValue, e.Quote == '"', func(name string) (string, bool) {
+		refs = append(refs, name)
+		return "", false
+	})
+	return refs
+}
+
+// expand interpolates s. With escapes set, backslash sequences are decoded
+// as in a double-quoted value; otherwise only \$ is recognized.
+func expand(s string, escapes bool, get func(string) (string, bool)) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c == '\\' && i+1 < len(s) {
+			next := s[i+1]
+			switch {
+			case next == '$':
+				b.WriteByte('$')
+				i++
+				continue
+			case escapes:
+				b.WriteString(unescape(s[i : i+2]))
+				i++
+				continue
+			}
+		}
+		if c != '$' || i+1 == len(s) {
+			b.WriteByte(c)
+			continue
+		}
+		if s[i+1] == '{' {
+			end := strings.IndexByte(s[i+2:], '}')
+			if end < 0 {
+				b.WriteByte(c)
+				continue
+			}
+			b.WriteString(expandBraced(s[i+2:i+2+end], escapes, get))
+			i += end + 2
+			continue
+		}
+		j := i + 1
+		for j < len(s) && isKeyByte(s[j], j == i+1) && s[j] != '.' && s[j] != '-' {
+			j++
+		}
+		if j == i+1 {
+			b.WriteByte(c)
+			continue
+		}
+		v, _ := get(s[i+1 : j])
+		b.WriteString(v)
+		i = j - 1
+	}
+	return b.String()
+}
+
+func expandBraced(body string, escapes bool, get func(string) (string, bool)) string {
+	name, def, hasDefault := body, "", false
+	emptyCounts := false
+	if i := strings.Index(body, ":-"); i >= 0 {
+		name, def, hasDefault, emptyCounts = body[:i], body[i+2:], true, true
+	} else if i := strings.IndexByte(body, '-'); i >= 0 {
+		name, def, hasDefault = body[:i], body[i+1:], true
+	}
+	v, ok := get(name)
+	if hasDefault && (!ok || (emptyCounts && v == "")) {
+		return expand(def, escapes, get)
+	}
+	return v
+}
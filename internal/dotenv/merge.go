@@ -0,0 +1,56 @@
+package dotenv
+
+// Conflict is a key that ours and theirs both changed, differently, since
+// base. A nil entry means the key is absent on that side.
+type Conflict struct {
+	Key    string
+	Base   *Entry
+	Ours   *Entry
+	Theirs *Entry
+}
+
+// Merge3 applies the changes ours made to base on top of theirs and
+// returns the keys both changed.
+func Merge3(base, ours, theirs *File) (*File, []Conflict) {
+	merged := &File{entries: theirs.Entries()}
+	var conflicts []Conflict
+
+	keys := ours.Keys()
+	for _, key := range base.Keys() {
+		if _, ok := ours.Lookup(key); !ok {
+			keys = append(keys, key)
+		}
+	}
+	for _, key := range keys {
+		b := lookupPtr(base, key)
+		o := lookupPtr(ours, key)
+		t := lookupPtr(theirs, key)
+		switch {
+		case sameValue(o, t), sameValue(o, b):
+			// Nothing for ours to contribute.
+		case sameValue(t, b):
+			if o == nil {
+				merged.Delete(key)
+			} else {
+				merged.Put(*o)
+			}
+		default:
+			conflicts = append(conflicts, Conflict{Key: key, Base: b, Ours: o, Theirs: t})
+		}
+	}
+	return merged, conflicts
+}
+
+func lookupPtr(f *File, key string) *Entry {
+	if e, ok := f.Lookup(key); ok {
+		return &e
+	}
+	return nil
+}
+
+func sameValue(a, b *Entry) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	return a.Value == b.Value
+}
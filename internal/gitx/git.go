@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"fmt"
 	"os/exec"
+	"path/filepath"
 	"strings"
 )
 
@@ -20,10 +21,51 @@ func RepoRoot(repoHint string) (string, error) {
 	return strings.TrimSpace(string(out)), nil
 }
 
+// HooksDir returns the absolute directory git runs hooks from for repoRoot.
+// It honors core.hooksPath and resolves to the common git dir shared by all
+// worktrees of the repository.
+func HooksDir(repoRoot string) (string, error) {
+	out, err := output(repoRoot, "rev-parse", "--git-path", "hooks")
+	if err != nil {
+		return "", err
+	}
+	if !filepath.IsAbs(out) {
+		out = filepath.Join(repoRoot, out)
+	}
+	return filepath.Clean(out), nil
+}
+
+// AddWorktree runs "git worktree add" for path, creating branch from base
+// when branch is set. base may be empty to use the current HEAD.
+func AddWorktree(repoRoot, path, branch, base string) error {
+	args := []string{"worktree", "add"}
+	if branch != "" {
+		args = append(args, "-b", branch)
+	}
+	args = append(args, path)
+	if base != "" {
+		args = append(args, base)
+	}
+	_, err := output(repoRoot, args...)
+	return err
+}
+
+// RemoveWorktree runs "git worktree remove" for path.
+func RemoveWorktree(repoRoot, path string, force bool) error {
+	args := []string{"worktree", "remove"}
+	if force {
+		args = append(args, "--force")
+	}
+	args = append(args, path)
+	_, err := output(repoRoot, args...)
+	return err
+}
+
 type Worktree struct {
-	Path   string
-	Branch string // e.g. "refs/heads/develop" (may be empty)
-	Head   string // full sha
+	Path     string
+	Branch   string // e.g. "refs/heads/develop" (may be empty)
+	Head     string // full sha
+	Prunable bool   // git considers the worktree stale (e.g. its directory is gone)
 }
 
 func ListWorktrees(repoRoot string) ([]Worktree, error) {
@@ -65,6 +107,10 @@ func parseWorktreePorcelain(s string) ([]Worktree, error) {
 			if cur != nil {
 				cur.Head = strings.TrimSpace(strings.TrimPrefix(line, "HEAD "))
 			}
+		case line == "prunable" || strings.HasPrefix(line, "prunable "):
+			if cur != nil {
+				cur.Prunable = true
+			}
 		default:
 			// ignore other lines like "locked"
 		}
@@ -79,3 +125,46 @@ func parseWorktreePorcelain(s string) ([]Worktree, error) {
 	return out, nil
 }
 
+// IgnoredFiles returns the untracked files git ignores in repoRoot, as
+// slash-separated paths relative to it.
+func IgnoredFiles(repoRoot string) ([]string, error) {
+	out, err := output(repoRoot, "ls-files", "--others", "--ignored", "--exclude-standard")
+	if err != nil {
+		return nil, err
+	}
+	if out == "" {
+		return nil, nil
+	}
+	return strings.Split(out, "\n"), nil
+}
+
+// RemoteURLs returns the fetch URLs of the repo's remotes.
+func RemoteURLs(repoRoot string) ([]string, error) {
+	out, err := output(repoRoot, "remote", "-v")
+	if err != nil {
+		return nil, err
+	}
+	var urls []string
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 3 && fields[2] == "(fetch)" {
+			urls = append(urls, fields[1])
+		}
+	}
+	return urls, nil
+}
+
+func output(dir string, args ...string) (string, error) {
+	cmd := exec.Command("git", append([]string{"-C", dir}, args...)...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		msg := strings.TrimSpace(stderr.String())
+		if msg != "" {
+			return "", fmt.Errorf("git %s failed: %s", strings.Join(args[:min(2, len(args))], " "), msg)
+		}
+		return "", fmt.Errorf("git %s failed: %w", strings.Join(args[:min(2, len(args))], " "), err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
@@ -1,6 +1,11 @@
 package gitx
 
-import "testing"
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
 
 func TestParseWorktreePorcelain(t *testing.T) {
 	in := `
@@ -11,20 +16,83 @@ branch refs/heads/develop
 worktree /repo-wt
 HEAD 2222222222222222222222222222222222222222
 branch refs/heads/feat/x
+
+worktree /repo-gone
+HEAD 3333333333333333333333333333333333333333
+detached
+prunable gitdir file points to non-existent location
 `
 
 	wts, err := parseWorktreePorcelain(in)
 	if err != nil {
 		t.Fatalf("expected nil err, got %v", err)
 	}
-	if len(wts) != 2 {
-		t.Fatalf("expected 2, got %d", len(wts))
+	if len(wts) != 3 {
+		t.Fatalf("expected 3, got %d", len(wts))
 	}
 	if wts[0].Path != "/repo" || wts[0].Branch != "refs/heads/develop" || wts[0].Head[:7] != "1111111" {
 		t.Fatalf("unexpected first: %#v", wts[0])
 	}
-	if wts[1].Path != "/repo-wt" || wts[1].Branch != "refs/heads/feat/x" || wts[1].Head[:7] != "2222222" {
+	if wts[1].Path != "/repo-wt" || wts[1].Branch != "refs/heads/feat/x" || wts[1].Head[:7] != "2222222" || wts[1].Prunable {
 		t.Fatalf("unexpected second: %#v", wts[1])
 	}
+	if wts[2].Path != "/repo-gone" || wts[2].Branch != "" || !wts[2].Prunable {
+		t.Fatalf("unexpected third: %#v", wts[2])
+	}
+}
+
+// newRepo creates a git repo with one commit, skipping the test when git is
+// not installed.
+func newRepo(t *testing.T) string {
+	t.Helper()
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+	dir, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo := filepath.Join(dir, "repo")
+	for _, args := range [][]string{
+		{"init", "-q", repo},
+		{"-C", repo, "-c", "user.name=wtm", "-c", "user.email=wtm@example.com", "commit", "-q", "--allow-empty", "-m", "init"},
+	} {
+		if out, err := exec.Command("git", args...).CombinedOutput(); err != nil {
+			t.Fatalf("git %v: %v\n%s", args, err, out)
+		}
+	}
+	return repo
 }
 
+func TestAddAndRemoveWorktree(t *testing.T) {
+	repo := newRepo(t)
+	path := filepath.Join(filepath.Dir(repo), "repo-feat")
+
+	if err := AddWorktree(repo, path, "feat/a", "HEAD"); err != nil {
+		t.Fatalf("add: %v", err)
+	}
+	wts, err := ListWorktrees(repo)
+	if err != nil {
+		t.Fatalf("list: %v", err)
+	}
+	if len(wts) != 2 || wts[1].Path != path || wts[1].Branch != "refs/heads/feat/a" {
+		t.Fatalf("expected the new worktree on feat/a, got %+v", wts)
+	}
+
+	// A worktree with untracked files is only removed with force.
+	if err := os.WriteFile(filepath.Join(path, "scratch"), []byte("x"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := RemoveWorktree(repo, path, false); err == nil {
+		t.Fatal("expected git to refuse a dirty worktree")
+	}
+	if err := RemoveWorktree(repo, path, true); err != nil {
+		t.Fatalf("remove: %v", err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("expected %s to be gone, got %v", path, err)
+	}
+	if wts, err := ListWorktrees(repo); err != nil || len(wts) != 1 {
+		t.Fatalf("expected only the main worktree, got %+v (%v)", wts, err)
+	}
+}
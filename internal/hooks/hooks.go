@@ -0,0 +1,241 @@
+package hooks
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/aayushgautam/wtm/internal/gitx"
+)
+
+const (
+	hookName    = "post-checkout"
+	chainedName = hookName + ".wtm-chained"
+	marker      = "# wtm-managed-hook"
+)
+
+type hookOptions struct {
+	repoHint string
+	bin      string
+}
+
+// Run dispatches "wtm hooks <install|uninstall|status>".
+func Run(args []string) error {
+	if len(args) == 0 {
+		return usageError(fmt.Errorf("missing subcommand"))
+	}
+	sub := args[0]
+	switch sub {
+	case "install", "uninstall", "status":
+	default:
+		return usageError(fmt.Errorf("unknown subcommand %q", sub))
+	}
+	opts, err := parseOptions(sub, args[1:])
+	if err != nil {
+		return usageError(err)
+	}
+
+	repoRoot, err := gitx.RepoRoot(opts.repoHint)
+	if err != nil {
+		return err
+	}
+	dir, err := gitx.HooksDir(repoRoot)
+	if err != nil {
+		return err
+	}
+
+	switch sub {
+	case "install":
+		chained, err := Install(dir, opts.bin)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(os.Stderr, "Installed", filepath.Join(dir, hookName))
+		if chained {
+			fmt.Fprintln(os.Stderr, "Existing hook kept as", filepath.Join(dir, chainedName), "and runs first.")
+		}
+		return nil
+	case "uninstall":
+		restored, err := Uninstall(dir)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(os.Stderr, "Removed", filepath.Join(dir, hookName))
+		if restored {
+			fmt.Fprintln(os.Stderr, "Restored previous hook from", chainedName)
+		}
+		return nil
+	case "status":
+		st, err := Inspect(dir)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(os.Stdout, "Hooks dir:", dir)
+		switch {
+		case st.Managed:
+			fmt.Fprintln(os.Stdout, "post-checkout: installed (wtm)")
+		case st.Foreign:
+			fmt.Fprintln(os.Stdout, "post-checkout: present, not managed by wtm")
+		default:
+			fmt.Fprintln(os.Stdout, "post-checkout: not installed")
+		}
+		if st.Chained {
+			fmt.Fprintln(os.Stdout, "Chained hook:", filepath.Join(dir, chainedName))
+		}
+	}
+	return nil
+}
+
+func parseOptions(sub string, args []string) (hookOptions, error) {
+	fsFlags := flag.NewFlagSet("hooks "+sub, flag.ContinueOnError)
+	fsFlags.SetOutput(io.Discard)
+
+	var opts hookOptions
+	fsFlags.StringVar(&opts.repoHint, "repo", "", "repo path (defaults to current dir repo)")
+	if sub == "install" {
+		fsFlags.StringVar(&opts.bin, "bin", "wtm", "wtm executable the hook should run")
+	}
+
+	if err := fsFlags.Parse(args); err != nil {
+		return hookOptions{}, err
+	}
+	if fsFlags.NArg() > 0 {
+		return hookOptions{}, fmt.Errorf("unexpected argument %q", fsFlags.Arg(0))
+	}
+	return opts, nil
+}
+
+func usageError(err error) error {
+	msg := strings.TrimSpace(err.Error())
+	if msg != "" {
+		fmt.Fprintln(os.Stderr, "Error:", msg)
+	}
+	fmt.Fprintln(os.Stderr, "usage: wtm hooks <install [--bin PATH] | uninstall | status> [--repo PATH]")
+	return fmt.Errorf("invalid arguments")
+}
+
+// State describes the post-checkout hook found in a hooks directory.
+type State struct {
+	Managed bool // post-checkout was written by wtm
+	Foreign bool // post-checkout exists but was not written by wtm
+	Chained bool // a previous hook is preserved next to ours
+}
+
+func Inspect(dir string) (State, error) {
+	var st State
+	b, err := os.ReadFile(filepath.Join(dir, hookName))
+	switch {
+	case err == nil:
+		st.Managed = isManaged(b)
+		st.Foreign = !st.Managed
+	case !errors.Is(err, os.ErrNotExist):
+		return State{}, fmt.Errorf("read hook: %w", err)
+	}
+	if _, err := os.Lstat(filepath.Join(dir, chainedName)); err == nil {
+		st.Chained = true
+	}
+	return st, nil
+}
+
+// Install writes the managed post-checkout hook into dir; chained reports
+// whether an existing hook was moved aside.
+func Install(dir, bin string) (chained bool, err error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return false, fmt.Errorf("mkdir %s: %w", dir, err)
+	}
+	st, err := Inspect(dir)
+	if err != nil {
+		return false, err
+	}
+	path := filepath.Join(dir, hookName)
+	if st.Foreign {
+		if st.Chained {
+			return false, fmt.Errorf("%s already exists; refusing to replace %s", filepath.Join(dir, chainedName), path)
+		}
+		if err := os.Rename(path, filepath.Join(dir, chainedName)); err != nil {
+			return false, fmt.Errorf("move existing hook: %w", err)
+		}
+		chained = true
+	}
+	if err := os.WriteFile(path, []byte(Script(bin)), 0o755); err != nil {
+		return chained, fmt.Errorf("write %s: %w", path, err)
+	}
+	// WriteFile keeps the mode of an existing file, so set it explicitly.
+	if err := os.Chmod(path, 0o755); err != nil {
+		return chained, fmt.Errorf("chmod %s: %w", path, err)
+	}
+	return chained, nil
+}
+
+// Uninstall removes the managed hook and restores any chained hook.
+func Uninstall(dir string) (restored bool, err error) {
+	st, err := Inspect(dir)
+	if err != nil {
+		return false, err
+	}
+	path := filepath.Join(dir, hookName)
+	if st.Foreign {
+		return false, fmt.Errorf("%s is not managed by wtm; leaving it alone", path)
+	}
+	if !st.Managed {
+		return false, fmt.Errorf("no wtm hook installed in %s", dir)
+	}
+	if err := os.Remove(path); err != nil {
+		return false, fmt.Errorf("remove %s: %w", path, err)
+	}
+	if st.Chained {
+		if err := os.Rename(filepath.Join(dir, chainedName), path); err != nil {
+			return false, fmt.Errorf("restore chained hook: %w", err)
+		}
+		restored = true
+	}
+	return restored, nil
+}
+
+func isManaged(b []byte) bool {
+	return strings.Contains(string(b), marker)
+}
+
+// Script renders the post-checkout hook.
+func Script(bin string) string {
+	return `#!/bin/sh
+` + marker + `
+# Installed by "wtm hooks install"; remove with "wtm hooks uninstall".
+# A pre-existing post-checkout hook is kept as ` + chainedName + ` and runs first.
+
+status=0
+chained="$(dirname "$0")/` + chainedName + `"
+if [ -x "$chained" ]; then
+	"$chained" "$@" || status=$?
+fi
+
+case "$1" in
+"" | *[!0]*) exit $status ;;
+esac
+
+WTM=${WTM_BIN:-` + shellQuote(bin) + `}
+command -v "$WTM" >/dev/null 2>&1 || exit $status
+
+dest=$(git rev-parse --show-toplevel 2>/dev/null)
+main=$(git worktree list --porcelain 2>/dev/null | sed -n '1s/^worktree //p')
+if [ -z "$dest" ] || [ -z "$main" ] || [ "$dest" = "$main" ]; then
+	exit $status
+fi
+
+unset GIT_DIR GIT_WORK_TREE GIT_INDEX_FILE
+"$WTM" sync --repo "$main" --dest "$dest" --yes </dev/null
+case $? in
+0 | 3) ;; # synced, or nothing to sync
+*) echo "wtm: sync into $dest failed" >&2 ;;
+esac
+exit $status
+`
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
@@ -0,0 +1,100 @@
+package hooks
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestInstallFreshAndUninstall(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "hooks")
+	chained, err := Install(dir, "/usr/local/bin/wtm")
+	if err != nil {
+		t.Fatalf("install: %v", err)
+	}
+	if chained {
+		t.Fatalf("expected no chained hook")
+	}
+	path := filepath.Join(dir, hookName)
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("stat: %v", err)
+	}
+	if info.Mode().Perm()&0o100 == 0 {
+		t.Fatalf("hook not executable: %v", info.Mode())
+	}
+	b, _ := os.ReadFile(path)
+	if !strings.Contains(string(b), "'/usr/local/bin/wtm'") {
+		t.Fatalf("hook does not reference bin:\n%s", b)
+	}
+
+	// Re-installing over our own hook must not chain it.
+	if chained, err := Install(dir, "wtm"); err != nil || chained {
+		t.Fatalf("reinstall: chained=%v err=%v", chained, err)
+	}
+
+	restored, err := Uninstall(dir)
+	if err != nil {
+		t.Fatalf("uninstall: %v", err)
+	}
+	if restored {
+		t.Fatalf("expected nothing restored")
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("expected hook removed, got %v", err)
+	}
+}
+
+func TestInstallChainsExistingHook(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, hookName)
+	orig := "#!/bin/sh\necho custom\n"
+	if err := os.WriteFile(path, []byte(orig), 0o755); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	chained, err := Install(dir, "wtm")
+	if err != nil {
+		t.Fatalf("install: %v", err)
+	}
+	if !chained {
+		t.Fatalf("expected existing hook to be chained")
+	}
+	st, err := Inspect(dir)
+	if err != nil {
+		t.Fatalf("inspect: %v", err)
+	}
+	if !st.Managed || !st.Chained || st.Foreign {
+		t.Fatalf("unexpected state: %#v", st)
+	}
+
+	restored, err := Uninstall(dir)
+	if err != nil {
+		t.Fatalf("uninstall: %v", err)
+	}
+	if !restored {
+		t.Fatalf("expected chained hook restored")
+	}
+	b, err := os.ReadFile(path)
+	if err != nil || string(b) != orig {
+		t.Fatalf("expected original hook back, got %q (%v)", b, err)
+	}
+}
+
+func TestUninstallRefusesForeignHook(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, hookName), []byte("#!/bin/sh\n"), 0o755); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if _, err := Uninstall(dir); err == nil {
+		t.Fatalf("expected error for foreign hook")
+	}
+}
+
+func TestRunRejectsUnknownSubcommandOutsideRepo(t *testing.T) {
+	err := Run([]string{"bogus", "--repo", t.TempDir()})
+	if err == nil || err.Error() != "invalid arguments" {
+		t.Fatalf("expected a usage error, got %v", err)
+	}
+}
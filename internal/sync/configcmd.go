@@ -0,0 +1,317 @@
+package sync
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/aayushgautam/wtm/internal/config"
+	"github.com/aayushgautam/wtm/internal/gitx"
+)
+
+type configOptions struct {
+	repoHint   string
+	resolved   bool
+	detect     bool
+	force      bool
+	positional []string
+}
+
+// candidatePatterns are the files "wtm config init --detect" suggests when
+// git ignores them: local env, settings and key files.
+var candidatePatterns = []string{
+	"**/.env", "**/.env.*", "**/*.local", "**/*.local.*", "**/local.*",
+	"**/.npmrc", "**/*.pem", "**/*.key", "**/secrets.*",
+}
+
+// Config dispatches "wtm config <show|init|validate|explain>".
+func Config(args []string) error {
+	return newSession(nil).config(args)
+}
+
+func (s *session) config(args []string) error {
+	if len(args) == 0 {
+		return configUsageError(fmt.Errorf("missing subcommand"))
+	}
+	sub := args[0]
+	fsFlags := flag.NewFlagSet("config "+sub, flag.ContinueOnError)
+	fsFlags.SetOutput(io.Discard)
+
+	var opts configOptions
+	fsFlags.StringVar(&opts.repoHint, "repo", "", "repo path (defaults to current dir repo)")
+	switch sub {
+	case "show":
+		fsFlags.BoolVar(&opts.resolved, "resolved", false, "print the merged config and where each setting came from")
+	case "init":
+		fsFlags.BoolVar(&opts.detect, "detect", false, "include the git-ignored env and key files found in the repo")
+		fsFlags.BoolVar(&opts.force, "force", false, "replace an existing config file")
+	}
+	positional, err := parseInterspersed(fsFlags, args[1:])
+	if err != nil {
+		return configUsageError(err)
+	}
+	opts.positional = positional
+
+	switch sub {
+	case "show", "init", "validate":
+		if len(opts.positional) > 0 {
+			return configUsageError(fmt.Errorf("unexpected argument %q", opts.positional[0]))
+		}
+	case "explain":
+		if len(opts.positional) != 1 {
+			return configUsageError(fmt.Errorf("explain takes one path"))
+		}
+	}
+
+	switch sub {
+	case "show":
+		return s.showConfig(opts)
+	case "init":
+		return s.initConfig(opts)
+	case "validate":
+		return s.validateConfig(opts)
+	case "explain":
+		return s.explainConfig(opts)
+	default:
+		return configUsageError(fmt.Errorf("unknown subcommand %q", sub))
+	}
+}
+
+func configUsageError(err error) error {
+	msg := strings.TrimSpace(err.Error())
+	if msg != "" {
+		fmt.Fprintln(os.Stderr, "Error:", msg)
+	}
+	fmt.Fprintln(os.Stderr, "usage: wtm config show [--resolved] [--repo PATH]")
+	fmt.Fprintln(os.Stderr, "       wtm config init [--detect] [--force] [--repo PATH]")
+	fmt.Fprintln(os.Stderr, "       wtm config validate [--repo PATH]")
+	fmt.Fprintln(os.Stderr, "       wtm config explain PATH [--repo PATH]")
+	return fmt.Errorf("invalid arguments")
+}
+
+// showConfig prints the repo's config file as written or, with --resolved,
+// the config wtm actually uses once the user config is merged in.
+func (s *session) showConfig(opts configOptions) error {
+	repoRoot, err := s.git.RepoRoot(opts.repoHint)
+	if err != nil {
+		return err
+	}
+
+	if !opts.resolved {
+		path := filepath.Join(repoRoot, config.DefaultConfigFileName)
+		b, err := os.ReadFile(path)
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				fmt.Fprintln(os.Stderr, "No", path+"; run \"wtm config show --resolved\" to see the settings in use.")
+				return nil
+			}
+			return fmt.Errorf("read %s: %w", path, err)
+		}
+		_, err = os.Stdout.Write(b)
+		return err
+	}
+
+	loaded, err := s.loadConfig(repoRoot)
+	if err != nil {
+		return err
+	}
+	out, err := loaded.Resolved()
+	if err != nil {
+		return err
+	}
+	_, err = os.Stdout.Write(out)
+	return err
+}
+
+// initConfig writes a commented config file.
+func (s *session) initConfig(opts configOptions) error {
+	repoRoot, err := s.git.RepoRoot(opts.repoHint)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(repoRoot, config.DefaultConfigFileName)
+	if _, err := os.Stat(path); err == nil && !opts.force {
+		return fmt.Errorf("%s already exists; pass --force to replace it", path)
+	}
+
+	var include []string
+	if opts.detect {
+		ignored, err := gitx.IgnoredFiles(repoRoot)
+		if err != nil {
+			return err
+		}
+		defaults := config.Default()
+		include = append(include, defaults.Include...)
+		var found []string
+		for _, rel := range ignored {
+			if !matchesAny(candidatePatterns, rel) || matchesAny(normalizePatterns(defaults.Exclude), rel) {
+				continue
+			}
+			found = append(found, rel)
+			if !matchesAny(normalizePatterns(defaults.Include), rel) {
+				include = append(include, rel)
+			}
+		}
+		fmt.Fprintf(os.Stderr, "Detected %d candidate files:\n", len(found))
+		for _, rel := range found {
+			fmt.Fprintln(os.Stdout, rel)
+		}
+	}
+
+	if err := os.WriteFile(path, config.Template(include), 0o644); err != nil {
+		return fmt.Errorf("write %s: %w", path, err)
+	}
+	fmt.Fprintln(os.Stderr, "Wrote", path)
+	return nil
+}
+
+// validateConfig reports config errors, and patterns that match no file
+// as warnings.
+func (s *session) validateConfig(opts configOptions) error {
+	repoRoot, err := s.git.RepoRoot(opts.repoHint)
+	if err != nil {
+		return err
+	}
+	problems, err := config.Check(repoRoot)
+	if err != nil {
+		return err
+	}
+	for _, p := range problems {
+		fmt.Fprintln(os.Stdout, "error:", p)
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("config has %d errors", len(problems))
+	}
+
+	loaded, err := s.loadConfig(repoRoot)
+	if err != nil {
+		return err
+	}
+	cfg := loaded.Config
+	rules := linkRulePatterns(cfg)
+	includeHits := make([]bool, len(cfg.Include))
+	ruleHits := make([]bool, len(rules))
+	err = s.walkRepoFiles(repoRoot, func(_, rel string) error {
+		rel, _ = templateRel(rel)
+		if i := firstMatch(cfg.Include, rel); i >= 0 {
+			includeHits[i] = true
+		}
+		for i, p := range rules {
+			if !ruleHits[i] && matchesAny(normalizePatterns([]string{p}), rel) {
+				ruleHits[i] = true
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	warnings := 0
+	if origin := loaded.Origins["include"]; origin != "defaults" {
+		for i, hit := range includeHits {
+			if !hit {
+				fmt.Fprintf(os.Stdout, "warning: %s: include %q matches no file in the repo\n", origin, cfg.Include[i])
+				warnings++
+			}
+		}
+	}
+	for i, hit := range ruleHits {
+		if !hit {
+			fmt.Fprintf(os.Stdout, "warning: %s: link.rules[%d] %q matches no file in the repo\n", loaded.Origins["link.rules"], i, rules[i])
+			warnings++
+		}
+	}
+	if warnings > 0 {
+		fmt.Fprintf(os.Stderr, "Config is valid, with %d warnings.\n", warnings)
+	} else {
+		fmt.Fprintln(os.Stderr, "Config is valid.")
+	}
+	return nil
+}
+
+// explainConfig says which include and exclude patterns decide whether
+// sync picks up a path, and which link mode it would get.
+func (s *session) explainConfig(opts configOptions) error {
+	repoRoot, err := s.git.RepoRoot(opts.repoHint)
+	if err != nil {
+		return err
+	}
+	loaded, err := s.loadConfig(repoRoot)
+	if err != nil {
+		return err
+	}
+	rel, err := repoRelative(repoRoot, opts.positional[0])
+	if err != nil {
+		return err
+	}
+	cfg := loaded.Config
+
+	fmt.Fprintln(os.Stdout, rel)
+	if _, err := s.fs.Lstat(filepath.Join(repoRoot, filepath.FromSlash(rel))); err != nil {
+		fmt.Fprintln(os.Stdout, "  note:    no such file in the repo")
+	}
+	if out, ok := templateRel(rel); ok {
+		fmt.Fprintf(os.Stdout, "  note:    a template; sync renders it into %s\n", out)
+		rel = out
+	}
+	for _, dir := range strings.Split(rel, "/")[:strings.Count(rel, "/")] {
+		if containsString(skippedRepoDirs, dir) {
+			fmt.Fprintf(os.Stdout, "  skipped: inside %s, which sync never walks\n", dir)
+			fmt.Fprintln(os.Stdout, "  result:  not synced")
+			return nil
+		}
+	}
+
+	included := false
+	if i := firstMatch(cfg.Include, rel); i >= 0 {
+		included = true
+		fmt.Fprintf(os.Stdout, "  include: include[%d] %q matches (%s)\n", i, cfg.Include[i], loaded.Origins["include"])
+	} else {
+		fmt.Fprintf(os.Stdout, "  include: no pattern matches (%s)\n", loaded.Origins["include"])
+	}
+	excluded := false
+	if i := firstMatch(cfg.Exclude, rel); i >= 0 {
+		excluded = true
+		fmt.Fprintf(os.Stdout, "  exclude: exclude[%d] %q matches (%s)\n", i, cfg.Exclude[i], loaded.Origins["exclude"])
+	} else {
+		fmt.Fprintf(os.Stdout, "  exclude: no pattern matches (%s)\n", loaded.Origins["exclude"])
+	}
+	if !included || excluded {
+		fmt.Fprintln(os.Stdout, "  result:  not synced")
+		return nil
+	}
+
+	fmt.Fprintln(os.Stdout, "  result:  synced")
+	switch i := firstMatch(linkRulePatterns(cfg), rel); {
+	case cfg.Encryption.Enabled():
+		fmt.Fprintf(os.Stdout, "  link:    %s (the store is encrypted)\n", config.LinkCopy)
+	case i >= 0:
+		fmt.Fprintf(os.Stdout, "  link:    %s (link.rules[%d] %q, %s)\n", cfg.Link.Rules[i].Mode, i, cfg.Link.Rules[i].Pattern, loaded.Origins["link.rules"])
+	default:
+		fmt.Fprintf(os.Stdout, "  link:    %s (link.mode, %s)\n", cfg.Link.Mode, loaded.Origins["link.mode"])
+	}
+	return nil
+}
+
+// repoRelative turns path into a slash-separated path relative to
+// repoRoot.
+func repoRelative(repoRoot, path string) (string, error) {
+	abs := path
+	if !filepath.IsAbs(abs) {
+		if _, err := os.Lstat(path); err != nil {
+			abs = filepath.Join(repoRoot, path)
+		} else if abs, err = filepath.Abs(path); err != nil {
+			return "", err
+		}
+	}
+	rel, err := filepath.Rel(repoRoot, abs)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%s is outside the repo %s", path, repoRoot)
+	}
+	return filepath.ToSlash(rel), nil
+}
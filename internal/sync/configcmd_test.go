@@ -0,0 +1,82 @@
+package sync
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aayushgautam/wtm/internal/config"
+)
+
+// dirGit is a repo at root on disk.
+type dirGit struct {
+	fakeGit
+	root string
+}
+
+func (g dirGit) RepoRoot(string) (string, error) { return g.root, nil }
+
+// configSession returns a session for a repo on disk holding files and the
+// config file cfg.
+func configSession(t *testing.T, cfg string, files ...string) *session {
+	t.Helper()
+	root := t.TempDir()
+	files = append(files, config.DefaultConfigFileName)
+	for _, rel := range files {
+		content := "A=1\n"
+		if rel == config.DefaultConfigFileName {
+			content = cfg
+		}
+		path := filepath.Join(root, filepath.FromSlash(rel))
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatalf("mkdir: %v", err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+	s := newSession(nil)
+	s.git = dirGit{root: root}
+	return s
+}
+
+func TestConfigValidate(t *testing.T) {
+	s := configSession(t, "include:\n  - \"**/.env\"\n  - \"**/.missing\"\n", ".env")
+	var err error
+	out := captureStdout(t, func() { err = s.config([]string{"validate"}) })
+	wantExit(t, err, 0)
+	if !strings.Contains(out, `include "**/.missing" matches no file`) || strings.Contains(out, `"**/.env"`) {
+		t.Fatalf("expected a warning for the unused pattern only, got:\n%s", out)
+	}
+
+	s = configSession(t, "inclde:\n  - \"**/.env\"\n", ".env")
+	out = captureStdout(t, func() { err = s.config([]string{"validate"}) })
+	if err == nil || !strings.Contains(out, "error: ") || !strings.Contains(out, "inclde") {
+		t.Fatalf("expected the unknown key reported, got %v:\n%s", err, out)
+	}
+}
+
+func TestConfigExplain(t *testing.T) {
+	s := configSession(t, "exclude:\n  - \"apps/**\"\nlink:\n  rules:\n    - pattern: \"**/.env.local\"\n      mode: copy\n",
+		".env", ".env.local", "apps/api/.env")
+	for path, want := range map[string][]string{
+		".env":                          {"include: include[0]", "result:  synced", "link:    symlink (link.mode, defaults)"},
+		".env.local":                    {"result:  synced", "link:    copy (link.rules[0]"},
+		"apps/api/.env":                 {`exclude: exclude[0] "apps/**" matches`, "result:  not synced"},
+		"node_modules/.env":             {"note:    no such file in the repo", "inside node_modules", "result:  not synced"},
+		".env.example" + templateSuffix: {"a template; sync renders it into .env.example"},
+	} {
+		var err error
+		out := captureStdout(t, func() { err = s.config([]string{"explain", path}) })
+		wantExit(t, err, 0)
+		for _, w := range want {
+			if !strings.Contains(out, w) {
+				t.Fatalf("%s: expected %q in:\n%s", path, w, out)
+			}
+		}
+	}
+	if err := s.config([]string{"explain", "../outside"}); err == nil {
+		t.Fatal("expected a path outside the repo to be rejected")
+	}
+}
@@ -0,0 +1,199 @@
+package sync
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/crypto/hkdf"
+
+	"github.com/aayushgautam/wtm/internal/age"
+	"github.com/aayushgautam/wtm/internal/config"
+)
+
+const (
+	identityFileName = "identity.txt"
+	identityEnv      = "WTM_IDENTITY"
+)
+
+// hashKeyInfo separates the content hash key from other uses of the
+// identity.
+const hashKeyInfo = "wtm content hash"
+
+// storeCipher encrypts store writes when recipients are configured and
+// decrypts age files it reads back.
+type storeCipher struct {
+	recipients []*age.Recipient
+	identities []*age.Identity // loaded on first decrypt
+	// hashKey keys the content hashes of an encrypted store, so the
+	// manifest and history do not give away a hash of each secret.
+	hashKey []byte
+}
+
+func newStoreCipher(cfg config.Config) (*storeCipher, error) {
+	c := &storeCipher{}
+	for _, s := range cfg.Encryption.Recipients {
+		r, err := age.ParseRecipient(s)
+		if err != nil {
+			return nil, err
+		}
+		c.recipients = append(c.recipients, r)
+	}
+	if c.enabled() {
+		key, err := c.identityHashKey()
+		if err != nil {
+			return nil, err
+		}
+		c.hashKey = key
+	}
+	return c, nil
+}
+
+// identityHashKey derives the content hash key from the first identity.
+func (c *storeCipher) identityHashKey() ([]byte, error) {
+	if c.identities == nil {
+		ids, err := loadIdentities()
+		if err != nil {
+			return nil, err
+		}
+		c.identities = ids
+	}
+	key := make([]byte, sha256.Size)
+	r := hkdf.New(sha256.New, []byte(c.identities[0].String()), nil, []byte(hashKeyInfo))
+	if _, err := io.ReadFull(r, key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// hash returns the hex hash the manifest and history record for plain:
+// HMAC-SHA-256 under hashKey in an encrypted store, SHA-256 otherwise.
+func (c *storeCipher) hash(plain []byte) string {
+	if c == nil || c.hashKey == nil {
+		sum := sha256.Sum256(plain)
+		return hex.EncodeToString(sum[:])
+	}
+	mac := hmac.New(sha256.New, c.hashKey)
+	mac.Write(plain)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// enabled reports whether store files are written encrypted. Worktrees then
+// get decrypted copies instead of links into the store.
+func (c *storeCipher) enabled() bool {
+	return len(c.recipients) > 0
+}
+
+func (c *storeCipher) seal(plain []byte) ([]byte, error) {
+	if !c.enabled() {
+		return plain, nil
+	}
+	return age.Encrypt(plain, c.recipients...)
+}
+
+func (c *storeCipher) open(b []byte) ([]byte, error) {
+	if !age.IsEncrypted(b) {
+		return b, nil
+	}
+	if c.identities == nil {
+		ids, err := loadIdentities()
+		if err != nil {
+			return nil, err
+		}
+		c.identities = ids
+	}
+	return age.Decrypt(b, c.identities...)
+}
+
+// contentHash is the hash recorded for plain in the manifest and history.
+func (s *session) contentHash(plain []byte) string {
+	return s.cipher.hash(plain)
+}
+
+// readFile returns the plain-text content of the store file at path.
+func (s *session) readFile(path string) ([]byte, error) {
+	b, err := s.fs.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read %s: %w", path, err)
+	}
+	plain, err := s.cipher.open(b)
+	if err != nil {
+		return nil, fmt.Errorf("decrypt %s: %w", path, err)
+	}
+	return plain, nil
+}
+
+// writeFile seals plain and writes it to path. Encrypted files are private
+// to the user regardless of perm.
+func (s *session) writeFile(path string, plain []byte, perm os.FileMode) error {
+	b, err := s.cipher.seal(plain)
+	if err != nil {
+		return fmt.Errorf("encrypt %s: %w", path, err)
+	}
+	if s.cipher.enabled() {
+		perm = 0o600
+	}
+	if err := s.fs.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return fmt.Errorf("mkdir %s: %w", filepath.Dir(path), err)
+	}
+	tmp := filepath.Join(filepath.Dir(path), metaDirPrefix+"tmp-"+filepath.Base(path))
+	if err := s.fs.WriteFile(tmp, b, perm); err != nil {
+		return fmt.Errorf("write %s: %w", tmp, err)
+	}
+	if err := s.fs.Rename(tmp, path); err != nil {
+		_ = s.fs.Remove(tmp)
+		return fmt.Errorf("rename %s: %w", path, err)
+	}
+	return nil
+}
+
+// sealRepoFile writes the repo file src into the store at dst, encrypted
+// when encryption is enabled.
+func (s *session) sealRepoFile(src, dst string) error {
+	if !s.cipher.enabled() {
+		return s.copyRepoToStore(src, dst)
+	}
+	b, err := s.fs.ReadFile(src)
+	if err != nil {
+		return fmt.Errorf("read %s: %w", src, err)
+	}
+	return s.writeFile(dst, b, 0o600)
+}
+
+// identityPath is the age identity file used to decrypt stores: $WTM_IDENTITY
+// or ~/.wtm/identity.txt.
+func identityPath() (string, error) {
+	if p := os.Getenv(identityEnv); p != "" {
+		return p, nil
+	}
+	home, err := wtmHome()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, identityFileName), nil
+}
+
+func loadIdentities() ([]*age.Identity, error) {
+	path, err := identityPath()
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("store is encrypted but there is no identity at %s; run \"wtm keygen\" or set %s", path, identityEnv)
+		}
+		return nil, fmt.Errorf("open %s: %w", path, err)
+	}
+	defer f.Close()
+	ids, err := age.ParseIdentities(f)
+	if err != nil {
+		return nil, fmt.Errorf("read %s: %w", path, err)
+	}
+	return ids, nil
+}
@@ -0,0 +1,329 @@
+package sync
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/aayushgautam/wtm/internal/config"
+	"github.com/aayushgautam/wtm/internal/dotenv"
+	"github.com/aayushgautam/wtm/internal/textdiff"
+)
+
+const maskedValue = "****"
+
+type diffOptions struct {
+	repoHint     string
+	worktreeNum  int
+	destOverride string
+	keys         bool
+	showValues   bool
+	output       string
+}
+
+// jsonDiffEntry is one differing file of "wtm diff --output".
+type jsonDiffEntry struct {
+	Rel      string          `json:"rel"`
+	RepoAbs  string          `json:"repoAbs"`
+	StoreAbs string          `json:"storeAbs"`
+	Diff     string          `json:"diff,omitempty"`
+	Keys     []jsonKeyChange `json:"keys,omitempty"`
+	Error    string          `json:"error,omitempty"`
+}
+
+// jsonKeyChange is one variable that differs, masked like the text output.
+type jsonKeyChange struct {
+	Key  string `json:"key"`
+	Kind string `json:"kind"`
+	Old  string `json:"old,omitempty"`
+	New  string `json:"new,omitempty"`
+}
+
+type diffSummary struct {
+	Outcome string `json:"outcome"`
+	Files   int    `json:"files"`
+	Differ  int    `json:"differ"`
+}
+
+func (s diffSummary) exit() error {
+	return outcomeError(s.Outcome, "")
+}
+
+// Diff is "wtm diff".
+func Diff(args []string) error {
+	return newSession(nil).diff(args)
+}
+
+// diff prints how each store file differs from its repo copy, i.e. what
+// "wtm push" would change.
+func (s *session) diff(args []string) error {
+	opts, err := parseDiffOptions(args)
+	if err != nil {
+		return diffUsageError(err)
+	}
+
+	repoRoot, err := s.git.RepoRoot(opts.repoHint)
+	if err != nil {
+		return err
+	}
+
+	wts, err := s.git.ListWorktrees(repoRoot)
+	if err != nil {
+		return err
+	}
+
+	worktree, err := s.pickWorktree(repoRoot, wts, opts.destOverride, opts.worktreeNum)
+	if err != nil {
+		return err
+	}
+
+	loaded, err := s.loadConfig(repoRoot)
+	if err != nil {
+		return err
+	}
+	if s.cipher, err = newStoreCipher(loaded.Config); err != nil {
+		return err
+	}
+
+	storeRoot, err := pushStoreRoot(repoRoot, worktree, loaded.Config.Store.Mode)
+	if err != nil {
+		return err
+	}
+
+	plan, err := s.buildDiffPlan(repoRoot, storeRoot, loaded.Config)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintln(os.Stderr, "Repo:", repoRoot)
+	fmt.Fprintln(os.Stderr, "Store:", storeRoot)
+
+	rep := newReporter(opts.output, "diff", os.Stdout)
+	sum := diffSummary{Outcome: outcomeOK, Files: len(plan)}
+	for _, it := range plan {
+		if it.link != config.LinkSymlink && loaded.Config.Store.Mode != config.StoreModeLayered {
+			// A worktree copy may hold edits not yet in the store; push
+			// copies them in first, so compare against it.
+			copyAbs := filepath.Join(worktree.Path, filepath.FromSlash(it.rel))
+			if info, err := s.fs.Lstat(copyAbs); err == nil && info.Mode().IsRegular() && !samePath(copyAbs, it.repoAbs) {
+				it.storeAbs = copyAbs
+			}
+		}
+		if rep.machine() {
+			e := jsonDiffEntry{Rel: it.rel, RepoAbs: it.repoAbs, StoreAbs: it.storeAbs}
+			if opts.keys {
+				changes, err := s.keyChangesOf(it)
+				if err != nil {
+					e.Error = err.Error()
+				}
+				e.Keys = newJSONKeyChanges(changes, opts.showValues)
+			} else {
+				e.Diff = s.fileDiff(it.repoAbs, it.storeAbs, "repo/"+it.rel, "store/"+it.rel)
+			}
+			if e.Diff == "" && len(e.Keys) == 0 && e.Error == "" {
+				continue
+			}
+			sum.Differ++
+			if err := rep.add("entry", e); err != nil {
+				return err
+			}
+			continue
+		}
+		var out string
+		if opts.keys {
+			out = s.keyDiff(it, opts.showValues)
+		} else {
+			out = s.fileDiff(it.repoAbs, it.storeAbs, "repo/"+it.rel, "store/"+it.rel)
+		}
+		if out == "" {
+			continue
+		}
+		sum.Differ++
+		fmt.Fprint(os.Stdout, out)
+	}
+	fmt.Fprintf(os.Stderr, "%d of %d files differ.\n", sum.Differ, len(plan))
+	return finish(rep, sum)
+}
+
+func parseDiffOptions(args []string) (diffOptions, error) {
+	fsFlags := flag.NewFlagSet("diff", flag.ContinueOnError)
+	fsFlags.SetOutput(io.Discard)
+
+	var opts diffOptions
+	fsFlags.StringVar(&opts.repoHint, "repo", "", "repo path (defaults to current dir repo)")
+	fsFlags.IntVar(&opts.worktreeNum, "worktree", 0, "worktree number (1-indexed)")
+	fsFlags.StringVar(&opts.destOverride, "dest", "", "worktree path")
+	fsFlags.BoolVar(&opts.keys, "keys", false, "compare dotenv variables instead of lines")
+	fsFlags.BoolVar(&opts.showValues, "show-values", false, "with --keys, print values instead of masking them")
+	fsFlags.StringVar(&opts.output, "output", outputText, "text, json or ndjson")
+
+	if err := fsFlags.Parse(args); err != nil {
+		return diffOptions{}, err
+	}
+	if err := validOutput(opts.output); err != nil {
+		return diffOptions{}, err
+	}
+	return opts, nil
+}
+
+func diffUsageError(err error) error {
+	msg := strings.TrimSpace(err.Error())
+	if msg != "" {
+		fmt.Fprintln(os.Stderr, "Error:", msg)
+	}
+	fmt.Fprintln(os.Stderr, "usage: wtm diff [--repo PATH] [--worktree N | --dest PATH] [--keys [--show-values]] [--output text|json|ndjson]")
+	return fmt.Errorf("invalid arguments")
+}
+
+// buildDiffPlan pairs every matching file that exists in the store, the
+// repo, or both. Store files are taken as push finds them; repo files
+// without a store copy are added so a missing store file shows up too.
+func (s *session) buildDiffPlan(repoRoot, storeRoot string, cfg config.Config) ([]planItem, error) {
+	plan, err := s.buildPushPlan(storeRoot, repoRoot, cfg)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	seen := make(map[string]bool, len(plan))
+	for _, it := range plan {
+		seen[it.rel] = true
+	}
+
+	include := normalizePatterns(cfg.Include)
+	exclude := normalizePatterns(cfg.Exclude)
+	err = s.walkRepoFiles(filepath.Clean(repoRoot), func(path, rel string) error {
+		if seen[rel] || strings.HasSuffix(rel, templateSuffix) {
+			return nil
+		}
+		if !matchesAny(include, rel) || matchesAny(exclude, rel) {
+			return nil
+		}
+		if _, err := s.fs.Stat(path + templateSuffix); err == nil {
+			// Rendered from a template, which push leaves alone.
+			return nil
+		}
+		plan = append(plan, planItem{
+			rel:      rel,
+			repoAbs:  path,
+			storeAbs: filepath.Join(filepath.Clean(storeRoot), filepath.FromSlash(rel)),
+			link:     linkModeFor(cfg, rel),
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sortPlan(plan)
+	return plan, nil
+}
+
+// fileDiff returns a unified diff from the file at from to the file at to.
+// A missing file diffs as empty and is labelled /dev/null.
+func (s *session) fileDiff(from, to, fromLabel, toLabel string) string {
+	a, aName := s.readForDiff(from, fromLabel)
+	b, bName := s.readForDiff(to, toLabel)
+	return textdiff.Unified(aName, bName, a, b, textdiff.DefaultContext)
+}
+
+func (s *session) readForDiff(path, label string) ([]byte, string) {
+	b, err := s.readFile(path)
+	if err != nil {
+		return nil, "/dev/null"
+	}
+	return b, label
+}
+
+// keyDiff lists the variables that differ between the repo and store copies
+// of it. Values are masked unless showValues is set.
+func (s *session) keyDiff(it planItem, showValues bool) string {
+	changes, err := s.keyChangesOf(it)
+	if err != nil {
+		return fmt.Sprintf("%s: %v; compare it without --keys\n", it.rel, err)
+	}
+	if len(changes) == 0 {
+		return ""
+	}
+	return formatKeyChanges(it.rel, changes, showValues)
+}
+
+func (s *session) keyChangesOf(it planItem) ([]dotenv.Change, error) {
+	from, err := s.parseDotenvFile(it.repoAbs)
+	if err != nil {
+		return nil, err
+	}
+	to, err := s.parseDotenvFile(it.storeAbs)
+	if err != nil {
+		return nil, err
+	}
+	return dotenv.Diff(from, to), nil
+}
+
+func newJSONKeyChanges(changes []dotenv.Change, showValues bool) []jsonKeyChange {
+	show := func(v string) string {
+		if showValues {
+			return v
+		}
+		return maskValue(v)
+	}
+	var out []jsonKeyChange
+	for _, c := range changes {
+		j := jsonKeyChange{Key: c.Key, Kind: c.Kind.String()}
+		if c.Kind != dotenv.Added {
+			j.Old = show(c.Old)
+		}
+		if c.Kind != dotenv.Removed {
+			j.New = show(c.New)
+		}
+		out = append(out, j)
+	}
+	return out
+}
+
+func formatKeyChanges(title string, changes []dotenv.Change, showValues bool) string {
+	show := func(v string) string {
+		if showValues {
+			return v
+		}
+		return maskValue(v)
+	}
+	var b strings.Builder
+	b.WriteString(title + "\n")
+	for _, c := range changes {
+		switch c.Kind {
+		case dotenv.Added:
+			fmt.Fprintf(&b, "  + %s=%s\n", c.Key, show(c.New))
+		case dotenv.Removed:
+			fmt.Fprintf(&b, "  - %s=%s\n", c.Key, show(c.Old))
+		case dotenv.Changed:
+			fmt.Fprintf(&b, "  ~ %s: %s -> %s\n", c.Key, show(c.Old), show(c.New))
+		}
+	}
+	return b.String()
+}
+
+// maskValue hides a secret while still telling empty and set values apart.
+func maskValue(v string) string {
+	if v == "" {
+		return "(empty)"
+	}
+	return maskedValue
+}
+
+// parseDotenvFile parses path, treating a missing file as empty.
+func (s *session) parseDotenvFile(path string) (*dotenv.File, error) {
+	b, err := s.readFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return dotenv.Parse(nil)
+		}
+		return nil, err
+	}
+	f, err := dotenv.Parse(b)
+	if err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	return f, nil
+}
@@ -0,0 +1,66 @@
+package sync
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestDiffOutputJSON(t *testing.T) {
+	e := syncedEnv(t, "A=1\nB=1\n")
+	e.write(e.store(2, ".env"), "A=2\nB=1\nC=1\n")
+
+	var err error
+	out := captureStdout(t, func() {
+		err = e.session().diff([]string{"--worktree", "2", "--keys", "--show-values", "--output", "json"})
+	})
+	wantExit(t, err, 0)
+	var doc struct {
+		Entries []jsonDiffEntry `json:"entries"`
+		Summary diffSummary     `json:"summary"`
+	}
+	if err := json.Unmarshal([]byte(out), &doc); err != nil {
+		t.Fatalf("parse %q: %v", out, err)
+	}
+	want := []jsonKeyChange{{Key: "A", Kind: "changed", Old: "1", New: "2"}, {Key: "C", Kind: "added", New: "1"}}
+	if len(doc.Entries) != 1 || len(doc.Entries[0].Keys) != len(want) {
+		t.Fatalf("expected one file with %v, got %+v", want, doc.Entries)
+	}
+	for i, k := range doc.Entries[0].Keys {
+		if k != want[i] {
+			t.Fatalf("expected %v, got %v", want, doc.Entries[0].Keys)
+		}
+	}
+	if doc.Summary.Differ != 1 || doc.Summary.Files != 1 {
+		t.Fatalf("unexpected summary %+v", doc.Summary)
+	}
+}
+
+func TestDiffKeysMasksValues(t *testing.T) {
+	e := syncedEnv(t, "A=secret1\nB=same\n")
+	e.write(e.store(2, ".env"), "A=secret2\nB=same\nC=secret3\nD=\n")
+	// A repo file with no store copy yet, and a store file that does not
+	// parse, neither of which may echo a value.
+	e.write(e.repo(".env.local"), "E=secret4\n")
+	e.write(e.store(2, ".env.test"), "F=\"x\" secret5\n")
+
+	var err error
+	out := captureStdout(t, func() {
+		err = e.session().diff([]string{"--worktree", "2", "--keys"})
+	})
+	wantExit(t, err, 0)
+	if strings.Contains(out, "secret") {
+		t.Fatalf("expected every value masked, got:\n%s", out)
+	}
+	for _, want := range []string{
+		"  ~ A: **** -> ****\n",
+		"  + C=****\n",
+		"  + D=(empty)\n",
+		".env.local\n  - E=****\n",
+		".env.test: ",
+	} {
+		if !strings.Contains(out, want) {
+			t.Fatalf("expected %q in:\n%s", want, out)
+		}
+	}
+}
@@ -0,0 +1,496 @@
+package sync
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/aayushgautam/wtm/internal/config"
+	"github.com/aayushgautam/wtm/internal/gitx"
+)
+
+// Problems doctor finds with the worktree file of a plan item.
+const (
+	problemMissing      = "missing"       // the worktree file is gone
+	problemMissingStore = "missing-store" // the store file is gone
+	problemDangling     = "dangling"      // a symlink to a file that is gone
+	problemWrongTarget  = "wrong-target"  // a symlink to a file other than the store file
+	problemWrongKind    = "wrong-kind"    // a symlink where a copy or hard link belongs
+	problemReplaced     = "replaced"      // a separate file where a link belongs
+	problemBlocked      = "blocked"       // something doctor cannot repair
+)
+
+// Repairs doctor applies with --fix. Each ends with the store file placed
+// into the worktree again.
+const (
+	repairLink   = "link"   // the store file is kept
+	repairAdopt  = "adopt"  // the newer worktree content is copied into the store
+	repairResync = "resync" // the repo file is copied into the store, as sync does
+	repairNone   = "none"
+)
+
+// backupDir holds content a repair replaced, under the store root.
+const backupDir = metaDirPrefix + "backup"
+
+type doctorOptions struct {
+	repoHint     string
+	worktreeNum  int
+	destOverride string
+	fix          bool
+	yes          bool
+	output       string
+}
+
+// jsonDoctorEntry is one problem listed by "wtm doctor --output".
+type jsonDoctorEntry struct {
+	Worktree    string `json:"worktree"`
+	Rel         string `json:"rel"`
+	Problem     string `json:"problem"`
+	Detail      string `json:"detail,omitempty"`
+	Repair      string `json:"repair"`
+	WorktreeAbs string `json:"worktreeAbs"`
+}
+
+type doctorSummary struct {
+	Outcome  string `json:"outcome"`
+	Checked  int    `json:"checked"`
+	Problems int    `json:"problems"`
+	Repaired int    `json:"repaired"`
+	fix      bool
+}
+
+func (s doctorSummary) exit() error {
+	switch {
+	case s.Outcome != outcomePartial:
+		return outcomeError(s.Outcome, "")
+	case s.fix:
+		return outcomeError(s.Outcome, fmt.Sprintf("%d entries still need repair", s.Problems-s.Repaired))
+	}
+	return outcomeError(s.Outcome, fmt.Sprintf("%d of %d entries need repair", s.Problems, s.Checked))
+}
+
+type doctorEntry struct {
+	worktree  gitx.Worktree
+	storeRoot string
+	item      planItem
+	problem   string
+	detail    string
+	repair    string
+	// source is the file repairAdopt copies into the store: the worktree
+	// file, or what a wrong symlink points at.
+	source string
+	// backup is set when the file the repair replaces holds content found
+	// nowhere else: the worktree file for repairLink, the store file for
+	// repairAdopt.
+	backup bool
+}
+
+// Doctor is "wtm doctor".
+func Doctor(args []string) error {
+	return newSession(nil).doctor(args)
+}
+
+// doctor checks how every included file is placed and, with --fix,
+// repairs it, keeping the newer content.
+func (s *session) doctor(args []string) error {
+	opts, err := parseDoctorOptions(args)
+	if err != nil {
+		return doctorUsageError(err)
+	}
+
+	repoRoot, err := s.git.RepoRoot(opts.repoHint)
+	if err != nil {
+		return err
+	}
+
+	wts, err := s.git.ListWorktrees(repoRoot)
+	if err != nil {
+		return err
+	}
+
+	if opts.destOverride != "" || opts.worktreeNum != 0 {
+		wt, err := s.pickWorktree(repoRoot, wts, opts.destOverride, opts.worktreeNum)
+		if err != nil {
+			return err
+		}
+		wts = []gitx.Worktree{wt}
+	}
+
+	loaded, err := s.loadConfig(repoRoot)
+	if err != nil {
+		return err
+	}
+	if s.cipher, err = newStoreCipher(loaded.Config); err != nil {
+		return err
+	}
+	s.historyKeep = loaded.Config.History.Keep
+
+	var problems []doctorEntry
+	checked := 0
+	for _, wt := range wts {
+		if samePath(repoRoot, wt.Path) || wt.Prunable {
+			continue
+		}
+		storeRoot, err := storeRootPath(repoRoot, wt, loaded.Config.Store.Mode)
+		if err != nil {
+			return err
+		}
+		if _, err := s.fs.Stat(storeRoot); os.IsNotExist(err) {
+			// Never synced; there is nothing to repair.
+			continue
+		}
+		plan, err := s.buildSyncPlan(repoRoot, wt.Path, storeRoot, loaded.Config)
+		if err != nil {
+			return err
+		}
+		for _, it := range plan {
+			checked++
+			e, ok := s.diagnose(it)
+			if ok {
+				continue
+			}
+			e.worktree, e.storeRoot = wt, storeRoot
+			problems = append(problems, e)
+		}
+	}
+
+	rep := newReporter(opts.output, "doctor", os.Stdout)
+	sum := doctorSummary{Outcome: outcomeOK, Checked: checked, Problems: len(problems), fix: opts.fix}
+	if len(problems) == 0 {
+		fmt.Fprintf(os.Stderr, "Checked %d entries; no problems found.\n", checked)
+		return finish(rep, sum)
+	}
+	if rep.machine() {
+		for _, e := range problems {
+			err := rep.add("entry", jsonDoctorEntry{
+				Worktree:    e.worktree.Path,
+				Rel:         e.item.rel,
+				Problem:     e.problem,
+				Detail:      e.detail,
+				Repair:      e.repair,
+				WorktreeAbs: e.item.worktreeAbs,
+			})
+			if err != nil {
+				return err
+			}
+		}
+	} else {
+		printDoctor(os.Stdout, problems)
+	}
+	sum.Outcome = outcomePartial
+	if !opts.fix {
+		fmt.Fprintf(os.Stderr, "Checked %d entries; %d need repair. Run \"wtm doctor --fix\" to repair them.\n", checked, len(problems))
+		return finish(rep, sum)
+	}
+
+	if !opts.yes {
+		if !s.confirm(fmt.Sprintf("Repair %d entries? [y/N] ", len(problems))) {
+			fmt.Fprintln(os.Stderr, "Aborted.")
+			sum.Outcome = outcomeAborted
+			return finish(rep, sum)
+		}
+	}
+
+	manifests := make(map[string]*storeManifest)
+	for _, e := range problems {
+		result := itemResult{Worktree: e.worktree.Path, Rel: e.item.rel, Action: actionRepaired}
+		if e.repair == repairNone {
+			fmt.Fprintf(os.Stderr, "Skipped: %s: %s\n", e.item.worktreeAbs, e.detail)
+			result.Action, result.Reason = actionSkipped, e.detail
+		} else if backup, err := s.repair(manifests, repoRoot, e); err != nil {
+			fmt.Fprintln(os.Stderr, "Error repairing:", err)
+			result.Action, result.Reason = actionError, err.Error()
+		} else {
+			sum.Repaired++
+			if backup != "" {
+				fmt.Fprintf(os.Stderr, "Repaired: %s (older content saved to %s)\n", e.item.worktreeAbs, backup)
+				result.Reason = "older content saved to " + backup
+			} else {
+				fmt.Fprintln(os.Stderr, "Repaired:", e.item.worktreeAbs)
+			}
+		}
+		if err := rep.add("result", result); err != nil {
+			return err
+		}
+	}
+	for _, m := range manifests {
+		if err := m.save(); err != nil {
+			fmt.Fprintln(os.Stderr, "Error updating manifest:", err)
+		}
+	}
+
+	fmt.Fprintf(os.Stderr, "Done. Repaired %d of %d entries.\n", sum.Repaired, len(problems))
+	if sum.Repaired == len(problems) {
+		sum.Outcome = outcomeOK
+	}
+	return finish(rep, sum)
+}
+
+func parseDoctorOptions(args []string) (doctorOptions, error) {
+	fsFlags := flag.NewFlagSet("doctor", flag.ContinueOnError)
+	fsFlags.SetOutput(io.Discard)
+
+	var opts doctorOptions
+	fsFlags.StringVar(&opts.repoHint, "repo", "", "repo path (defaults to current dir repo)")
+	fsFlags.IntVar(&opts.worktreeNum, "worktree", 0, "only check this worktree number (1-indexed)")
+	fsFlags.StringVar(&opts.destOverride, "dest", "", "only check this worktree path")
+	fsFlags.BoolVar(&opts.fix, "fix", false, "repair the problems found")
+	fsFlags.BoolVar(&opts.yes, "yes", false, "repair without confirmation")
+	fsFlags.StringVar(&opts.output, "output", outputText, "text, json or ndjson")
+
+	if err := fsFlags.Parse(args); err != nil {
+		return doctorOptions{}, err
+	}
+	if fsFlags.NArg() > 0 {
+		return doctorOptions{}, fmt.Errorf("unexpected argument %q", fsFlags.Arg(0))
+	}
+	if opts.yes && !opts.fix {
+		return doctorOptions{}, fmt.Errorf("--yes needs --fix")
+	}
+	if err := validOutput(opts.output); err != nil {
+		return doctorOptions{}, err
+	}
+	if opts.output != outputText && opts.fix && !opts.yes {
+		return doctorOptions{}, fmt.Errorf("--output %s needs --yes with --fix", opts.output)
+	}
+	return opts, nil
+}
+
+func doctorUsageError(err error) error {
+	msg := strings.TrimSpace(err.Error())
+	if msg != "" {
+		fmt.Fprintln(os.Stderr, "Error:", msg)
+	}
+	fmt.Fprintln(os.Stderr, "usage: wtm doctor [--repo PATH] [--worktree N | --dest PATH] [--fix [--yes]] [--output text|json|ndjson]")
+	return fmt.Errorf("invalid arguments")
+}
+
+// diagnose reports what is wrong with the worktree file of it; ok is set
+// when nothing is.
+func (s *session) diagnose(it planItem) (e doctorEntry, ok bool) {
+	e = doctorEntry{item: it, repair: repairNone}
+	storeInfo, storeErr := s.fs.Stat(it.storeAbs)
+	info, err := s.fs.Lstat(it.worktreeAbs)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			e.problem, e.detail = problemBlocked, err.Error()
+			return e, false
+		}
+		e.problem = problemMissing
+		if storeErr != nil {
+			e.detail, e.repair = "worktree and store file deleted", repairResync
+		} else {
+			e.detail, e.repair = "worktree file deleted", repairLink
+		}
+		return e, false
+	}
+
+	switch {
+	case info.Mode()&os.ModeSymlink != 0:
+		target, err := s.readLinkAbs(it.worktreeAbs)
+		if err != nil {
+			e.problem, e.detail = problemBlocked, err.Error()
+			return e, false
+		}
+		targetInfo, targetErr := s.fs.Stat(it.worktreeAbs)
+		atStore := samePath(target, it.storeAbs) || s.sameFile(target, it.storeAbs)
+		switch {
+		case targetErr != nil && samePath(target, it.storeAbs):
+			e.problem, e.detail, e.repair = problemMissingStore, "link points at deleted store file", repairResync
+		case targetErr != nil:
+			e.problem, e.detail = problemDangling, "points at missing "+target
+			e.repair = repairLink
+			if storeErr != nil {
+				e.repair = repairResync
+			}
+		case atStore && it.link == config.LinkSymlink:
+			return e, true
+		case atStore:
+			e.problem, e.detail, e.repair = problemWrongKind, "symlink instead of "+linkNoun(it.link), repairLink
+		case storeErr != nil:
+			// Edits made through the wrong link are the newest content
+			// there is.
+			e.problem, e.detail = problemWrongTarget, "points at "+target+"; store file deleted"
+			e.repair, e.source = repairAdopt, it.worktreeAbs
+		default:
+			e.problem, e.detail = problemWrongTarget, "points at "+target
+			s.preferNewer(&e, target, targetInfo, storeInfo, false)
+		}
+		return e, false
+
+	case info.Mode().IsRegular():
+		if it.link == config.LinkHardlink && s.sameFile(it.worktreeAbs, it.storeAbs) {
+			return e, true
+		}
+		if storeErr != nil {
+			e.problem, e.detail = problemMissingStore, "store file deleted; worktree file kept"
+			e.repair, e.source = repairAdopt, it.worktreeAbs
+			return e, false
+		}
+		switch it.link {
+		case config.LinkCopy:
+			return e, true
+		case config.LinkHardlink:
+			e.problem, e.detail = problemReplaced, "hard link broken"
+		default:
+			e.problem, e.detail = problemReplaced, "regular file instead of link"
+		}
+		s.preferNewer(&e, it.worktreeAbs, info, storeInfo, true)
+		return e, false
+
+	default:
+		e.problem, e.detail = problemBlocked, "not a file; remove it by hand"
+		return e, false
+	}
+}
+
+// preferNewer picks the repair for it: the newer of source and the store
+// file wins.
+func (s *session) preferNewer(e *doctorEntry, source string, info, storeInfo os.FileInfo, own bool) {
+	it := e.item
+	got, err := s.fs.ReadFile(source)
+	if err != nil {
+		e.problem, e.detail = problemBlocked, err.Error()
+		return
+	}
+	stored, err := s.readFile(it.storeAbs)
+	if err != nil {
+		e.problem, e.detail = problemBlocked, err.Error()
+		return
+	}
+	switch {
+	case bytes.Equal(got, stored):
+		e.detail += "; same content as store"
+		e.repair = repairLink
+	case !info.ModTime().After(storeInfo.ModTime()):
+		e.detail += "; store is newer"
+		e.repair, e.backup = repairLink, own
+	case it.baseAbs != "":
+		// A layered store file is rendered from the shared base and the
+		// overlay, so there is nothing to copy the content into.
+		e.detail += "; newer than the rendered store file"
+		e.repair, e.backup = repairLink, own
+	default:
+		e.detail += "; newer than store"
+		e.repair, e.source, e.backup = repairAdopt, source, true
+	}
+}
+
+// repair applies the repair of e and returns where content it replaced was
+// saved, if anywhere.
+func (s *session) repair(manifests map[string]*storeManifest, repoRoot string, e doctorEntry) (string, error) {
+	it := e.item
+	backup := ""
+	switch e.repair {
+	case repairResync:
+		if err := s.withHistory(it, it.syncedAbs(), historyDoctor, func() error { return s.writeStore(it, historyDoctor) }); err != nil {
+			return "", err
+		}
+		p := worktreePlan{worktree: e.worktree, storeRoot: e.storeRoot}
+		if err := s.recordSync(manifests, repoRoot, p, it); err != nil {
+			return "", err
+		}
+	case repairAdopt:
+		content, err := s.fs.ReadFile(e.source)
+		if err != nil {
+			return "", fmt.Errorf("read %s: %w", e.source, err)
+		}
+		perm := os.FileMode(0o644)
+		if info, err := s.fs.Stat(it.storeAbs); err == nil {
+			perm = info.Mode().Perm()
+		}
+		if e.backup {
+			old, err := s.readFile(it.storeAbs)
+			if err != nil {
+				return "", err
+			}
+			if backup, err = s.backupFile(e.storeRoot, it.rel, old); err != nil {
+				return "", err
+			}
+		}
+		if err := s.withHistory(it, it.storeAbs, historyDoctor, func() error { return s.writeFile(it.storeAbs, content, perm) }); err != nil {
+			return "", err
+		}
+	case repairLink:
+		if e.backup {
+			old, err := s.fs.ReadFile(it.worktreeAbs)
+			if err != nil {
+				return "", fmt.Errorf("read %s: %w", it.worktreeAbs, err)
+			}
+			if backup, err = s.backupFile(e.storeRoot, it.rel, old); err != nil {
+				return "", err
+			}
+		}
+	default:
+		return "", fmt.Errorf("%s: %s", it.worktreeAbs, e.detail)
+	}
+
+	m, err := s.manifestFor(manifests, e.storeRoot)
+	if err != nil {
+		return backup, err
+	}
+	copied, err := s.placeWorktreeFile(it, "", true)
+	if copied != nil {
+		m.recordCopy(it.rel, e.worktree.Path, copied)
+	}
+	return backup, err
+}
+
+// backupFile saves content of rel that a repair is about to replace under
+// the backup directory of storeRoot, sealed like the store itself.
+func (s *session) backupFile(storeRoot, rel string, content []byte) (string, error) {
+	path := filepath.Join(storeRoot, backupDir, filepath.FromSlash(rel)+"."+time.Now().Format("20060102-150405"))
+	if err := s.writeFile(path, content, 0o600); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+func (e doctorEntry) repairText() string {
+	place := "link to store"
+	if e.item.link == config.LinkCopy {
+		place = "copy from store"
+	}
+	switch e.repair {
+	case repairLink:
+		if e.backup {
+			return "back up worktree file, " + place
+		}
+		return place
+	case repairAdopt:
+		from := "worktree file"
+		if e.source != e.item.worktreeAbs {
+			from = e.source
+		}
+		if e.backup {
+			return "back up store file, copy " + from + " into store, " + place
+		}
+		return "copy " + from + " into store, " + place
+	case repairResync:
+		return "copy repo file into store, " + place
+	default:
+		return "none"
+	}
+}
+
+func linkNoun(mode string) string {
+	if mode == config.LinkHardlink {
+		return "hard link"
+	}
+	return "copy"
+}
+
+func printDoctor(w io.Writer, entries []doctorEntry) {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "PROBLEM\tWORKTREE\tFILE\tDETAIL\tREPAIR")
+	for _, e := range entries {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", e.problem, e.worktree.Path, e.item.rel, e.detail, e.repairText())
+	}
+	_ = tw.Flush()
+}
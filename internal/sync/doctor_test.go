@@ -0,0 +1,173 @@
+package sync
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func (e *testEnv) doctor(args ...string) error {
+	e.t.Helper()
+	err := e.session().doctor(args)
+	if len(e.p.answers) > 0 {
+		e.t.Fatalf("unused answers %q", e.p.answers)
+	}
+	return err
+}
+
+// backups returns the content of every backup in the store of worktree n.
+func (e *testEnv) backups(n int) []string {
+	e.t.Helper()
+	var found []string
+	root := filepath.Join(filepath.Dir(e.store(n, ".env")), backupDir)
+	entries, _ := e.fs.ReadDir(root)
+	for _, d := range entries {
+		found = append(found, e.read(filepath.Join(root, d.Name())))
+	}
+	return found
+}
+
+func TestDoctorRelinksDeletedFiles(t *testing.T) {
+	e := syncedEnv(t, "A=1\n")
+	if err := e.fs.Remove(e.wt(2, ".env")); err != nil {
+		t.Fatalf("remove: %v", err)
+	}
+
+	wantExit(t, e.doctor(), ExitPartial)
+	if _, err := e.fs.Lstat(e.wt(2, ".env")); err == nil {
+		t.Fatal("expected doctor without --fix to change nothing")
+	}
+
+	e.answer("y")
+	wantExit(t, e.doctor("--fix"), 0)
+	e.wantLink(2, ".env")
+	// Worktree 3 was never synced, so it has nothing to repair.
+	wantExit(t, e.doctor(), 0)
+}
+
+func TestDoctorKeepsNewerWorktreeFile(t *testing.T) {
+	e := syncedEnv(t, "A=1\n")
+	if err := e.fs.Remove(e.wt(2, ".env")); err != nil {
+		t.Fatalf("remove: %v", err)
+	}
+	e.write(e.wt(2, ".env"), "A=edited\n")
+	e.age(e.store(2, ".env"), time.Hour)
+
+	wantExit(t, e.doctor("--fix", "--yes"), 0)
+	e.wantLink(2, ".env")
+	if got := e.read(e.store(2, ".env")); got != "A=edited\n" {
+		t.Fatalf("expected the worktree edit in the store, got %q", got)
+	}
+	if got := e.backups(2); len(got) != 1 || got[0] != "A=1\n" {
+		t.Fatalf("expected the old store content backed up, got %q", got)
+	}
+	if got := e.read(e.repo(".env")); got != "A=1\n" {
+		t.Fatalf("expected the repo file untouched, got %q", got)
+	}
+}
+
+func TestDoctorKeepsNewerStoreFile(t *testing.T) {
+	e := syncedEnv(t, "A=1\n")
+	if err := e.fs.Remove(e.wt(2, ".env")); err != nil {
+		t.Fatalf("remove: %v", err)
+	}
+	e.write(e.wt(2, ".env"), "A=stale\n")
+	e.age(e.wt(2, ".env"), time.Hour)
+
+	wantExit(t, e.doctor("--fix", "--yes"), 0)
+	e.wantLink(2, ".env")
+	if got := e.read(e.store(2, ".env")); got != "A=1\n" {
+		t.Fatalf("expected the store content kept, got %q", got)
+	}
+	if got := e.backups(2); len(got) != 1 || got[0] != "A=stale\n" {
+		t.Fatalf("expected the worktree file backed up, got %q", got)
+	}
+}
+
+func TestDoctorRestoresDeletedStoreFile(t *testing.T) {
+	e := syncedEnv(t, "A=1\n")
+	e.write(e.repo("api/.env"), "B=1\n")
+	wantExit(t, e.sync("--worktree", "2", "--yes"), 0)
+	// The link to .env dangles; api/.env was replaced before the store
+	// file went away, so the worktree holds the only copy of its edits.
+	if err := e.fs.Remove(e.wt(2, "api/.env")); err != nil {
+		t.Fatalf("remove: %v", err)
+	}
+	e.write(e.wt(2, "api/.env"), "B=edited\n")
+	for _, rel := range []string{".env", "api/.env"} {
+		if err := e.fs.Remove(e.store(2, rel)); err != nil {
+			t.Fatalf("remove: %v", err)
+		}
+	}
+
+	wantExit(t, e.doctor("--fix", "--yes"), 0)
+	e.wantLink(2, ".env")
+	e.wantLink(2, "api/.env")
+	if got := e.read(e.store(2, ".env")); got != "A=1\n" {
+		t.Fatalf("expected the repo content in the store, got %q", got)
+	}
+	if got := e.read(e.store(2, "api/.env")); got != "B=edited\n" {
+		t.Fatalf("expected the worktree content in the store, got %q", got)
+	}
+}
+
+func TestDoctorRepointsWrongTarget(t *testing.T) {
+	e := syncedEnv(t, "A=1\n")
+	wantExit(t, e.sync("--worktree", "3", "--yes"), 0)
+	if err := e.fs.Remove(e.wt(2, ".env")); err != nil {
+		t.Fatalf("remove: %v", err)
+	}
+	if err := e.fs.Symlink(e.store(3, ".env"), e.wt(2, ".env")); err != nil {
+		t.Fatalf("symlink: %v", err)
+	}
+
+	wantExit(t, e.doctor("--worktree", "2"), ExitPartial)
+	e.answer("n")
+	wantExit(t, e.doctor("--worktree", "2", "--fix"), ExitAborted)
+	wantExit(t, e.doctor("--worktree", "2", "--fix", "--yes"), 0)
+	e.wantLink(2, ".env")
+	e.wantLink(3, ".env")
+}
+
+func TestParseDoctorOptions(t *testing.T) {
+	if _, err := parseDoctorOptions([]string{"--fix", "--yes"}); err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	for _, args := range [][]string{{"--yes"}, {"extra"}} {
+		if _, err := parseDoctorOptions(args); err == nil {
+			t.Fatalf("%q: expected an error", args)
+		}
+	}
+}
+
+func TestDoctorOutputJSON(t *testing.T) {
+	e := syncedEnv(t, "A=1\n")
+	if err := e.fs.Remove(e.wt(2, ".env")); err != nil {
+		t.Fatalf("remove: %v", err)
+	}
+
+	var err error
+	out := captureStdout(t, func() { err = e.doctor("--output", "json") })
+	wantExit(t, err, ExitPartial)
+	var doc struct {
+		Entries []jsonDoctorEntry `json:"entries"`
+		Summary doctorSummary     `json:"summary"`
+	}
+	if err := json.Unmarshal([]byte(out), &doc); err != nil {
+		t.Fatalf("parse %q: %v", out, err)
+	}
+	if len(doc.Entries) != 1 || doc.Entries[0].Problem != problemMissing || doc.Entries[0].Rel != ".env" {
+		t.Fatalf("expected one missing .env, got %+v", doc.Entries)
+	}
+	if doc.Summary.Outcome != outcomePartial || doc.Summary.Problems != 1 {
+		t.Fatalf("unexpected summary %+v", doc.Summary)
+	}
+
+	out = captureStdout(t, func() { err = e.doctor("--fix", "--yes", "--output", "ndjson") })
+	wantExit(t, err, 0)
+	if !strings.Contains(out, `"action":"repaired"`) || !strings.Contains(out, `"outcome":"ok"`) {
+		t.Fatalf("expected a repaired result and an ok summary, got %q", out)
+	}
+}
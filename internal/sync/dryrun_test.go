@@ -0,0 +1,99 @@
+package sync
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/aayushgautam/wtm/internal/config"
+	"github.com/aayushgautam/wtm/internal/gitx"
+)
+
+// dryRunFixture is a repo, a store and a worktree on disk with one plan
+// item per file name in rels.
+func dryRunFixture(t *testing.T, link string, rels ...string) (string, worktreePlan) {
+	t.Helper()
+	dir := t.TempDir()
+	repo := filepath.Join(dir, "repo")
+	wt := filepath.Join(dir, "wt")
+	store := filepath.Join(dir, "store")
+	p := worktreePlan{worktree: gitx.Worktree{Path: wt}, storeRoot: store}
+	for _, rel := range rels {
+		writeTestFile(t, filepath.Join(repo, rel), "KEY="+rel+"\n")
+		p.items = append(p.items, planItem{
+			rel:         rel,
+			repoAbs:     filepath.Join(repo, rel),
+			storeAbs:    filepath.Join(store, rel),
+			worktreeAbs: filepath.Join(wt, rel),
+			link:        link,
+		})
+	}
+	return repo, p
+}
+
+func dryRunActions(res syncResult) map[string]string {
+	actions := make(map[string]string)
+	for _, r := range res.items {
+		actions[r.Rel] = r.Action
+	}
+	return actions
+}
+
+func TestDryRunSyncReportsActions(t *testing.T) {
+	repo, p := dryRunFixture(t, config.LinkSymlink, "missing.env", "linked.env", "edited.env")
+	// A previous sync linked linked.env; edited.env was replaced by hand.
+	writeTestFile(t, p.items[1].storeAbs, "KEY=linked.env\n")
+	if err := os.MkdirAll(p.worktree.Path, 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	if err := os.Symlink(p.items[1].storeAbs, p.items[1].worktreeAbs); err != nil {
+		t.Fatalf("symlink: %v", err)
+	}
+	writeTestFile(t, p.items[2].worktreeAbs, "KEY=local\n")
+
+	res := newSession(&storeCipher{}).dryRunSession().applySyncPlan(repo, p, false, "")
+	want := map[string]string{
+		"missing.env": actionCreateLink,
+		"linked.env":  actionNoOp,
+		"edited.env":  actionConflict,
+	}
+	got := dryRunActions(res)
+	for rel, action := range want {
+		if got[rel] != action {
+			t.Fatalf("%s: expected %s, got %s", rel, action, got[rel])
+		}
+	}
+	if res.conflicts != 1 {
+		t.Fatalf("expected 1 conflict, got %d", res.conflicts)
+	}
+
+	if _, err := os.Lstat(p.items[0].worktreeAbs); !os.IsNotExist(err) {
+		t.Fatalf("dry run created %s: %v", p.items[0].worktreeAbs, err)
+	}
+	if _, err := os.Stat(filepath.Join(p.storeRoot, manifestName)); !os.IsNotExist(err) {
+		t.Fatalf("dry run wrote the manifest: %v", err)
+	}
+	b, err := os.ReadFile(p.items[2].worktreeAbs)
+	if err != nil || string(b) != "KEY=local\n" {
+		t.Fatalf("dry run changed %s: %q, %v", p.items[2].worktreeAbs, b, err)
+	}
+}
+
+func TestDryRunSyncForceReplaces(t *testing.T) {
+	repo, p := dryRunFixture(t, config.LinkSymlink, "edited.env")
+	writeTestFile(t, p.items[0].worktreeAbs, "KEY=local\n")
+
+	res := newSession(&storeCipher{}).dryRunSession().applySyncPlan(repo, p, true, "")
+	if got := dryRunActions(res)["edited.env"]; got != actionReplace {
+		t.Fatalf("expected %s, got %s", actionReplace, got)
+	}
+}
+
+func TestDryRunSyncCopyMode(t *testing.T) {
+	repo, p := dryRunFixture(t, config.LinkCopy, "new.env")
+
+	res := newSession(&storeCipher{}).dryRunSession().applySyncPlan(repo, p, false, "")
+	if got := dryRunActions(res)["new.env"]; got != actionCreateCopy {
+		t.Fatalf("expected %s, got %s", actionCreateCopy, got)
+	}
+}
@@ -0,0 +1,647 @@
+package sync
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aayushgautam/wtm/internal/config"
+	"github.com/aayushgautam/wtm/internal/dotenv"
+	"github.com/aayushgautam/wtm/internal/gitx"
+)
+
+// Snapshots of store files, kept once per hash and indexed per file.
+const (
+	historyDirName   = metaDirPrefix + "history"
+	historyIndexName = metaDirPrefix + "history.json"
+	historyVersion   = 1
+)
+
+// Reasons recorded with a snapshot.
+const (
+	historyExisting = "existing" // in the store before wtm kept history of it
+	historyEdited   = "edited"   // edited in the store since wtm last wrote it
+	historySync     = "sync"     // copied from the repo by sync
+	historyMerge    = "merge"    // sync merged repo changes into store edits
+	historyCapture  = "capture"  // edits to a worktree copy, copied in by push or watch
+	historyWatch    = "watch"    // a replaced link's file, copied in by watch
+	historyDoctor   = "doctor"   // written by a doctor repair
+	historyRestore  = "restore"  // rolled back by restore
+	historyConvert  = "convert"  // written by store convert
+	historyOverlay  = "overlay"  // store edits sync moved into the overlay
+)
+
+type storeHistory struct {
+	root    string
+	session *session // snapshots hold secrets and are encrypted like the store
+
+	Version int                       `json:"version"`
+	Files   map[string][]historyEntry `json:"files"`
+}
+
+type historyEntry struct {
+	Version int       `json:"version"`
+	SHA256  string    `json:"sha256"`
+	Time    time.Time `json:"time"`
+	Reason  string    `json:"reason"`
+}
+
+type historyOptions struct {
+	repoHint     string
+	worktreeNum  int
+	destOverride string
+	rel          string
+	showValues   bool
+	output       string
+	at           string // restore only
+	yes          bool   // restore only
+}
+
+// jsonHistoryVersion is one snapshot listed by "wtm history --output".
+type jsonHistoryVersion struct {
+	Version int             `json:"version"`
+	Time    time.Time       `json:"time"`
+	Reason  string          `json:"reason"`
+	SHA256  string          `json:"sha256"`
+	Current bool            `json:"current,omitempty"`
+	Keys    []jsonKeyChange `json:"keys,omitempty"`
+	Error   string          `json:"error,omitempty"`
+}
+
+type historySummary struct {
+	Outcome  string `json:"outcome"`
+	Rel      string `json:"rel"`
+	Store    string `json:"store"`
+	Versions int    `json:"versions"`
+}
+
+func (s historySummary) exit() error {
+	return outcomeError(s.Outcome, "")
+}
+
+type restoreSummary struct {
+	Outcome string          `json:"outcome"`
+	Rel     string          `json:"rel"`
+	Path    string          `json:"path"`
+	Version int             `json:"version"`
+	Keys    []jsonKeyChange `json:"keys,omitempty"`
+}
+
+func (s restoreSummary) exit() error {
+	return outcomeError(s.Outcome, "")
+}
+
+// loadHistory reads the history index of the store at root. A store without
+// one yields an empty history.
+func (s *session) loadHistory(root string) (*storeHistory, error) {
+	h := &storeHistory{root: root, session: s, Version: historyVersion, Files: map[string][]historyEntry{}}
+	path := filepath.Join(root, historyIndexName)
+	b, err := s.fs.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return h, nil
+		}
+		return nil, fmt.Errorf("read %s: %w", path, err)
+	}
+	if err := json.Unmarshal(b, h); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	if h.Version > historyVersion {
+		return nil, fmt.Errorf("%s was written by a newer wtm (version %d)", path, h.Version)
+	}
+	if h.Files == nil {
+		h.Files = map[string][]historyEntry{}
+	}
+	return h, nil
+}
+
+// save writes the index atomically and deletes snapshots no entry refers to
+// any more.
+func (h *storeHistory) save() error {
+	b, err := json.MarshalIndent(h, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(h.root, historyIndexName)
+	tmp := path + ".tmp"
+	fsys := h.session.fs
+	if err := fsys.WriteFile(tmp, append(b, '\n'), 0o644); err != nil {
+		return fmt.Errorf("write %s: %w", tmp, err)
+	}
+	if err := fsys.Rename(tmp, path); err != nil {
+		_ = fsys.Remove(tmp)
+		return fmt.Errorf("rename %s: %w", path, err)
+	}
+
+	referenced := make(map[string]bool)
+	for _, entries := range h.Files {
+		for _, e := range entries {
+			referenced[e.SHA256] = true
+		}
+	}
+	dir := filepath.Join(h.root, historyDirName)
+	entries, err := fsys.ReadDir(dir)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return fmt.Errorf("read %s: %w", dir, err)
+	}
+	for _, e := range entries {
+		if !referenced[e.Name()] {
+			_ = fsys.Remove(filepath.Join(dir, e.Name()))
+		}
+	}
+	return nil
+}
+
+// content returns the plain-text content of snapshot e.
+func (h *storeHistory) content(e historyEntry) ([]byte, error) {
+	return h.session.readFile(filepath.Join(h.root, historyDirName, e.SHA256))
+}
+
+// withHistory runs write, which replaces path, the store file of it, its
+// shared base or its overlay, between snapshots of what path held before
+// and after.
+func (s *session) withHistory(it planItem, path, reason string, write func() error) error {
+	root, rel := historyFile(it, path)
+	if err := s.snapshot(root, rel, path, historyEdited); err != nil {
+		return err
+	}
+	if err := write(); err != nil {
+		return err
+	}
+	return s.snapshot(root, rel, path, reason)
+}
+
+// historyFile returns the store root and name the history of path, one of
+// the files of it, is kept under. An overlay is kept in the history of its
+// worktree's store as the file in the overlay directory.
+func historyFile(it planItem, path string) (root, rel string) {
+	rel = it.rel
+	if it.overlayAbs != "" && path == it.overlayAbs {
+		rel = overlayDirName + "/" + it.rel
+	}
+	return strings.TrimSuffix(path, string(filepath.Separator)+filepath.FromSlash(rel)), rel
+}
+
+// snapshot adds the store file at path to the history of rel in root.
+func (s *session) snapshot(root, rel, path, reason string) error {
+	plain, err := s.readFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	h, err := s.loadHistory(root)
+	if err != nil {
+		return err
+	}
+	sum := s.contentHash(plain)
+	entries := h.Files[rel]
+	var last historyEntry
+	if n := len(entries); n > 0 {
+		last = entries[n-1]
+		if last.SHA256 == sum {
+			return nil
+		}
+	}
+
+	at := time.Now().UTC()
+	if reason == historyEdited {
+		if len(entries) == 0 {
+			reason = historyExisting
+		}
+		if info, err := s.fs.Stat(path); err == nil {
+			at = info.ModTime().UTC()
+		}
+		if at.Before(last.Time) {
+			at = last.Time
+		}
+	}
+
+	obj := filepath.Join(root, historyDirName, sum)
+	if _, err := s.fs.Stat(obj); errors.Is(err, os.ErrNotExist) {
+		if err := s.writeFile(obj, plain, 0o600); err != nil {
+			return err
+		}
+	}
+	entries = append(entries, historyEntry{Version: last.Version + 1, SHA256: sum, Time: at, Reason: reason})
+	keep := s.historyKeep
+	if keep <= 0 {
+		keep = config.DefaultHistoryKeep
+	}
+	if len(entries) > keep {
+		entries = append([]historyEntry(nil), entries[len(entries)-keep:]...)
+	}
+	h.Files[rel] = entries
+	return h.save()
+}
+
+// History is "wtm history".
+func History(args []string) error {
+	return newSession(nil).history(args)
+}
+
+// history lists the snapshots of one store file, newest first, with the
+// variables each changed.
+func (s *session) history(args []string) error {
+	opts, err := parseHistoryOptions("history", args)
+	if err != nil {
+		return historyUsageError("history", err)
+	}
+	t, err := s.openHistory(opts)
+	if err != nil {
+		return err
+	}
+	h := t.history
+	entries := h.Files[opts.rel]
+	rep := newReporter(opts.output, "history", os.Stdout)
+	sum := historySummary{Outcome: outcomeOK, Rel: opts.rel, Store: h.root, Versions: len(entries)}
+	if len(entries) == 0 {
+		fmt.Fprintf(os.Stderr, "No history of %s in %s.\n", opts.rel, h.root)
+		sum.Outcome = outcomeNothingToDo
+		return finish(rep, sum)
+	}
+
+	current := ""
+	if plain, err := s.readFile(t.path); err == nil {
+		current = s.contentHash(plain)
+	}
+	for i := len(entries) - 1; i >= 0; i-- {
+		e := entries[i]
+		// An older version with the same content was current before.
+		isCurrent := e.SHA256 == current
+		if isCurrent {
+			current = ""
+		}
+		var prev *historyEntry
+		if i > 0 {
+			prev = &entries[i-1]
+		}
+		if rep.machine() {
+			v := jsonHistoryVersion{Version: e.Version, Time: e.Time, Reason: e.Reason, SHA256: e.SHA256, Current: isCurrent}
+			changes, err := h.changeList(prev, e)
+			if err != nil {
+				v.Error = err.Error()
+			}
+			v.Keys = newJSONKeyChanges(changes, opts.showValues)
+			if err := rep.add("version", v); err != nil {
+				return err
+			}
+			continue
+		}
+		title := fmt.Sprintf("v%d  %s  %s", e.Version, e.Time.Local().Format("2006-01-02 15:04:05"), e.Reason)
+		if isCurrent {
+			title += "  (current)"
+		}
+		fmt.Fprint(os.Stdout, h.changes(title, prev, e, opts.showValues))
+	}
+	fmt.Fprintf(os.Stderr, "Versions of %s kept: %d (in %s).\n", opts.rel, len(entries), h.root)
+	return finish(rep, sum)
+}
+
+// changes renders the variables e changed since prev (or since an empty
+// file), headed by title.
+func (h *storeHistory) changes(title string, prev *historyEntry, e historyEntry, showValues bool) string {
+	from, to, err := h.versions(prev, e)
+	if err != nil {
+		return fmt.Sprintf("%s\n  %v\n", title, err)
+	}
+	return keyChanges(title, from, to, showValues)
+}
+
+// changeList is changes as a list.
+func (h *storeHistory) changeList(prev *historyEntry, e historyEntry) ([]dotenv.Change, error) {
+	from, to, err := h.versions(prev, e)
+	if err != nil {
+		return nil, err
+	}
+	return dotenvChanges(from, to)
+}
+
+func (h *storeHistory) versions(prev *historyEntry, e historyEntry) ([]byte, []byte, error) {
+	var from []byte
+	if prev != nil {
+		b, err := h.content(*prev)
+		if err != nil {
+			return nil, nil, err
+		}
+		from = b
+	}
+	to, err := h.content(e)
+	if err != nil {
+		return nil, nil, err
+	}
+	return from, to, nil
+}
+
+// keyChanges is formatKeyChanges for two versions of a file, noting when
+// they cannot be compared by variable.
+func keyChanges(title string, from, to []byte, showValues bool) string {
+	changes, err := dotenvChanges(from, to)
+	if err != nil {
+		return title + "\n  (not a dotenv file)\n"
+	}
+	if len(changes) == 0 {
+		return title + "\n  (no variable changes)\n"
+	}
+	return formatKeyChanges(title, changes, showValues)
+}
+
+func dotenvChanges(from, to []byte) ([]dotenv.Change, error) {
+	f, err := dotenv.Parse(from)
+	if err != nil {
+		return nil, fmt.Errorf("not a dotenv file")
+	}
+	t, err := dotenv.Parse(to)
+	if err != nil {
+		return nil, fmt.Errorf("not a dotenv file")
+	}
+	return dotenv.Diff(f, t), nil
+}
+
+// Restore is "wtm restore".
+func Restore(args []string) error {
+	return newSession(nil).restore(args)
+}
+
+// restore rolls a store file back to one of its snapshots. The content it
+// replaces is itself snapshotted first, so a restore can be undone.
+func (s *session) restore(args []string) error {
+	opts, err := parseHistoryOptions("restore", args)
+	if err != nil {
+		return historyUsageError("restore", err)
+	}
+	t, err := s.openHistory(opts)
+	if err != nil {
+		return err
+	}
+	h, it := t.history, t.item
+	e, err := pickVersion(h.Files[opts.rel], opts.at, time.Now())
+	if err != nil {
+		return fmt.Errorf("%s: %w", opts.rel, err)
+	}
+	want, err := h.content(e)
+	if err != nil {
+		return err
+	}
+	current, err := s.readFile(t.path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	rep := newReporter(opts.output, "restore", os.Stdout)
+	sum := restoreSummary{Outcome: outcomeOK, Rel: opts.rel, Path: t.path, Version: e.Version}
+	if err == nil && s.contentHash(current) == e.SHA256 {
+		fmt.Fprintf(os.Stderr, "%s is already at v%d; nothing to do.\n", opts.rel, e.Version)
+		sum.Outcome = outcomeNothingToDo
+		return finish(rep, sum)
+	}
+
+	if rep.machine() {
+		// A file that is not dotenv has no variables to list.
+		changes, _ := dotenvChanges(current, want)
+		sum.Keys = newJSONKeyChanges(changes, opts.showValues)
+	} else {
+		title := fmt.Sprintf("Restore %s to v%d (%s, %s):", t.path, e.Version, e.Time.Local().Format("2006-01-02 15:04:05"), e.Reason)
+		fmt.Fprint(os.Stdout, keyChanges(title, current, want, opts.showValues))
+	}
+	if !opts.yes && !s.confirm("Restore? [y/N] ") {
+		fmt.Fprintln(os.Stderr, "Aborted.")
+		sum.Outcome = outcomeAborted
+		return finish(rep, sum)
+	}
+
+	perm := os.FileMode(0o644)
+	if info, err := s.fs.Stat(t.path); err == nil {
+		perm = info.Mode().Perm()
+	}
+	if err := s.withHistory(it, t.path, historyRestore, func() error { return s.writeFile(t.path, want, perm) }); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Restored %s to v%d.\n", t.path, e.Version)
+	if err := s.placeRestored(t); err != nil {
+		return err
+	}
+	return finish(rep, sum)
+}
+
+// placeRestored brings the worktree file of t up to date with its restored
+// store file and records it in the manifest.
+func (s *session) placeRestored(t historyTarget) error {
+	it := t.item
+	m, err := s.loadManifest(t.storeRoot)
+	if err != nil {
+		return err
+	}
+	if it.baseAbs != "" {
+		// The worktree sees the base through its rendered file, which is
+		// recorded so the next sync does not take it for an edit.
+		if err := s.withHistory(it, it.storeAbs, historyRestore, func() error { return s.renderLayered(it) }); err != nil {
+			return err
+		}
+		rendered, err := s.readFile(it.storeAbs)
+		if err != nil {
+			return err
+		}
+		if err := m.recordSync(it.rel, rendered, t.repoRoot, t.worktree); err != nil {
+			return err
+		}
+		fmt.Fprintln(os.Stderr, "Run wtm push to bring it into the repo; the next sync replaces the shared base with the repo file.")
+	}
+
+	// A symlink shows the restored file as is; copies and hard links (which
+	// the new store file no longer shares) are placed again.
+	if it.link == "" || it.link == config.LinkSymlink {
+		return m.save()
+	}
+	tracked := ""
+	if it.link == config.LinkCopy {
+		tracked = m.copyHash(it.rel, t.worktree.Path)
+	}
+	copied, err := s.placeWorktreeFile(it, tracked, it.link == config.LinkHardlink)
+	if err != nil {
+		return err
+	}
+	if copied == nil {
+		return nil
+	}
+	m.recordCopy(it.rel, t.worktree.Path, copied)
+	return m.save()
+}
+
+// historyTarget is the store file history and restore work on.
+type historyTarget struct {
+	history   *storeHistory
+	repoRoot  string
+	worktree  gitx.Worktree
+	storeRoot string
+	// item is the sync plan entry of the file, or only its store path when
+	// the repo no longer has the file.
+	item planItem
+	// path is the file the history is of: the store file, or in layered
+	// mode the shared base.
+	path string
+}
+
+// openHistory finds the store of the worktree opts select and reads its
+// history.
+func (s *session) openHistory(opts historyOptions) (historyTarget, error) {
+	repoRoot, err := s.git.RepoRoot(opts.repoHint)
+	if err != nil {
+		return historyTarget{}, err
+	}
+	wts, err := s.git.ListWorktrees(repoRoot)
+	if err != nil {
+		return historyTarget{}, err
+	}
+	wt, err := s.pickWorktree(repoRoot, wts, opts.destOverride, opts.worktreeNum)
+	if err != nil {
+		return historyTarget{}, err
+	}
+	loaded, err := s.loadConfig(repoRoot)
+	if err != nil {
+		return historyTarget{}, err
+	}
+	if s.cipher, err = newStoreCipher(loaded.Config); err != nil {
+		return historyTarget{}, err
+	}
+	s.historyKeep = loaded.Config.History.Keep
+	storeRoot, err := storeRootPath(repoRoot, wt, loaded.Config.Store.Mode)
+	if err != nil {
+		return historyTarget{}, err
+	}
+	baseRoot, err := pushStoreRoot(repoRoot, wt, loaded.Config.Store.Mode)
+	if err != nil {
+		return historyTarget{}, err
+	}
+	t := historyTarget{
+		repoRoot:  repoRoot,
+		worktree:  wt,
+		storeRoot: storeRoot,
+		item:      planItem{rel: opts.rel, storeAbs: filepath.Join(storeRoot, filepath.FromSlash(opts.rel))},
+		path:      filepath.Join(baseRoot, filepath.FromSlash(opts.rel)),
+	}
+	plan, err := s.buildSyncPlan(repoRoot, wt.Path, storeRoot, loaded.Config)
+	if err != nil {
+		return historyTarget{}, err
+	}
+	for _, it := range plan {
+		if it.rel == opts.rel {
+			t.item, t.path = it, it.syncedAbs()
+		}
+	}
+	root := strings.TrimSuffix(t.path, string(filepath.Separator)+filepath.FromSlash(opts.rel))
+	if t.history, err = s.loadHistory(root); err != nil {
+		return historyTarget{}, err
+	}
+	return t, nil
+}
+
+// pickVersion returns the entry at a version number or time.
+func pickVersion(entries []historyEntry, at string, now time.Time) (historyEntry, error) {
+	if len(entries) == 0 {
+		return historyEntry{}, fmt.Errorf("no history")
+	}
+	if n, err := strconv.Atoi(strings.TrimPrefix(at, "v")); err == nil {
+		for _, e := range entries {
+			if e.Version == n {
+				return e, nil
+			}
+		}
+		return historyEntry{}, fmt.Errorf("no version %d (kept: v%d to v%d)", n, entries[0].Version, entries[len(entries)-1].Version)
+	}
+	t, err := parseHistoryTime(at, now)
+	if err != nil {
+		return historyEntry{}, err
+	}
+	for i := len(entries) - 1; i >= 0; i-- {
+		if !entries[i].Time.After(t) {
+			return entries[i], nil
+		}
+	}
+	return historyEntry{}, fmt.Errorf("no version as old as %s (oldest kept: %s)", t.Local().Format("2006-01-02 15:04:05"), entries[0].Time.Local().Format("2006-01-02 15:04:05"))
+}
+
+func parseHistoryTime(at string, now time.Time) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, at); err == nil {
+		return t, nil
+	}
+	for _, layout := range []string{"2006-01-02 15:04:05", "2006-01-02T15:04:05", "2006-01-02 15:04", "2006-01-02T15:04", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, at, time.Local); err == nil {
+			if layout == "2006-01-02" {
+				// A day means its end: the version that was current
+				// when it was over.
+				t = t.AddDate(0, 0, 1).Add(-time.Nanosecond)
+			}
+			return t, nil
+		}
+	}
+	if d, err := parseAge(at); err == nil {
+		return now.Add(-d), nil
+	}
+	return time.Time{}, fmt.Errorf("invalid --at %q (want a version, a time such as 2006-01-02 15:04, or an age such as 2h or 3d)", at)
+}
+
+func parseHistoryOptions(command string, args []string) (historyOptions, error) {
+	fsFlags := flag.NewFlagSet(command, flag.ContinueOnError)
+	fsFlags.SetOutput(io.Discard)
+
+	var opts historyOptions
+	fsFlags.StringVar(&opts.repoHint, "repo", "", "repo path (defaults to current dir repo)")
+	fsFlags.IntVar(&opts.worktreeNum, "worktree", 0, "worktree number (1-indexed)")
+	fsFlags.StringVar(&opts.destOverride, "dest", "", "worktree path")
+	fsFlags.BoolVar(&opts.showValues, "show-values", false, "print values instead of masking them")
+	fsFlags.StringVar(&opts.output, "output", outputText, "text, json or ndjson")
+	if command == "restore" {
+		fsFlags.StringVar(&opts.at, "at", "", "version number, time or age to restore")
+		fsFlags.BoolVar(&opts.yes, "yes", false, "restore without confirmation")
+	}
+
+	positional, err := parseInterspersed(fsFlags, args)
+	if err != nil {
+		return historyOptions{}, err
+	}
+	switch len(positional) {
+	case 0:
+		return historyOptions{}, fmt.Errorf("missing file")
+	case 1:
+		opts.rel = filepath.ToSlash(filepath.Clean(positional[0]))
+	default:
+		return historyOptions{}, fmt.Errorf("unexpected argument %q", positional[1])
+	}
+	if filepath.IsAbs(opts.rel) || opts.rel == ".." || strings.HasPrefix(opts.rel, "../") {
+		return historyOptions{}, fmt.Errorf("%s: want a path relative to the repo root", positional[0])
+	}
+	if command == "restore" && opts.at == "" {
+		return historyOptions{}, fmt.Errorf("missing --at")
+	}
+	if err := validOutput(opts.output); err != nil {
+		return historyOptions{}, err
+	}
+	if command == "restore" && opts.output != outputText && !opts.yes {
+		return historyOptions{}, fmt.Errorf("--output %s needs --yes", opts.output)
+	}
+	return opts, nil
+}
+
+func historyUsageError(command string, err error) error {
+	msg := strings.TrimSpace(err.Error())
+	if msg != "" {
+		fmt.Fprintln(os.Stderr, "Error:", msg)
+	}
+	if command == "restore" {
+		fmt.Fprintln(os.Stderr, "usage: wtm restore <file> --at VERSION|TIME [--repo PATH] [--worktree N | --dest PATH] [--yes] [--show-values] [--output text|json|ndjson]")
+	} else {
+		fmt.Fprintln(os.Stderr, "usage: wtm history <file> [--repo PATH] [--worktree N | --dest PATH] [--show-values] [--output text|json|ndjson]")
+	}
+	return fmt.Errorf("invalid arguments")
+}
@@ -0,0 +1,283 @@
+package sync
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aayushgautam/wtm/internal/config"
+)
+
+func (e *testEnv) restore(args ...string) error {
+	e.t.Helper()
+	err := e.session().restore(args)
+	if len(e.p.answers) > 0 {
+		e.t.Fatalf("unused answers %q", e.p.answers)
+	}
+	return err
+}
+
+// history returns the reason and content of every snapshot of rel in the
+// store of worktree n, oldest first.
+func (e *testEnv) history(n int, rel string) [][2]string {
+	e.t.Helper()
+	root := filepath.Dir(e.store(n, ".env"))
+	h, err := e.session().loadHistory(root)
+	if err != nil {
+		e.t.Fatalf("load history: %v", err)
+	}
+	var got [][2]string
+	for _, entry := range h.Files[rel] {
+		b, err := h.content(entry)
+		if err != nil {
+			e.t.Fatalf("v%d: %v", entry.Version, err)
+		}
+		got = append(got, [2]string{entry.Reason, string(b)})
+	}
+	return got
+}
+
+func wantHistory(t *testing.T, got [][2]string, want ...[2]string) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("expected history %q, got %q", want, got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("expected history %q, got %q", want, got)
+		}
+	}
+}
+
+func TestSyncSnapshotsStoreWrites(t *testing.T) {
+	e := syncedEnv(t, "A=1\n")
+	e.write(e.store(2, ".env"), "A=edited\n")
+	e.write(e.repo(".env"), "A=2\n")
+	wantExit(t, e.sync("--worktree", "2", "--yes", "--prefer", "repo"), 0)
+	wantExit(t, e.sync("--worktree", "2", "--yes"), 0)
+
+	wantHistory(t, e.history(2, ".env"),
+		[2]string{historySync, "A=1\n"},
+		[2]string{historyEdited, "A=edited\n"},
+		[2]string{historySync, "A=2\n"},
+	)
+}
+
+func TestHistoryKeepsConfiguredVersions(t *testing.T) {
+	e := syncedEnv(t, "A=1\n")
+	e.cfg.History = config.HistoryConfig{Keep: 2}
+	for _, v := range []string{"A=2\n", "A=3\n"} {
+		e.write(e.repo(".env"), v)
+		wantExit(t, e.sync("--worktree", "2", "--yes"), 0)
+	}
+
+	wantHistory(t, e.history(2, ".env"),
+		[2]string{historySync, "A=2\n"},
+		[2]string{historySync, "A=3\n"},
+	)
+	objects, _ := e.fs.ReadDir(filepath.Join(filepath.Dir(e.store(2, ".env")), historyDirName))
+	if len(objects) != 2 {
+		t.Fatalf("expected dropped snapshots to be deleted, got %d objects", len(objects))
+	}
+}
+
+func TestRestoreRollsBackStoreFile(t *testing.T) {
+	e := syncedEnv(t, "A=1\n")
+	e.write(e.repo(".env"), "A=2\n")
+	wantExit(t, e.sync("--worktree", "2", "--yes"), 0)
+
+	e.answer("n")
+	wantExit(t, e.restore(".env", "--worktree", "2", "--at", "1"), ExitAborted)
+	if got := e.read(e.store(2, ".env")); got != "A=2\n" {
+		t.Fatalf("expected an aborted restore to change nothing, got %q", got)
+	}
+
+	e.answer("y")
+	wantExit(t, e.restore(".env", "--worktree", "2", "--at", "1"), 0)
+	e.wantLink(2, ".env")
+	if got := e.read(e.store(2, ".env")); got != "A=1\n" {
+		t.Fatalf("expected the store rolled back, got %q", got)
+	}
+	wantExit(t, e.restore(".env", "--worktree", "2", "--at", "1", "--yes"), ExitNothingToDo)
+
+	// The restore is itself a version, so it can be undone.
+	wantHistory(t, e.history(2, ".env"),
+		[2]string{historySync, "A=1\n"},
+		[2]string{historySync, "A=2\n"},
+		[2]string{historyRestore, "A=1\n"},
+	)
+	wantExit(t, e.restore(".env", "--worktree", "2", "--at", "v2", "--yes"), 0)
+	if got := e.read(e.store(2, ".env")); got != "A=2\n" {
+		t.Fatalf("expected the restore undone, got %q", got)
+	}
+}
+
+func TestRestoreRefreshesCopies(t *testing.T) {
+	e := newTestEnv(t)
+	e.cfg.Link.Mode = config.LinkCopy
+	e.write(e.repo(".env"), "A=1\n")
+	wantExit(t, e.sync("--worktree", "2", "--yes"), 0)
+	e.write(e.repo(".env"), "A=2\n")
+	wantExit(t, e.sync("--worktree", "2", "--yes"), 0)
+
+	wantExit(t, e.restore(".env", "--worktree", "2", "--at", "1", "--yes"), 0)
+	if got := e.read(e.wt(2, ".env")); got != "A=1\n" {
+		t.Fatalf("expected the worktree copy refreshed, got %q", got)
+	}
+	// Like any store edit, the restored content is kept by the next sync
+	// and the tracked copy is left alone.
+	wantExit(t, e.sync("--worktree", "2", "--yes"), 0)
+	if got := e.read(e.wt(2, ".env")); got != "A=1\n" {
+		t.Fatalf("expected sync to keep the restored content, got %q", got)
+	}
+}
+
+func TestRestoreWithoutHistory(t *testing.T) {
+	e := syncedEnv(t, "A=1\n")
+	if err := e.restore("api/.env", "--worktree", "2", "--at", "1", "--yes"); err == nil {
+		t.Fatal("expected an error for a file without history")
+	}
+}
+
+func TestRestoreOutputJSON(t *testing.T) {
+	e := syncedEnv(t, "A=1\n")
+	e.write(e.repo(".env"), "A=2\nB=1\n")
+	wantExit(t, e.sync("--worktree", "2", "--yes"), 0)
+
+	restore := func(want int) map[string]interface{} {
+		t.Helper()
+		var err error
+		out := captureStdout(t, func() { err = e.restore(".env", "--worktree", "2", "--at", "1", "--yes", "--output", "json") })
+		wantExit(t, err, want)
+		var doc struct {
+			Summary map[string]interface{} `json:"summary"`
+		}
+		if err := json.Unmarshal([]byte(out), &doc); err != nil {
+			t.Fatalf("parse %q: %v", out, err)
+		}
+		return doc.Summary
+	}
+	sum := restore(0)
+	if sum["outcome"] != outcomeOK || sum["version"] != 1.0 || len(sum["keys"].([]interface{})) != 2 {
+		t.Fatalf("unexpected summary %v", sum)
+	}
+	if sum := restore(ExitNothingToDo); sum["outcome"] != outcomeNothingToDo {
+		t.Fatalf("expected nothing to do, got %v", sum)
+	}
+	if err := e.restore(".env", "--worktree", "2", "--at", "1", "--output", "json"); err == nil {
+		t.Fatal("expected --output without --yes to be refused")
+	}
+}
+
+func TestPickVersion(t *testing.T) {
+	now := time.Date(2024, 5, 10, 12, 0, 0, 0, time.Local)
+	entries := []historyEntry{
+		{Version: 3, Time: now.Add(-72 * time.Hour)},
+		{Version: 4, Time: now.Add(-2 * time.Hour)},
+		{Version: 5, Time: now.Add(-time.Minute)},
+	}
+	for at, want := range map[string]int{
+		"4":                   4,
+		"v5":                  5,
+		"1h":                  4,
+		"3d":                  3,
+		"2024-05-09":          3,
+		"2024-05-10 10:30":    4,
+		"2024-05-10T11:59:30": 5,
+	} {
+		e, err := pickVersion(entries, at, now)
+		if err != nil || e.Version != want {
+			t.Fatalf("%s: expected v%d, got v%d, %v", at, want, e.Version, err)
+		}
+	}
+	for _, at := range []string{"2", "4d", "yesterday"} {
+		if _, err := pickVersion(entries, at, now); err == nil {
+			t.Fatalf("%s: expected an error", at)
+		}
+	}
+}
+
+func TestParseHistoryOptions(t *testing.T) {
+	opts, err := parseHistoryOptions("restore", []string{"api/.env", "--at", "3", "--yes"})
+	if err != nil || opts.rel != "api/.env" || opts.at != "3" || !opts.yes {
+		t.Fatalf("unexpected options %+v, %v", opts, err)
+	}
+	for _, c := range []struct {
+		command string
+		args    []string
+	}{
+		{"history", nil},
+		{"history", []string{".env", "extra"}},
+		{"history", []string{"../.env"}},
+		{"history", []string{".env", "--at", "3"}},
+		{"restore", []string{".env"}},
+	} {
+		if _, err := parseHistoryOptions(c.command, c.args); err == nil {
+			t.Fatalf("%s %q: expected an error", c.command, c.args)
+		}
+	}
+}
+
+func TestHistoryOutputNDJSON(t *testing.T) {
+	e := syncedEnv(t, "A=1\n")
+	e.write(e.repo(".env"), "A=2\nB=1\n")
+	wantExit(t, e.sync("--worktree", "2", "--yes"), 0)
+
+	var err error
+	out := captureStdout(t, func() { err = e.session().history([]string{".env", "--worktree", "2", "--output", "ndjson"}) })
+	wantExit(t, err, 0)
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("expected two versions and a summary, got %q", out)
+	}
+	var v jsonHistoryVersion
+	if err := json.Unmarshal([]byte(lines[0]), &v); err != nil {
+		t.Fatalf("parse %q: %v", lines[0], err)
+	}
+	if v.Version != 2 || !v.Current || len(v.Keys) != 2 || v.Keys[0].Old != maskedValue {
+		t.Fatalf("expected the current v2 with two masked changes, got %+v", v)
+	}
+	if !strings.Contains(lines[2], `"type":"summary"`) || !strings.Contains(lines[2], `"versions":2`) {
+		t.Fatalf("unexpected summary %q", lines[2])
+	}
+}
+
+func TestLayeredHistoryKeepsTheBase(t *testing.T) {
+	e := newTestEnv(t)
+	e.cfg.Store.Mode = config.StoreModeLayered
+	e.write(e.repo(".env"), "A=1\n")
+	wantExit(t, e.sync("--worktree", "2", "--yes"), 0)
+	e.write(e.repo(".env"), "A=2\n")
+	wantExit(t, e.sync("--worktree", "2", "--yes"), 0)
+
+	base, err := pushStoreRoot(testRepo, e.wts[1], config.StoreModeLayered)
+	if err != nil {
+		t.Fatalf("base root: %v", err)
+	}
+	h, err := e.session().loadHistory(base)
+	if err != nil {
+		t.Fatalf("load history: %v", err)
+	}
+	if n := len(h.Files[".env"]); n != 2 {
+		t.Fatalf("expected two versions of the base, got %d", n)
+	}
+
+	wantExit(t, e.restore(".env", "--worktree", "2", "--at", "1", "--yes"), 0)
+	if got := e.read(filepath.Join(base, ".env")); got != "A=1\n" {
+		t.Fatalf("expected the base restored, got %q", got)
+	}
+	if got := e.read(e.wt(2, ".env")); got != "A=1\n" {
+		t.Fatalf("expected the rendered file to follow the base, got %q", got)
+	}
+	wantHistory(t, e.history(2, ".env"),
+		[2]string{historySync, "A=1\n"},
+		[2]string{historySync, "A=2\n"},
+		[2]string{historyRestore, "A=1\n"},
+	)
+	wantExit(t, e.push("--worktree", "2", "--yes"), 0)
+	if got := e.read(e.repo(".env")); got != "A=1\n" {
+		t.Fatalf("expected push to bring the restored base over, got %q", got)
+	}
+}
@@ -0,0 +1,405 @@
+package sync
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/aayushgautam/wtm/internal/age"
+	"github.com/aayushgautam/wtm/internal/config"
+	"github.com/aayushgautam/wtm/internal/gitx"
+)
+
+type keygenOptions struct {
+	out   string
+	force bool
+}
+
+// Keygen creates an age identity for decrypting encrypted stores and prints
+// its public key.
+func Keygen(args []string) error {
+	return newSession(nil).keygen(args)
+}
+
+func (s *session) keygen(args []string) error {
+	fsFlags := flag.NewFlagSet("keygen", flag.ContinueOnError)
+	fsFlags.SetOutput(io.Discard)
+
+	var opts keygenOptions
+	fsFlags.StringVar(&opts.out, "out", "", "identity file to write (defaults to $WTM_IDENTITY or identity.txt in the wtm home)")
+	fsFlags.BoolVar(&opts.force, "force", false, "replace an existing identity file")
+	if err := fsFlags.Parse(args); err != nil {
+		return keygenUsageError(err)
+	}
+	if fsFlags.NArg() > 0 {
+		return keygenUsageError(fmt.Errorf("unexpected argument %q", fsFlags.Arg(0)))
+	}
+
+	path := opts.out
+	if path == "" {
+		p, err := identityPath()
+		if err != nil {
+			return err
+		}
+		path = p
+	}
+	if _, err := s.fs.Stat(path); err == nil && !opts.force {
+		return fmt.Errorf("%s already exists; pass --force to replace it", path)
+	}
+
+	id, err := age.GenerateIdentity()
+	if err != nil {
+		return err
+	}
+	recipient := id.Recipient().String()
+	content := fmt.Sprintf("# created: %s\n# public key: %s\n%s\n", time.Now().Format(time.RFC3339), recipient, id)
+
+	if err := s.fs.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return fmt.Errorf("mkdir %s: %w", filepath.Dir(path), err)
+	}
+	if err := s.fs.WriteFile(path, []byte(content), 0o600); err != nil {
+		return fmt.Errorf("write %s: %w", path, err)
+	}
+	fmt.Fprintln(os.Stderr, "Wrote identity", path)
+	fmt.Fprintln(os.Stdout, recipient)
+	fmt.Fprintln(os.Stderr, "Add the public key to a repo with: wtm recipients add", recipient)
+	return nil
+}
+
+func keygenUsageError(err error) error {
+	msg := strings.TrimSpace(err.Error())
+	if msg != "" {
+		fmt.Fprintln(os.Stderr, "Error:", msg)
+	}
+	fmt.Fprintln(os.Stderr, "usage: wtm keygen [--out PATH] [--force]")
+	return fmt.Errorf("invalid arguments")
+}
+
+type recipientsOptions struct {
+	repoHint   string
+	positional []string
+}
+
+// Recipients dispatches "wtm recipients <list|add|remove>", which edit
+// encryption.recipients in the repo's config file.
+func Recipients(args []string) error {
+	return newSession(nil).recipients(args)
+}
+
+func (s *session) recipients(args []string) error {
+	if len(args) == 0 {
+		return recipientsUsageError(fmt.Errorf("missing subcommand"))
+	}
+	sub := args[0]
+	fsFlags := flag.NewFlagSet("recipients "+sub, flag.ContinueOnError)
+	fsFlags.SetOutput(io.Discard)
+
+	var opts recipientsOptions
+	fsFlags.StringVar(&opts.repoHint, "repo", "", "repo path (defaults to current dir repo)")
+	positional, err := parseInterspersed(fsFlags, args[1:])
+	if err != nil {
+		return recipientsUsageError(err)
+	}
+	opts.positional = positional
+
+	switch sub {
+	case "list":
+		if len(opts.positional) != 0 {
+			return recipientsUsageError(fmt.Errorf("list takes no arguments"))
+		}
+		return s.listRecipients(opts)
+	case "add", "remove":
+		if len(opts.positional) == 0 {
+			return recipientsUsageError(fmt.Errorf("%s takes one or more public keys", sub))
+		}
+		return s.editRecipients(opts, sub == "add")
+	default:
+		return recipientsUsageError(fmt.Errorf("unknown subcommand %q", sub))
+	}
+}
+
+func recipientsUsageError(err error) error {
+	msg := strings.TrimSpace(err.Error())
+	if msg != "" {
+		fmt.Fprintln(os.Stderr, "Error:", msg)
+	}
+	fmt.Fprintln(os.Stderr, "usage: wtm recipients list [--repo PATH]")
+	fmt.Fprintln(os.Stderr, "       wtm recipients add <age1...>... [--repo PATH]")
+	fmt.Fprintln(os.Stderr, "       wtm recipients remove <age1...>... [--repo PATH]")
+	return fmt.Errorf("invalid arguments")
+}
+
+func (s *session) listRecipients(opts recipientsOptions) error {
+	repoRoot, err := s.git.RepoRoot(opts.repoHint)
+	if err != nil {
+		return err
+	}
+	loaded, err := s.loadConfig(repoRoot)
+	if err != nil {
+		return err
+	}
+	for _, r := range loaded.Config.Encryption.Recipients {
+		fmt.Fprintln(os.Stdout, r)
+	}
+	if !loaded.Config.Encryption.Enabled() {
+		fmt.Fprintln(os.Stderr, "No recipients; the store is not encrypted.")
+	}
+	return nil
+}
+
+func (s *session) editRecipients(opts recipientsOptions, add bool) error {
+	repoRoot, err := s.git.RepoRoot(opts.repoHint)
+	if err != nil {
+		return err
+	}
+	loaded, err := s.loadConfig(repoRoot)
+	if err != nil {
+		return err
+	}
+	for _, k := range opts.positional {
+		if _, err := age.ParseRecipient(k); err != nil {
+			return err
+		}
+	}
+
+	current := loaded.Config.Encryption.Recipients
+	var next []string
+	if add {
+		next = append(next, current...)
+		for _, k := range opts.positional {
+			if containsString(next, k) {
+				fmt.Fprintln(os.Stderr, "Already a recipient:", k)
+				continue
+			}
+			next = append(next, k)
+		}
+	} else {
+		for _, r := range current {
+			if !containsString(opts.positional, r) {
+				next = append(next, r)
+			}
+		}
+		for _, k := range opts.positional {
+			if !containsString(current, k) {
+				fmt.Fprintln(os.Stderr, "Not a recipient:", k)
+			}
+		}
+	}
+	if len(next) == len(current) {
+		return nil
+	}
+	if len(next) > 0 && loaded.Config.Store.Mode == config.StoreModeLayered {
+		return fmt.Errorf("encryption is not supported with store.mode %q", config.StoreModeLayered)
+	}
+
+	path, err := s.setRecipients(repoRoot, next)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(os.Stderr, "Updated", path)
+	fmt.Fprintln(os.Stderr, "Run \"wtm rekey\" to re-encrypt the store for the new recipients.")
+	return nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Rekey re-encrypts every file in the repo's store for the configured
+// recipients, or decrypts them when there are none.
+func Rekey(args []string) error {
+	return newSession(nil).rekey(args)
+}
+
+func (s *session) rekey(args []string) error {
+	fsFlags := flag.NewFlagSet("rekey", flag.ContinueOnError)
+	fsFlags.SetOutput(io.Discard)
+
+	var repoHint string
+	fsFlags.StringVar(&repoHint, "repo", "", "repo path (defaults to current dir repo)")
+	if err := fsFlags.Parse(args); err != nil {
+		return rekeyUsageError(err)
+	}
+	if fsFlags.NArg() > 0 {
+		return rekeyUsageError(fmt.Errorf("unexpected argument %q", fsFlags.Arg(0)))
+	}
+
+	repoRoot, err := s.git.RepoRoot(repoHint)
+	if err != nil {
+		return err
+	}
+	loaded, err := s.loadConfig(repoRoot)
+	if err != nil {
+		return err
+	}
+	// The hashes recorded so far may have been keyed by the identity;
+	// remember its key to recognise them.
+	prevKey, _ := (&storeCipher{}).identityHashKey()
+	if s.cipher, err = newStoreCipher(loaded.Config); err != nil {
+		return err
+	}
+	storeDir, err := repoStoreDir(repoRoot)
+	if err != nil {
+		return err
+	}
+
+	files, indexed, err := s.rekeyFiles(storeDir)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			fmt.Fprintln(os.Stderr, "No store for this repo at", storeDir)
+			return nil
+		}
+		return err
+	}
+
+	changed := 0
+	for _, path := range files {
+		plain, err := s.readFile(path)
+		if err != nil {
+			return err
+		}
+		info, err := s.fs.Stat(path)
+		if err != nil {
+			return fmt.Errorf("stat %s: %w", path, err)
+		}
+		if err := s.writeFile(path, plain, info.Mode().Perm()); err != nil {
+			return err
+		}
+		changed++
+	}
+	for _, root := range indexed {
+		if err := s.rehashStore(root, prevKey); err != nil {
+			return err
+		}
+	}
+
+	if s.cipher.enabled() {
+		fmt.Fprintf(os.Stderr, "Re-encrypted %d files for %d recipients.\n", changed, len(s.cipher.recipients))
+	} else {
+		fmt.Fprintf(os.Stderr, "Decrypted %d files; no recipients are configured.\n", changed)
+	}
+	fmt.Fprintln(os.Stderr, "Run \"wtm sync --all\" to refresh worktree copies.")
+	return nil
+}
+
+func rekeyUsageError(err error) error {
+	msg := strings.TrimSpace(err.Error())
+	if msg != "" {
+		fmt.Fprintln(os.Stderr, "Error:", msg)
+	}
+	fmt.Fprintln(os.Stderr, "usage: wtm rekey [--repo PATH]")
+	return fmt.Errorf("invalid arguments")
+}
+
+// rekeyFiles lists the store files holding env content, and the store
+// roots with a manifest or history index.
+func (s *session) rekeyFiles(storeDir string) (files, indexed []string, err error) {
+	if _, err := s.fs.Stat(storeDir); err != nil {
+		return nil, nil, err
+	}
+	seen := make(map[string]bool)
+	err = walkDir(s.fs, storeDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		name := d.Name()
+		if d.IsDir() {
+			sealed := name == objectsDirName || name == historyDirName || name == backupDir
+			if path != storeDir && strings.HasPrefix(name, metaDirPrefix) && !sealed {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		if name == manifestName || name == historyIndexName {
+			if dir := filepath.Dir(path); !seen[dir] {
+				seen[dir] = true
+				indexed = append(indexed, dir)
+			}
+			return nil
+		}
+		if strings.HasPrefix(name, metaDirPrefix) {
+			return nil
+		}
+		files = append(files, path)
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return files, indexed, nil
+}
+
+// rehashStore records the manifest and history hashes of the store at root
+// under the current key, writing the objects and snapshots they name anew.
+// A worktree copy keeps its old hash unless it still holds what that hash,
+// plain or keyed by prevKey, was taken of.
+func (s *session) rehashStore(root string, prevKey []byte) error {
+	matches := func(recorded string, b []byte) bool {
+		return recorded == (&storeCipher{}).hash(b) || recorded == (&storeCipher{hashKey: prevKey}).hash(b)
+	}
+
+	m, err := s.loadManifest(root)
+	if err != nil {
+		return err
+	}
+	for rel, f := range m.Files {
+		content, ok, err := m.base(rel)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		if _, err := m.record(rel, content, f.Repo, gitx.Worktree{Path: f.Worktree, Branch: f.Branch, Head: f.Head}); err != nil {
+			return err
+		}
+		for wt, old := range f.Copies {
+			copied, err := s.fs.ReadFile(filepath.Join(wt, filepath.FromSlash(rel)))
+			if err == nil && matches(old, copied) {
+				f.Copies[wt] = s.contentHash(copied)
+			}
+		}
+	}
+	if err := m.save(); err != nil {
+		return err
+	}
+
+	h, err := s.loadHistory(root)
+	if err != nil {
+		return err
+	}
+	for _, entries := range h.Files {
+		for i, e := range entries {
+			content, err := h.content(e)
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			sum := s.contentHash(content)
+			snap := filepath.Join(root, historyDirName, sum)
+			if _, err := s.fs.Stat(snap); errors.Is(err, os.ErrNotExist) {
+				if err := s.writeFile(snap, content, 0o600); err != nil {
+					return err
+				}
+			}
+			entries[i].SHA256 = sum
+		}
+	}
+	return h.save()
+}
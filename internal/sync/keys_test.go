@@ -0,0 +1,230 @@
+package sync
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aayushgautam/wtm/internal/age"
+)
+
+// useIdentity writes a new identity to a temporary file and points
+// WTM_IDENTITY at it.
+func useIdentity(t *testing.T) *age.Identity {
+	t.Helper()
+	id, err := age.GenerateIdentity()
+	if err != nil {
+		t.Fatalf("generate identity: %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "identity.txt")
+	if err := os.WriteFile(path, []byte(id.String()+"\n"), 0o600); err != nil {
+		t.Fatalf("write identity: %v", err)
+	}
+	t.Setenv(identityEnv, path)
+	return id
+}
+
+// cipherSession returns a session with the cipher of the current config.
+func (e *testEnv) cipherSession() *session {
+	e.t.Helper()
+	s := e.session()
+	var err error
+	if s.cipher, err = newStoreCipher(e.cfg); err != nil {
+		e.t.Fatalf("cipher: %v", err)
+	}
+	return s
+}
+
+func TestKeygenWritesIdentity(t *testing.T) {
+	e := newTestEnv(t)
+	path := "/keys/identity.txt"
+
+	var err error
+	out := captureStdout(t, func() { err = e.session().keygen([]string{"--out", path}) })
+	wantExit(t, err, 0)
+	ids, err := age.ParseIdentities(strings.NewReader(e.read(path)))
+	if err != nil || len(ids) != 1 {
+		t.Fatalf("expected one identity in %s, got %v (%v)", path, ids, err)
+	}
+	if out != ids[0].Recipient().String()+"\n" {
+		t.Fatalf("expected the public key on stdout, got %q", out)
+	}
+	if info, err := e.fs.Stat(path); err != nil || info.Mode().Perm() != 0o600 {
+		t.Fatalf("expected a private identity file, got %v (%v)", info, err)
+	}
+
+	if err := e.session().keygen([]string{"--out", path}); err == nil {
+		t.Fatal("expected keygen to refuse replacing the identity")
+	}
+	captureStdout(t, func() { err = e.session().keygen([]string{"--out", path, "--force"}) })
+	wantExit(t, err, 0)
+	if e.read(path) == ids[0].String() {
+		t.Fatal("expected --force to write a new identity")
+	}
+}
+
+func TestRecipientsAddAndRemove(t *testing.T) {
+	e := newTestEnv(t)
+	a, err := age.GenerateIdentity()
+	if err != nil {
+		t.Fatalf("generate identity: %v", err)
+	}
+	key := a.Recipient().String()
+
+	wantExit(t, e.session().recipients([]string{"add", key}), 0)
+	wantExit(t, e.session().recipients([]string{"add", key}), 0)
+	if got := e.cfg.Encryption.Recipients; len(got) != 1 || got[0] != key {
+		t.Fatalf("expected %s added once, got %v", key, got)
+	}
+	out := captureStdout(t, func() { err = e.session().recipients([]string{"list"}) })
+	wantExit(t, err, 0)
+	if out != key+"\n" {
+		t.Fatalf("expected the recipient listed, got %q", out)
+	}
+	if err := e.session().recipients([]string{"add", "age1bogus"}); err == nil {
+		t.Fatal("expected an invalid key to be rejected")
+	}
+
+	wantExit(t, e.session().recipients([]string{"remove", key}), 0)
+	if len(e.cfg.Encryption.Recipients) != 0 {
+		t.Fatalf("expected no recipients left, got %v", e.cfg.Encryption.Recipients)
+	}
+}
+
+func TestSyncAndPushEncryptStore(t *testing.T) {
+	id := useIdentity(t)
+	e := newTestEnv(t)
+	e.cfg.Encryption.Recipients = []string{id.Recipient().String()}
+	e.write(e.repo(".env"), "A=1\n")
+
+	wantExit(t, e.sync("--worktree", "2", "--yes"), 0)
+	if raw := e.read(e.store(2, ".env")); !age.IsEncrypted([]byte(raw)) {
+		t.Fatalf("expected ciphertext in the store, got %q", raw)
+	}
+	info, err := e.fs.Lstat(e.wt(2, ".env"))
+	if err != nil || !info.Mode().IsRegular() || e.read(e.wt(2, ".env")) != "A=1\n" {
+		t.Fatalf("expected a plain-text copy in the worktree, got %v (%v)", info, err)
+	}
+
+	e.write(e.wt(2, ".env"), "A=2\n")
+	wantExit(t, e.push("--worktree", "2", "--yes"), 0)
+	if got := e.read(e.repo(".env")); got != "A=2\n" {
+		t.Fatalf("expected push to decrypt into the repo, got %q", got)
+	}
+	plain, err := e.cipherSession().readFile(e.store(2, ".env"))
+	if err != nil || string(plain) != "A=2\n" {
+		t.Fatalf("expected the edit in the store, got %q (%v)", plain, err)
+	}
+	if raw := e.read(e.store(2, ".env")); !age.IsEncrypted([]byte(raw)) {
+		t.Fatalf("expected the store to stay encrypted, got %q", raw)
+	}
+}
+
+// storeFiles returns the files of the store of worktree n by directory,
+// leaving out the manifest and history index.
+func (e *testEnv) storeFiles(n int) map[string][]string {
+	e.t.Helper()
+	root := filepath.Dir(e.store(n, ".env"))
+	files := make(map[string][]string)
+	err := walkDir(e.fs, root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || d.Name() == manifestName || d.Name() == historyIndexName {
+			return err
+		}
+		dir, _ := filepath.Rel(root, filepath.Dir(path))
+		files[dir] = append(files[dir], path)
+		return nil
+	})
+	if err != nil {
+		e.t.Fatalf("walk: %v", err)
+	}
+	return files
+}
+
+// wantHashes checks that the manifest and history of the store of worktree
+// n name their objects and snapshots by the hash of s.
+func (e *testEnv) wantHashes(s *session, n int) {
+	e.t.Helper()
+	root := filepath.Dir(e.store(n, ".env"))
+	m, err := s.loadManifest(root)
+	if err != nil {
+		e.t.Fatalf("manifest: %v", err)
+	}
+	content, ok, err := m.base(".env")
+	if err != nil || !ok || m.Files[".env"].SHA256 != s.contentHash(content) {
+		e.t.Fatalf("expected the manifest rehashed, got %+v (%v)", m.Files[".env"], err)
+	}
+	h, err := s.loadHistory(root)
+	if err != nil {
+		e.t.Fatalf("history: %v", err)
+	}
+	if len(h.Files[".env"]) == 0 {
+		e.t.Fatal("expected history of .env")
+	}
+	for _, v := range h.Files[".env"] {
+		content, err := h.content(v)
+		if err != nil || v.SHA256 != s.contentHash(content) {
+			e.t.Fatalf("expected snapshot v%d rehashed, got %v", v.Version, err)
+		}
+	}
+}
+
+func TestRekeyRewritesWholeStore(t *testing.T) {
+	e := syncedEnv(t, "A=1\n")
+	// A doctor repair leaves a backup and history behind.
+	if err := e.fs.Remove(e.wt(2, ".env")); err != nil {
+		t.Fatalf("remove: %v", err)
+	}
+	e.write(e.wt(2, ".env"), "A=edited\n")
+	e.age(e.store(2, ".env"), time.Hour)
+	wantExit(t, e.doctor("--fix", "--yes"), 0)
+
+	id := useIdentity(t)
+	e.cfg.Encryption.Recipients = []string{id.Recipient().String()}
+	wantExit(t, e.session().rekey(nil), 0)
+	files := e.storeFiles(2)
+	for _, dir := range []string{".", objectsDirName, historyDirName, backupDir} {
+		if len(files[dir]) == 0 {
+			t.Fatalf("expected files in %s, got %v", dir, files)
+		}
+	}
+	for _, paths := range files {
+		for _, path := range paths {
+			if !age.IsEncrypted([]byte(e.read(path))) {
+				t.Fatalf("expected %s to be encrypted", path)
+			}
+		}
+	}
+	s := e.cipherSession()
+	e.wantHashes(s, 2)
+	if strings.Contains(e.read(filepath.Join(filepath.Dir(e.store(2, ".env")), manifestName)), (&storeCipher{}).hash([]byte("A=edited\n"))) {
+		t.Fatal("expected no plain hash of the content left in the manifest")
+	}
+
+	// Sync turns the link into a copy, without seeing a conflict.
+	wantExit(t, e.sync("--worktree", "2", "--yes"), 0)
+	if got := e.read(e.wt(2, ".env")); got != "A=edited\n" {
+		t.Fatalf("expected a copy of the store, got %q", got)
+	}
+
+	e.cfg.Encryption.Recipients = nil
+	wantExit(t, e.session().rekey(nil), 0)
+	for _, paths := range e.storeFiles(2) {
+		for _, path := range paths {
+			if age.IsEncrypted([]byte(e.read(path))) {
+				t.Fatalf("expected %s to be decrypted", path)
+			}
+		}
+	}
+	s = e.cipherSession()
+	e.wantHashes(s, 2)
+	m, err := s.loadManifest(filepath.Dir(e.store(2, ".env")))
+	if err != nil {
+		t.Fatalf("manifest: %v", err)
+	}
+	if got := m.copyHash(".env", e.wts[1].Path); got != s.contentHash([]byte("A=edited\n")) {
+		t.Fatalf("expected the worktree copy rehashed, got %q", got)
+	}
+}
@@ -0,0 +1,236 @@
+package sync
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/aayushgautam/wtm/internal/config"
+)
+
+// linkModeFor returns how sync places the store file for rel into a
+// worktree.
+func linkModeFor(cfg config.Config, rel string) string {
+	if cfg.Encryption.Enabled() {
+		return config.LinkCopy
+	}
+	if i := firstMatch(linkRulePatterns(cfg), rel); i >= 0 {
+		return cfg.Link.Rules[i].Mode
+	}
+	if cfg.Link.Mode == "" {
+		return config.LinkSymlink
+	}
+	return cfg.Link.Mode
+}
+
+func linkRulePatterns(cfg config.Config) []string {
+	patterns := make([]string, len(cfg.Link.Rules))
+	for i, r := range cfg.Link.Rules {
+		patterns[i] = r.Pattern
+	}
+	return patterns
+}
+
+// placeWorktreeFile puts the store file of it into the worktree and, for
+// copies, returns the content written.
+func (s *session) placeWorktreeFile(it planItem, tracked string, force bool) ([]byte, error) {
+	switch it.link {
+	case config.LinkCopy:
+		return s.ensureWorktreeCopy(it.storeAbs, it.worktreeAbs, tracked, force)
+	case config.LinkHardlink:
+		return nil, s.ensureWorktreeHardlink(it.storeAbs, it.worktreeAbs, force)
+	default:
+		return nil, s.ensureWorktreeLink(it.storeAbs, it.worktreeAbs, it.relative, force)
+	}
+}
+
+// symlinkTarget returns what a symlink at link should contain to point at
+// target.
+func (s *session) symlinkTarget(target, link string, relative bool) (string, error) {
+	if !relative {
+		return target, nil
+	}
+	from := filepath.Dir(link)
+	if r, err := s.fs.EvalSymlinks(from); err == nil {
+		from = r
+	}
+	to := target
+	if r, err := s.fs.EvalSymlinks(filepath.Dir(target)); err == nil {
+		to = filepath.Join(r, filepath.Base(target))
+	}
+	rel, err := filepath.Rel(from, to)
+	if err != nil {
+		return "", fmt.Errorf("relative path from %s to %s: %w", from, to, err)
+	}
+	return rel, nil
+}
+
+// readLinkAbs returns the path the symlink at link points at, made absolute
+// if it is stored relative to the link.
+func (s *session) readLinkAbs(link string) (string, error) {
+	current, err := s.fs.Readlink(link)
+	if err != nil {
+		return "", err
+	}
+	if !filepath.IsAbs(current) {
+		current = filepath.Join(filepath.Dir(link), current)
+	}
+	return current, nil
+}
+
+// linksTo reports whether link is a symlink pointing at target, in either
+// form.
+func (s *session) linksTo(link, target string) bool {
+	current, err := s.readLinkAbs(link)
+	if err != nil {
+		return false
+	}
+	return samePath(current, target) || s.sameFile(current, target)
+}
+
+// ensureWorktreeHardlink makes link a hard link to target. A symlink to
+// target, or a file with the same content, is replaced without asking.
+func (s *session) ensureWorktreeHardlink(target, link string, force bool) error {
+	if err := s.fs.MkdirAll(filepath.Dir(link), 0o755); err != nil {
+		return fmt.Errorf("mkdir %s: %w", filepath.Dir(link), err)
+	}
+	if info, err := s.fs.Lstat(link); err == nil {
+		if info.Mode().IsRegular() && s.sameFile(link, target) {
+			return nil
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			if s.linksTo(link, target) {
+				force = true
+			}
+		} else if s.sameFileContents(link, target) {
+			force = true
+		}
+		if err := s.handleExisting(link, force); err != nil {
+			return err
+		}
+	} else if !os.IsNotExist(err) {
+		return fmt.Errorf("stat %s: %w", link, err)
+	}
+	if err := s.fs.Link(target, link); err != nil {
+		return fmt.Errorf("hard link %s -> %s: %w (store and worktree must be on the same file system; use link mode %q otherwise)", link, target, err, config.LinkCopy)
+	}
+	return nil
+}
+
+// ensureWorktreeCopy writes the store file to dst, asking before it
+// replaces a copy with local edits unless force is set.
+func (s *session) ensureWorktreeCopy(storeAbs, dst, tracked string, force bool) ([]byte, error) {
+	plain, err := s.readFile(storeAbs)
+	if err != nil {
+		return nil, err
+	}
+	info, err := s.fs.Stat(storeAbs)
+	if err != nil {
+		return nil, fmt.Errorf("stat %s: %w", storeAbs, err)
+	}
+	perm := info.Mode().Perm()
+	if s.cipher.enabled() {
+		perm = 0o600
+	}
+	if err := s.fs.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		return nil, fmt.Errorf("mkdir %s: %w", filepath.Dir(dst), err)
+	}
+	if info, err := s.fs.Lstat(dst); err == nil {
+		switch {
+		case info.Mode()&os.ModeSymlink != 0:
+			if s.linksTo(dst, storeAbs) {
+				force = true
+			}
+		case s.sameFile(dst, storeAbs):
+			force = true
+		default:
+			cur, err := s.fs.ReadFile(dst)
+			if err == nil && bytes.Equal(cur, plain) {
+				return plain, nil
+			}
+			if err == nil && tracked != "" && s.contentHash(cur) == tracked {
+				force = true
+			}
+		}
+		if err := s.handleExisting(dst, force); err != nil {
+			return nil, err
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("stat %s: %w", dst, err)
+	}
+	if err := s.fs.WriteFile(dst, plain, perm); err != nil {
+		return nil, fmt.Errorf("write %s: %w", dst, err)
+	}
+	return plain, nil
+}
+
+// captureWorktreeCopy writes edits made to the worktree copy of it into
+// the store and reports whether the store changed.
+func (s *session) captureWorktreeCopy(m *storeManifest, it planItem, worktreeRoot string) (bool, error) {
+	if it.link == config.LinkSymlink {
+		return false, nil
+	}
+	path := filepath.Join(worktreeRoot, filepath.FromSlash(it.rel))
+	info, err := s.fs.Lstat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, fmt.Errorf("stat %s: %w", path, err)
+	}
+	if !info.Mode().IsRegular() || s.sameFile(path, it.storeAbs) {
+		return false, nil
+	}
+	edited, err := s.fs.ReadFile(path)
+	if err != nil {
+		return false, fmt.Errorf("read %s: %w", path, err)
+	}
+	stored, err := s.readFile(it.storeAbs)
+	if err != nil {
+		return false, err
+	}
+	if bytes.Equal(edited, stored) {
+		return false, nil
+	}
+	if tracked := m.copyHash(it.rel, worktreeRoot); tracked != "" {
+		if s.contentHash(edited) == tracked {
+			// Only the store changed since the copy was made; "wtm sync"
+			// refreshes the copy.
+			return false, nil
+		}
+		if s.contentHash(stored) != tracked {
+			return false, fmt.Errorf("%s and %s both changed since the last sync", path, it.storeAbs)
+		}
+	}
+
+	storeInfo, err := s.fs.Stat(it.storeAbs)
+	if err != nil {
+		return false, fmt.Errorf("stat %s: %w", it.storeAbs, err)
+	}
+	write := func() error { return s.writeFile(it.storeAbs, edited, storeInfo.Mode().Perm()) }
+	if err := s.withHistory(it, it.storeAbs, historyCapture, write); err != nil {
+		return false, err
+	}
+	if it.link == config.LinkHardlink {
+		// The store file was replaced; link the worktree to it again.
+		if err := s.fs.Remove(path); err != nil {
+			return true, fmt.Errorf("remove %s: %w", path, err)
+		}
+		if err := s.fs.Link(it.storeAbs, path); err != nil {
+			return true, fmt.Errorf("hard link %s -> %s: %w", path, it.storeAbs, err)
+		}
+		return true, nil
+	}
+	m.recordCopy(it.rel, worktreeRoot, edited)
+	return true, nil
+}
+
+func (s *session) sameFile(a, b string) bool {
+	ai, err := s.fs.Stat(a)
+	if err != nil {
+		return false
+	}
+	bi, err := s.fs.Stat(b)
+	return err == nil && s.fs.SameFile(ai, bi)
+}
@@ -0,0 +1,254 @@
+package sync
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aayushgautam/wtm/internal/gitx"
+)
+
+// The manifest records the hash each store file was last written with;
+// the objects directory keeps that content for push's three-way merge.
+const (
+	manifestName    = metaDirPrefix + "manifest.json"
+	objectsDirName  = metaDirPrefix + "objects"
+	manifestVersion = 1
+)
+
+type storeManifest struct {
+	root    string
+	session *session // objects hold secrets and are encrypted like the store
+
+	Version int                      `json:"version"`
+	Files   map[string]*manifestFile `json:"files"`
+}
+
+type manifestFile struct {
+	Repo     string     `json:"repo"`
+	Worktree string     `json:"worktree"`
+	Branch   string     `json:"branch,omitempty"`
+	Head     string     `json:"head,omitempty"`
+	SHA256   string     `json:"sha256"`
+	SyncedAt time.Time  `json:"synced_at"`
+	PushedAt *time.Time `json:"pushed_at,omitempty"`
+	// Copies maps worktree paths holding a copy of the file (link mode
+	// copy) to the hash of what wtm last wrote there.
+	Copies map[string]string `json:"copies,omitempty"`
+}
+
+// loadManifest reads the manifest of the store at root. A store without one
+// yields an empty manifest.
+func (s *session) loadManifest(root string) (*storeManifest, error) {
+	m := &storeManifest{root: root, session: s, Version: manifestVersion, Files: map[string]*manifestFile{}}
+	path := filepath.Join(root, manifestName)
+	b, err := s.fs.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return m, nil
+		}
+		return nil, fmt.Errorf("read %s: %w", path, err)
+	}
+	if err := json.Unmarshal(b, m); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	if m.Version > manifestVersion {
+		return nil, fmt.Errorf("%s was written by a newer wtm (version %d)", path, m.Version)
+	}
+	if m.Files == nil {
+		m.Files = map[string]*manifestFile{}
+	}
+	return m, nil
+}
+
+// save writes the manifest atomically and deletes objects no entry refers
+// to any more.
+func (m *storeManifest) save() error {
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(m.root, manifestName)
+	tmp := path + ".tmp"
+	fsys := m.session.fs
+	if err := fsys.WriteFile(tmp, append(b, '\n'), 0o644); err != nil {
+		return fmt.Errorf("write %s: %w", tmp, err)
+	}
+	if err := fsys.Rename(tmp, path); err != nil {
+		_ = fsys.Remove(tmp)
+		return fmt.Errorf("rename %s: %w", path, err)
+	}
+
+	referenced := make(map[string]bool, len(m.Files))
+	for _, f := range m.Files {
+		referenced[f.SHA256] = true
+	}
+	objDir := filepath.Join(m.root, objectsDirName)
+	entries, err := fsys.ReadDir(objDir)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return fmt.Errorf("read %s: %w", objDir, err)
+	}
+	for _, e := range entries {
+		if !referenced[e.Name()] {
+			_ = fsys.Remove(filepath.Join(objDir, e.Name()))
+		}
+	}
+	return nil
+}
+
+// recordSync notes that rel now holds the plain-text content, copied from repoRoot for wt.
+func (m *storeManifest) recordSync(rel string, content []byte, repoRoot string, wt gitx.Worktree) error {
+	f, err := m.record(rel, content, repoRoot, wt)
+	if err != nil {
+		return err
+	}
+	f.SyncedAt = time.Now().UTC()
+	f.PushedAt = nil
+	return nil
+}
+
+// recordPush notes that content of rel was pushed into repoRoot from wt.
+func (m *storeManifest) recordPush(rel string, content []byte, repoRoot string, wt gitx.Worktree) error {
+	f, err := m.record(rel, content, repoRoot, wt)
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	if f.SyncedAt.IsZero() {
+		f.SyncedAt = now
+	}
+	f.PushedAt = &now
+	return nil
+}
+
+func (m *storeManifest) record(rel string, content []byte, repoRoot string, wt gitx.Worktree) (*manifestFile, error) {
+	hash := m.session.contentHash(content)
+	objDir := filepath.Join(m.root, objectsDirName)
+	if err := m.session.fs.MkdirAll(objDir, 0o755); err != nil {
+		return nil, fmt.Errorf("mkdir %s: %w", objDir, err)
+	}
+	obj := filepath.Join(objDir, hash)
+	if _, err := m.session.fs.Stat(obj); errors.Is(err, os.ErrNotExist) {
+		if err := m.session.writeFile(obj, content, 0o600); err != nil {
+			return nil, err
+		}
+	}
+	f := m.Files[rel]
+	if f == nil {
+		f = &manifestFile{}
+		m.Files[rel] = f
+	}
+	f.Repo = repoRoot
+	f.Worktree = wt.Path
+	f.Branch = strings.TrimPrefix(wt.Branch, "refs/heads/")
+	f.Head = wt.Head
+	f.SHA256 = hash
+	return f, nil
+}
+
+// adopt copies from's record of rel, and the object it refers to, into m.
+func (m *storeManifest) adopt(rel string, from *storeManifest) error {
+	f := from.Files[rel]
+	if m == from || f == nil {
+		return nil
+	}
+	content, ok, err := from.base(rel)
+	if err != nil || !ok {
+		return err
+	}
+	rec, err := m.record(rel, content, f.Repo, gitx.Worktree{Path: f.Worktree, Branch: f.Branch, Head: f.Head})
+	if err != nil {
+		return err
+	}
+	rec.SyncedAt, rec.PushedAt = f.SyncedAt, f.PushedAt
+	return nil
+}
+
+// recordCopy notes that the worktree at wtPath holds a copy of rel with
+// content.
+func (m *storeManifest) recordCopy(rel, wtPath string, content []byte) {
+	f := m.Files[rel]
+	if f == nil {
+		f = &manifestFile{}
+		m.Files[rel] = f
+	}
+	if f.Copies == nil {
+		f.Copies = map[string]string{}
+	}
+	f.Copies[wtPath] = m.session.contentHash(content)
+}
+
+// copyHash returns the hash recorded by recordCopy, or "" if there is none.
+func (m *storeManifest) copyHash(rel, wtPath string) string {
+	if f := m.Files[rel]; f != nil {
+		return f.Copies[wtPath]
+	}
+	return ""
+}
+
+// base returns the content rel had when wtm last wrote it. ok is false when
+// the store has no record of it, e.g. for stores synced by an older wtm.
+func (m *storeManifest) base(rel string) (content []byte, ok bool, err error) {
+	f := m.Files[rel]
+	if f == nil || f.SHA256 == "" {
+		return nil, false, nil
+	}
+	obj := filepath.Join(m.root, objectsDirName, f.SHA256)
+	content, err = m.session.readFile(obj)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, false, nil
+		}
+		return nil, false, err
+	}
+	return content, true, nil
+}
+
+// lastUsed returns when wtm last synced or pushed any file of the store.
+func (m *storeManifest) lastUsed() time.Time {
+	var t time.Time
+	for _, f := range m.Files {
+		if f.SyncedAt.After(t) {
+			t = f.SyncedAt
+		}
+		if f.PushedAt != nil && f.PushedAt.After(t) {
+			t = *f.PushedAt
+		}
+	}
+	return t
+}
+
+// worktrees returns the distinct worktree paths recorded in the manifest,
+// sorted.
+func (m *storeManifest) worktrees() []string {
+	seen := make(map[string]bool)
+	var out []string
+	for _, f := range m.Files {
+		if f.Worktree != "" && !seen[f.Worktree] {
+			seen[f.Worktree] = true
+			out = append(out, f.Worktree)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+// otherRepo returns a repo other than repoRoot that the manifest records a
+// file of, or "" when there is none. Repos with the same base name share a
+// store directory, so a store there may not be repoRoot's.
+func (m *storeManifest) otherRepo(repoRoot string) string {
+	for _, f := range m.Files {
+		if f.Repo != "" && !samePath(f.Repo, repoRoot) {
+			return f.Repo
+		}
+	}
+	return ""
+}
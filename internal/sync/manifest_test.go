@@ -0,0 +1,61 @@
+package sync
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestManifestRejectsNewerVersion(t *testing.T) {
+	e := newTestEnv(t)
+	root := e.store(2, "")
+	e.write(filepath.Join(root, manifestName), `{"version": 2, "files": {}}`)
+	if _, err := e.session().loadManifest(root); err == nil {
+		t.Fatal("expected a manifest written by a newer wtm to be rejected")
+	}
+}
+
+func TestManifestSaveDeletesUnreferencedObjects(t *testing.T) {
+	e := newTestEnv(t)
+	s := e.session()
+	s.cipher = &storeCipher{}
+	root := e.store(2, "")
+	m, err := s.loadManifest(root)
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	for _, content := range []string{"A=1\n", "A=2\n"} {
+		if err := m.recordSync(".env", []byte(content), testRepo, e.wts[1]); err != nil {
+			t.Fatalf("record: %v", err)
+		}
+	}
+	if err := m.save(); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+
+	objects, err := e.fs.ReadDir(filepath.Join(root, objectsDirName))
+	if err != nil || len(objects) != 1 {
+		t.Fatalf("expected only the recorded object to be kept, got %v (%v)", objects, err)
+	}
+	if m, err = s.loadManifest(root); err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+	base, ok, err := m.base(".env")
+	if err != nil || !ok || string(base) != "A=2\n" {
+		t.Fatalf("expected the last recorded content, got %q (%v, %v)", base, ok, err)
+	}
+}
+
+func TestManifestLastUsed(t *testing.T) {
+	m := &storeManifest{Files: map[string]*manifestFile{}}
+	if !m.lastUsed().IsZero() {
+		t.Fatalf("expected an empty manifest to be unused, got %v", m.lastUsed())
+	}
+	synced := time.Date(2024, 5, 10, 12, 0, 0, 0, time.UTC)
+	pushed := synced.Add(time.Hour)
+	m.Files[".env"] = &manifestFile{SyncedAt: synced}
+	m.Files["api/.env"] = &manifestFile{SyncedAt: synced.Add(-time.Hour), PushedAt: &pushed}
+	if got := m.lastUsed(); !got.Equal(pushed) {
+		t.Fatalf("expected the latest push, got %v", got)
+	}
+}
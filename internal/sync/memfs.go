@@ -0,0 +1,560 @@
+package sync
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// maxSymlinkHops bounds symlink resolution, like the kernel's ELOOP limit.
+const maxSymlinkHops = 40
+
+// memFS is an in-memory file system, copy-on-write over base when set. It
+// records every path it changes.
+type memFS struct {
+	base    fileSystem
+	nodes   map[string]*memNode // by clean absolute path; nil marks a removal
+	changes []string            // resolved paths changed, oldest first
+}
+
+// memNode is a file, directory or symlink. Hard links share one node.
+type memNode struct {
+	mode    fs.FileMode
+	data    []byte
+	target  string
+	modTime time.Time
+	// opaque marks a directory that hides the base directory at the same
+	// path: it was created where the base had none, or had one removed.
+	opaque bool
+}
+
+func newMemFS(base fileSystem) *memFS {
+	m := &memFS{base: base, nodes: make(map[string]*memNode)}
+	if base == nil {
+		m.nodes[string(filepath.Separator)] = &memNode{mode: fs.ModeDir | 0o755, modTime: time.Now(), opaque: true}
+	}
+	return m
+}
+
+type memInfo struct {
+	name string
+	node *memNode
+}
+
+func (i memInfo) Name() string       { return i.name }
+func (i memInfo) Mode() fs.FileMode  { return i.node.mode }
+func (i memInfo) ModTime() time.Time { return i.node.modTime }
+func (i memInfo) IsDir() bool        { return i.node.mode.IsDir() }
+func (i memInfo) Sys() interface{}   { return i.node }
+
+func (i memInfo) Size() int64 {
+	if i.node.mode&fs.ModeSymlink != 0 {
+		return int64(len(i.node.target))
+	}
+	return int64(len(i.node.data))
+}
+
+// entry returns what is at p without following a symlink there.
+func (m *memFS) entry(p string) (*memNode, fs.FileInfo, error) {
+	if n, ok := m.nodes[p]; ok {
+		if n == nil {
+			return nil, nil, fs.ErrNotExist
+		}
+		return n, memInfo{name: filepath.Base(p), node: n}, nil
+	}
+	if m.base == nil || m.hidden(p) {
+		return nil, nil, fs.ErrNotExist
+	}
+	info, err := m.base.Lstat(p)
+	if err != nil {
+		var pe *fs.PathError
+		if errors.As(err, &pe) {
+			err = pe.Err
+		}
+		return nil, nil, err
+	}
+	return nil, info, nil
+}
+
+// hidden reports whether a change to a directory above p hides what the
+// base has at p.
+func (m *memFS) hidden(p string) bool {
+	for dir := filepath.Dir(p); ; dir = filepath.Dir(dir) {
+		if n, ok := m.nodes[dir]; ok {
+			return n == nil || !n.mode.IsDir() || n.opaque
+		}
+		if dir == filepath.Dir(dir) {
+			return false
+		}
+	}
+}
+
+// resolve returns name with every symlink above it followed, and the one
+// at name too when followLast is set.
+func (m *memFS) resolve(name string, followLast bool) (string, error) {
+	p, err := filepath.Abs(name)
+	if err != nil {
+		return "", err
+	}
+	for hops := 0; hops <= maxSymlinkHops; hops++ {
+		next, followed, err := m.resolveOnce(p, followLast)
+		if err != nil || !followed {
+			return next, err
+		}
+		p = next
+	}
+	return "", syscall.ELOOP
+}
+
+// resolveOnce rewrites p at the first symlink it has to follow, reporting
+// whether there was one.
+func (m *memFS) resolveOnce(p string, followLast bool) (string, bool, error) {
+	vol := filepath.VolumeName(p)
+	sep := string(filepath.Separator)
+	parts := strings.Split(strings.TrimPrefix(p[len(vol):], sep), sep)
+	cur := vol + sep
+	for i, part := range parts {
+		if part == "" {
+			continue
+		}
+		next := filepath.Join(cur, part)
+		rest := append([]string{next}, parts[i+1:]...)
+		if i == len(parts)-1 && !followLast {
+			return next, false, nil
+		}
+		n, info, err := m.entry(next)
+		if err != nil {
+			return filepath.Join(rest...), false, nil
+		}
+		if info.Mode()&fs.ModeSymlink != 0 {
+			target := ""
+			if n != nil {
+				target = n.target
+			} else if target, err = m.base.Readlink(next); err != nil {
+				return "", false, err
+			}
+			if !filepath.IsAbs(target) {
+				target = filepath.Join(cur, target)
+			}
+			rest[0] = target
+			return filepath.Join(rest...), true, nil
+		}
+		cur = next
+	}
+	return cur, false, nil
+}
+
+// lookup resolves name and returns the entry there, with errors reported
+// like the os package does for op.
+func (m *memFS) lookup(op, name string, follow bool) (string, *memNode, fs.FileInfo, error) {
+	p, err := m.resolve(name, follow)
+	if err != nil {
+		return "", nil, nil, &fs.PathError{Op: op, Path: name, Err: err}
+	}
+	n, info, err := m.entry(p)
+	if err != nil {
+		return p, nil, nil, &fs.PathError{Op: op, Path: name, Err: err}
+	}
+	return p, n, info, nil
+}
+
+// materialize copies the base entry at p into memory so it can be changed.
+func (m *memFS) materialize(p string) (*memNode, error) {
+	n, info, err := m.entry(p)
+	if err != nil || n != nil {
+		return n, err
+	}
+	n = &memNode{mode: info.Mode(), modTime: info.ModTime()}
+	switch {
+	case info.Mode()&fs.ModeSymlink != 0:
+		n.target, err = m.base.Readlink(p)
+	case info.Mode().IsRegular():
+		n.data, err = m.base.ReadFile(p)
+	}
+	if err != nil {
+		return nil, err
+	}
+	m.nodes[p] = n
+	return n, nil
+}
+
+// checkParent reports an error unless the directory p is created in exists.
+func (m *memFS) checkParent(op, name, p string) error {
+	_, info, err := m.entry(filepath.Dir(p))
+	if err != nil {
+		return &fs.PathError{Op: op, Path: name, Err: err}
+	}
+	if !info.IsDir() {
+		return &fs.PathError{Op: op, Path: name, Err: syscall.ENOTDIR}
+	}
+	return nil
+}
+
+// drop forgets every change below p.
+func (m *memFS) drop(p string) {
+	prefix := p + string(filepath.Separator)
+	for k := range m.nodes {
+		if strings.HasPrefix(k, prefix) {
+			delete(m.nodes, k)
+		}
+	}
+}
+
+func (m *memFS) changed(paths ...string) {
+	m.changes = append(m.changes, paths...)
+}
+
+// changedSince reports whether name was changed after the first mark
+// changes were recorded.
+func (m *memFS) changedSince(mark int, name string) bool {
+	p, err := m.resolve(name, false)
+	if err != nil {
+		return false
+	}
+	for _, c := range m.changes[mark:] {
+		if c == p {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *memFS) Stat(name string) (fs.FileInfo, error) {
+	_, _, info, err := m.lookup("stat", name, true)
+	return info, err
+}
+
+func (m *memFS) Lstat(name string) (fs.FileInfo, error) {
+	_, _, info, err := m.lookup("lstat", name, false)
+	return info, err
+}
+
+func (m *memFS) ReadFile(name string) ([]byte, error) {
+	p, n, info, err := m.lookup("open", name, true)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return nil, &fs.PathError{Op: "read", Path: name, Err: syscall.EISDIR}
+	}
+	if n == nil {
+		return m.base.ReadFile(p)
+	}
+	return append([]byte(nil), n.data...), nil
+}
+
+func (m *memFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	p, n, info, err := m.lookup("open", name, true)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, &fs.PathError{Op: "readdirent", Path: name, Err: syscall.ENOTDIR}
+	}
+	byName := make(map[string]fs.DirEntry)
+	if m.base != nil && (n == nil || !n.opaque) {
+		entries, err := m.base.ReadDir(p)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+		for _, e := range entries {
+			byName[e.Name()] = e
+		}
+	}
+	for path, c := range m.nodes {
+		if path == p || filepath.Dir(path) != p {
+			continue
+		}
+		base := filepath.Base(path)
+		if c == nil {
+			delete(byName, base)
+			continue
+		}
+		byName[base] = fs.FileInfoToDirEntry(memInfo{name: base, node: c})
+	}
+	entries := make([]fs.DirEntry, 0, len(byName))
+	for _, e := range byName {
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries, nil
+}
+
+func (m *memFS) Readlink(name string) (string, error) {
+	p, n, info, err := m.lookup("readlink", name, false)
+	if err != nil {
+		return "", err
+	}
+	if info.Mode()&fs.ModeSymlink == 0 {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: syscall.EINVAL}
+	}
+	if n == nil {
+		return m.base.Readlink(p)
+	}
+	return n.target, nil
+}
+
+func (m *memFS) EvalSymlinks(path string) (string, error) {
+	p, _, _, err := m.lookup("lstat", path, true)
+	if err != nil {
+		return "", err
+	}
+	return p, nil
+}
+
+func (m *memFS) SameFile(a, b fs.FileInfo) bool {
+	an, aok := a.Sys().(*memNode)
+	bn, bok := b.Sys().(*memNode)
+	if aok || bok {
+		return aok && bok && an == bn
+	}
+	return m.base != nil && m.base.SameFile(a, b)
+}
+
+func (m *memFS) WriteFile(name string, data []byte, perm fs.FileMode) error {
+	p, err := m.resolve(name, true)
+	if err != nil {
+		return &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	n, info, err := m.entry(p)
+	switch {
+	case err == nil && info.IsDir():
+		return &fs.PathError{Op: "open", Path: name, Err: syscall.EISDIR}
+	case err == nil && n == nil:
+		// The base file keeps its mode, like a truncated file does.
+		n = &memNode{mode: info.Mode().Perm()}
+	case err == nil:
+	case errors.Is(err, fs.ErrNotExist):
+		if err := m.checkParent("open", name, p); err != nil {
+			return err
+		}
+		n = &memNode{mode: perm.Perm()}
+	default:
+		return &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	n.data = append([]byte(nil), data...)
+	n.modTime = time.Now()
+	m.nodes[p] = n
+	m.changed(p)
+	return nil
+}
+
+func (m *memFS) MkdirAll(path string, perm fs.FileMode) error {
+	p, err := m.resolve(path, true)
+	if err != nil {
+		return &fs.PathError{Op: "mkdir", Path: path, Err: err}
+	}
+	_, info, err := m.entry(p)
+	if err == nil {
+		if info.IsDir() {
+			return nil
+		}
+		return &fs.PathError{Op: "mkdir", Path: path, Err: syscall.ENOTDIR}
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return &fs.PathError{Op: "mkdir", Path: path, Err: err}
+	}
+	if parent := filepath.Dir(p); parent != p {
+		if err := m.MkdirAll(parent, perm); err != nil {
+			return err
+		}
+	}
+	m.nodes[p] = &memNode{mode: fs.ModeDir | perm.Perm(), modTime: time.Now(), opaque: true}
+	m.changed(p)
+	return nil
+}
+
+func (m *memFS) Remove(name string) error {
+	p, _, info, err := m.lookup("remove", name, false)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		entries, err := m.ReadDir(p)
+		if err != nil {
+			return err
+		}
+		if len(entries) > 0 {
+			return &fs.PathError{Op: "remove", Path: name, Err: syscall.ENOTEMPTY}
+		}
+	}
+	m.drop(p)
+	m.nodes[p] = nil
+	m.changed(p)
+	return nil
+}
+
+func (m *memFS) RemoveAll(path string) error {
+	p, _, _, err := m.lookup("unlinkat", path, false)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	m.drop(p)
+	m.nodes[p] = nil
+	m.changed(p)
+	return nil
+}
+
+func (m *memFS) Rename(oldpath, newpath string) error {
+	linkErr := func(err error) error {
+		var pe *fs.PathError
+		if errors.As(err, &pe) {
+			err = pe.Err
+		}
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: err}
+	}
+	po, _, info, err := m.lookup("rename", oldpath, false)
+	if err != nil {
+		return linkErr(err)
+	}
+	pn, err := m.resolve(newpath, false)
+	if err != nil {
+		return linkErr(err)
+	}
+	if po == pn {
+		return nil
+	}
+	if err := m.checkParent("rename", newpath, pn); err != nil {
+		return linkErr(err)
+	}
+	if _, existing, err := m.entry(pn); err == nil {
+		switch {
+		case existing.IsDir() && !info.IsDir():
+			return linkErr(syscall.EISDIR)
+		case !existing.IsDir() && info.IsDir():
+			return linkErr(syscall.ENOTDIR)
+		case existing.IsDir():
+			if entries, err := m.ReadDir(pn); err != nil || len(entries) > 0 {
+				return linkErr(syscall.ENOTEMPTY)
+			}
+		}
+	}
+	if info.IsDir() && strings.HasPrefix(pn, po+string(filepath.Separator)) {
+		return linkErr(syscall.EINVAL)
+	}
+
+	moved, err := m.subtree(po)
+	if err != nil {
+		return linkErr(err)
+	}
+	m.drop(po)
+	m.nodes[po] = nil
+	m.drop(pn)
+	for rel, n := range moved {
+		if n.mode.IsDir() {
+			// Everything below is copied, so the base has nothing to add.
+			n.opaque = true
+		}
+		m.nodes[filepath.Join(pn, rel)] = n
+	}
+	m.changed(po, pn)
+	return nil
+}
+
+// subtree materializes p and everything below it, by path relative to p.
+func (m *memFS) subtree(p string) (map[string]*memNode, error) {
+	n, err := m.materialize(p)
+	if err != nil {
+		return nil, err
+	}
+	out := map[string]*memNode{".": n}
+	if !n.mode.IsDir() {
+		return out, nil
+	}
+	entries, err := m.ReadDir(p)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		sub, err := m.subtree(filepath.Join(p, e.Name()))
+		if err != nil {
+			return nil, err
+		}
+		for rel, c := range sub {
+			out[filepath.Join(e.Name(), rel)] = c
+		}
+	}
+	return out, nil
+}
+
+func (m *memFS) Symlink(oldname, newname string) error {
+	pn, err := m.resolve(newname, false)
+	if err != nil {
+		return &os.LinkError{Op: "symlink", Old: oldname, New: newname, Err: err}
+	}
+	if _, _, err := m.entry(pn); err == nil {
+		return &os.LinkError{Op: "symlink", Old: oldname, New: newname, Err: fs.ErrExist}
+	}
+	if err := m.checkParent("symlink", newname, pn); err != nil {
+		return err
+	}
+	m.nodes[pn] = &memNode{mode: fs.ModeSymlink | 0o777, target: oldname, modTime: time.Now()}
+	m.changed(pn)
+	return nil
+}
+
+func (m *memFS) Link(oldname, newname string) error {
+	linkErr := func(err error) error {
+		return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: err}
+	}
+	po, err := m.resolve(oldname, false)
+	if err != nil {
+		return linkErr(err)
+	}
+	n, err := m.materialize(po)
+	if err != nil {
+		return linkErr(err)
+	}
+	if n.mode.IsDir() {
+		return linkErr(syscall.EPERM)
+	}
+	pn, err := m.resolve(newname, false)
+	if err != nil {
+		return linkErr(err)
+	}
+	if _, _, err := m.entry(pn); err == nil {
+		return linkErr(fs.ErrExist)
+	}
+	if err := m.checkParent("link", newname, pn); err != nil {
+		return err
+	}
+	m.nodes[pn] = n
+	m.changed(pn)
+	return nil
+}
+
+func (m *memFS) Chmod(name string, mode fs.FileMode) error {
+	p, err := m.resolve(name, true)
+	if err != nil {
+		return &fs.PathError{Op: "chmod", Path: name, Err: err}
+	}
+	n, err := m.materialize(p)
+	if err != nil {
+		return &fs.PathError{Op: "chmod", Path: name, Err: err}
+	}
+	n.mode = n.mode&fs.ModeType | mode.Perm()
+	m.changed(p)
+	return nil
+}
+
+func (m *memFS) Chtimes(name string, atime, mtime time.Time) error {
+	p, err := m.resolve(name, true)
+	if err != nil {
+		return &fs.PathError{Op: "chtimes", Path: name, Err: err}
+	}
+	n, err := m.materialize(p)
+	if err != nil {
+		return &fs.PathError{Op: "chtimes", Path: name, Err: err}
+	}
+	n.modTime = mtime
+	m.changed(p)
+	return nil
+}
@@ -0,0 +1,146 @@
+package sync
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeTestFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+}
+
+func TestMemFSLeavesBaseUntouched(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "a", ".env")
+	writeTestFile(t, path, "A=1\n")
+
+	m := newMemFS(osFS{})
+	if err := m.WriteFile(path, []byte("A=2\n"), 0o600); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if err := m.Symlink(path, filepath.Join(dir, "link")); err != nil {
+		t.Fatalf("symlink: %v", err)
+	}
+	if err := m.MkdirAll(filepath.Join(dir, "b", "c"), 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+
+	got, err := m.ReadFile(filepath.Join(dir, "link"))
+	if err != nil || string(got) != "A=2\n" {
+		t.Fatalf("expected the changed file through the link, got %q, %v", got, err)
+	}
+	info, err := m.Stat(path)
+	if err != nil || info.Mode().Perm() != 0o644 {
+		t.Fatalf("expected the base mode to be kept, got %v, %v", info, err)
+	}
+	onDisk, err := os.ReadFile(path)
+	if err != nil || string(onDisk) != "A=1\n" {
+		t.Fatalf("base file changed: %q, %v", onDisk, err)
+	}
+	for _, p := range []string{filepath.Join(dir, "link"), filepath.Join(dir, "b")} {
+		if _, err := os.Lstat(p); !os.IsNotExist(err) {
+			t.Fatalf("expected %s only in memory, got %v", p, err)
+		}
+	}
+}
+
+func TestMemFSRemoveHidesBase(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFile(t, filepath.Join(dir, "d", "x"), "x")
+	writeTestFile(t, filepath.Join(dir, "d", "y"), "y")
+
+	m := newMemFS(osFS{})
+	if err := m.Remove(filepath.Join(dir, "d")); err == nil {
+		t.Fatal("expected removing a non-empty directory to fail")
+	}
+	if err := m.Remove(filepath.Join(dir, "d", "x")); err != nil {
+		t.Fatalf("remove: %v", err)
+	}
+	entries, err := m.ReadDir(filepath.Join(dir, "d"))
+	if err != nil || len(entries) != 1 || entries[0].Name() != "y" {
+		t.Fatalf("expected only y, got %v, %v", entries, err)
+	}
+	if err := m.RemoveAll(filepath.Join(dir, "d")); err != nil {
+		t.Fatalf("remove all: %v", err)
+	}
+	if err := m.MkdirAll(filepath.Join(dir, "d"), 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	entries, err = m.ReadDir(filepath.Join(dir, "d"))
+	if err != nil || len(entries) != 0 {
+		t.Fatalf("expected a recreated directory to be empty, got %v, %v", entries, err)
+	}
+}
+
+func TestMemFSErrorsMatchOS(t *testing.T) {
+	m := newMemFS(nil)
+	if _, err := m.ReadFile("/missing"); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("expected not exist, got %v", err)
+	}
+	if err := m.WriteFile("/no/such/dir/f", nil, 0o644); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("expected not exist for a missing parent, got %v", err)
+	}
+	if err := m.WriteFile("/f", []byte("1"), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if err := m.Symlink("/f", "/f"); !errors.Is(err, fs.ErrExist) {
+		t.Fatalf("expected exist, got %v", err)
+	}
+	if err := m.Symlink("/loop2", "/loop1"); err != nil {
+		t.Fatalf("symlink: %v", err)
+	}
+	if err := m.Symlink("/loop1", "/loop2"); err != nil {
+		t.Fatalf("symlink: %v", err)
+	}
+	if _, err := m.Stat("/loop1"); err == nil {
+		t.Fatal("expected a symlink loop to fail")
+	}
+}
+
+func TestMemFSHardLinksShareContent(t *testing.T) {
+	m := newMemFS(nil)
+	if err := m.WriteFile("/a", []byte("1"), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if err := m.Link("/a", "/b"); err != nil {
+		t.Fatalf("link: %v", err)
+	}
+	if err := m.WriteFile("/a", []byte("2"), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	got, err := m.ReadFile("/b")
+	if err != nil || string(got) != "2" {
+		t.Fatalf("expected the link to see the write, got %q, %v", got, err)
+	}
+	a, _ := m.Stat("/a")
+	b, _ := m.Stat("/b")
+	if !m.SameFile(a, b) {
+		t.Fatal("expected SameFile for hard links")
+	}
+}
+
+func TestMemFSRenameMovesTree(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFile(t, filepath.Join(dir, "old", "sub", "f"), "f")
+
+	m := newMemFS(osFS{})
+	if err := m.Rename(filepath.Join(dir, "old"), filepath.Join(dir, "new")); err != nil {
+		t.Fatalf("rename: %v", err)
+	}
+	if _, err := m.Stat(filepath.Join(dir, "old")); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("expected old to be gone, got %v", err)
+	}
+	got, err := m.ReadFile(filepath.Join(dir, "new", "sub", "f"))
+	if err != nil || string(got) != "f" {
+		t.Fatalf("expected the file under new, got %q, %v", got, err)
+	}
+}
@@ -0,0 +1,480 @@
+package sync
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/aayushgautam/wtm/internal/age"
+	"github.com/aayushgautam/wtm/internal/dotenv"
+	"github.com/aayushgautam/wtm/internal/gitx"
+)
+
+// Push strategies decide conflicts without prompting. "Ours" is the store
+// (what is being pushed), "theirs" the current repo file.
+const (
+	strategyOurs   = "ours"
+	strategyTheirs = "theirs"
+	strategyMerge  = "merge"
+)
+
+const (
+	markerOurs   = "<<<<<<< store"
+	markerSep    = "======="
+	markerTheirs = ">>>>>>> repo"
+)
+
+// Sync preferences decide whose edits win when the store file changed since
+// the last sync and the repo file did too.
+const (
+	preferRepo   = "repo"
+	preferStore  = "store"
+	preferNewest = "newest"
+)
+
+type pushOutcome int
+
+const (
+	pushWritten    pushOutcome = iota // repo file replaced by the store copy
+	pushMerged                        // changes from both sides combined
+	pushConflicted                    // merged, with conflict markers left in
+	pushUnchanged                     // nothing in the store to push
+	pushKept                          // repo file left as is
+)
+
+type storeOutcome int
+
+const (
+	storeWritten  storeOutcome = iota // store file replaced by the repo copy
+	storeMerged                       // repo changes merged into the store edits
+	storeKept                         // store edits kept as they are
+	storeConflict                     // dry run: would have asked
+	storeOverlaid                     // layered: store edits moved into the overlay
+)
+
+// syncStoreFile copies the repo file of it into the store unless the store
+// file was edited since the last sync; then prefer decides, and without a
+// preference force lets the repo file win.
+func (s *session) syncStoreFile(manifests map[string]*storeManifest, repoRoot string, p worktreePlan, it planItem, prefer string, force bool) (storeOutcome, error) {
+	written := func() (storeOutcome, error) {
+		if err := s.withHistory(it, it.syncedAbs(), historySync, func() error { return s.writeStore(it, historySync) }); err != nil {
+			return 0, err
+		}
+		return storeWritten, s.recordSync(manifests, repoRoot, p, it)
+	}
+	if prefer == preferRepo {
+		return written()
+	}
+	stored, err := s.readFile(it.storeAbs)
+	if errors.Is(err, os.ErrNotExist) {
+		return written()
+	}
+	if err != nil {
+		return 0, err
+	}
+	m, err := s.manifestFor(manifests, p.storeRoot)
+	if err != nil {
+		return 0, err
+	}
+	rec := m.Files[it.rel]
+	if rec != nil && s.contentHash(stored) == rec.SHA256 {
+		return written()
+	}
+	if it.overlayAbs != "" {
+		// push only reads the shared base, so edits to the rendered file
+		// are kept by moving them into the overlay.
+		if err := s.foldIntoOverlay(m, it, stored); err != nil {
+			return 0, err
+		}
+		if _, err := written(); err != nil {
+			return 0, err
+		}
+		return storeOverlaid, nil
+	}
+
+	incoming, err := s.incomingContent(it)
+	if err != nil {
+		return 0, err
+	}
+	if bytes.Equal(stored, incoming) {
+		return written()
+	}
+	base, ok, err := m.base(it.rel)
+	if err != nil {
+		return 0, err
+	}
+	if ok && bytes.Equal(base, incoming) {
+		// Only the store changed; push brings the edits into the repo.
+		return storeKept, nil
+	}
+
+	switch prefer {
+	case preferStore:
+		return storeKept, nil
+	case preferNewest:
+		storeInfo, err := s.fs.Stat(it.storeAbs)
+		if err != nil {
+			return 0, fmt.Errorf("stat %s: %w", it.storeAbs, err)
+		}
+		repoInfo, err := s.fs.Stat(it.repoAbs)
+		if err != nil {
+			return 0, fmt.Errorf("stat %s: %w", it.repoAbs, err)
+		}
+		if repoInfo.ModTime().After(storeInfo.ModTime()) {
+			return written()
+		}
+		return storeKept, nil
+	}
+
+	if ok {
+		if merged, err := mergeDotenvClean(base, stored, incoming); err == nil {
+			info, err := s.fs.Stat(it.storeAbs)
+			if err != nil {
+				return 0, fmt.Errorf("stat %s: %w", it.storeAbs, err)
+			}
+			write := func() error { return s.writeFile(it.storeAbs, merged, info.Mode().Perm()) }
+			if err := s.withHistory(it, it.storeAbs, historyMerge, write); err != nil {
+				return 0, err
+			}
+			if err := s.recordSync(manifests, repoRoot, p, it); err != nil {
+				return 0, err
+			}
+			// The store now holds the repo content plus edits push has
+			// yet to bring over, so the repo content is the new base.
+			return storeMerged, m.recordSync(it.rel, incoming, repoRoot, p.worktree)
+		}
+	}
+	switch {
+	case force:
+		return written()
+	case s.dryRun:
+		return storeConflict, nil
+	}
+	fmt.Fprintf(os.Stderr, "%s was edited since the last sync, and %s changed too.\n", it.storeAbs, it.repoAbs)
+	showDiff := func() string { return s.fileDiff(it.storeAbs, it.repoAbs, it.storeAbs, it.repoAbs) }
+	if !s.confirmOverwrite(it.storeAbs, showDiff) {
+		return storeKept, nil
+	}
+	return written()
+}
+
+// foldIntoOverlay writes the variables stored sets differently from the
+// last render of it into the worktree overlay.
+func (s *session) foldIntoOverlay(m *storeManifest, it planItem, stored []byte) error {
+	rendered, ok, err := m.base(it.rel)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		if rendered, err = s.incomingContent(it); err != nil {
+			return err
+		}
+	}
+	refuse := func(why string) error {
+		return fmt.Errorf("%s %s; edit %s or the repo file instead", it.storeAbs, why, it.overlayAbs)
+	}
+	changes, err := dotenvChanges(rendered, stored)
+	if err != nil {
+		return refuse("was edited but is " + err.Error())
+	}
+	edited, err := dotenv.Parse(stored)
+	if err != nil {
+		return refuse("was edited but is not a dotenv file")
+	}
+	overlay, err := s.fs.ReadFile(it.overlayAbs)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("read %s: %w", it.overlayAbs, err)
+	}
+	o, err := dotenv.Parse(overlay)
+	if err != nil {
+		return fmt.Errorf("parse %s: %w", it.overlayAbs, err)
+	}
+	for _, c := range changes {
+		if c.Kind == dotenv.Removed {
+			return refuse("has " + c.Key + " removed, which an overlay cannot do")
+		}
+		e, _ := edited.Lookup(c.Key)
+		o.Put(e)
+	}
+	return s.withHistory(it, it.overlayAbs, historyOverlay, func() error {
+		if err := s.fs.MkdirAll(filepath.Dir(it.overlayAbs), 0o755); err != nil {
+			return fmt.Errorf("mkdir %s: %w", filepath.Dir(it.overlayAbs), err)
+		}
+		if err := s.fs.WriteFile(it.overlayAbs, o.Bytes(), 0o600); err != nil {
+			return fmt.Errorf("write %s: %w", it.overlayAbs, err)
+		}
+		return nil
+	})
+}
+
+// incomingContent is what sync would write into the store for it.
+func (s *session) incomingContent(it planItem) ([]byte, error) {
+	if it.template != nil {
+		return s.templateContent(it, true)
+	}
+	if it.baseAbs == "" {
+		b, err := s.fs.ReadFile(it.repoAbs)
+		if err != nil {
+			return nil, fmt.Errorf("read %s: %w", it.repoAbs, err)
+		}
+		return b, nil
+	}
+	// Render over the repo file rather than the shared base, which is
+	// only brought up to date when the store file is written.
+	fromRepo := it
+	fromRepo.baseAbs = it.repoAbs
+	return s.renderedContent(fromRepo)
+}
+
+// mergeDotenvClean merges the key changes of ours and theirs since base, and
+// fails when the files are not dotenv files or both changed the same key.
+func mergeDotenvClean(base, ours, theirs []byte) ([]byte, error) {
+	b, err := dotenv.Parse(base)
+	if err != nil {
+		return nil, err
+	}
+	o, err := dotenv.Parse(ours)
+	if err != nil {
+		return nil, err
+	}
+	t, err := dotenv.Parse(theirs)
+	if err != nil {
+		return nil, err
+	}
+	merged, conflicts := dotenv.Merge3(b, o, t)
+	if len(conflicts) > 0 {
+		return nil, fmt.Errorf("%d keys changed on both sides", len(conflicts))
+	}
+	return merged.Bytes(), nil
+}
+
+// pushItem merges the store copy of it into the repo and records the
+// pushed content in m.
+func (s *session) pushItem(m *storeManifest, repoRoot string, wt gitx.Worktree, it planItem, strategy string) (pushOutcome, error) {
+	raw, err := s.fs.ReadFile(it.storeAbs)
+	if err != nil {
+		return 0, fmt.Errorf("read %s: %w", it.storeAbs, err)
+	}
+	ours, err := s.cipher.open(raw)
+	if err != nil {
+		return 0, fmt.Errorf("decrypt %s: %w", it.storeAbs, err)
+	}
+	// Plain store files are copied so their mode and mtime carry over.
+	writeOurs := func() error {
+		if age.IsEncrypted(raw) {
+			return s.writeRepoFile(it.repoAbs, ours)
+		}
+		return s.copyStoreToRepo(it.storeAbs, it.repoAbs, true)
+	}
+
+	theirs, err := s.fs.ReadFile(it.repoAbs)
+	if errors.Is(err, os.ErrNotExist) {
+		if err := writeOurs(); err != nil {
+			return 0, err
+		}
+		return pushWritten, m.recordPush(it.rel, ours, repoRoot, wt)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("read %s: %w", it.repoAbs, err)
+	}
+	if bytes.Equal(ours, theirs) {
+		return pushUnchanged, m.recordPush(it.rel, ours, repoRoot, wt)
+	}
+
+	base, ok, err := m.base(it.rel)
+	if err != nil {
+		return 0, err
+	}
+	if ok && bytes.Equal(base, theirs) {
+		if err := writeOurs(); err != nil {
+			return 0, err
+		}
+		return pushWritten, m.recordPush(it.rel, ours, repoRoot, wt)
+	}
+	if ok && bytes.Equal(base, ours) {
+		fmt.Fprintln(os.Stderr, "Repo is newer:", it.repoAbs)
+		return pushUnchanged, nil
+	}
+
+	if ok {
+		if merged, outcome, err := s.mergeDotenvPush(it, base, ours, theirs, strategy); err == nil {
+			if err := s.writeRepoFile(it.repoAbs, merged); err != nil {
+				return 0, err
+			}
+			return outcome, m.recordPush(it.rel, ours, repoRoot, wt)
+		}
+	}
+
+	// Without a base, or for files that are not dotenv, the whole file is
+	// one conflict.
+	switch strategy {
+	case strategyTheirs:
+		return pushKept, nil
+	case strategyMerge:
+		var b strings.Builder
+		writeConflict(&b, string(ours), string(theirs), "\n")
+		if err := s.writeRepoFile(it.repoAbs, []byte(b.String())); err != nil {
+			return 0, err
+		}
+		return pushConflicted, m.recordPush(it.rel, ours, repoRoot, wt)
+	case "":
+		if s.dryRun {
+			return pushConflicted, nil
+		}
+		showDiff := func() string { return s.fileDiff(it.repoAbs, it.storeAbs, it.repoAbs, it.storeAbs) }
+		if !s.confirmOverwrite(it.repoAbs, showDiff) {
+			return pushKept, nil
+		}
+	}
+	if err := writeOurs(); err != nil {
+		return 0, err
+	}
+	return pushWritten, m.recordPush(it.rel, ours, repoRoot, wt)
+}
+
+// mergeDotenvPush merges the key changes of ours and theirs since base.
+func (s *session) mergeDotenvPush(it planItem, base, ours, theirs []byte, strategy string) ([]byte, pushOutcome, error) {
+	b, err := dotenv.Parse(base)
+	if err != nil {
+		return nil, 0, err
+	}
+	o, err := dotenv.Parse(ours)
+	if err != nil {
+		return nil, 0, err
+	}
+	t, err := dotenv.Parse(theirs)
+	if err != nil {
+		return nil, 0, err
+	}
+	merged, conflicts := dotenv.Merge3(b, o, t)
+
+	marked := make(map[string]dotenv.Conflict)
+	for _, c := range conflicts {
+		choice := strategy
+		switch {
+		case choice == "" && s.dryRun:
+			choice = strategyMerge
+		case choice == "":
+			choice = s.promptConflict(it.rel, c)
+		}
+		switch choice {
+		case strategyOurs:
+			if c.Ours == nil {
+				merged.Delete(c.Key)
+			} else {
+				merged.Put(*c.Ours)
+			}
+		case strategyMerge:
+			marked[c.Key] = c
+		}
+	}
+	if len(marked) > 0 {
+		return renderConflicts(merged, marked), pushConflicted, nil
+	}
+	return merged.Bytes(), pushMerged, nil
+}
+
+func (s *session) promptConflict(rel string, c dotenv.Conflict) string {
+	show := func(e *dotenv.Entry) string {
+		if e == nil {
+			return "(unset)"
+		}
+		return e.Value
+	}
+	fmt.Fprintf(os.Stderr, "Conflict in %s on %s:\n  store: %s\n  repo:  %s\n", rel, c.Key, show(c.Ours), show(c.Theirs))
+	for {
+		switch strings.ToLower(strings.TrimSpace(s.prompter.prompt("Keep [o]urs (store), [t]heirs (repo) or write conflict [m]arkers? [o/t/M] "))) {
+		case "o", "ours":
+			return strategyOurs
+		case "t", "theirs":
+			return strategyTheirs
+		case "", "m", "markers":
+			return strategyMerge
+		}
+	}
+}
+
+// renderConflicts serializes f with the last assignment of every marked key
+// replaced by a conflict block. Keys f no longer has are appended.
+func renderConflicts(f *dotenv.File, marked map[string]dotenv.Conflict) []byte {
+	entries := f.Entries()
+	last := make(map[string]int)
+	for i, e := range entries {
+		if e.Kind == dotenv.Assignment {
+			last[e.Key] = i
+		}
+	}
+	nl := "\n"
+	if len(entries) > 0 && strings.HasSuffix(entries[0].Raw(), "\r\n") {
+		nl = "\r\n"
+	}
+
+	var b strings.Builder
+	for i, e := range entries {
+		if c, ok := marked[e.Key]; ok && e.Kind == dotenv.Assignment && last[e.Key] == i {
+			writeConflict(&b, entryLine(c.Ours, nl), entryLine(c.Theirs, nl), nl)
+			continue
+		}
+		b.WriteString(e.Raw())
+	}
+	for _, c := range sortedConflicts(marked) {
+		if _, ok := last[c.Key]; ok {
+			continue
+		}
+		if b.Len() > 0 && !strings.HasSuffix(b.String(), "\n") {
+			b.WriteString(nl)
+		}
+		writeConflict(&b, entryLine(c.Ours, nl), entryLine(c.Theirs, nl), nl)
+	}
+	return []byte(b.String())
+}
+
+func writeConflict(b *strings.Builder, ours, theirs, nl string) {
+	b.WriteString(markerOurs + nl)
+	b.WriteString(ours)
+	if ours != "" && !strings.HasSuffix(ours, "\n") {
+		b.WriteString(nl)
+	}
+	b.WriteString(markerSep + nl)
+	b.WriteString(theirs)
+	if theirs != "" && !strings.HasSuffix(theirs, "\n") {
+		b.WriteString(nl)
+	}
+	b.WriteString(markerTheirs + nl)
+}
+
+func entryLine(e *dotenv.Entry, nl string) string {
+	if e == nil {
+		return ""
+	}
+	return strings.TrimRight(e.Raw(), "\r\n") + nl
+}
+
+func sortedConflicts(marked map[string]dotenv.Conflict) []dotenv.Conflict {
+	out := make([]dotenv.Conflict, 0, len(marked))
+	for _, c := range marked {
+		out = append(out, c)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Key < out[j].Key })
+	return out
+}
+
+// writeRepoFile replaces the repo file at path with content, keeping the
+// mode of the file it replaces.
+func (s *session) writeRepoFile(path string, content []byte) error {
+	perm := os.FileMode(0o644)
+	if info, err := s.fs.Stat(path); err == nil {
+		perm = info.Mode().Perm()
+	}
+	if err := s.fs.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return fmt.Errorf("mkdir %s: %w", filepath.Dir(path), err)
+	}
+	if err := s.fs.WriteFile(path, content, perm); err != nil {
+		return fmt.Errorf("write %s: %w", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,479 @@
+package sync
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/aayushgautam/wtm/internal/config"
+	"github.com/aayushgautam/wtm/internal/gitx"
+)
+
+// migrateStore moves every store to opts.to and repoints worktree links.
+func (s *session) migrateStore(opts storeOptions) error {
+	if dir := os.Getenv(homeEnv); dir != "" {
+		return fmt.Errorf("%s is set to %s and takes precedence over store.root; unset it, or move %s yourself", homeEnv, dir, filepath.Join(dir, storeSubDir))
+	}
+	oldBase, err := storeBase()
+	if err != nil {
+		return err
+	}
+	newBase, err := config.ExpandHome(opts.to)
+	if err != nil {
+		return err
+	}
+	if newBase, err = filepath.Abs(newBase); err != nil {
+		return err
+	}
+	if samePath(oldBase, newBase) {
+		fmt.Fprintln(os.Stderr, "Stores already live in", newBase+"; nothing to do.")
+		return nil
+	}
+	if within(newBase, oldBase) || within(oldBase, newBase) {
+		return fmt.Errorf("cannot move %s to %s: one contains the other", oldBase, newBase)
+	}
+	if entries, err := s.fs.ReadDir(newBase); err == nil && len(entries) > 0 {
+		return fmt.Errorf("%s already exists and is not empty", newBase)
+	} else if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("%s: %w", newBase, err)
+	}
+
+	_, statErr := s.fs.Stat(oldBase)
+	oldExists := statErr == nil
+	var relinks []relinkEntry
+	if oldExists {
+		relinks, err = s.migrateLinks(opts.repoHint, oldBase, newBase)
+		if err != nil {
+			return err
+		}
+	}
+
+	fmt.Fprintln(os.Stderr, "Stores:", oldBase)
+	fmt.Fprintln(os.Stderr, "Move to:", newBase)
+	if !oldExists {
+		fmt.Fprintln(os.Stderr, "No stores yet; only store.root will be set.")
+	}
+	for _, r := range relinks {
+		fmt.Fprintf(os.Stdout, "%s -> %s\n", r.link, r.target)
+	}
+	fmt.Fprintf(os.Stderr, "Links to update: %d\n", len(relinks))
+
+	if !opts.yes {
+		if !s.confirm("Proceed? [y/N] ") {
+			fmt.Fprintln(os.Stderr, "Aborted.")
+			return nil
+		}
+	}
+
+	copied := false
+	if oldExists {
+		if copied, err = s.moveDir(oldBase, newBase); err != nil {
+			return err
+		}
+	} else if err := s.fs.MkdirAll(newBase, 0o755); err != nil {
+		return fmt.Errorf("mkdir %s: %w", newBase, err)
+	}
+
+	// Any failure from here on puts the links and the stores back, so no
+	// link is left pointing at the wrong place.
+	var done []relinkEntry
+	rollback := func(cause error) error {
+		for i := len(done) - 1; i >= 0; i-- {
+			if err := s.replaceSymlink(done[i].target, done[i].link); err != nil {
+				fmt.Fprintln(os.Stderr, "Error restoring link:", err)
+			}
+		}
+		if oldExists {
+			if _, err := s.moveDir(newBase, oldBase); err != nil {
+				return fmt.Errorf("%w; moving the stores back also failed: %v", cause, err)
+			}
+		}
+		return fmt.Errorf("%w; the stores were left in %s", cause, oldBase)
+	}
+	for _, r := range relinks {
+		current, err := s.fs.Readlink(r.link)
+		if err != nil {
+			return rollback(fmt.Errorf("readlink %s: %w", r.link, err))
+		}
+		target := r.target
+		if !filepath.IsAbs(current) {
+			if target, err = s.symlinkTarget(r.target, r.link, true); err != nil {
+				return rollback(err)
+			}
+		}
+		if err := s.replaceSymlink(target, r.link); err != nil {
+			return rollback(err)
+		}
+		done = append(done, relinkEntry{link: r.link, target: current})
+	}
+
+	cfgPath, err := config.SetUserStoreRoot(newBase)
+	if err != nil {
+		return rollback(err)
+	}
+	fmt.Fprintln(os.Stderr, "Set store.root in", cfgPath)
+	fmt.Fprintf(os.Stderr, "Done. Moved stores to %s, relinked %d.\n", newBase, len(done))
+	if copied {
+		fmt.Fprintln(os.Stderr, "The stores were copied to another file system, so hard links into them were lost; run \"wtm sync\" to recreate them.")
+	}
+	return nil
+}
+
+// migrateLinks pairs the symlinks in the worktrees of every known repo that
+// point into oldBase with their targets under newBase. Repos are known from
+// the store manifests and repoHint; a store directory of any other repo is
+// reported, as links into it cannot be found.
+func (s *session) migrateLinks(repoHint, oldBase, newBase string) ([]relinkEntry, error) {
+	repos, err := s.manifestRepos(oldBase)
+	if err != nil {
+		return nil, err
+	}
+	if root, err := s.git.RepoRoot(repoHint); err == nil && !containsString(repos, root) {
+		repos = append(repos, root)
+	}
+
+	known := make(map[string]bool)
+	seen := make(map[string]bool)
+	var relinks []relinkEntry
+	for _, repo := range repos {
+		known[repoSlug(repo)] = true
+		wts, err := s.git.ListWorktrees(repo)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Skipping links of %s: %v\n", repo, err)
+			continue
+		}
+		for _, wt := range wts {
+			if wt.Prunable {
+				continue
+			}
+			err := s.walkRepoFiles(wt.Path, func(link, _ string) error {
+				if seen[link] {
+					return nil
+				}
+				seen[link] = true
+				info, err := s.fs.Lstat(link)
+				if err != nil || info.Mode()&os.ModeSymlink == 0 {
+					return nil
+				}
+				target, err := s.readLinkAbs(link)
+				if err != nil || !within(target, oldBase) {
+					return nil
+				}
+				rel, err := filepath.Rel(oldBase, target)
+				if err != nil {
+					return err
+				}
+				relinks = append(relinks, relinkEntry{link: link, target: filepath.Join(newBase, rel)})
+				return nil
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	entries, err := s.fs.ReadDir(oldBase)
+	if err != nil {
+		return nil, fmt.Errorf("read %s: %w", oldBase, err)
+	}
+	for _, e := range entries {
+		if e.IsDir() && !known[e.Name()] && !strings.HasPrefix(e.Name(), metaDirPrefix) {
+			fmt.Fprintf(os.Stderr, "Warning: no repo is known for %s, so links into it are not updated; run \"wtm relink\" in its worktrees afterwards.\n", filepath.Join(oldBase, e.Name()))
+		}
+	}
+	return relinks, nil
+}
+
+// manifestRepos returns the repos recorded in the manifests of every store
+// under base.
+func (s *session) manifestRepos(base string) ([]string, error) {
+	var repos []string
+	err := walkDir(s.fs, base, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if path != base && strings.HasPrefix(d.Name(), metaDirPrefix) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.Name() != manifestName {
+			return nil
+		}
+		m, err := s.loadManifest(filepath.Dir(path))
+		if err != nil {
+			return err
+		}
+		for _, f := range m.Files {
+			if f.Repo != "" && !containsString(repos, f.Repo) {
+				repos = append(repos, f.Repo)
+			}
+		}
+		return nil
+	})
+	return repos, err
+}
+
+// walkStoreFiles calls fn for every file mirrored from a repo below root,
+// with its path relative to root. A missing root has no files.
+func (s *session) walkStoreFiles(root string, fn func(path, rel string) error) error {
+	return walkDir(s.fs, root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && path == root {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		if d.IsDir() {
+			if path != root && strings.HasPrefix(d.Name(), metaDirPrefix) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if strings.HasPrefix(d.Name(), metaDirPrefix) {
+			return nil
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		return fn(path, rel)
+	})
+}
+
+// moveDir renames src to dst. Across file systems it copies src next to dst,
+// renames the copy into place and then deletes src; copied reports that.
+func (s *session) moveDir(src, dst string) (copied bool, err error) {
+	if err := s.fs.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		return false, fmt.Errorf("mkdir %s: %w", filepath.Dir(dst), err)
+	}
+	// An empty directory at dst is replaced.
+	_ = s.fs.Remove(dst)
+	err = s.fs.Rename(src, dst)
+	if err == nil {
+		return false, nil
+	}
+	if !errors.Is(err, syscall.EXDEV) {
+		return false, fmt.Errorf("move %s to %s: %w", src, dst, err)
+	}
+
+	tmp := dst + ".wtm-tmp"
+	_ = s.fs.RemoveAll(tmp)
+	if err := s.copyTree(src, tmp); err != nil {
+		_ = s.fs.RemoveAll(tmp)
+		return false, err
+	}
+	if err := s.fs.Rename(tmp, dst); err != nil {
+		_ = s.fs.RemoveAll(tmp)
+		return false, fmt.Errorf("rename %s -> %s: %w", tmp, dst, err)
+	}
+	if err := s.fs.RemoveAll(src); err != nil {
+		return true, fmt.Errorf("remove %s: %w", src, err)
+	}
+	return true, nil
+}
+
+// copyTree copies the directories, regular files and symlinks below src to
+// dst, keeping modes and modification times.
+func (s *session) copyTree(src, dst string) error {
+	return walkDir(s.fs, src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		switch {
+		case info.IsDir():
+			if err := s.fs.MkdirAll(target, info.Mode().Perm()); err != nil {
+				return fmt.Errorf("mkdir %s: %w", target, err)
+			}
+		case info.Mode()&os.ModeSymlink != 0:
+			link, err := s.fs.Readlink(path)
+			if err != nil {
+				return fmt.Errorf("readlink %s: %w", path, err)
+			}
+			if err := s.fs.Symlink(link, target); err != nil {
+				return fmt.Errorf("symlink %s: %w", target, err)
+			}
+		case info.Mode().IsRegular():
+			if err := s.copyFileContents(path, target); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// moveLegacyStores moves the store of each worktree outside repoRoot from
+// where older versions kept it: beside the repo's store directory, or inside
+// it without the parent hop. A store moves only when its manifest or the
+// worktree's links show it belongs to that worktree.
+func (s *session) moveLegacyStores(repoRoot string, wts []gitx.Worktree, mode string) error {
+	if mode == config.StoreModeShared {
+		return nil
+	}
+	base, err := storeBase()
+	if err != nil {
+		return err
+	}
+	live := make(map[string]bool)
+	liveKeys := make(map[string]bool)
+	for _, wt := range wts {
+		if !wt.Prunable {
+			live[storeRootIn(base, repoRoot, wt, mode)] = true
+			liveKeys[portKey(repoRoot, wt)] = true
+		}
+	}
+
+	var ports *portTable
+	for _, wt := range wts {
+		if wt.Prunable || samePath(repoRoot, wt.Path) {
+			continue
+		}
+		segments := worktreePathSegments(repoRoot, wt)
+		if !containsString(segments, parentSegment) {
+			continue
+		}
+		root := storeRootIn(base, repoRoot, wt, mode)
+		if _, err := s.fs.Lstat(root); err == nil {
+			continue
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+		for _, old := range legacyStoreRoots(base, repoRoot, segments) {
+			if !s.legacyStoreOf(old, wt, live) {
+				continue
+			}
+			if err := s.moveStore(old, root, wt); err != nil {
+				return err
+			}
+			s.removeEmptyParents(filepath.Dir(old), base)
+			fmt.Fprintf(os.Stderr, "Moved store %s to %s\n", old, root)
+
+			if ports == nil {
+				if ports, err = s.loadPorts(repoRoot); err != nil {
+					return err
+				}
+			}
+			key := portKey(repoRoot, wt)
+			oldKey := strings.Join(legacySegments(segments, false), "/")
+			if p, ok := ports.Worktrees[oldKey]; ok && !liveKeys[oldKey] && ports.Worktrees[key] == nil {
+				delete(ports.Worktrees, oldKey)
+				ports.Worktrees[key] = p
+				ports.changed = true
+			}
+			break
+		}
+	}
+	if ports != nil && ports.changed {
+		return ports.save(s.fs)
+	}
+	return nil
+}
+
+// legacyStoreRoots returns where older versions kept the store of the
+// worktree at segments: without the parent hops, then with them resolved.
+func legacyStoreRoots(base, repoRoot string, segments []string) []string {
+	var roots []string
+	prefix := []string{base, repoSlug(repoRoot)}
+	if collapsed := legacySegments(segments, false); len(collapsed) > 0 {
+		roots = append(roots, filepath.Join(append(prefix, collapsed...)...))
+	}
+	if resolved := filepath.Join(append(prefix, legacySegments(segments, true)...)...); within(resolved, base) {
+		roots = append(roots, resolved)
+	}
+	return roots
+}
+
+// legacySegments drops the parent hops from segments, or with hops turns
+// them back into "..".
+func legacySegments(segments []string, hops bool) []string {
+	out := make([]string, 0, len(segments))
+	for _, seg := range segments {
+		switch {
+		case seg != parentSegment:
+			out = append(out, seg)
+		case hops:
+			out = append(out, "..")
+		}
+	}
+	return out
+}
+
+// legacyStoreOf reports whether dir is an old store of wt: no live worktree
+// uses it and either its manifest names wt or a link of wt points into it.
+func (s *session) legacyStoreOf(dir string, wt gitx.Worktree, live map[string]bool) bool {
+	for root := range live {
+		if samePath(root, dir) || within(root, dir) {
+			return false
+		}
+	}
+	if info, err := s.fs.Stat(dir); err != nil || !info.IsDir() {
+		return false
+	}
+	m, err := s.loadManifest(dir)
+	if err != nil {
+		return false
+	}
+	if owners := m.worktrees(); len(owners) > 0 {
+		for _, owner := range owners {
+			if samePath(owner, wt.Path) {
+				return true
+			}
+		}
+		return false
+	}
+	linked := false
+	_ = s.walkStoreFiles(dir, func(path, rel string) error {
+		link := filepath.Join(wt.Path, rel)
+		if s.sameFile(link, path) {
+			linked = true
+			return filepath.SkipAll
+		}
+		return nil
+	})
+	return linked
+}
+
+// moveStore renames the store at old to root and repoints the symlinks of
+// wt into it. Hard links and copies survive the rename.
+func (s *session) moveStore(old, root string, wt gitx.Worktree) error {
+	if err := s.fs.MkdirAll(filepath.Dir(root), 0o755); err != nil {
+		return fmt.Errorf("mkdir %s: %w", filepath.Dir(root), err)
+	}
+	if err := s.fs.Rename(old, root); err != nil {
+		return fmt.Errorf("move %s to %s: %w", old, root, err)
+	}
+	return s.walkStoreFiles(root, func(path, rel string) error {
+		link := filepath.Join(wt.Path, rel)
+		if _, ok := s.linkToRepoint(link, filepath.Join(old, rel), path); !ok {
+			return nil
+		}
+		target := path
+		if current, err := s.fs.Readlink(link); err == nil && !filepath.IsAbs(current) {
+			var err error
+			if target, err = s.symlinkTarget(path, link, true); err != nil {
+				return err
+			}
+		}
+		return s.replaceSymlink(target, link)
+	})
+}
+
+// within reports whether path is below dir.
+func within(path, dir string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != "." && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
@@ -0,0 +1,184 @@
+package sync
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/aayushgautam/wtm/internal/config"
+)
+
+// crossDeviceFS fails renames out of dir the way os.Rename does between
+// file systems.
+type crossDeviceFS struct {
+	*memFS
+	dir string
+}
+
+func (c crossDeviceFS) Rename(oldpath, newpath string) error {
+	if oldpath == c.dir {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: syscall.EXDEV}
+	}
+	return c.memFS.Rename(oldpath, newpath)
+}
+
+func TestStoreBasePrefersWTMHome(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	if _, err := config.SetUserStoreRoot("/vault"); err != nil {
+		t.Fatalf("set store.root: %v", err)
+	}
+	if base, err := storeBase(); err != nil || base != "/wtm/configs" {
+		t.Fatalf("expected WTM_HOME to win, got %s (%v)", base, err)
+	}
+	e := newTestEnv(t)
+	if err := e.session().migrateStore(storeOptions{to: "/elsewhere", yes: true}); err == nil {
+		t.Fatal("expected migrate to refuse while WTM_HOME is set")
+	}
+
+	t.Setenv(homeEnv, "")
+	if base, err := storeBase(); err != nil || base != "/vault" {
+		t.Fatalf("expected store.root without WTM_HOME, got %s (%v)", base, err)
+	}
+}
+
+func TestMoveDirCopiesAcrossFileSystems(t *testing.T) {
+	e := newTestEnv(t)
+	src, dst := "/disk1/configs", "/disk2/configs"
+	e.write(filepath.Join(src, "app/_up/app-feat/.env"), "A=1\n")
+	if err := e.fs.Chmod(filepath.Join(src, "app/_up/app-feat/.env"), 0o600); err != nil {
+		t.Fatalf("chmod: %v", err)
+	}
+	if err := e.fs.Symlink("_up/app-feat", filepath.Join(src, "app/feat")); err != nil {
+		t.Fatalf("symlink: %v", err)
+	}
+	s := e.session()
+	s.fs = crossDeviceFS{memFS: e.fs, dir: src}
+
+	copied, err := s.moveDir(src, dst)
+	if err != nil || !copied {
+		t.Fatalf("expected a copy, got %v (copied %v)", err, copied)
+	}
+	if e.exists(src) || e.exists(dst+".wtm-tmp") {
+		t.Fatal("expected the source and the temporary copy to be gone")
+	}
+	info, err := e.fs.Stat(filepath.Join(dst, "app/_up/app-feat/.env"))
+	if err != nil || info.Mode().Perm() != 0o600 {
+		t.Fatalf("expected the file to keep its mode, got %v (%v)", info, err)
+	}
+	if target, err := e.fs.Readlink(filepath.Join(dst, "app/feat")); err != nil || target != "_up/app-feat" {
+		t.Fatalf("expected the symlink to be copied as is, got %q (%v)", target, err)
+	}
+
+	if copied, err := s.moveDir(dst, "/disk2/moved"); err != nil || copied {
+		t.Fatalf("expected a plain rename, got %v (copied %v)", err, copied)
+	}
+}
+
+func TestMigrateStoreRepointsLinks(t *testing.T) {
+	useDataHome(t)
+	e := newTestEnv(t)
+	e.write(e.repo(".env"), "A=1\n")
+	wantExit(t, e.sync("--worktree", "2", "--yes"), 0)
+	e.cfg.Symlinks = config.SymlinksRelative
+	wantExit(t, e.sync("--worktree", "3", "--yes"), 0)
+	e.cfg.Symlinks = config.SymlinksAbsolute
+	old := e.store(2, ".env")
+
+	relinks, err := e.session().migrateLinks("", "/data/wtm/configs", "/vault")
+	if err != nil {
+		t.Fatalf("migrate links: %v", err)
+	}
+	if len(relinks) != 2 {
+		t.Fatalf("expected both worktree links, got %+v", relinks)
+	}
+
+	if err := e.session().migrateStore(storeOptions{to: "/vault", yes: true}); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	if e.exists(old) {
+		t.Fatalf("expected %s to be moved", old)
+	}
+	if base, err := storeBase(); err != nil || base != "/vault" {
+		t.Fatalf("expected store.root to be set, got %s (%v)", base, err)
+	}
+	e.wantLink(2, ".env")
+	target, err := e.fs.Readlink(e.wt(3, ".env"))
+	if err != nil || filepath.IsAbs(target) {
+		t.Fatalf("expected the relative link to stay relative, got %q (%v)", target, err)
+	}
+	if got := e.read(e.wt(3, ".env")); got != "A=1\n" {
+		t.Fatalf("expected the relative link to resolve, got %q", got)
+	}
+}
+
+// failingSymlinkFS fails to create the symlink that replaces link.
+type failingSymlinkFS struct {
+	*memFS
+	link string
+}
+
+func (f failingSymlinkFS) Symlink(oldname, newname string) error {
+	if newname == f.link+".wtm-tmp" {
+		return &os.LinkError{Op: "symlink", Old: oldname, New: newname, Err: syscall.EACCES}
+	}
+	return f.memFS.Symlink(oldname, newname)
+}
+
+// useDataHome makes /data/wtm the wtm home, with no store.root set.
+func useDataHome(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv("XDG_DATA_HOME", "/data")
+	t.Setenv(homeEnv, "")
+}
+
+func TestMigrateStoreRepointsLinksWithoutManifest(t *testing.T) {
+	useDataHome(t)
+	e := newTestEnv(t)
+	// A store written by an older wtm, without a manifest and not where
+	// the store of the worktree is now.
+	e.write("/data/wtm/configs/app/app-feat/.env", "A=1\n")
+	if err := e.fs.Symlink("/data/wtm/configs/app/app-feat/.env", e.wt(2, ".env")); err != nil {
+		t.Fatalf("symlink: %v", err)
+	}
+	e.write("/data/wtm/configs/other/worktree/.env", "B=2\n")
+
+	if err := e.session().migrateStore(storeOptions{to: "/vault", yes: true}); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	if target, err := e.fs.Readlink(e.wt(2, ".env")); err != nil || target != "/vault/app/app-feat/.env" {
+		t.Fatalf("expected the link repointed, got %q (%v)", target, err)
+	}
+	if got := e.read("/vault/other/worktree/.env"); got != "B=2\n" {
+		t.Fatalf("expected the other repo's store to move too, got %q", got)
+	}
+}
+
+func TestMigrateStoreRollsBackFailedRelink(t *testing.T) {
+	useDataHome(t)
+	e := newTestEnv(t)
+	e.write(e.repo(".env"), "A=1\n")
+	wantExit(t, e.sync("--all", "--yes"), 0)
+	old2, old3 := e.store(2, ".env"), e.store(3, ".env")
+
+	s := e.session()
+	s.fs = failingSymlinkFS{memFS: e.fs, link: e.wt(3, ".env")}
+	if err := s.migrateStore(storeOptions{to: "/vault", yes: true}); err == nil {
+		t.Fatal("expected the failed relink to fail the migration")
+	}
+	if base, err := storeBase(); err != nil || base != "/data/wtm/configs" {
+		t.Fatalf("expected store.root to stay unset, got %s (%v)", base, err)
+	}
+	if e.exists(filepath.Join("/vault", "app")) {
+		t.Fatal("expected the stores to be moved back")
+	}
+	for n, old := range map[int]string{2: old2, 3: old3} {
+		if target, err := e.fs.Readlink(e.wt(n, ".env")); err != nil || target != old {
+			t.Fatalf("worktree %d: expected the link to %s back, got %q (%v)", n, old, target, err)
+		}
+	}
+	if got := e.read(e.wt(2, ".env")); got != "A=1\n" {
+		t.Fatalf("expected the restored link to resolve, got %q", got)
+	}
+}
@@ -0,0 +1,226 @@
+package sync
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Formats accepted by --output.
+const (
+	outputText   = "text"
+	outputJSON   = "json"
+	outputNDJSON = "ndjson"
+)
+
+// Exit codes for outcomes other than success (0) and errors (1).
+const (
+	ExitNothingToDo = 3 // nothing matched, so nothing was done
+	ExitPartial     = 4 // some entries were skipped, failed or conflicted
+	ExitAborted     = 5 // the confirmation prompt was declined
+)
+
+// Outcomes reported in summaries, matching the exit codes.
+const (
+	outcomeOK          = "ok"
+	outcomeNothingToDo = "nothing-to-do"
+	outcomePartial     = "partial"
+	outcomeAborted     = "aborted"
+)
+
+// exitError carries an exit code for main. An empty msg prints nothing.
+type exitError struct {
+	code int
+	msg  string
+}
+
+func (e exitError) Error() string {
+	return e.msg
+}
+
+// ExitCode returns the process exit code for an error returned by a
+// command: the code of an exitError, else 1.
+func ExitCode(err error) int {
+	var e exitError
+	if errors.As(err, &e) {
+		return e.code
+	}
+	return 1
+}
+
+// outcomeError returns the error a command ends with for outcome, or nil
+// for outcomeOK. msg is printed by main unless empty.
+func outcomeError(outcome, msg string) error {
+	switch outcome {
+	case outcomeNothingToDo:
+		return exitError{code: ExitNothingToDo, msg: msg}
+	case outcomePartial:
+		return exitError{code: ExitPartial, msg: msg}
+	case outcomeAborted:
+		return exitError{code: ExitAborted, msg: msg}
+	}
+	return nil
+}
+
+func validOutput(format string) error {
+	switch format {
+	case outputText, outputJSON, outputNDJSON:
+		return nil
+	}
+	return fmt.Errorf("invalid --output %q (want %s, %s or %s)", format, outputText, outputJSON, outputNDJSON)
+}
+
+// listKeys names the JSON list each record type is collected into.
+var listKeys = map[string]string{
+	"plan":    "plan",
+	"result":  "results",
+	"entry":   "entries",
+	"store":   "stores",
+	"version": "versions",
+}
+
+// reporter writes a command's json or ndjson output; in text mode it
+// writes nothing.
+type reporter struct {
+	format  string
+	w       io.Writer
+	command string
+	lists   map[string][]json.RawMessage
+}
+
+func newReporter(format, command string, w io.Writer) *reporter {
+	return &reporter{format: format, w: w, command: command, lists: make(map[string][]json.RawMessage)}
+}
+
+// machine reports whether the command should skip its text output.
+func (r *reporter) machine() bool {
+	return r.format == outputJSON || r.format == outputNDJSON
+}
+
+// add records v, a struct with JSON tags, under typ ("plan", "result",
+// "entry", "store", "version" or "summary").
+func (r *reporter) add(typ string, v interface{}) error {
+	if !r.machine() {
+		return nil
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if r.format == outputNDJSON {
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal(b, &fields); err != nil {
+			return err
+		}
+		fields["type"], _ = json.Marshal(typ)
+		line, err := json.Marshal(fields)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(r.w, "%s\n", line)
+		return err
+	}
+	key := listKeys[typ]
+	if key == "" {
+		key = typ
+	}
+	r.lists[key] = append(r.lists[key], b)
+	return nil
+}
+
+// summary is the last record of a command's output. exit turns it into the
+// error the command ends with.
+type summary interface {
+	exit() error
+}
+
+// finish writes sum and turns its outcome into the command's exit status.
+func finish(rep *reporter, sum summary) error {
+	if err := rep.finish(sum); err != nil {
+		return err
+	}
+	return sum.exit()
+}
+
+// finish writes the summary record and, for json, the whole document.
+func (r *reporter) finish(summary summary) error {
+	if !r.machine() {
+		return nil
+	}
+	if r.format == outputNDJSON {
+		return r.add("summary", summary)
+	}
+	doc := map[string]interface{}{"command": r.command, "summary": summary}
+	for key, list := range r.lists {
+		doc[key] = list
+	}
+	b, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(r.w, "%s\n", b)
+	return err
+}
+
+// jsonPlanItem is one planned entry of sync or push.
+type jsonPlanItem struct {
+	Worktree    string `json:"worktree"`
+	Rel         string `json:"rel"`
+	RepoAbs     string `json:"repoAbs"`
+	StoreAbs    string `json:"storeAbs"`
+	WorktreeAbs string `json:"worktreeAbs"`
+	Link        string `json:"link,omitempty"`
+}
+
+func newJSONPlanItem(worktree string, it planItem) jsonPlanItem {
+	return jsonPlanItem{
+		Worktree:    worktree,
+		Rel:         it.rel,
+		RepoAbs:     it.repoAbs,
+		StoreAbs:    it.storeAbs,
+		WorktreeAbs: it.worktreeAbs,
+		Link:        it.link,
+	}
+}
+
+// itemResult is what happened to one planned entry.
+type itemResult struct {
+	Worktree string `json:"worktree"`
+	Rel      string `json:"rel"`
+	Action   string `json:"action"`
+	Reason   string `json:"reason,omitempty"`
+	// Store is set when sync kept or merged edits made to the store file.
+	Store string `json:"store,omitempty"`
+}
+
+// Actions reported in item results.
+const (
+	actionCopied    = "copied"    // written into the worktree as a copy, or into the repo by push
+	actionLinked    = "linked"    // linked into the worktree
+	actionMerged    = "merged"    // push merged store and repo changes
+	actionConflict  = "conflict"  // push left conflict markers
+	actionUnchanged = "unchanged" // already up to date
+	actionSkipped   = "skipped"   // left alone by choice
+	actionDeleted   = "deleted"   // prune removed the store
+	actionRepaired  = "repaired"  // doctor repaired the worktree file
+	actionError     = "error"     // failed; see the reason
+)
+
+// What sync did to a store file edited since the last sync.
+const (
+	storeActionKept     = "kept"     // the edits were kept over the repo file
+	storeActionMerged   = "merged"   // repo changes were merged into them
+	storeActionOverlaid = "overlaid" // layered: the edits were moved into the overlay
+)
+
+// Actions reported by --dry-run for the worktree file of sync and the repo
+// file of push; conflict and error are reported as above.
+const (
+	actionCreateLink = "create-link"  // sync would link or hard link a missing file
+	actionCreateCopy = "create-copy"  // sync would copy a missing file
+	actionCreateFile = "create-file"  // push would write a missing repo file
+	actionReplace    = "replace-file" // the existing file would be replaced
+	actionMerge      = "merge"        // push would merge store and repo changes
+	actionNoOp       = "no-op"        // nothing would change
+)
@@ -0,0 +1,93 @@
+package sync
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/aayushgautam/wtm/internal/dotenv"
+)
+
+const overlayDirName = metaDirPrefix + "overlay"
+
+// writeStore copies the repo file of it into the store, rendering
+// templates and layered files. The caller snapshots syncedAbs; a rendered
+// layered file is snapshotted here, for reason.
+func (s *session) writeStore(it planItem, reason string) error {
+	if it.template != nil {
+		return s.renderTemplate(it)
+	}
+	if it.baseAbs == "" {
+		return s.sealRepoFile(it.repoAbs, it.storeAbs)
+	}
+	if err := s.copyRepoToStore(it.repoAbs, it.baseAbs); err != nil {
+		return err
+	}
+	return s.withHistory(it, it.storeAbs, reason, func() error { return s.renderLayered(it) })
+}
+
+// renderLayered writes storeAbs from baseAbs with the overlay applied. Without
+// an overlay file the base is copied unchanged.
+func (s *session) renderLayered(it planItem) error {
+	overlay, err := s.fs.ReadFile(it.overlayAbs)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return s.copyRepoToStore(it.baseAbs, it.storeAbs)
+		}
+		return fmt.Errorf("read %s: %w", it.overlayAbs, err)
+	}
+	base, err := s.fs.ReadFile(it.baseAbs)
+	if err != nil {
+		return fmt.Errorf("read %s: %w", it.baseAbs, err)
+	}
+	info, err := s.fs.Stat(it.baseAbs)
+	if err != nil {
+		return fmt.Errorf("stat %s: %w", it.baseAbs, err)
+	}
+	if err := s.fs.MkdirAll(filepath.Dir(it.storeAbs), 0o755); err != nil {
+		return fmt.Errorf("mkdir %s: %w", filepath.Dir(it.storeAbs), err)
+	}
+	merged, err := mergeDotenv(base, overlay)
+	if err != nil {
+		return fmt.Errorf("merge %s: %w", it.rel, err)
+	}
+	if err := s.fs.WriteFile(it.storeAbs, merged, info.Mode().Perm()); err != nil {
+		return fmt.Errorf("write %s: %w", it.storeAbs, err)
+	}
+	return nil
+}
+
+// renderedContent returns what renderLayered would write for it.
+func (s *session) renderedContent(it planItem) ([]byte, error) {
+	base, err := s.fs.ReadFile(it.baseAbs)
+	if err != nil {
+		return nil, fmt.Errorf("read %s: %w", it.baseAbs, err)
+	}
+	overlay, err := s.fs.ReadFile(it.overlayAbs)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return base, nil
+		}
+		return nil, fmt.Errorf("read %s: %w", it.overlayAbs, err)
+	}
+	return mergeDotenv(base, overlay)
+}
+
+// mergeDotenv applies the assignments in overlay to base.
+func mergeDotenv(base, overlay []byte) ([]byte, error) {
+	b, err := dotenv.Parse(base)
+	if err != nil {
+		return nil, fmt.Errorf("base: %w", err)
+	}
+	o, err := dotenv.Parse(overlay)
+	if err != nil {
+		return nil, fmt.Errorf("overlay: %w", err)
+	}
+	for _, e := range o.Entries() {
+		if e.Kind == dotenv.Assignment {
+			b.Put(e)
+		}
+	}
+	return b.Bytes(), nil
+}
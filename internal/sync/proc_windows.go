@@ -0,0 +1,32 @@
+package sync
+
+import (
+	"os"
+	"syscall"
+)
+
+// detachedProcAttr starts a process in its own process group, so Ctrl+C in
+// the console that started it does not reach it.
+func detachedProcAttr() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{CreationFlags: syscall.CREATE_NEW_PROCESS_GROUP}
+}
+
+// processAlive reports whether pid names a process; FindProcess opens a
+// handle to it on Windows.
+func processAlive(pid int) bool {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	_ = p.Release()
+	return true
+}
+
+// terminateProcess kills pid, Windows having no SIGTERM to send.
+func terminateProcess(pid int) error {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return err
+	}
+	return p.Kill()
+}
@@ -0,0 +1,406 @@
+package sync
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/aayushgautam/wtm/internal/config"
+	"github.com/aayushgautam/wtm/internal/gitx"
+)
+
+type pruneOptions struct {
+	repoHint  string
+	yes       bool
+	dryRun    bool
+	olderThan time.Duration
+	output    string
+}
+
+// jsonOrphanStore is one store listed by "wtm prune --output".
+type jsonOrphanStore struct {
+	Path     string    `json:"path"`
+	Size     int64     `json:"size"`
+	LastUsed time.Time `json:"lastUsed"`
+	Worktree string    `json:"worktree,omitempty"`
+}
+
+// pruneResult is what happened to one orphaned store.
+type pruneResult struct {
+	Path   string `json:"path"`
+	Action string `json:"action"`
+	Reason string `json:"reason,omitempty"`
+}
+
+type pruneSummary struct {
+	Outcome string `json:"outcome"`
+	Orphans int    `json:"orphans"`
+	Deleted int    `json:"deleted"`
+	Errors  int    `json:"errors"`
+	DryRun  bool   `json:"dryRun,omitempty"`
+}
+
+func (s pruneSummary) exit() error {
+	return outcomeError(s.Outcome, "")
+}
+
+type orphanStore struct {
+	path     string
+	size     int64
+	modTime  time.Time // last sync or push per the manifest, else newest file
+	worktree string    // worktree recorded in the manifest, if any
+}
+
+// Prune deletes store directories that no longer belong to a live worktree.
+func Prune(args []string) error {
+	return newSession(&storeCipher{}).prune(args)
+}
+
+func (s *session) prune(args []string) error {
+	opts, err := parsePruneOptions(args)
+	if err != nil {
+		return pruneUsageError(err)
+	}
+
+	repoRoot, err := s.git.RepoRoot(opts.repoHint)
+	if err != nil {
+		return err
+	}
+
+	wts, err := s.git.ListWorktrees(repoRoot)
+	if err != nil {
+		return err
+	}
+
+	loaded, err := s.loadConfig(repoRoot)
+	if err != nil {
+		return err
+	}
+	if opts.dryRun {
+		s = s.dryRunSession()
+	}
+	// A store an older version kept elsewhere would otherwise look orphaned.
+	if err := s.moveLegacyStores(repoRoot, wts, loaded.Config.Store.Mode); err != nil {
+		return err
+	}
+
+	storeDir, err := repoStoreDir(repoRoot)
+	if err != nil {
+		return err
+	}
+
+	live := make(map[string]bool)
+	for _, wt := range wts {
+		if wt.Prunable {
+			continue
+		}
+		root, err := storeRootPath(repoRoot, wt, loaded.Config.Store.Mode)
+		if err != nil {
+			return err
+		}
+		live[filepath.Clean(root)] = true
+	}
+	if loaded.Config.Store.Mode == config.StoreModeLayered {
+		base, err := storeRootPath(repoRoot, gitx.Worktree{}, config.StoreModeShared)
+		if err != nil {
+			return err
+		}
+		live[filepath.Clean(base)] = true
+	}
+
+	orphans, err := s.findOrphanStores(repoRoot, storeDir, live)
+	if err != nil {
+		return err
+	}
+	if opts.olderThan > 0 {
+		cutoff := time.Now().Add(-opts.olderThan)
+		kept := orphans[:0]
+		for _, o := range orphans {
+			if o.modTime.Before(cutoff) {
+				kept = append(kept, o)
+			}
+		}
+		orphans = kept
+	}
+
+	rep := newReporter(opts.output, "prune", os.Stdout)
+	sum := pruneSummary{Outcome: outcomeOK, Orphans: len(orphans), DryRun: opts.dryRun}
+	fmt.Fprintln(os.Stderr, "Store:", storeDir)
+	if len(orphans) == 0 {
+		fmt.Fprintln(os.Stderr, "No orphaned stores; nothing to do.")
+		sum.Outcome = outcomeNothingToDo
+		return finish(rep, sum)
+	}
+	if rep.machine() {
+		for _, o := range orphans {
+			if err := rep.add("store", jsonOrphanStore{Path: o.path, Size: o.size, LastUsed: o.modTime, Worktree: o.worktree}); err != nil {
+				return err
+			}
+		}
+	} else {
+		printOrphans(os.Stdout, orphans)
+	}
+
+	if opts.dryRun {
+		fmt.Fprintf(os.Stderr, "Dry run: would delete %d orphaned stores.\n", len(orphans))
+		return finish(rep, sum)
+	}
+	if !opts.yes {
+		if !s.confirm(fmt.Sprintf("Delete %d orphaned stores? [y/N] ", len(orphans))) {
+			fmt.Fprintln(os.Stderr, "Aborted.")
+			sum.Outcome = outcomeAborted
+			return finish(rep, sum)
+		}
+	}
+
+	for _, o := range orphans {
+		result := pruneResult{Path: o.path, Action: actionDeleted}
+		if err := s.fs.RemoveAll(o.path); err != nil {
+			fmt.Fprintln(os.Stderr, "Error deleting:", err)
+			sum.Errors++
+			result.Action, result.Reason = actionError, err.Error()
+		} else {
+			s.removeEmptyParents(filepath.Dir(o.path), storeDir)
+			sum.Deleted++
+		}
+		if err := rep.add("result", result); err != nil {
+			return err
+		}
+	}
+	fmt.Fprintf(os.Stderr, "Done. Deleted %d of %d orphaned stores.\n", sum.Deleted, len(orphans))
+	if sum.Errors > 0 {
+		sum.Outcome = outcomePartial
+	}
+	return finish(rep, sum)
+}
+
+func parsePruneOptions(args []string) (pruneOptions, error) {
+	fsFlags := flag.NewFlagSet("prune", flag.ContinueOnError)
+	fsFlags.SetOutput(io.Discard)
+
+	var opts pruneOptions
+	var olderThan string
+	fsFlags.StringVar(&opts.repoHint, "repo", "", "repo path (defaults to current dir repo)")
+	fsFlags.BoolVar(&opts.yes, "yes", false, "delete without confirmation")
+	fsFlags.BoolVar(&opts.dryRun, "dry-run", false, "list orphaned stores without deleting them")
+	fsFlags.StringVar(&olderThan, "older-than", "", "only prune stores not modified within this age (e.g. 30d, 12h)")
+	fsFlags.StringVar(&opts.output, "output", outputText, "text, json or ndjson")
+
+	if err := fsFlags.Parse(args); err != nil {
+		return pruneOptions{}, err
+	}
+	if err := validOutput(opts.output); err != nil {
+		return pruneOptions{}, err
+	}
+	if opts.output != outputText && !opts.yes && !opts.dryRun {
+		return pruneOptions{}, fmt.Errorf("--output %s needs --yes or --dry-run", opts.output)
+	}
+	if olderThan != "" {
+		d, err := parseAge(olderThan)
+		if err != nil {
+			return pruneOptions{}, err
+		}
+		opts.olderThan = d
+	}
+	return opts, nil
+}
+
+func pruneUsageError(err error) error {
+	msg := strings.TrimSpace(err.Error())
+	if msg != "" {
+		fmt.Fprintln(os.Stderr, "Error:", msg)
+	}
+	fmt.Fprintln(os.Stderr, "usage: wtm prune [--repo PATH] [--older-than AGE] [--dry-run | --yes] [--output text|json|ndjson]")
+	return fmt.Errorf("invalid arguments")
+}
+
+// parseAge accepts time.ParseDuration syntax plus whole days ("30d") and
+// weeks ("2w").
+func parseAge(s string) (time.Duration, error) {
+	s = strings.TrimSpace(s)
+	for suffix, unit := range map[string]time.Duration{"d": 24 * time.Hour, "w": 7 * 24 * time.Hour} {
+		if n, ok := strings.CutSuffix(s, suffix); ok {
+			v, err := strconv.Atoi(n)
+			if err != nil || v < 0 {
+				return 0, fmt.Errorf("invalid age %q", s)
+			}
+			return time.Duration(v) * unit, nil
+		}
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid age %q", s)
+	}
+	return d, nil
+}
+
+// findOrphanStores walks storeDir and returns the topmost entries that are
+// neither a live store root nor a directory leading to one. Stores whose
+// manifest names another repo belong to a repo with the same base name as
+// repoRoot and are left out.
+func (s *session) findOrphanStores(repoRoot, storeDir string, live map[string]bool) ([]orphanStore, error) {
+	leadsToLive := func(dir string) bool {
+		prefix := dir + string(filepath.Separator)
+		for root := range live {
+			if strings.HasPrefix(root, prefix) {
+				return true
+			}
+		}
+		return false
+	}
+
+	var orphans []orphanStore
+	err := walkDir(s.fs, storeDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && path == storeDir {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		path = filepath.Clean(path)
+		if path == storeDir {
+			return nil
+		}
+		if strings.HasPrefix(d.Name(), metaDirPrefix) {
+			// wtm metadata, such as the repo's port allocations.
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if live[path] {
+			return filepath.SkipDir
+		}
+		if d.IsDir() && leadsToLive(path) {
+			return nil
+		}
+		var m *storeManifest
+		if d.IsDir() {
+			if m, err = s.loadManifest(path); err != nil {
+				return err
+			}
+			if other := m.otherRepo(repoRoot); other != "" {
+				fmt.Fprintf(os.Stderr, "Skipping %s: it is a store of %s\n", path, other)
+				return filepath.SkipDir
+			}
+			if len(m.Files) == 0 {
+				foreign, err := s.holdsOtherRepoStore(repoRoot, path)
+				if err != nil {
+					return err
+				}
+				if foreign {
+					return nil
+				}
+			}
+		}
+		size, modTime, err := s.treeUsage(path)
+		if err != nil {
+			return err
+		}
+		o := orphanStore{path: path, size: size, modTime: modTime}
+		if m != nil {
+			if t := m.lastUsed(); !t.IsZero() {
+				o.modTime = t
+			}
+			o.worktree = strings.Join(m.worktrees(), ", ")
+		}
+		orphans = append(orphans, o)
+		if d.IsDir() {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	return orphans, err
+}
+
+// holdsOtherRepoStore reports whether a store of a repo other than repoRoot
+// lies below dir.
+func (s *session) holdsOtherRepoStore(repoRoot, dir string) (bool, error) {
+	found := false
+	err := walkDir(s.fs, dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() || path == dir || strings.HasPrefix(d.Name(), metaDirPrefix) {
+			return nil
+		}
+		m, err := s.loadManifest(path)
+		if err != nil {
+			return err
+		}
+		if m.otherRepo(repoRoot) != "" {
+			found = true
+			return filepath.SkipAll
+		}
+		return nil
+	})
+	return found, err
+}
+
+// treeUsage sums file sizes below root and returns the newest modification
+// time found.
+func (s *session) treeUsage(root string) (int64, time.Time, error) {
+	var size int64
+	var newest time.Time
+	err := walkDir(s.fs, root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if info.ModTime().After(newest) {
+			newest = info.ModTime()
+		}
+		if info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, newest, err
+}
+
+// removeEmptyParents deletes dir and its ancestors while they are empty,
+// stopping at (and never removing) stop.
+func (s *session) removeEmptyParents(dir, stop string) {
+	stop = filepath.Clean(stop)
+	for dir = filepath.Clean(dir); dir != stop && strings.HasPrefix(dir, stop+string(filepath.Separator)); dir = filepath.Dir(dir) {
+		if err := s.fs.Remove(dir); err != nil {
+			return
+		}
+	}
+}
+
+func printOrphans(w io.Writer, orphans []orphanStore) {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "SIZE\tLAST USED\tSTORE\tWORKTREE")
+	for _, o := range orphans {
+		worktree := o.worktree
+		if worktree == "" {
+			worktree = "-"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", humanSize(o.size), o.modTime.Local().Format("2006-01-02 15:04"), o.path, worktree)
+	}
+	_ = tw.Flush()
+}
+
+func humanSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
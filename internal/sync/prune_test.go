@@ -0,0 +1,180 @@
+package sync
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/aayushgautam/wtm/internal/gitx"
+)
+
+func TestFindOrphanStoresKeepsMetadata(t *testing.T) {
+	storeDir := t.TempDir()
+	live := filepath.Join(storeDir, "app-feat")
+	gone := filepath.Join(storeDir, "app-gone")
+	for _, path := range []string{
+		filepath.Join(live, ".env"),
+		filepath.Join(gone, ".env"),
+		filepath.Join(storeDir, portsFileName),
+	} {
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatalf("mkdir: %v", err)
+		}
+		if err := os.WriteFile(path, []byte("A=1\n"), 0o644); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+
+	orphans, err := newSession(&storeCipher{}).findOrphanStores("/src/app", storeDir, map[string]bool{live: true})
+	if err != nil {
+		t.Fatalf("find: %v", err)
+	}
+	if len(orphans) != 1 || orphans[0].path != gone {
+		t.Fatalf("expected only %s to be orphaned, got %+v", gone, orphans)
+	}
+}
+
+func (e *testEnv) prune(args ...string) error {
+	e.t.Helper()
+	err := e.session().prune(args)
+	if len(e.p.answers) > 0 {
+		e.t.Fatalf("unused answers %q", e.p.answers)
+	}
+	return err
+}
+
+func (e *testEnv) exists(path string) bool {
+	_, err := e.fs.Lstat(path)
+	return err == nil
+}
+
+func TestPruneDeletesOrphanedStores(t *testing.T) {
+	e := syncedEnv(t, "A=1\n")
+	wantExit(t, e.sync("--worktree", "3", "--yes"), 0)
+	gone := e.store(3, "")
+	// git reports the worktree as prunable once its directory is deleted.
+	e.wts[2].Prunable = true
+
+	wantExit(t, e.prune("--dry-run"), 0)
+	if !e.exists(gone) {
+		t.Fatal("expected --dry-run to keep the store")
+	}
+	e.answer("n")
+	wantExit(t, e.prune(), ExitAborted)
+	if !e.exists(gone) {
+		t.Fatal("expected a declined prune to keep the store")
+	}
+
+	wantExit(t, e.prune("--yes"), 0)
+	if e.exists(gone) {
+		t.Fatal("expected the orphaned store to be deleted")
+	}
+	if e.read(e.store(2, ".env")) != "A=1\n" {
+		t.Fatal("expected the live store to be kept")
+	}
+	wantExit(t, e.prune("--yes"), ExitNothingToDo)
+}
+
+func TestPruneKeepsStoresOfSameNamedRepo(t *testing.T) {
+	e := syncedEnv(t, "A=1\n")
+	wantExit(t, e.sync("--worktree", "3", "--yes"), 0)
+	e.wts[2].Prunable = true
+	// /other/app shares the store directory of /src/app.
+	other := filepath.Join(filepath.Dir(e.store(3, "")), "app-other")
+	e.write(filepath.Join(other, ".env"), "B=2\n")
+	s := e.session()
+	s.cipher = &storeCipher{}
+	m, err := s.loadManifest(other)
+	if err != nil {
+		t.Fatalf("manifest: %v", err)
+	}
+	if err := m.recordSync(".env", []byte("B=2\n"), "/other/app", gitx.Worktree{Path: "/other/app-other"}); err != nil {
+		t.Fatalf("record: %v", err)
+	}
+	if err := m.save(); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+
+	wantExit(t, e.prune("--yes"), 0)
+	if e.exists(e.store(3, "")) {
+		t.Fatal("expected this repo's orphaned store to be deleted")
+	}
+	if got := e.read(filepath.Join(other, ".env")); got != "B=2\n" {
+		t.Fatalf("expected the other repo's store to be kept, got %q", got)
+	}
+	wantExit(t, e.prune("--yes"), ExitNothingToDo)
+}
+
+func TestNestedAndSiblingWorktreesGetSeparateStores(t *testing.T) {
+	e := syncedEnv(t, "A=1\n")
+	nested := gitx.Worktree{Path: filepath.Join(testRepo, "app-feat"), Branch: "refs/heads/nested"}
+	if portKey(testRepo, nested) == portKey(testRepo, e.wts[1]) {
+		t.Fatalf("expected distinct port keys, both are %q", portKey(testRepo, nested))
+	}
+	e.wts = append(e.wts, nested)
+	if err := e.fs.MkdirAll(nested.Path, 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	if e.store(2, "") == e.store(4, "") {
+		t.Fatalf("expected distinct stores, both are %s", e.store(2, ""))
+	}
+
+	wantExit(t, e.sync("--worktree", "4", "--yes"), 0)
+	e.write(e.wt(2, ".env"), "A=2\n")
+	if got := e.read(e.wt(4, ".env")); got != "A=1\n" {
+		t.Fatalf("expected the nested worktree to keep its own store, got %q", got)
+	}
+	// Neither store is taken for the other's legacy one.
+	wantExit(t, e.prune("--yes"), ExitNothingToDo)
+}
+
+func TestLegacySiblingStoresAreMoved(t *testing.T) {
+	for name, old := range map[string]string{
+		"without parent hop": "/wtm/configs/app/app-feat",
+		"beside repo store":  "/wtm/configs/app-feat",
+	} {
+		t.Run(name, func(t *testing.T) {
+			e := newTestEnv(t)
+			e.write(e.repo(".env"), "A=1\n")
+			e.write(filepath.Join(old, ".env"), "A=1\n")
+			e.write(filepath.Join(old, ".env.local"), "B=2\n")
+			if err := e.fs.Symlink(filepath.Join(old, ".env"), e.wt(2, ".env")); err != nil {
+				t.Fatalf("symlink: %v", err)
+			}
+			if err := e.fs.Symlink(filepath.Join(old, ".env.local"), e.wt(2, ".env.local")); err != nil {
+				t.Fatalf("symlink: %v", err)
+			}
+			e.write("/wtm/configs/app/"+portsFileName, `{"version": 1, "worktrees": {"app-feat": {"db": 12345}}}`)
+
+			wantExit(t, e.sync("--worktree", "2", "--yes"), 0)
+			if e.exists(old) {
+				t.Fatalf("expected %s to be moved", old)
+			}
+			e.wantLink(2, ".env")
+			e.wantLink(2, ".env.local")
+			if got := e.read(e.wt(2, ".env.local")); got != "B=2\n" {
+				t.Fatalf("expected the store file to move, got %q", got)
+			}
+			ports, err := e.session().loadPorts(testRepo)
+			if err != nil {
+				t.Fatalf("ports: %v", err)
+			}
+			if p := ports.Worktrees[portKey(testRepo, e.wts[1])]["db"]; p != 12345 {
+				t.Fatalf("expected the port to move with the store, got %v", ports.Worktrees)
+			}
+		})
+	}
+}
+
+func TestLegacyStoresOfOtherWorktreesStay(t *testing.T) {
+	e := newTestEnv(t)
+	e.write(e.repo(".env"), "A=1\n")
+	old := "/wtm/configs/app/app-feat"
+	e.write(filepath.Join(old, ".env"), "A=1\n")
+
+	wantExit(t, e.sync("--worktree", "2", "--yes"), 0)
+	if !e.exists(old) {
+		t.Fatal("expected a store no link points into to stay")
+	}
+	e.wantLink(2, ".env")
+}
@@ -0,0 +1,195 @@
+package sync
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/aayushgautam/wtm/internal/config"
+	"github.com/aayushgautam/wtm/internal/gitx"
+)
+
+type relinkOptions struct {
+	repoHint     string
+	worktreeNum  int
+	destOverride string
+	to           string
+	dryRun       bool
+}
+
+// Relink rewrites the symlinks from worktrees into their stores in absolute
+// or relative form.
+func Relink(args []string) error {
+	return newSession(&storeCipher{}).relink(args)
+}
+
+func (s *session) relink(args []string) error {
+	opts, err := parseRelinkOptions(args)
+	if err != nil {
+		return relinkUsageError(err)
+	}
+
+	repoRoot, err := s.git.RepoRoot(opts.repoHint)
+	if err != nil {
+		return err
+	}
+
+	wts, err := s.git.ListWorktrees(repoRoot)
+	if err != nil {
+		return err
+	}
+
+	if opts.destOverride != "" || opts.worktreeNum != 0 {
+		wt, err := s.pickWorktree(repoRoot, wts, opts.destOverride, opts.worktreeNum)
+		if err != nil {
+			return err
+		}
+		wts = []gitx.Worktree{wt}
+	}
+
+	loaded, err := s.loadConfig(repoRoot)
+	if err != nil {
+		return err
+	}
+	to := opts.to
+	if to == "" {
+		to = loaded.Config.Symlinks
+	}
+	switch to {
+	case config.SymlinksAbsolute, config.SymlinksRelative:
+	default:
+		return relinkUsageError(fmt.Errorf("unknown form %q", to))
+	}
+
+	rewritten, unchanged := 0, 0
+	for _, wt := range wts {
+		if samePath(repoRoot, wt.Path) || wt.Prunable {
+			continue
+		}
+		storeRoot, err := storeRootPath(repoRoot, wt, loaded.Config.Store.Mode)
+		if err != nil {
+			return err
+		}
+		r, u, err := s.relinkWorktree(storeRoot, wt.Path, to == config.SymlinksRelative, opts.dryRun)
+		if err != nil {
+			return err
+		}
+		rewritten += r
+		unchanged += u
+	}
+
+	if opts.dryRun {
+		fmt.Fprintf(os.Stderr, "Dry run: %d links would be rewritten as %s; %d already are.\n", rewritten, to, unchanged)
+		return nil
+	}
+	fmt.Fprintf(os.Stderr, "Rewrote %d links as %s; %d already were.\n", rewritten, to, unchanged)
+	if to != loaded.Config.Symlinks {
+		fmt.Fprintf(os.Stderr, "Set symlinks to %q in %s so \"wtm sync\" keeps this form.\n", to, config.DefaultConfigFileName)
+	}
+	return nil
+}
+
+func parseRelinkOptions(args []string) (relinkOptions, error) {
+	fsFlags := flag.NewFlagSet("relink", flag.ContinueOnError)
+	fsFlags.SetOutput(io.Discard)
+
+	var opts relinkOptions
+	fsFlags.StringVar(&opts.repoHint, "repo", "", "repo path (defaults to current dir repo)")
+	fsFlags.IntVar(&opts.worktreeNum, "worktree", 0, "only relink this worktree number (1-indexed)")
+	fsFlags.StringVar(&opts.destOverride, "dest", "", "only relink this worktree path")
+	fsFlags.StringVar(&opts.to, "to", "", "absolute|relative (defaults to the symlinks setting)")
+	fsFlags.BoolVar(&opts.dryRun, "dry-run", false, "list the links without rewriting them")
+
+	if err := fsFlags.Parse(args); err != nil {
+		return relinkOptions{}, err
+	}
+	if fsFlags.NArg() > 0 {
+		return relinkOptions{}, fmt.Errorf("unexpected argument %q", fsFlags.Arg(0))
+	}
+	return opts, nil
+}
+
+func relinkUsageError(err error) error {
+	msg := strings.TrimSpace(err.Error())
+	if msg != "" {
+		fmt.Fprintln(os.Stderr, "Error:", msg)
+	}
+	fmt.Fprintln(os.Stderr, "usage: wtm relink [--repo PATH] [--worktree N | --dest PATH] [--to absolute|relative] [--dry-run]")
+	return fmt.Errorf("invalid arguments")
+}
+
+// relinkWorktree rewrites the symlinks in worktreeRoot into storeRoot and
+// returns how many it changed and how many were already right. A dangling
+// link counts as one into the store when its target ends in the store
+// file's path below the store base, as after the home directory moved.
+func (s *session) relinkWorktree(storeRoot, worktreeRoot string, relative, dryRun bool) (int, int, error) {
+	base, err := storeBase()
+	if err != nil {
+		return 0, 0, err
+	}
+	rewritten, unchanged := 0, 0
+	err = walkDir(s.fs, storeRoot, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && path == storeRoot {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		if d.IsDir() {
+			if path != storeRoot && strings.HasPrefix(d.Name(), metaDirPrefix) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		rel, err := filepath.Rel(storeRoot, path)
+		if err != nil {
+			return err
+		}
+		link := filepath.Join(worktreeRoot, rel)
+		info, err := s.fs.Lstat(link)
+		if err != nil || info.Mode()&os.ModeSymlink == 0 {
+			return nil
+		}
+		if !s.linksTo(link, path) && !s.danglingInto(link, path, base) {
+			return nil
+		}
+		want, err := s.symlinkTarget(path, link, relative)
+		if err != nil {
+			return err
+		}
+		if current, err := s.fs.Readlink(link); err == nil && current == want {
+			unchanged++
+			return nil
+		}
+		if !dryRun {
+			if err := s.replaceSymlink(want, link); err != nil {
+				return err
+			}
+		}
+		fmt.Fprintf(os.Stdout, "%s -> %s\n", link, want)
+		rewritten++
+		return nil
+	})
+	return rewritten, unchanged, err
+}
+
+// danglingInto reports whether link no longer resolves and its target ends
+// in the path of storeFile below base.
+func (s *session) danglingInto(link, storeFile, base string) bool {
+	if _, err := s.fs.Stat(link); !os.IsNotExist(err) {
+		return false
+	}
+	rel, err := filepath.Rel(base, storeFile)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return false
+	}
+	target, err := s.readLinkAbs(link)
+	if err != nil {
+		return false
+	}
+	return strings.HasSuffix(filepath.Clean(target), string(filepath.Separator)+rel)
+}
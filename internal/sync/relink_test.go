@@ -0,0 +1,107 @@
+package sync
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aayushgautam/wtm/internal/config"
+)
+
+func (e *testEnv) relink(args ...string) (string, error) {
+	e.t.Helper()
+	var err error
+	out := captureStdout(e.t, func() { err = e.session().relink(args) })
+	return out, err
+}
+
+func TestRelinkRewritesLinksIntoTheStore(t *testing.T) {
+	e := newTestEnv(t)
+	e.write(e.repo(".env"), "A=1\n")
+	e.write(e.repo("apps/api/.env"), "B=2\n")
+	wantExit(t, e.sync("--worktree", "2", "--yes"), 0)
+	// A link that points outside the store is not wtm's to rewrite.
+	e.write("/elsewhere/.env.local", "C=3\n")
+	if err := e.fs.Symlink("/elsewhere/.env.local", e.wt(2, ".env.local")); err != nil {
+		t.Fatalf("symlink: %v", err)
+	}
+
+	out, err := e.relink("--to", "relative", "--dry-run")
+	wantExit(t, err, 0)
+	if n := strings.Count(out, "\n"); n != 2 {
+		t.Fatalf("expected 2 links listed, got %q", out)
+	}
+	e.wantLink(2, ".env")
+
+	_, err = e.relink("--to", "relative")
+	wantExit(t, err, 0)
+	for _, rel := range []string{".env", "apps/api/.env"} {
+		target, err := e.fs.Readlink(e.wt(2, rel))
+		if err != nil {
+			t.Fatalf("readlink: %v", err)
+		}
+		if filepath.IsAbs(target) || !samePath(filepath.Join(filepath.Dir(e.wt(2, rel)), target), e.store(2, rel)) {
+			t.Fatalf("%s: expected a relative link to %s, got %s", rel, e.store(2, rel), target)
+		}
+	}
+	if target, _ := e.fs.Readlink(e.wt(2, ".env.local")); target != "/elsewhere/.env.local" {
+		t.Fatalf("expected the foreign link to be left alone, got %s", target)
+	}
+
+	out, err = e.relink("--to", "relative")
+	wantExit(t, err, 0)
+	if out != "" {
+		t.Fatalf("expected nothing left to rewrite, got %q", out)
+	}
+
+	// Without --to the symlinks setting decides.
+	_, err = e.relink()
+	wantExit(t, err, 0)
+	e.wantLink(2, ".env")
+	e.wantLink(2, "apps/api/.env")
+}
+
+func TestRelinkRepairsLinksIntoMovedStore(t *testing.T) {
+	e := syncedEnv(t, "A=1\n")
+	e.write(e.store(2, ".env.local"), "B=2\n")
+	// The store was under a home directory that has since moved.
+	for rel, target := range map[string]string{
+		".env":       "/old-home/.wtm/configs/app/_up/app-feat/.env",
+		".env.local": "/gone/.env.local",
+	} {
+		_ = e.fs.Remove(e.wt(2, rel))
+		if err := e.fs.Symlink(target, e.wt(2, rel)); err != nil {
+			t.Fatalf("symlink: %v", err)
+		}
+	}
+
+	_, err := e.relink()
+	wantExit(t, err, 0)
+	e.wantLink(2, ".env")
+	if target, _ := e.fs.Readlink(e.wt(2, ".env.local")); target != "/gone/.env.local" {
+		t.Fatalf("expected a dangling link elsewhere to be left alone, got %s", target)
+	}
+}
+
+func TestRelinkLeavesCopiesAlone(t *testing.T) {
+	e := newTestEnv(t)
+	e.cfg.Link.Mode = config.LinkCopy
+	e.write(e.repo(".env"), "A=1\n")
+	wantExit(t, e.sync("--worktree", "2", "--yes"), 0)
+
+	out, err := e.relink("--to", "relative")
+	wantExit(t, err, 0)
+	if out != "" {
+		t.Fatalf("expected no links to rewrite, got %q", out)
+	}
+	if got := e.read(e.wt(2, ".env")); got != "A=1\n" {
+		t.Fatalf("expected the copy to stay, got %q", got)
+	}
+}
+
+func TestRelinkRejectsUnknownForm(t *testing.T) {
+	e := newTestEnv(t)
+	if _, err := e.relink("--to", "sideways"); err == nil {
+		t.Fatal("expected an unknown form to be rejected")
+	}
+}
@@ -0,0 +1,130 @@
+package sync
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/aayushgautam/wtm/internal/config"
+	"github.com/aayushgautam/wtm/internal/gitx"
+)
+
+// session holds the file system, cipher, prompter and git access a command
+// uses; dry runs and tests swap them out.
+type session struct {
+	fs       fileSystem
+	cipher   *storeCipher
+	prompter prompter
+	git      gitRepo
+	// loadConfig loads the config of a repo, config.Load outside tests.
+	loadConfig func(repoRoot string) (config.Loaded, error)
+	// setRecipients writes encryption.recipients to the config file of a
+	// repo, config.SetRecipients outside tests.
+	setRecipients func(repoRoot string, recipients []string) (string, error)
+	// dryRun is set for a memFS over the real file system. A question a
+	// real run would ask is then answered with a promptError, or as a
+	// conflict, instead of waiting for the user.
+	dryRun bool
+	// historyKeep is how many snapshots of each store file are kept,
+	// config.DefaultHistoryKeep when unset.
+	historyKeep int
+}
+
+func newSession(c *storeCipher) *session {
+	return &session{
+		fs:            osFS{},
+		cipher:        c,
+		prompter:      stdinPrompter,
+		git:           gitCLI{},
+		loadConfig:    config.Load,
+		setRecipients: config.SetRecipients,
+	}
+}
+
+// dryRunSession returns a copy of s that keeps every change in memory.
+func (s *session) dryRunSession() *session {
+	d := *s
+	d.fs = newMemFS(s.fs)
+	d.dryRun = true
+	return &d
+}
+
+// prompter asks the user for a line of input.
+type prompter interface {
+	prompt(msg string) string
+}
+
+// ttyPrompter writes questions to stderr and reads the answers from r.
+type ttyPrompter struct {
+	r *bufio.Reader
+}
+
+// stdinPrompter is shared so input read ahead by its buffer is not lost
+// between questions.
+var stdinPrompter = &ttyPrompter{r: bufio.NewReader(os.Stdin)}
+
+func (p *ttyPrompter) prompt(msg string) string {
+	fmt.Fprint(os.Stderr, msg)
+	s, _ := p.r.ReadString('\n')
+	return strings.TrimRight(s, "\r\n")
+}
+
+// gitRepo is the git access of the commands.
+type gitRepo interface {
+	RepoRoot(hint string) (string, error)
+	ListWorktrees(repoRoot string) ([]gitx.Worktree, error)
+	AddWorktree(repoRoot, path, branch, base string) error
+	RemoveWorktree(repoRoot, path string, force bool) error
+}
+
+// gitCLI runs git through the gitx package.
+type gitCLI struct{}
+
+func (gitCLI) RepoRoot(hint string) (string, error) { return gitx.RepoRoot(hint) }
+
+func (gitCLI) ListWorktrees(repoRoot string) ([]gitx.Worktree, error) {
+	return gitx.ListWorktrees(repoRoot)
+}
+
+func (gitCLI) AddWorktree(repoRoot, path, branch, base string) error {
+	return gitx.AddWorktree(repoRoot, path, branch, base)
+}
+
+func (gitCLI) RemoveWorktree(repoRoot, path string, force bool) error {
+	return gitx.RemoveWorktree(repoRoot, path, force)
+}
+
+// promptError is returned in a dry run where a real run would ask before
+// overwriting path.
+type promptError struct {
+	path string
+}
+
+func (e promptError) Error() string {
+	return "would ask before overwriting " + e.path
+}
+
+// dryRunProbe is the state of a path before a dry run applies an item to it.
+type dryRunProbe struct {
+	path    string
+	existed bool
+	mark    int
+}
+
+func (s *session) probe(path string) dryRunProbe {
+	_, err := s.fs.Lstat(path)
+	return dryRunProbe{path: path, existed: err == nil, mark: len(s.fs.(*memFS).changes)}
+}
+
+// action tells what applying an item did to path since p was taken.
+func (s *session) action(p dryRunProbe, created string) string {
+	switch {
+	case !s.fs.(*memFS).changedSince(p.mark, p.path):
+		return actionNoOp
+	case p.existed:
+		return actionReplace
+	default:
+		return created
+	}
+}
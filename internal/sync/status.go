@@ -0,0 +1,389 @@
+package sync
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/aayushgautam/wtm/internal/config"
+	"github.com/aayushgautam/wtm/internal/gitx"
+)
+
+type linkState int
+
+const (
+	stateLinked linkState = iota
+	stateDivergent
+	stateDangling
+	stateWrongTarget
+	stateShadowed
+	stateMissing
+)
+
+func (s linkState) String() string {
+	switch s {
+	case stateLinked:
+		return "ok"
+	case stateDivergent:
+		return "divergent"
+	case stateDangling:
+		return "dangling"
+	case stateWrongTarget:
+		return "wrong-target"
+	case stateShadowed:
+		return "shadowed"
+	case stateMissing:
+		return "missing"
+	default:
+		return "unknown"
+	}
+}
+
+type statusOptions struct {
+	repoHint     string
+	worktreeNum  int
+	destOverride string
+	quiet        bool
+	output       string
+}
+
+// jsonStatusEntry is one entry of "wtm status --output".
+type jsonStatusEntry struct {
+	Worktree    string `json:"worktree"`
+	Rel         string `json:"rel"`
+	State       string `json:"state"`
+	Detail      string `json:"detail,omitempty"`
+	RepoAbs     string `json:"repoAbs"`
+	StoreAbs    string `json:"storeAbs"`
+	WorktreeAbs string `json:"worktreeAbs"`
+}
+
+type statusSummary struct {
+	Outcome   string `json:"outcome"`
+	Checked   int    `json:"checked"`
+	OutOfSync int    `json:"outOfSync"`
+	quiet     bool
+}
+
+func (s statusSummary) exit() error {
+	if s.OutOfSync == 0 || s.quiet {
+		return outcomeError(s.Outcome, "")
+	}
+	return outcomeError(s.Outcome, fmt.Sprintf("%d of %d entries out of sync", s.OutOfSync, s.Checked))
+}
+
+type statusEntry struct {
+	worktree gitx.Worktree
+	item     planItem
+	state    linkState
+	detail   string
+}
+
+func Status(args []string) error {
+	return newSession(nil).status(args)
+}
+
+func (s *session) status(args []string) error {
+	opts, err := parseStatusOptions(args)
+	if err != nil {
+		return statusUsageError(err)
+	}
+
+	repoRoot, err := s.git.RepoRoot(opts.repoHint)
+	if err != nil {
+		return err
+	}
+
+	wts, err := s.git.ListWorktrees(repoRoot)
+	if err != nil {
+		return err
+	}
+
+	if opts.destOverride != "" || opts.worktreeNum != 0 {
+		wt, err := s.pickWorktree(repoRoot, wts, opts.destOverride, opts.worktreeNum)
+		if err != nil {
+			return err
+		}
+		wts = []gitx.Worktree{wt}
+	}
+
+	loaded, err := s.loadConfig(repoRoot)
+	if err != nil {
+		return err
+	}
+	if s.cipher, err = newStoreCipher(loaded.Config); err != nil {
+		return err
+	}
+
+	var entries []statusEntry
+	for _, wt := range wts {
+		if samePath(repoRoot, wt.Path) || wt.Prunable {
+			continue
+		}
+		storeRoot, err := storeRootPath(repoRoot, wt, loaded.Config.Store.Mode)
+		if err != nil {
+			return err
+		}
+		plan, err := s.buildSyncPlan(repoRoot, wt.Path, storeRoot, loaded.Config)
+		if err != nil {
+			return err
+		}
+		baseRoot, err := pushStoreRoot(repoRoot, wt, loaded.Config.Store.Mode)
+		if err != nil {
+			return err
+		}
+		manifest, err := s.loadManifest(baseRoot)
+		if err != nil {
+			return err
+		}
+		for _, it := range plan {
+			state, detail := s.inspectItem(it, manifest.Files[it.rel], manifest.copyHash(it.rel, wt.Path))
+			entries = append(entries, statusEntry{worktree: wt, item: it, state: state, detail: detail})
+		}
+	}
+
+	outOfSync := 0
+	for _, e := range entries {
+		if e.state != stateLinked {
+			outOfSync++
+		}
+	}
+
+	rep := newReporter(opts.output, "status", os.Stdout)
+	sum := statusSummary{Outcome: outcomeOK, Checked: len(entries), OutOfSync: outOfSync, quiet: opts.quiet}
+	if outOfSync > 0 {
+		sum.Outcome = outcomePartial
+	}
+	switch {
+	case rep.machine():
+		for _, e := range entries {
+			err := rep.add("entry", jsonStatusEntry{
+				Worktree:    e.worktree.Path,
+				Rel:         e.item.rel,
+				State:       e.state.String(),
+				Detail:      e.detail,
+				RepoAbs:     e.item.repoAbs,
+				StoreAbs:    e.item.storeAbs,
+				WorktreeAbs: e.item.worktreeAbs,
+			})
+			if err != nil {
+				return err
+			}
+		}
+	case !opts.quiet:
+		printStatus(os.Stdout, entries)
+		fmt.Fprintf(os.Stderr, "Checked %d entries; %d out of sync.\n", len(entries), outOfSync)
+	}
+	return finish(rep, sum)
+}
+
+func parseStatusOptions(args []string) (statusOptions, error) {
+	fsFlags := flag.NewFlagSet("status", flag.ContinueOnError)
+	fsFlags.SetOutput(io.Discard)
+
+	var opts statusOptions
+	fsFlags.StringVar(&opts.repoHint, "repo", "", "repo path (defaults to current dir repo)")
+	fsFlags.IntVar(&opts.worktreeNum, "worktree", 0, "only check this worktree number (1-indexed)")
+	fsFlags.StringVar(&opts.destOverride, "dest", "", "only check this worktree path")
+	fsFlags.BoolVar(&opts.quiet, "quiet", false, "print nothing; only set the exit status")
+	fsFlags.StringVar(&opts.output, "output", outputText, "text, json or ndjson")
+
+	if err := fsFlags.Parse(args); err != nil {
+		return statusOptions{}, err
+	}
+	if err := validOutput(opts.output); err != nil {
+		return statusOptions{}, err
+	}
+	return opts, nil
+}
+
+func statusUsageError(err error) error {
+	msg := strings.TrimSpace(err.Error())
+	if msg != "" {
+		fmt.Fprintln(os.Stderr, "Error:", msg)
+	}
+	fmt.Fprintln(os.Stderr, "usage: wtm status [--repo PATH] [--worktree N | --dest PATH] [--quiet] [--output text|json|ndjson]")
+	return fmt.Errorf("invalid arguments")
+}
+
+// inspectItem reports how the worktree copy of it relates to the store
+// and the repo.
+func (s *session) inspectItem(it planItem, rec *manifestFile, tracked string) (linkState, string) {
+	info, err := s.fs.Lstat(it.worktreeAbs)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return stateMissing, "not present in worktree"
+		}
+		return stateMissing, err.Error()
+	}
+
+	switch it.link {
+	case config.LinkCopy:
+		return s.inspectCopy(it, rec, tracked, info)
+	case config.LinkHardlink:
+		return s.inspectHardlink(it, rec, info)
+	}
+
+	if info.Mode()&os.ModeSymlink == 0 {
+		return stateShadowed, "regular file instead of link to store"
+	}
+
+	current, err := s.readLinkAbs(it.worktreeAbs)
+	if err != nil {
+		return stateDangling, err.Error()
+	}
+	if !samePath(current, it.storeAbs) {
+		return stateWrongTarget, "points at " + current
+	}
+	if _, err := s.fs.Stat(it.storeAbs); err != nil {
+		return stateDangling, "store file missing"
+	}
+	return s.inspectContent(it, rec)
+}
+
+// inspectCopy is inspectItem for link mode copy.
+func (s *session) inspectCopy(it planItem, rec *manifestFile, tracked string, info os.FileInfo) (linkState, string) {
+	if info.Mode()&os.ModeSymlink != 0 {
+		return stateWrongTarget, "link instead of copy"
+	}
+	if _, err := s.fs.Stat(it.storeAbs); err != nil {
+		return stateDangling, "store file missing"
+	}
+	store, err := s.readFile(it.storeAbs)
+	if err != nil {
+		return stateDivergent, err.Error()
+	}
+	copied, err := s.fs.ReadFile(it.worktreeAbs)
+	if err != nil {
+		return stateDivergent, err.Error()
+	}
+	if !bytes.Equal(copied, store) {
+		switch {
+		case it.baseAbs != "":
+			return stateDivergent, "worktree copy differs from rendered file; run wtm sync"
+		case tracked == "":
+			return stateDivergent, "worktree copy changed; run wtm push"
+		case s.contentHash(copied) == tracked:
+			return stateDivergent, "store changed since copy; run wtm sync"
+		case s.contentHash(store) == tracked:
+			return stateDivergent, "worktree copy changed; run wtm push"
+		default:
+			return stateDivergent, "worktree copy and store both changed since last sync"
+		}
+	}
+	return s.inspectContent(it, rec)
+}
+
+// inspectHardlink is inspectItem for link mode hardlink. Editors that save
+// by replacing the file break the link, leaving a separate file behind.
+func (s *session) inspectHardlink(it planItem, rec *manifestFile, info os.FileInfo) (linkState, string) {
+	if info.Mode()&os.ModeSymlink != 0 {
+		return stateWrongTarget, "symlink instead of hard link"
+	}
+	if _, err := s.fs.Stat(it.storeAbs); err != nil {
+		return stateDangling, "store file missing"
+	}
+	if !s.sameFile(it.worktreeAbs, it.storeAbs) {
+		if s.sameFileContents(it.worktreeAbs, it.storeAbs) {
+			return stateShadowed, "separate file instead of hard link to store"
+		}
+		if it.baseAbs != "" {
+			return stateDivergent, "hard link broken and file changed; run wtm sync"
+		}
+		return stateDivergent, "hard link broken and file changed; run wtm push"
+	}
+	return s.inspectContent(it, rec)
+}
+
+// inspectContent compares the store file of a correctly placed item with
+// the repo copy (and in layered mode, with its base and overlay).
+func (s *session) inspectContent(it planItem, rec *manifestFile) (linkState, string) {
+	if it.template != nil {
+		want, err := s.templateContent(it, false)
+		if err != nil {
+			return stateDivergent, err.Error()
+		}
+		got, err := s.readFile(it.storeAbs)
+		if err != nil {
+			return stateDangling, err.Error()
+		}
+		switch {
+		case bytes.Equal(want, got):
+			return stateLinked, ""
+		case rec != nil && rec.SHA256 == s.contentHash(got):
+			return stateDivergent, "template or its variables changed since last sync; run wtm sync"
+		default:
+			return stateDivergent, "rendered copy was edited; edit the template instead"
+		}
+	}
+	if it.baseAbs != "" {
+		detail, err := s.driftDetail(it.repoAbs, it.baseAbs, "shared base", rec)
+		if err != nil {
+			return stateDivergent, err.Error()
+		}
+		if detail != "" {
+			return stateDivergent, detail
+		}
+		want, err := s.renderedContent(it)
+		if err != nil {
+			return stateDivergent, err.Error()
+		}
+		got, err := s.fs.ReadFile(it.storeAbs)
+		if err != nil {
+			return stateDangling, err.Error()
+		}
+		if !bytes.Equal(want, got) {
+			return stateDivergent, "rendered copy is out of date with base/overlay"
+		}
+		return stateLinked, ""
+	}
+
+	detail, err := s.driftDetail(it.repoAbs, it.storeAbs, "store", rec)
+	if err != nil {
+		return stateDivergent, err.Error()
+	}
+	if detail != "" {
+		return stateDivergent, detail
+	}
+	return stateLinked, ""
+}
+
+// driftDetail tells which of the repo and store copy changed since the
+// last sync or push, or "" when they are equal.
+func (s *session) driftDetail(repoAbs, storeAbs, storeLabel string, rec *manifestFile) (string, error) {
+	repo, err := s.fs.ReadFile(repoAbs)
+	if err != nil {
+		return "", fmt.Errorf("read %s: %w", repoAbs, err)
+	}
+	store, err := s.readFile(storeAbs)
+	if err != nil {
+		return "", err
+	}
+	if bytes.Equal(repo, store) {
+		return "", nil
+	}
+	if rec == nil {
+		return storeLabel + " differs from repo copy (no sync recorded)", nil
+	}
+	switch rec.SHA256 {
+	case s.contentHash(store):
+		return "repo changed since last sync; run wtm sync", nil
+	case s.contentHash(repo):
+		return storeLabel + " changed since last sync; run wtm push", nil
+	default:
+		return "repo and " + storeLabel + " both changed since last sync", nil
+	}
+}
+
+func printStatus(w io.Writer, entries []statusEntry) {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "STATE\tWORKTREE\tFILE\tDETAIL")
+	for _, e := range entries {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", e.state, e.worktree.Path, e.item.rel, e.detail)
+	}
+	_ = tw.Flush()
+}
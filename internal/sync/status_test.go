@@ -0,0 +1,34 @@
+package sync
+
+import (
+	"testing"
+)
+
+func (e *testEnv) status(args ...string) error {
+	e.t.Helper()
+	return e.session().status(args)
+}
+
+func TestStatusReportsLinkHealth(t *testing.T) {
+	e := syncedEnv(t, "A=1\n")
+	// Worktree 3 was never synced, so its .env is missing.
+	wantExit(t, e.status("--worktree", "2"), 0)
+	wantExit(t, e.status(), ExitPartial)
+
+	e.write(e.repo(".env"), "A=2\n")
+	wantExit(t, e.status("--worktree", "2"), ExitPartial)
+	wantExit(t, e.sync("--worktree", "2", "--yes"), 0)
+	wantExit(t, e.status("--worktree", "2"), 0)
+}
+
+func TestStatusQuietPrintsNothing(t *testing.T) {
+	e := syncedEnv(t, "A=1\n")
+	err := e.status("--quiet")
+	wantExit(t, err, ExitPartial)
+	if err.Error() != "" {
+		t.Fatalf("expected no message with --quiet, got %q", err.Error())
+	}
+	if err := e.status(); err == nil || err.Error() == "" {
+		t.Fatalf("expected a message without --quiet, got %v", err)
+	}
+}
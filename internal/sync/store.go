@@ -0,0 +1,514 @@
+package sync
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/aayushgautam/wtm/internal/config"
+	"github.com/aayushgautam/wtm/internal/gitx"
+)
+
+type storeOptions struct {
+	repoHint string
+	to       string
+	yes      bool
+}
+
+// mergeCandidate is one existing copy of a store file that a conversion
+// may keep.
+type mergeCandidate struct {
+	path    string
+	owner   string
+	sum     [sha256.Size]byte
+	modTime time.Time
+}
+
+// mergeEntry is a single destination file written by a conversion.
+type mergeEntry struct {
+	rel        string
+	dst        string
+	candidates []mergeCandidate
+	chosen     int
+}
+
+func (e mergeEntry) conflict() bool {
+	for _, c := range e.candidates[1:] {
+		if c.sum != e.candidates[0].sum {
+			return true
+		}
+	}
+	return false
+}
+
+// relinkEntry repoints a worktree file from an old store file to a new one.
+type relinkEntry struct {
+	link   string
+	target string
+	// mode is how link is placed, as a link mode; empty for a symlink. A
+	// copy is written again and recorded for worktree under rel.
+	mode     string
+	worktree string
+	rel      string
+}
+
+// Store dispatches "wtm store <convert|migrate>".
+func Store(args []string) error {
+	if len(args) == 0 {
+		return storeUsageError(fmt.Errorf("missing subcommand"))
+	}
+	sub := args[0]
+	opts, err := parseStoreOptions(sub, args[1:])
+	if err != nil {
+		return storeUsageError(err)
+	}
+	switch sub {
+	case "convert":
+		return newSession(nil).convertStore(opts)
+	case "migrate":
+		if opts.to == "" {
+			return storeUsageError(fmt.Errorf("migrate needs --to PATH"))
+		}
+		return newSession(&storeCipher{}).migrateStore(opts)
+	default:
+		return storeUsageError(fmt.Errorf("unknown subcommand %q", sub))
+	}
+}
+
+func parseStoreOptions(sub string, args []string) (storeOptions, error) {
+	fsFlags := flag.NewFlagSet("store "+sub, flag.ContinueOnError)
+	fsFlags.SetOutput(io.Discard)
+
+	var opts storeOptions
+	fsFlags.StringVar(&opts.repoHint, "repo", "", "repo path (defaults to current dir repo)")
+	fsFlags.BoolVar(&opts.yes, "yes", false, "skip confirmation")
+	switch sub {
+	case "convert":
+		fsFlags.StringVar(&opts.to, "to", "", "store mode to convert to (defaults to the configured store.mode)")
+	case "migrate":
+		fsFlags.StringVar(&opts.to, "to", "", "directory to move every store to")
+	}
+
+	if err := fsFlags.Parse(args); err != nil {
+		return storeOptions{}, err
+	}
+	if fsFlags.NArg() > 0 {
+		return storeOptions{}, fmt.Errorf("unexpected argument %q", fsFlags.Arg(0))
+	}
+	return opts, nil
+}
+
+func storeUsageError(err error) error {
+	msg := strings.TrimSpace(err.Error())
+	if msg != "" {
+		fmt.Fprintln(os.Stderr, "Error:", msg)
+	}
+	fmt.Fprintln(os.Stderr, "usage: wtm store convert [--to shared|per-worktree] [--repo PATH] [--yes]")
+	fmt.Fprintln(os.Stderr, "       wtm store migrate --to PATH [--repo PATH] [--yes]")
+	return fmt.Errorf("invalid arguments")
+}
+
+// convertStore merges the stores of every worktree into the layout of the
+// target mode.
+func (s *session) convertStore(opts storeOptions) error {
+	repoRoot, err := s.git.RepoRoot(opts.repoHint)
+	if err != nil {
+		return err
+	}
+	wts, err := s.git.ListWorktrees(repoRoot)
+	if err != nil {
+		return err
+	}
+	loaded, err := s.loadConfig(repoRoot)
+	if err != nil {
+		return err
+	}
+	if s.cipher, err = newStoreCipher(loaded.Config); err != nil {
+		return err
+	}
+	s.historyKeep = loaded.Config.History.Keep
+
+	to := opts.to
+	if to == "" {
+		to = loaded.Config.Store.Mode
+	}
+	from := config.StoreModePerWorktree
+	switch to {
+	case config.StoreModeShared:
+	case config.StoreModePerWorktree:
+		from = config.StoreModeShared
+	case config.StoreModeLayered:
+		return fmt.Errorf("%q stores are rendered by \"wtm sync\"; set store.mode and re-run sync instead of converting", to)
+	default:
+		return storeUsageError(fmt.Errorf("unknown store mode %q", to))
+	}
+
+	var targets []gitx.Worktree
+	for _, wt := range wts {
+		if samePath(repoRoot, wt.Path) || wt.Prunable {
+			continue
+		}
+		targets = append(targets, wt)
+	}
+
+	var entries []mergeEntry
+	var relinks []relinkEntry
+	if to == config.StoreModeShared {
+		entries, relinks, err = s.planToShared(repoRoot, targets)
+	} else {
+		entries, relinks, err = s.planToPerWorktree(repoRoot, targets)
+	}
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintln(os.Stderr, "Repo:", repoRoot)
+	fmt.Fprintf(os.Stderr, "Converting %s stores to %s\n", from, to)
+	if len(entries) == 0 {
+		fmt.Fprintln(os.Stderr, "No store files found; nothing to do.")
+		return nil
+	}
+	conflicts := printMergePlan(os.Stdout, entries)
+	fmt.Fprintf(os.Stderr, "Files: %d, conflicts: %d (newest copy wins), links to update: %d\n", len(entries), conflicts, len(relinks))
+
+	if !opts.yes {
+		if !s.confirm("Proceed? [y/N] ") {
+			fmt.Fprintln(os.Stderr, "Aborted.")
+			return nil
+		}
+	}
+
+	manifests := make(map[string]*storeManifest)
+	written := 0
+	for _, e := range entries {
+		if err := s.convertEntry(manifests, e); err != nil {
+			fmt.Fprintln(os.Stderr, "Error writing store:", err)
+			continue
+		}
+		written++
+	}
+
+	relinked := 0
+	for _, r := range relinks {
+		if err := s.repoint(manifests, r, loaded.Config.Symlinks == config.SymlinksRelative); err != nil {
+			fmt.Fprintln(os.Stderr, "Error relinking:", err)
+			continue
+		}
+		relinked++
+	}
+	for _, m := range manifests {
+		if err := m.save(); err != nil {
+			fmt.Fprintln(os.Stderr, "Error updating manifest:", err)
+		}
+	}
+
+	fmt.Fprintf(os.Stderr, "Done. Wrote %d files, relinked %d.\n", written, relinked)
+	if to != loaded.Config.Store.Mode {
+		fmt.Fprintf(os.Stderr, "Set store.mode to %q in %s so later commands use the converted store.\n", to, config.DefaultConfigFileName)
+	}
+	fmt.Fprintln(os.Stderr, "The previous store directories were left in place; remove them with \"wtm prune\" once you are happy with the result.")
+	return nil
+}
+
+// convertEntry writes the chosen copy of e to its destination and carries
+// its manifest record over, so push still sees what the store changed.
+func (s *session) convertEntry(manifests map[string]*storeManifest, e mergeEntry) error {
+	src := e.candidates[e.chosen].path
+	suffix := string(filepath.Separator) + filepath.FromSlash(e.rel)
+	from, err := s.manifestFor(manifests, strings.TrimSuffix(src, suffix))
+	if err != nil {
+		return err
+	}
+	to, err := s.manifestFor(manifests, strings.TrimSuffix(e.dst, suffix))
+	if err != nil {
+		return err
+	}
+	if !samePath(src, e.dst) {
+		plain, err := s.readFile(src)
+		if err != nil {
+			return err
+		}
+		info, err := s.fs.Stat(src)
+		if err != nil {
+			return fmt.Errorf("stat %s: %w", src, err)
+		}
+		write := func() error { return s.writeFile(e.dst, plain, info.Mode().Perm()) }
+		if err := s.withHistory(planItem{rel: e.rel}, e.dst, historyConvert, write); err != nil {
+			return err
+		}
+	}
+	return to.adopt(e.rel, from)
+}
+
+// repoint places r.link from its new store file.
+func (s *session) repoint(manifests map[string]*storeManifest, r relinkEntry, relative bool) error {
+	switch r.mode {
+	case config.LinkHardlink:
+		return s.ensureWorktreeHardlink(r.target, r.link, true)
+	case config.LinkCopy:
+		content, err := s.ensureWorktreeCopy(r.target, r.link, "", true)
+		if err != nil {
+			return err
+		}
+		m, err := s.manifestFor(manifests, strings.TrimSuffix(r.target, string(filepath.Separator)+filepath.FromSlash(r.rel)))
+		if err != nil {
+			return err
+		}
+		m.recordCopy(r.rel, r.worktree, content)
+		return nil
+	}
+	target, err := s.symlinkTarget(r.target, r.link, relative)
+	if err != nil {
+		return err
+	}
+	return s.replaceSymlink(target, r.link)
+}
+
+func (s *session) planToShared(repoRoot string, wts []gitx.Worktree) ([]mergeEntry, []relinkEntry, error) {
+	shared, err := storeRootPath(repoRoot, gitx.Worktree{}, config.StoreModeShared)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	byRel := make(map[string][]mergeCandidate)
+	if err := s.collectCandidates(shared, sharedStoreName, byRel); err != nil {
+		return nil, nil, err
+	}
+	oldRoots := make(map[string]string, len(wts))
+	for _, wt := range wts {
+		root, err := storeRootPath(repoRoot, wt, config.StoreModePerWorktree)
+		if err != nil {
+			return nil, nil, err
+		}
+		oldRoots[wt.Path] = root
+		if err := s.collectCandidates(root, wt.Path, byRel); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	var entries []mergeEntry
+	for rel, cands := range byRel {
+		entries = append(entries, newMergeEntry(rel, filepath.Join(shared, filepath.FromSlash(rel)), cands))
+	}
+	sortMergeEntries(entries)
+
+	var relinks []relinkEntry
+	for _, wt := range wts {
+		for _, e := range entries {
+			relOS := filepath.FromSlash(e.rel)
+			if r, ok := s.worktreeToRepoint(wt.Path, e.rel, filepath.Join(oldRoots[wt.Path], relOS), e.dst); ok {
+				relinks = append(relinks, r)
+			}
+		}
+	}
+	return entries, relinks, nil
+}
+
+func (s *session) planToPerWorktree(repoRoot string, wts []gitx.Worktree) ([]mergeEntry, []relinkEntry, error) {
+	shared, err := storeRootPath(repoRoot, gitx.Worktree{}, config.StoreModeShared)
+	if err != nil {
+		return nil, nil, err
+	}
+	sharedFiles := make(map[string][]mergeCandidate)
+	if err := s.collectCandidates(shared, sharedStoreName, sharedFiles); err != nil {
+		return nil, nil, err
+	}
+
+	var entries []mergeEntry
+	var relinks []relinkEntry
+	for _, wt := range wts {
+		root, err := storeRootPath(repoRoot, wt, config.StoreModePerWorktree)
+		if err != nil {
+			return nil, nil, err
+		}
+		existing := make(map[string][]mergeCandidate)
+		if err := s.collectCandidates(root, wt.Path, existing); err != nil {
+			return nil, nil, err
+		}
+		for rel, cands := range sharedFiles {
+			dst := filepath.Join(root, filepath.FromSlash(rel))
+			entries = append(entries, newMergeEntry(rel, dst, append(append([]mergeCandidate(nil), cands...), existing[rel]...)))
+			if r, ok := s.worktreeToRepoint(wt.Path, rel, cands[0].path, dst); ok {
+				relinks = append(relinks, r)
+			}
+		}
+	}
+	sortMergeEntries(entries)
+	return entries, relinks, nil
+}
+
+// collectCandidates adds every file below root to byRel, labelled owner.
+// Candidates are compared by their decrypted content.
+func (s *session) collectCandidates(root, owner string, byRel map[string][]mergeCandidate) error {
+	return walkDir(s.fs, root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && path == root {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		if d.IsDir() {
+			if path != root && strings.HasPrefix(d.Name(), metaDirPrefix) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if strings.HasPrefix(d.Name(), metaDirPrefix) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		relOS, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		plain, err := s.readFile(path)
+		if err != nil {
+			return err
+		}
+		rel := filepath.ToSlash(relOS)
+		byRel[rel] = append(byRel[rel], mergeCandidate{path: path, owner: owner, sum: sha256.Sum256(plain), modTime: info.ModTime()})
+		return nil
+	})
+}
+
+func newMergeEntry(rel, dst string, cands []mergeCandidate) mergeEntry {
+	e := mergeEntry{rel: rel, dst: dst, candidates: cands}
+	for i, c := range cands {
+		if c.modTime.After(cands[e.chosen].modTime) {
+			e.chosen = i
+		}
+	}
+	return e
+}
+
+func sortMergeEntries(entries []mergeEntry) {
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].rel != entries[j].rel {
+			return entries[i].rel < entries[j].rel
+		}
+		return entries[i].dst < entries[j].dst
+	})
+}
+
+// worktreeToRepoint reports whether the worktree file rel of wtPath was
+// placed from oldTarget, and how to place it from newTarget instead. A copy
+// is only replaced while it holds what oldTarget does.
+func (s *session) worktreeToRepoint(wtPath, rel, oldTarget, newTarget string) (relinkEntry, bool) {
+	link := filepath.Join(wtPath, filepath.FromSlash(rel))
+	info, err := s.fs.Lstat(link)
+	if err != nil {
+		return relinkEntry{}, false
+	}
+	if info.Mode()&os.ModeSymlink != 0 {
+		return s.linkToRepoint(link, oldTarget, newTarget)
+	}
+	if !info.Mode().IsRegular() || samePath(oldTarget, newTarget) {
+		return relinkEntry{}, false
+	}
+	r := relinkEntry{link: link, target: newTarget, mode: config.LinkHardlink, worktree: wtPath, rel: rel}
+	if s.sameFile(link, oldTarget) {
+		return r, true
+	}
+	old, err := s.readFile(oldTarget)
+	if err != nil {
+		return relinkEntry{}, false
+	}
+	cur, err := s.fs.ReadFile(link)
+	if err != nil || !bytes.Equal(cur, old) {
+		return relinkEntry{}, false
+	}
+	r.mode = config.LinkCopy
+	return r, true
+}
+
+// linkToRepoint reports whether link is a symlink to oldTarget that should
+// be pointed at newTarget instead.
+func (s *session) linkToRepoint(link, oldTarget, newTarget string) (relinkEntry, bool) {
+	info, err := s.fs.Lstat(link)
+	if err != nil || info.Mode()&os.ModeSymlink == 0 {
+		return relinkEntry{}, false
+	}
+	current, err := s.readLinkAbs(link)
+	if err != nil {
+		return relinkEntry{}, false
+	}
+	if !samePath(current, oldTarget) || samePath(current, newTarget) {
+		return relinkEntry{}, false
+	}
+	return relinkEntry{link: link, target: newTarget}, true
+}
+
+func printMergePlan(w io.Writer, entries []mergeEntry) int {
+	conflicts := 0
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "FILE\tDESTINATION\tRESULT")
+	for _, e := range entries {
+		chosen := e.candidates[e.chosen]
+		if !e.conflict() {
+			fmt.Fprintf(tw, "%s\t%s\tidentical in %d store(s)\n", e.rel, e.dst, len(e.candidates))
+			continue
+		}
+		conflicts++
+		var others []string
+		for i, c := range e.candidates {
+			if i != e.chosen && c.sum != chosen.sum {
+				others = append(others, c.owner)
+			}
+		}
+		fmt.Fprintf(tw, "%s\t%s\tCONFLICT: keeping %s (modified %s); differs in %s\n",
+			e.rel, e.dst, chosen.owner, chosen.modTime.Format("2006-01-02 15:04"), strings.Join(others, ", "))
+	}
+	_ = tw.Flush()
+	if dropped := droppedCopies(entries); len(dropped) > 0 {
+		fmt.Fprintln(w, "Differing copies that will not be kept:")
+		for _, path := range dropped {
+			fmt.Fprintln(w, "  "+path)
+		}
+	}
+	return conflicts
+}
+
+// droppedCopies returns the paths of the candidates whose content differs
+// from the copy chosen for their entry.
+func droppedCopies(entries []mergeEntry) []string {
+	var dropped []string
+	for _, e := range entries {
+		chosen := e.candidates[e.chosen]
+		for _, c := range e.candidates {
+			if c.sum != chosen.sum {
+				dropped = append(dropped, c.path)
+			}
+		}
+	}
+	return dropped
+}
+
+// replaceSymlink atomically points link at target by renaming a freshly
+// created symlink over it.
+func (s *session) replaceSymlink(target, link string) error {
+	tmp := link + ".wtm-tmp"
+	_ = s.fs.Remove(tmp)
+	if err := s.fs.Symlink(target, tmp); err != nil {
+		return fmt.Errorf("symlink %s -> %s: %w", tmp, target, err)
+	}
+	if err := s.fs.Rename(tmp, link); err != nil {
+		_ = s.fs.Remove(tmp)
+		return fmt.Errorf("rename %s -> %s: %w", tmp, link, err)
+	}
+	return nil
+}
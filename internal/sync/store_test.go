@@ -0,0 +1,111 @@
+package sync
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aayushgautam/wtm/internal/age"
+	"github.com/aayushgautam/wtm/internal/config"
+)
+
+func (e *testEnv) convert(to string) string {
+	e.t.Helper()
+	var err error
+	out := captureStdout(e.t, func() { err = e.session().convertStore(storeOptions{to: to, yes: true}) })
+	wantExit(e.t, err, 0)
+	return out
+}
+
+func TestConvertComparesDecryptedContent(t *testing.T) {
+	id, err := age.GenerateIdentity()
+	if err != nil {
+		t.Fatalf("generate identity: %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "identity.txt")
+	if err := os.WriteFile(path, []byte(id.String()+"\n"), 0o600); err != nil {
+		t.Fatalf("write identity: %v", err)
+	}
+	t.Setenv(identityEnv, path)
+
+	e := newTestEnv(t)
+	e.cfg.Encryption.Recipients = []string{id.Recipient().String()}
+	e.write(e.repo(".env"), "A=1\n")
+	wantExit(t, e.sync("--all", "--yes"), 0)
+	if e.read(e.store(2, ".env")) == e.read(e.store(3, ".env")) {
+		t.Fatal("expected the stores to be encrypted separately")
+	}
+
+	if out := e.convert(config.StoreModeShared); !strings.Contains(out, "identical in 2 store(s)") || strings.Contains(out, "CONFLICT") {
+		t.Fatalf("expected no conflict, got:\n%s", out)
+	}
+	e.cfg.Store.Mode = config.StoreModeShared
+	shared := e.store(2, ".env")
+	s := e.session()
+	if s.cipher, err = newStoreCipher(e.cfg); err != nil {
+		t.Fatalf("cipher: %v", err)
+	}
+	plain, err := s.readFile(shared)
+	if err != nil || string(plain) != "A=1\n" {
+		t.Fatalf("expected the shared store to hold A=1, got %q (%v)", plain, err)
+	}
+
+	// The copies are recorded in the shared manifest, so sync leaves them be.
+	m, err := s.loadManifest(filepath.Dir(shared))
+	if err != nil {
+		t.Fatalf("load manifest: %v", err)
+	}
+	rec := m.Files[".env"]
+	if rec == nil || rec.SHA256 != s.contentHash([]byte("A=1\n")) || len(rec.Copies) != 2 {
+		t.Fatalf("expected the record and both copies carried over, got %+v", rec)
+	}
+}
+
+func TestConvertRelinksEveryLinkMode(t *testing.T) {
+	e := newTestEnv(t)
+	e.cfg.Link.Rules = []config.LinkRule{{Pattern: ".env.hard", Mode: config.LinkHardlink}, {Pattern: ".env.copy", Mode: config.LinkCopy}}
+	for _, rel := range []string{".env", ".env.hard", ".env.copy"} {
+		e.write(e.repo(rel), "A=1\n")
+	}
+	wantExit(t, e.sync("--worktree", "2", "--yes"), 0)
+	e.write(e.wt(2, ".env"), "A=2\n")
+
+	e.convert(config.StoreModeShared)
+	e.cfg.Store.Mode = config.StoreModeShared
+	e.wantLink(2, ".env")
+	if !e.session().sameFile(e.wt(2, ".env.hard"), e.store(2, ".env.hard")) {
+		t.Fatal("expected .env.hard hard linked to the shared store")
+	}
+	m, err := e.session().loadManifest(filepath.Dir(e.store(2, ".env")))
+	if err != nil {
+		t.Fatalf("load manifest: %v", err)
+	}
+	if m.copyHash(".env.copy", e.wts[1].Path) == "" {
+		t.Fatal("expected the copy recorded in the shared manifest")
+	}
+
+	// The manifest still knows what the store started from, so push sees
+	// the edit made before the conversion.
+	wantExit(t, e.push("--worktree", "2", "--yes"), 0)
+	if got := e.read(e.repo(".env")); got != "A=2\n" {
+		t.Fatalf("expected push to bring the edit over, got %q", got)
+	}
+}
+
+func TestConvertListsDroppedCopies(t *testing.T) {
+	e := newTestEnv(t)
+	e.write(e.repo(".env"), "A=1\n")
+	wantExit(t, e.sync("--all", "--yes"), 0)
+	e.write(e.wt(2, ".env"), "A=2\n")
+	e.age(e.store(2, ".env"), time.Hour)
+
+	out := e.convert(config.StoreModeShared)
+	if !strings.Contains(out, "CONFLICT") || !strings.Contains(out, "  "+e.store(2, ".env")+"\n") {
+		t.Fatalf("expected the older copy to be listed as dropped, got:\n%s", out)
+	}
+	if strings.Contains(out, "  "+e.store(3, ".env")+"\n") {
+		t.Fatalf("expected the kept copy not to be listed, got:\n%s", out)
+	}
+}
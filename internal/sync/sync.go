@@ -1,7 +1,7 @@
 package sync
 
 import (
-	"bufio"
+	"bytes"
 	"errors"
 	"flag"
 	"fmt"
@@ -12,6 +12,7 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"text/tabwriter"
 	"time"
 
 	"github.com/aayushgautam/wtm/internal/config"
@@ -20,8 +21,16 @@ import (
 )
 
 const (
-	storeRootDir = ".wtm"
-	storeSubDir  = "configs"
+	storeRootDir    = ".wtm"
+	storeSubDir     = "configs"
+	homeEnv         = "WTM_HOME"
+	sharedStoreName = "_shared"
+	// parentSegment stands for ".." in a store path. sanitizeName trims
+	// "_", so no directory name maps to it.
+	parentSegment = "_up"
+	// metaDirPrefix marks directories and files inside a store that hold
+	// wtm's own data rather than files mirrored from the repo.
+	metaDirPrefix = ".wtm-"
 )
 
 type planItem struct {
@@ -29,6 +38,75 @@ type planItem struct {
 	repoAbs     string
 	storeAbs    string
 	worktreeAbs string
+	// Layered mode only: the shared base the repo file is copied to and the
+	// per-worktree overlay rendered on top of it into storeAbs.
+	baseAbs    string
+	overlayAbs string
+	// link is the config link mode used for the worktree copy, and
+	// relative whether symlinks are written relative to the worktree file.
+	link     string
+	relative bool
+	// template is set when repoAbs is a template rendered into storeAbs.
+	template *templateContext
+}
+
+// syncedAbs returns the store file sync copies the repo file of it into.
+func (it planItem) syncedAbs() string {
+	if it.baseAbs != "" {
+		return it.baseAbs
+	}
+	return it.storeAbs
+}
+
+type worktreePlan struct {
+	worktree  gitx.Worktree
+	storeRoot string
+	items     []planItem
+}
+
+type syncResult struct {
+	copied    int // written into the store
+	kept      int // store edits kept instead
+	linked    int // placed into the worktree
+	skipped   int // declined by the user
+	conflicts int // dry run: would have asked before overwriting
+	failed    int
+	items     []itemResult
+}
+
+// syncSummary is the summary record of "wtm sync --output".
+type syncSummary struct {
+	Outcome   string `json:"outcome"`
+	Worktrees int    `json:"worktrees"`
+	Copied    int    `json:"copied"`
+	Kept      int    `json:"kept,omitempty"`
+	Linked    int    `json:"linked"`
+	Skipped   int    `json:"skipped"`
+	Conflicts int    `json:"conflicts,omitempty"`
+	Errors    int    `json:"errors"`
+	DryRun    bool   `json:"dryRun,omitempty"`
+}
+
+func (s *syncSummary) add(res syncResult) {
+	s.Copied += res.copied
+	s.Kept += res.kept
+	s.Linked += res.linked
+	s.Skipped += res.skipped
+	s.Conflicts += res.conflicts
+	s.Errors += res.failed
+	if s.Outcome == outcomeOK && res.skipped+res.failed > 0 {
+		s.Outcome = outcomePartial
+	}
+}
+
+// pushSummary is the summary record of "wtm push --output".
+type pushSummary struct {
+	Outcome   string `json:"outcome"`
+	Pushed    int    `json:"pushed"`
+	Skipped   int    `json:"skipped"`
+	Conflicts int    `json:"conflicts"`
+	Errors    int    `json:"errors"`
+	DryRun    bool   `json:"dryRun,omitempty"`
 }
 
 type skipError struct {
@@ -41,181 +119,556 @@ type syncOptions struct {
 	destOverride string
 	yes          bool
 	force        bool
+	dryRun       bool
+	all          bool
+	branch       string
+	strategy     string
+	prefer       string
+	output       string
 }
 
 func (e skipError) Error() string {
 	return "skipped " + e.dst
 }
 
+// Run is "wtm sync".
 func Run(args []string) error {
+	return newSession(nil).sync(args)
+}
+
+func (s *session) sync(args []string) error {
 	opts, err := parseOptions("sync", args)
 	if err != nil {
 		return usageError("sync", err)
 	}
+	rep := newReporter(opts.output, "sync", os.Stdout)
+	if opts.all && (opts.destOverride != "" || opts.worktreeNum != 0) {
+		return usageError("sync", fmt.Errorf("--all cannot be combined with --worktree or --dest"))
+	}
+	if opts.branch != "" && !doublestar.ValidatePattern(opts.branch) {
+		return usageError("sync", fmt.Errorf("invalid --branch pattern %q", opts.branch))
+	}
 
-	repoRoot, err := gitx.RepoRoot(opts.repoHint)
+	repoRoot, err := s.git.RepoRoot(opts.repoHint)
 	if err != nil {
 		return err
 	}
 
-	wts, err := gitx.ListWorktrees(repoRoot)
+	wts, err := s.git.ListWorktrees(repoRoot)
 	if err != nil {
 		return err
 	}
 
-	worktree, err := pickWorktree(repoRoot, wts, opts.destOverride, opts.worktreeNum)
+	loaded, err := s.loadConfig(repoRoot)
 	if err != nil {
 		return err
 	}
-	destRoot := worktree.Path
-	if samePath(repoRoot, destRoot) {
-		return fmt.Errorf("selected worktree is the current repo root; nothing to sync")
+	if s.cipher, err = newStoreCipher(loaded.Config); err != nil {
+		return err
+	}
+	s.historyKeep = loaded.Config.History.Keep
+	if opts.dryRun {
+		s = s.dryRunSession()
+	}
+	if err := s.moveLegacyStores(repoRoot, wts, loaded.Config.Store.Mode); err != nil {
+		return err
+	}
+
+	if opts.all {
+		return s.runAll(repoRoot, wts, loaded, opts, rep)
 	}
 
-	loaded, err := config.Load(repoRoot)
+	worktree, err := s.pickWorktree(repoRoot, wts, opts.destOverride, opts.worktreeNum)
 	if err != nil {
 		return err
 	}
+	destRoot := worktree.Path
+	if samePath(repoRoot, destRoot) {
+		return fmt.Errorf("selected worktree is the current repo root; nothing to sync")
+	}
 
-	storeRoot, err := storeRootPath(repoRoot, worktree)
+	storeRoot, err := storeRootPath(repoRoot, worktree, loaded.Config.Store.Mode)
 	if err != nil {
 		return err
 	}
 
-	plan, err := buildSyncPlan(repoRoot, destRoot, storeRoot, loaded.Config)
+	plan, err := s.buildSyncPlan(repoRoot, destRoot, storeRoot, loaded.Config)
 	if err != nil {
 		return err
 	}
 
-	printSyncPlan(repoRoot, destRoot, storeRoot, loaded.Source, plan)
+	if rep.machine() {
+		for _, it := range plan {
+			if err := rep.add("plan", newJSONPlanItem(destRoot, it)); err != nil {
+				return err
+			}
+		}
+	} else {
+		printSyncPlan(repoRoot, destRoot, storeRoot, loaded.Source, plan)
+	}
 
-	plan, err = choosePlanEntries(plan, opts.yes, "sync")
+	sum := syncSummary{Outcome: outcomeOK, Worktrees: 1, DryRun: opts.dryRun}
+	plan, err = s.choosePlanEntries(plan, opts.yes || opts.dryRun, "sync")
 	if err != nil {
 		return err
 	}
 	if len(plan) == 0 {
 		fmt.Fprintln(os.Stderr, "No files matched; nothing to do.")
-		return nil
+		sum.Outcome = outcomeNothingToDo
+		return finish(rep, sum)
 	}
 
-	if !opts.yes {
-		if !confirm("Proceed? [y/N] ") {
+	if !opts.yes && !opts.dryRun {
+		if !s.confirm("Proceed? [y/N] ") {
 			fmt.Fprintln(os.Stderr, "Aborted.")
-			return nil
+			sum.Outcome = outcomeAborted
+			return finish(rep, sum)
 		}
 	}
 
-	copied := 0
-	linked := 0
-	skipped := 0
+	res := s.applySyncPlan(repoRoot, worktreePlan{worktree: worktree, storeRoot: storeRoot, items: plan}, opts.force, opts.prefer)
+	for _, r := range res.items {
+		if err := rep.add("result", r); err != nil {
+			return err
+		}
+	}
+	sum.add(res)
+	switch {
+	case opts.dryRun && !rep.machine():
+		printDryRun(res.items)
+	case !opts.dryRun:
+		fmt.Fprintf(os.Stderr, "Done. Copied into store: %d, linked: %d, skipped: %d\n", res.copied, res.linked, res.skipped+res.failed)
+	}
+	return finish(rep, sum)
+}
 
-	for _, it := range plan {
-		if err := copyRepoToStore(it.repoAbs, it.storeAbs); err != nil {
+func (s syncSummary) exit() error {
+	return outcomeError(s.Outcome, "")
+}
+
+func (s pushSummary) exit() error {
+	if s.Conflicts > 0 && !s.DryRun {
+		return outcomeError(s.Outcome, fmt.Sprintf("%d files have conflict markers; resolve them before committing", s.Conflicts))
+	}
+	return outcomeError(s.Outcome, "")
+}
+
+// runAll syncs every worktree other than repoRoot (optionally filtered by
+// branch) after a single confirmation.
+func (s *session) runAll(repoRoot string, wts []gitx.Worktree, loaded config.Loaded, opts syncOptions, rep *reporter) error {
+	var plans []worktreePlan
+	total := 0
+	for _, wt := range wts {
+		if samePath(repoRoot, wt.Path) || wt.Prunable {
+			continue
+		}
+		if opts.branch != "" && !branchMatches(opts.branch, wt.Branch) {
+			continue
+		}
+		storeRoot, err := storeRootPath(repoRoot, wt, loaded.Config.Store.Mode)
+		if err != nil {
+			return err
+		}
+		items, err := s.buildSyncPlan(repoRoot, wt.Path, storeRoot, loaded.Config)
+		if err != nil {
+			return err
+		}
+		plans = append(plans, worktreePlan{worktree: wt, storeRoot: storeRoot, items: items})
+		total += len(items)
+	}
+
+	sum := syncSummary{Outcome: outcomeOK, Worktrees: len(plans), DryRun: opts.dryRun}
+	if len(plans) == 0 {
+		if opts.branch != "" {
+			fmt.Fprintf(os.Stderr, "No worktrees match --branch %q; nothing to do.\n", opts.branch)
+		} else {
+			fmt.Fprintln(os.Stderr, "No other worktrees; nothing to do.")
+		}
+		sum.Outcome = outcomeNothingToDo
+		return finish(rep, sum)
+	}
+
+	if rep.machine() {
+		for _, p := range plans {
+			for _, it := range p.items {
+				if err := rep.add("plan", newJSONPlanItem(p.worktree.Path, it)); err != nil {
+					return err
+				}
+			}
+		}
+	} else {
+		printAllSyncPlans(repoRoot, loaded.Source, plans, total)
+	}
+
+	if total == 0 {
+		fmt.Fprintln(os.Stderr, "No files matched; nothing to do.")
+		sum.Outcome = outcomeNothingToDo
+		return finish(rep, sum)
+	}
+
+	if !opts.yes && !opts.dryRun {
+		if !s.confirm(fmt.Sprintf("Sync %d entries into %d worktrees? [y/N] ", total, len(plans))) {
+			fmt.Fprintln(os.Stderr, "Aborted.")
+			sum.Outcome = outcomeAborted
+			return finish(rep, sum)
+		}
+	}
+
+	var results []itemResult
+	for _, p := range plans {
+		res := s.applySyncPlan(repoRoot, p, opts.force, opts.prefer)
+		if !opts.dryRun {
+			fmt.Fprintf(os.Stderr, "%s: copied %d, linked %d, skipped %d\n", p.worktree.Path, res.copied, res.linked, res.skipped+res.failed)
+		}
+		for _, r := range res.items {
+			if err := rep.add("result", r); err != nil {
+				return err
+			}
+		}
+		results = append(results, res.items...)
+		sum.add(res)
+	}
+
+	switch {
+	case opts.dryRun && !rep.machine():
+		printDryRun(results)
+	case !opts.dryRun:
+		fmt.Fprintf(os.Stderr, "Done. %d worktrees; copied into store: %d, linked: %d, skipped: %d\n", len(plans), sum.Copied, sum.Linked, sum.Skipped+sum.Errors)
+	}
+	return finish(rep, sum)
+}
+
+// applySyncPlan writes the store files of p, places them in the worktree
+// and records them in the manifests.
+func (s *session) applySyncPlan(repoRoot string, p worktreePlan, force bool, prefer string) syncResult {
+	var res syncResult
+	manifests := make(map[string]*storeManifest)
+	for _, it := range p.items {
+		result := itemResult{Worktree: p.worktree.Path, Rel: it.rel}
+		var probe dryRunProbe
+		if s.dryRun {
+			probe = s.probe(it.worktreeAbs)
+		}
+		outcome, err := s.syncStoreFile(manifests, repoRoot, p, it, prefer, force)
+		if err != nil {
 			fmt.Fprintln(os.Stderr, "Error copying to store:", err)
-			skipped++
+			res.failed++
+			result.Action, result.Reason = actionError, "copying to store: "+err.Error()
+			res.items = append(res.items, result)
 			continue
 		}
-		copied++
+		switch outcome {
+		case storeConflict:
+			res.conflicts++
+			result.Action, result.Reason = actionConflict, "would ask before replacing store edits; pass --prefer to decide"
+			res.items = append(res.items, result)
+			continue
+		case storeKept:
+			if !s.dryRun {
+				fmt.Fprintln(os.Stderr, "Kept store edits:", it.storeAbs)
+			}
+			res.kept++
+			result.Store, result.Reason = storeActionKept, "store edits kept; run wtm push to bring them into the repo"
+		case storeMerged:
+			if !s.dryRun {
+				fmt.Fprintln(os.Stderr, "Merged repo changes into store edits:", it.storeAbs)
+			}
+			res.copied++
+			result.Store, result.Reason = storeActionMerged, "repo changes merged into store edits"
+		case storeOverlaid:
+			if !s.dryRun {
+				fmt.Fprintln(os.Stderr, "Moved store edits into the overlay:", it.overlayAbs)
+			}
+			res.copied++
+			result.Store, result.Reason = storeActionOverlaid, "store edits moved into "+it.overlayAbs
+		default:
+			res.copied++
+		}
 
-		if err := ensureWorktreeLink(it.storeAbs, it.worktreeAbs, opts.force); err != nil {
+		m := manifests[p.storeRoot]
+		tracked := ""
+		if m != nil {
+			tracked = m.copyHash(it.rel, p.worktree.Path)
+		}
+		copied, err := s.placeWorktreeFile(it, tracked, force)
+		if copied != nil && m != nil {
+			m.recordCopy(it.rel, p.worktree.Path, copied)
+		}
+		if err != nil {
 			var se skipError
+			var pe promptError
+			if errors.As(err, &pe) {
+				res.conflicts++
+				result.Action, result.Reason = actionConflict, pe.Error()+"; pass --force to replace it"
+				res.items = append(res.items, result)
+				continue
+			}
 			if errors.As(err, &se) {
 				fmt.Fprintln(os.Stderr, "Skipped:", se.dst)
-				skipped++
+				res.skipped++
+				result.Action, result.Reason = actionSkipped, "kept existing "+se.dst
+				res.items = append(res.items, result)
 				continue
 			}
-			fmt.Fprintln(os.Stderr, "Error symlinking:", err)
-			skipped++
+			fmt.Fprintln(os.Stderr, "Error linking:", err)
+			res.failed++
+			result.Action, result.Reason = actionError, "linking: "+err.Error()
+			res.items = append(res.items, result)
 			continue
 		}
-		linked++
+		res.linked++
+		result.Action = actionLinked
+		if it.link == config.LinkCopy {
+			result.Action = actionCopied
+		}
+		if s.dryRun {
+			created := actionCreateLink
+			if it.link == config.LinkCopy {
+				created = actionCreateCopy
+			}
+			result.Action = s.action(probe, created)
+		}
+		res.items = append(res.items, result)
+	}
+	for _, m := range manifests {
+		if err := m.save(); err != nil {
+			fmt.Fprintln(os.Stderr, "Error updating manifest:", err)
+		}
 	}
+	return res
+}
 
-	fmt.Fprintf(os.Stderr, "Done. Copied into store: %d, linked: %d, skipped: %d\n", copied, linked, skipped)
+// recordSync adds the file just written for it to the store manifests.
+func (s *session) recordSync(manifests map[string]*storeManifest, repoRoot string, p worktreePlan, it planItem) error {
+	roots := map[string]string{p.storeRoot: it.storeAbs}
+	if it.baseAbs != "" {
+		roots[strings.TrimSuffix(it.baseAbs, string(filepath.Separator)+filepath.FromSlash(it.rel))] = it.baseAbs
+	}
+	for root, path := range roots {
+		m, err := s.manifestFor(manifests, root)
+		if err != nil {
+			return err
+		}
+		content, err := s.readFile(path)
+		if err != nil {
+			return err
+		}
+		if err := m.recordSync(it.rel, content, repoRoot, p.worktree); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
+// manifestFor returns the manifest of the store at root from manifests,
+// loading it on first use.
+func (s *session) manifestFor(manifests map[string]*storeManifest, root string) (*storeManifest, error) {
+	if m := manifests[root]; m != nil {
+		return m, nil
+	}
+	m, err := s.loadManifest(root)
+	if err != nil {
+		return nil, err
+	}
+	manifests[root] = m
+	return m, nil
+}
+
+// Push is "wtm push".
 func Push(args []string) error {
+	return newSession(nil).push(args)
+}
+
+func (s *session) push(args []string) error {
 	opts, err := parseOptions("push", args)
 	if err != nil {
 		return usageError("push", err)
 	}
+	rep := newReporter(opts.output, "push", os.Stdout)
 
-	repoRoot, err := gitx.RepoRoot(opts.repoHint)
+	repoRoot, err := s.git.RepoRoot(opts.repoHint)
 	if err != nil {
 		return err
 	}
 
-	wts, err := gitx.ListWorktrees(repoRoot)
+	wts, err := s.git.ListWorktrees(repoRoot)
 	if err != nil {
 		return err
 	}
 
-	worktree, err := pickWorktree(repoRoot, wts, opts.destOverride, opts.worktreeNum)
+	worktree, err := s.pickWorktree(repoRoot, wts, opts.destOverride, opts.worktreeNum)
 	if err != nil {
 		return err
 	}
 
-	loaded, err := config.Load(repoRoot)
+	loaded, err := s.loadConfig(repoRoot)
 	if err != nil {
 		return err
 	}
+	if s.cipher, err = newStoreCipher(loaded.Config); err != nil {
+		return err
+	}
+	s.historyKeep = loaded.Config.History.Keep
+	if opts.dryRun {
+		s = s.dryRunSession()
+	}
+	if err := s.moveLegacyStores(repoRoot, wts, loaded.Config.Store.Mode); err != nil {
+		return err
+	}
 
-	storeRoot, err := storeRootPath(repoRoot, worktree)
+	storeRoot, err := pushStoreRoot(repoRoot, worktree, loaded.Config.Store.Mode)
 	if err != nil {
 		return err
 	}
 
-	if _, err := os.Stat(storeRoot); err != nil {
+	if _, err := s.fs.Stat(storeRoot); err != nil {
 		if os.IsNotExist(err) {
 			return fmt.Errorf("store %s does not exist; run \"wtm sync\" first", storeRoot)
 		}
 		return err
 	}
 
-	plan, err := buildPushPlan(storeRoot, repoRoot, loaded.Config)
+	plan, err := s.buildPushPlan(storeRoot, repoRoot, loaded.Config)
 	if err != nil {
 		return err
 	}
 
-	printPushPlan(repoRoot, storeRoot, loaded.Source, plan)
+	if rep.machine() {
+		for _, it := range plan {
+			if err := rep.add("plan", newJSONPlanItem(worktree.Path, it)); err != nil {
+				return err
+			}
+		}
+	} else {
+		printPushPlan(repoRoot, storeRoot, loaded.Source, plan)
+	}
 
-	plan, err = choosePlanEntries(plan, opts.yes, "push")
+	sum := pushSummary{Outcome: outcomeOK, DryRun: opts.dryRun}
+	plan, err = s.choosePlanEntries(plan, opts.yes || opts.dryRun, "push")
 	if err != nil {
 		return err
 	}
 	if len(plan) == 0 {
 		fmt.Fprintln(os.Stderr, "No files in store match the configured include/exclude patterns.")
-		return nil
+		sum.Outcome = outcomeNothingToDo
+		return finish(rep, sum)
 	}
 
-	if !opts.yes {
-		if !confirm("Proceed? [y/N] ") {
+	if !opts.yes && !opts.dryRun {
+		if !s.confirm("Proceed? [y/N] ") {
 			fmt.Fprintln(os.Stderr, "Aborted.")
-			return nil
+			sum.Outcome = outcomeAborted
+			return finish(rep, sum)
 		}
 	}
 
-	pushed := 0
-	skipped := 0
+	strategy := opts.strategy
+	if strategy == "" && opts.force {
+		strategy = strategyOurs
+	}
 
-	for _, it := range plan {
-		if err := copyStoreToRepo(it.storeAbs, it.repoAbs, opts.force); err != nil {
-			var se skipError
-			if errors.As(err, &se) {
-				fmt.Fprintln(os.Stderr, "Skipped:", se.dst)
-				skipped++
+	manifest, err := s.loadManifest(storeRoot)
+	if err != nil {
+		return err
+	}
+
+	// note prints progress, which a dry run replaces with its report.
+	note := func(a ...interface{}) {
+		if !opts.dryRun {
+			fmt.Fprintln(os.Stderr, a...)
+		}
+	}
+
+	if loaded.Config.Store.Mode != config.StoreModeLayered {
+		for _, it := range plan {
+			captured, err := s.captureWorktreeCopy(manifest, it, worktree.Path)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "Error copying worktree edits into store:", err)
 				continue
 			}
+			if captured {
+				note("Copied worktree edits into store:", it.storeAbs)
+			}
+		}
+	}
+
+	var results []itemResult
+	for _, it := range plan {
+		result := itemResult{Worktree: worktree.Path, Rel: it.rel}
+		var probe dryRunProbe
+		if s.dryRun {
+			probe = s.probe(it.repoAbs)
+		}
+		outcome, err := s.pushItem(manifest, repoRoot, worktree, it, strategy)
+		switch {
+		case err != nil:
 			fmt.Fprintln(os.Stderr, "Error copying from store:", err)
-			skipped++
-			continue
+			sum.Errors++
+			result.Action, result.Reason = actionError, err.Error()
+		case outcome == pushMerged:
+			note("Merged:", it.repoAbs)
+			sum.Pushed++
+			result.Action = actionMerged
+		case outcome == pushConflicted:
+			note("Conflict:", it.repoAbs)
+			sum.Pushed++
+			sum.Conflicts++
+			result.Action = actionConflict
+		case outcome == pushKept:
+			note("Skipped:", it.repoAbs)
+			sum.Skipped++
+			result.Action, result.Reason = actionSkipped, "kept the repo version"
+		case outcome == pushUnchanged:
+			result.Action = actionUnchanged
+		default:
+			sum.Pushed++
+			result.Action = actionCopied
+		}
+		if s.dryRun && err == nil {
+			result.Action, result.Reason = dryRunPushAction(result.Action, s.action(probe, actionCreateFile), strategy)
+		}
+		if err := rep.add("result", result); err != nil {
+			return err
+		}
+		results = append(results, result)
+	}
+	if err := manifest.save(); err != nil {
+		fmt.Fprintln(os.Stderr, "Error updating manifest:", err)
+	}
+
+	if opts.dryRun {
+		if !rep.machine() {
+			printDryRun(results)
 		}
-		pushed++
+		if sum.Errors > 0 {
+			sum.Outcome = outcomePartial
+		}
+		return finish(rep, sum)
+	}
+	fmt.Fprintf(os.Stderr, "Done. Pushed %d files to repo, skipped %d.\n", sum.Pushed, sum.Skipped+sum.Errors)
+	if sum.Skipped+sum.Errors+sum.Conflicts > 0 {
+		sum.Outcome = outcomePartial
 	}
+	return finish(rep, sum)
+}
 
-	fmt.Fprintf(os.Stderr, "Done. Pushed %d files to repo, skipped %d.\n", pushed, skipped)
-	return nil
+// dryRunPushAction turns the action a push reported in a dry run into what
+// would happen to the repo file; written is what the dry run did to it.
+func dryRunPushAction(action, written, strategy string) (string, string) {
+	switch action {
+	case actionMerged:
+		return actionMerge, ""
+	case actionConflict:
+		if strategy == "" {
+			return actionConflict, "would ask how to resolve changes made on both sides"
+		}
+		return actionConflict, "would write conflict markers"
+	case actionSkipped:
+		return actionNoOp, "keeps the repo version"
+	case actionUnchanged:
+		return actionNoOp, ""
+	}
+	return written, ""
 }
 
 func parseOptions(command string, args []string) (syncOptions, error) {
@@ -227,11 +680,41 @@ func parseOptions(command string, args []string) (syncOptions, error) {
 	fsFlags.IntVar(&opts.worktreeNum, "worktree", 0, "worktree number (1-indexed)")
 	fsFlags.StringVar(&opts.destOverride, "dest", "", "destination worktree path")
 	fsFlags.BoolVar(&opts.yes, "yes", false, "skip global proceed confirmation")
-	fsFlags.BoolVar(&opts.force, "force", false, "overwrite files without per-file prompting")
+	fsFlags.BoolVar(&opts.force, "force", false, "overwrite files without per-file prompting; on sync the repo wins where both sides changed, unless --prefer is given")
+	fsFlags.BoolVar(&opts.dryRun, "dry-run", false, "report what each entry would do without changing anything")
+	if command == "sync" {
+		fsFlags.BoolVar(&opts.all, "all", false, "sync into every worktree except the current one")
+		fsFlags.StringVar(&opts.branch, "branch", "", "with --all, only worktrees whose branch matches this glob")
+		fsFlags.StringVar(&opts.prefer, "prefer", "", "when store and repo both changed since the last sync: repo, store or newest")
+	}
+
+	if command == "push" {
+		fsFlags.StringVar(&opts.strategy, "strategy", "", "resolve conflicts without prompting: ours, theirs or merge")
+	}
+	fsFlags.StringVar(&opts.output, "output", outputText, "text, json or ndjson")
 
 	if err := fsFlags.Parse(args); err != nil {
 		return syncOptions{}, err
 	}
+	if err := validOutput(opts.output); err != nil {
+		return syncOptions{}, err
+	}
+	if opts.output != outputText && !opts.yes && !opts.dryRun {
+		return syncOptions{}, fmt.Errorf("--output %s needs --yes or --dry-run", opts.output)
+	}
+	switch opts.strategy {
+	case "", strategyOurs, strategyTheirs, strategyMerge:
+	default:
+		return syncOptions{}, fmt.Errorf("invalid --strategy %q (want ours, theirs or merge)", opts.strategy)
+	}
+	switch opts.prefer {
+	case "", preferRepo, preferStore, preferNewest:
+	default:
+		return syncOptions{}, fmt.Errorf("invalid --prefer %q (want repo, store or newest)", opts.prefer)
+	}
+	if opts.branch != "" {
+		opts.all = true
+	}
 	return opts, nil
 }
 
@@ -240,11 +723,16 @@ func usageError(command string, err error) error {
 	if msg != "" {
 		fmt.Fprintln(os.Stderr, "Error:", msg)
 	}
-	fmt.Fprintf(os.Stderr, "usage: wtm %s [--repo PATH] [--worktree N | --dest PATH] [--yes] [--force]\n", command)
+	if command == "sync" {
+		fmt.Fprintln(os.Stderr, "usage: wtm sync [--repo PATH] [--worktree N | --dest PATH | --all [--branch GLOB]] [--yes] [--force] [--prefer repo|store|newest] [--dry-run] [--output text|json|ndjson]")
+		fmt.Fprintln(os.Stderr, "  --force takes the repo file where store and repo both changed, unless --prefer says otherwise")
+	} else {
+		fmt.Fprintln(os.Stderr, "usage: wtm push [--repo PATH] [--worktree N | --dest PATH] [--yes] [--force] [--dry-run] [--strategy ours|theirs|merge] [--output text|json|ndjson]")
+	}
 	return fmt.Errorf("invalid arguments")
 }
 
-func pickWorktree(repoRoot string, wts []gitx.Worktree, destOverride string, worktreeNum int) (gitx.Worktree, error) {
+func (s *session) pickWorktree(repoRoot string, wts []gitx.Worktree, destOverride string, worktreeNum int) (gitx.Worktree, error) {
 	if destOverride != "" {
 		for _, wt := range wts {
 			if samePath(wt.Path, destOverride) {
@@ -263,20 +751,16 @@ func pickWorktree(repoRoot string, wts []gitx.Worktree, destOverride string, wor
 
 	fmt.Fprintln(os.Stderr, "Active worktrees:")
 	for i, wt := range wts {
-		branchLabel := "(detached)"
-		if wt.Branch != "" {
-			branchLabel = strings.TrimPrefix(wt.Branch, "refs/heads/")
-		}
 		headShort := wt.Head
 		if len(headShort) > 8 {
 			headShort = headShort[:8]
 		}
-		fmt.Fprintf(os.Stderr, "  [%d] %s  %s  %s\n", i+1, wt.Path, branchLabel, headShort)
+		fmt.Fprintf(os.Stderr, "  [%d] %s  %s  %s\n", i+1, wt.Path, branchLabel(wt), headShort)
 	}
 
 	for {
-		s := prompt("Select worktree number to sync into: ")
-		n, err := strconv.Atoi(strings.TrimSpace(s))
+		answer := s.prompter.prompt("Select worktree number to sync into: ")
+		n, err := strconv.Atoi(strings.TrimSpace(answer))
 		if err == nil && n >= 1 && n <= len(wts) {
 			return wts[n-1], nil
 		}
@@ -284,7 +768,24 @@ func pickWorktree(repoRoot string, wts []gitx.Worktree, destOverride string, wor
 	}
 }
 
-func buildSyncPlan(repoRoot, worktreeRoot, storeRoot string, cfg config.Config) ([]planItem, error) {
+func branchLabel(wt gitx.Worktree) string {
+	if wt.Branch == "" {
+		return "(detached)"
+	}
+	return strings.TrimPrefix(wt.Branch, "refs/heads/")
+}
+
+// branchMatches reports whether the worktree branch (without refs/heads/)
+// matches pattern. Detached worktrees never match.
+func branchMatches(pattern, branch string) bool {
+	if branch == "" {
+		return false
+	}
+	ok, err := doublestar.Match(pattern, strings.TrimPrefix(branch, "refs/heads/"))
+	return err == nil && ok
+}
+
+func (s *session) buildSyncPlan(repoRoot, worktreeRoot, storeRoot string, cfg config.Config) ([]planItem, error) {
 	repoRoot = filepath.Clean(repoRoot)
 	worktreeRoot = filepath.Clean(worktreeRoot)
 	storeRoot = filepath.Clean(storeRoot)
@@ -292,24 +793,22 @@ func buildSyncPlan(repoRoot, worktreeRoot, storeRoot string, cfg config.Config)
 	include := normalizePatterns(cfg.Include)
 	exclude := normalizePatterns(cfg.Exclude)
 
-	var items []planItem
-
-	err := filepath.WalkDir(repoRoot, func(path string, d fs.DirEntry, err error) error {
-		if err != nil {
-			return err
-		}
-		if d.IsDir() {
-			name := d.Name()
-			if name == ".git" || name == "node_modules" {
-				return filepath.SkipDir
-			}
-			return nil
-		}
-		relOS, err := filepath.Rel(repoRoot, path)
+	baseRoot := ""
+	if cfg.Store.Mode == config.StoreModeLayered {
+		shared, err := storeRootPath(repoRoot, gitx.Worktree{}, config.StoreModeShared)
 		if err != nil {
-			return err
+			return nil, err
 		}
-		rel := filepath.ToSlash(relOS)
+		baseRoot = shared
+	}
+
+	var items []planItem
+	byRel := make(map[string]int)
+	var tmpl *templateContext
+
+	err := s.walkRepoFiles(repoRoot, func(path, rel string) error {
+		rel, isTemplate := templateRel(rel)
+		relOS := filepath.FromSlash(rel)
 		if !matchesAny(include, rel) || matchesAny(exclude, rel) {
 			return nil
 		}
@@ -318,12 +817,43 @@ func buildSyncPlan(repoRoot, worktreeRoot, storeRoot string, cfg config.Config)
 			return nil
 		}
 		store := filepath.Join(storeRoot, relOS)
-		items = append(items, planItem{
+		it := planItem{
 			rel:         rel,
 			repoAbs:     path,
 			storeAbs:    store,
 			worktreeAbs: dest,
-		})
+			link:        linkModeFor(cfg, rel),
+			relative:    cfg.Symlinks == config.SymlinksRelative,
+		}
+		switch {
+		case isTemplate:
+			if cfg.Store.Mode == config.StoreModeShared {
+				return fmt.Errorf("%s: templates are rendered per worktree and need store.mode %q or %q", path, config.StoreModePerWorktree, config.StoreModeLayered)
+			}
+			if tmpl == nil {
+				var err error
+				if tmpl, err = s.newTemplateContext(repoRoot, worktreeRoot, cfg.Templates); err != nil {
+					return err
+				}
+			}
+			it.template = tmpl
+			if baseRoot != "" {
+				it.overlayAbs = filepath.Join(storeRoot, overlayDirName, relOS)
+			}
+		case baseRoot != "":
+			it.baseAbs = filepath.Join(baseRoot, relOS)
+			it.overlayAbs = filepath.Join(storeRoot, overlayDirName, relOS)
+		}
+		// A template takes the place of a plain file of the name it
+		// renders to.
+		if i, ok := byRel[rel]; ok {
+			if isTemplate {
+				items[i] = it
+			}
+			return nil
+		}
+		byRel[rel] = len(items)
+		items = append(items, it)
 		return nil
 	})
 	if err != nil {
@@ -333,7 +863,31 @@ func buildSyncPlan(repoRoot, worktreeRoot, storeRoot string, cfg config.Config)
 	return items, nil
 }
 
-func buildPushPlan(storeRoot, repoRoot string, cfg config.Config) ([]planItem, error) {
+// skippedRepoDirs are never walked for repo files, whatever the patterns say.
+var skippedRepoDirs = []string{".git", "node_modules"}
+
+// walkRepoFiles calls fn for every file in the repo outside skippedRepoDirs,
+// with its slash-separated path relative to repoRoot.
+func (s *session) walkRepoFiles(repoRoot string, fn func(path, rel string) error) error {
+	return walkDir(s.fs, repoRoot, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if containsString(skippedRepoDirs, d.Name()) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		rel, err := filepath.Rel(repoRoot, path)
+		if err != nil {
+			return err
+		}
+		return fn(path, filepath.ToSlash(rel))
+	})
+}
+
+func (s *session) buildPushPlan(storeRoot, repoRoot string, cfg config.Config) ([]planItem, error) {
 	repoRoot = filepath.Clean(repoRoot)
 	storeRoot = filepath.Clean(storeRoot)
 
@@ -342,17 +896,20 @@ func buildPushPlan(storeRoot, repoRoot string, cfg config.Config) ([]planItem, e
 
 	var items []planItem
 
-	err := filepath.WalkDir(storeRoot, func(path string, d fs.DirEntry, err error) error {
+	err := walkDir(s.fs, storeRoot, func(path string, d fs.DirEntry, err error) error {
 		if err != nil {
 			return err
 		}
 		if d.IsDir() {
 			name := d.Name()
-			if name == ".git" || name == "node_modules" {
+			if name == ".git" || name == "node_modules" || strings.HasPrefix(name, metaDirPrefix) {
 				return filepath.SkipDir
 			}
 			return nil
 		}
+		if strings.HasPrefix(d.Name(), metaDirPrefix) || strings.HasSuffix(d.Name(), templateSuffix) {
+			return nil
+		}
 		relOS, err := filepath.Rel(storeRoot, path)
 		if err != nil {
 			return err
@@ -362,10 +919,15 @@ func buildPushPlan(storeRoot, repoRoot string, cfg config.Config) ([]planItem, e
 			return nil
 		}
 		repo := filepath.Join(repoRoot, relOS)
+		if _, err := s.fs.Stat(repo + templateSuffix); err == nil {
+			// Rendered from a template; edit the template instead.
+			return nil
+		}
 		items = append(items, planItem{
 			rel:      rel,
 			repoAbs:  repo,
 			storeAbs: path,
+			link:     linkModeFor(cfg, rel),
 		})
 		return nil
 	})
@@ -387,6 +949,39 @@ func printSyncPlan(repoRoot, worktreeRoot, storeRoot, configSource string, plan
 	}
 }
 
+func printAllSyncPlans(repoRoot, configSource string, plans []worktreePlan, total int) {
+	fmt.Fprintln(os.Stderr, "Repo:", repoRoot)
+	fmt.Fprintln(os.Stderr, "Config:", configSource)
+	fmt.Fprintf(os.Stderr, "Worktrees: %d, planned entries: %d\n", len(plans), total)
+	n := 0
+	for _, p := range plans {
+		fmt.Fprintf(os.Stdout, "%s (%s) store %s\n", p.worktree.Path, branchLabel(p.worktree), p.storeRoot)
+		for _, it := range p.items {
+			n++
+			fmt.Fprintf(os.Stdout, "  [%d] %s -> %s -> %s\n", n, it.repoAbs, it.storeAbs, it.worktreeAbs)
+		}
+	}
+}
+
+// printDryRun lists what a dry run found for every entry and sums it up.
+func printDryRun(results []itemResult) {
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ACTION\tWORKTREE\tFILE\tDETAIL")
+	counts := make(map[string]int)
+	for _, r := range results {
+		counts[r.Action]++
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", r.Action, r.Worktree, r.Rel, r.Reason)
+	}
+	_ = tw.Flush()
+	var parts []string
+	for _, a := range []string{actionCreateLink, actionCreateCopy, actionCreateFile, actionReplace, actionMerge, actionNoOp, actionConflict, actionSkipped, actionError} {
+		if counts[a] > 0 {
+			parts = append(parts, fmt.Sprintf("%s %d", a, counts[a]))
+		}
+	}
+	fmt.Fprintf(os.Stderr, "Dry run; nothing was changed. %s\n", strings.Join(parts, ", "))
+}
+
 func printPushPlan(repoRoot, storeRoot, configSource string, plan []planItem) {
 	fmt.Fprintln(os.Stderr, "Repo:", repoRoot)
 	fmt.Fprintln(os.Stderr, "Store:", storeRoot)
@@ -397,13 +992,13 @@ func printPushPlan(repoRoot, storeRoot, configSource string, plan []planItem) {
 	}
 }
 
-func choosePlanEntries(plan []planItem, yes bool, action string) ([]planItem, error) {
+func (s *session) choosePlanEntries(plan []planItem, yes bool, action string) ([]planItem, error) {
 	if yes || len(plan) == 0 {
 		return plan, nil
 	}
 	for {
 		msg := fmt.Sprintf("Select entries to %s (numbers, comma/space separated; empty/all = everything): ", action)
-		input := prompt(msg)
+		input := s.prompter.prompt(msg)
 		trimmed := strings.TrimSpace(input)
 		if trimmed == "" || strings.EqualFold(trimmed, "all") {
 			return plan, nil
@@ -449,21 +1044,95 @@ func parseSelection(input string, max int) ([]int, error) {
 	return out, nil
 }
 
-func storeRootPath(repoRoot string, worktree gitx.Worktree) (string, error) {
+// wtmHome is the directory holding everything wtm keeps per user: $WTM_HOME,
+// else ~/.wtm when it exists, else $XDG_DATA_HOME/wtm (~/.local/share/wtm).
+func wtmHome() (string, error) {
+	if dir := os.Getenv(homeEnv); dir != "" {
+		return filepath.Abs(dir)
+	}
 	home, err := os.UserHomeDir()
 	if err != nil {
 		return "", fmt.Errorf("home dir: %w", err)
 	}
-	repoSlug := sanitizeName(filepath.Base(repoRoot))
-	if repoSlug == "" {
-		repoSlug = "repo"
+	legacy := filepath.Join(home, storeRootDir)
+	if _, err := os.Stat(legacy); err == nil {
+		return legacy, nil
+	}
+	data := os.Getenv("XDG_DATA_HOME")
+	if data == "" || !filepath.IsAbs(data) {
+		data = filepath.Join(home, ".local", "share")
+	}
+	return filepath.Join(data, "wtm"), nil
+}
+
+// storeBase is the directory holding the stores of every repo: configs/
+// under $WTM_HOME when set, else store.root from the user config, else
+// configs/ under wtmHome.
+func storeBase() (string, error) {
+	if os.Getenv(homeEnv) == "" {
+		user, _, err := config.LoadUser()
+		if err != nil {
+			return "", err
+		}
+		if user.Store.Root != "" {
+			return user.Store.Root, nil
+		}
+	}
+	home, err := wtmHome()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, storeSubDir), nil
+}
+
+// storeRootPath returns the store directory worktree links into. In shared
+// mode every worktree of the repo uses the same directory.
+func storeRootPath(repoRoot string, worktree gitx.Worktree, mode string) (string, error) {
+	base, err := storeBase()
+	if err != nil {
+		return "", err
+	}
+	return storeRootIn(base, repoRoot, worktree, mode), nil
+}
+
+// storeRootIn is storeRootPath for stores kept under base.
+func storeRootIn(base, repoRoot string, worktree gitx.Worktree, mode string) string {
+	if mode == config.StoreModeShared {
+		return filepath.Join(base, repoSlug(repoRoot), sharedStoreName)
 	}
 	segments := worktreePathSegments(repoRoot, worktree)
 	if len(segments) == 0 {
 		segments = []string{"worktree"}
 	}
-	parts := append([]string{home, storeRootDir, storeSubDir, repoSlug}, segments...)
-	return filepath.Join(parts...), nil
+	parts := append([]string{base, repoSlug(repoRoot)}, segments...)
+	return filepath.Join(parts...)
+}
+
+// pushStoreRoot returns the store directory whose files correspond to the
+// repo copies.
+func pushStoreRoot(repoRoot string, worktree gitx.Worktree, mode string) (string, error) {
+	if mode == config.StoreModeLayered {
+		mode = config.StoreModeShared
+	}
+	return storeRootPath(repoRoot, worktree, mode)
+}
+
+// repoStoreDir is the directory holding the stores of every worktree of
+// repoRoot.
+func repoStoreDir(repoRoot string) (string, error) {
+	base, err := storeBase()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(base, repoSlug(repoRoot)), nil
+}
+
+func repoSlug(repoRoot string) string {
+	slug := sanitizeName(filepath.Base(repoRoot))
+	if slug == "" {
+		slug = "repo"
+	}
+	return slug
 }
 
 func worktreePathSegments(repoRoot string, worktree gitx.Worktree) []string {
@@ -506,7 +1175,13 @@ func sanitizeSegments(parts []string) []string {
 	out := make([]string, 0, len(parts))
 	for _, part := range parts {
 		part = strings.TrimSpace(part)
-		if part == "" {
+		if part == "" || part == "." {
+			continue
+		}
+		// A sibling worktree (../feature-x) stays inside the repo's store
+		// directory without colliding with a nested one (./feature-x).
+		if part == ".." {
+			out = append(out, parentSegment)
 			continue
 		}
 		if sanitized := sanitizeName(part); sanitized != "" {
@@ -538,6 +1213,17 @@ func matchesAny(patterns []string, rel string) bool {
 	return false
 }
 
+// firstMatch returns the index of the first of patterns matching rel, or
+// -1. Unlike normalizePatterns it keeps indexes aligned with the config.
+func firstMatch(patterns []string, rel string) int {
+	for i, p := range patterns {
+		if matchesAny(normalizePatterns([]string{p}), rel) {
+			return i
+		}
+	}
+	return -1
+}
+
 func sortPlan(items []planItem) {
 	for i := 1; i < len(items); i++ {
 		j := i
@@ -548,31 +1234,36 @@ func sortPlan(items []planItem) {
 	}
 }
 
-func copyRepoToStore(src, dst string) error {
-	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+func (s *session) copyRepoToStore(src, dst string) error {
+	if err := s.fs.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
 		return fmt.Errorf("mkdir %s: %w", filepath.Dir(dst), err)
 	}
-	return copyFileContents(src, dst)
+	return s.copyFileContents(src, dst)
 }
 
-func copyStoreToRepo(src, dst string, force bool) error {
-	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+func (s *session) copyStoreToRepo(src, dst string, force bool) error {
+	if err := s.fs.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
 		return fmt.Errorf("mkdir %s: %w", filepath.Dir(dst), err)
 	}
-	if err := handleExisting(dst, force); err != nil {
+	if err := s.handleExisting(dst, force); err != nil {
 		return err
 	}
-	return copyFileContents(src, dst)
+	return s.copyFileContents(src, dst)
 }
 
-func handleExisting(path string, force bool) error {
-	if _, err := os.Lstat(path); err == nil {
+// handleExisting removes path, asking first unless force is set. A dry run
+// returns a promptError where it would ask.
+func (s *session) handleExisting(path string, force bool) error {
+	if _, err := s.fs.Lstat(path); err == nil {
 		if !force {
-			if !confirm(fmt.Sprintf("Overwrite %s? [y/N] ", path)) {
+			if s.dryRun {
+				return promptError{path: path}
+			}
+			if !s.confirm(fmt.Sprintf("Overwrite %s? [y/N] ", path)) {
 				return skipError{dst: path}
 			}
 		}
-		if err := os.Remove(path); err != nil {
+		if err := s.fs.Remove(path); err != nil {
 			return fmt.Errorf("remove %s: %w", path, err)
 		}
 	} else if err != nil && !os.IsNotExist(err) {
@@ -581,71 +1272,93 @@ func handleExisting(path string, force bool) error {
 	return nil
 }
 
-func copyFileContents(src, dst string) error {
-	srcInfo, err := os.Stat(src)
+func (s *session) copyFileContents(src, dst string) error {
+	srcInfo, err := s.fs.Stat(src)
 	if err != nil {
 		return fmt.Errorf("stat %s: %w", src, err)
 	}
-	in, err := os.Open(src)
-	if err != nil {
-		return fmt.Errorf("open %s: %w", src, err)
-	}
-	defer in.Close()
-	out, err := os.Create(dst)
+	b, err := s.fs.ReadFile(src)
 	if err != nil {
-		return fmt.Errorf("create %s: %w", dst, err)
+		return fmt.Errorf("read %s: %w", src, err)
 	}
-	defer func() {
-		_ = out.Close()
-	}()
-	if _, err := io.Copy(out, in); err != nil {
-		return fmt.Errorf("copy %s -> %s: %w", src, dst, err)
+	if err := s.fs.WriteFile(dst, b, srcInfo.Mode().Perm()); err != nil {
+		return fmt.Errorf("write %s: %w", dst, err)
 	}
-	if err := out.Close(); err != nil {
-		return fmt.Errorf("close %s: %w", dst, err)
-	}
-	if err := os.Chmod(dst, srcInfo.Mode()); err != nil {
+	if err := s.fs.Chmod(dst, srcInfo.Mode()); err != nil {
 		return fmt.Errorf("chmod %s: %w", dst, err)
 	}
 	mtime := srcInfo.ModTime()
 	atime := time.Now()
-	_ = os.Chtimes(dst, atime, mtime)
+	_ = s.fs.Chtimes(dst, atime, mtime)
 	return nil
 }
 
-func ensureWorktreeLink(target, link string, force bool) error {
-	if err := os.MkdirAll(filepath.Dir(link), 0o755); err != nil {
+// ensureWorktreeLink points link at target.
+func (s *session) ensureWorktreeLink(target, link string, relative, force bool) error {
+	if err := s.fs.MkdirAll(filepath.Dir(link), 0o755); err != nil {
 		return fmt.Errorf("mkdir %s: %w", filepath.Dir(link), err)
 	}
-	if info, err := os.Lstat(link); err == nil {
+	want, err := s.symlinkTarget(target, link, relative)
+	if err != nil {
+		return err
+	}
+	if info, err := s.fs.Lstat(link); err == nil {
 		if info.Mode()&os.ModeSymlink != 0 {
-			current, err := os.Readlink(link)
-			if err == nil && current == target {
+			current, err := s.fs.Readlink(link)
+			if err == nil && current == want {
 				return nil
 			}
+			if s.linksTo(link, target) {
+				return s.replaceSymlink(want, link)
+			}
+		} else if s.sameFileContents(link, target) {
+			// A copy left from link mode copy or an encrypted store.
+			force = true
 		}
-		if err := handleExisting(link, force); err != nil {
+		if err := s.handleExisting(link, force); err != nil {
 			return err
 		}
 	} else if err != nil && !os.IsNotExist(err) {
 		return fmt.Errorf("stat %s: %w", link, err)
 	}
-	if err := os.Symlink(target, link); err != nil {
-		return fmt.Errorf("symlink %s -> %s: %w", link, target, err)
+	if err := s.fs.Symlink(want, link); err != nil {
+		return fmt.Errorf("symlink %s -> %s: %w", link, want, err)
 	}
 	return nil
 }
 
-func prompt(msg string) string {
-	fmt.Fprint(os.Stderr, msg)
-	r := bufio.NewReader(os.Stdin)
-	s, _ := r.ReadString('\n')
-	return strings.TrimRight(s, "\r\n")
+func (s *session) sameFileContents(a, b string) bool {
+	x, err := s.fs.ReadFile(a)
+	if err != nil {
+		return false
+	}
+	y, err := s.fs.ReadFile(b)
+	return err == nil && bytes.Equal(x, y)
+}
+
+// confirmOverwrite asks before replacing path, offering to print showDiff
+// first.
+func (s *session) confirmOverwrite(path string, showDiff func() string) bool {
+	for {
+		answer := strings.ToLower(strings.TrimSpace(s.prompter.prompt(fmt.Sprintf("Overwrite %s? [y/N/d=show diff] ", path))))
+		switch answer {
+		case "y", "yes":
+			return true
+		case "d", "diff":
+			if d := showDiff(); d != "" {
+				fmt.Fprint(os.Stderr, d)
+			} else {
+				fmt.Fprintln(os.Stderr, "Files are identical.")
+			}
+		default:
+			return false
+		}
+	}
 }
 
-func confirm(msg string) bool {
-	s := strings.ToLower(strings.TrimSpace(prompt(msg)))
-	return s == "y" || s == "yes"
+func (s *session) confirm(msg string) bool {
+	answer := strings.ToLower(strings.TrimSpace(s.prompter.prompt(msg)))
+	return answer == "y" || answer == "yes"
 }
 
 func samePath(a, b string) bool {
@@ -0,0 +1,798 @@
+package sync
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aayushgautam/wtm/internal/config"
+	"github.com/aayushgautam/wtm/internal/gitx"
+)
+
+// TestMain keeps the tests away from the stores and user config of the
+// machine running them: stores live under /wtm in each test's memFS, and
+// the user config directory is empty.
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "wtm-sync-test")
+	if err != nil {
+		panic(err)
+	}
+	os.Setenv("XDG_CONFIG_HOME", dir)
+	os.Setenv(homeEnv, "/wtm")
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+const testRepo = "/src/app"
+
+// fakeGit is a repo with fixed worktrees. It records the worktrees it is
+// asked to add or remove in calls.
+type fakeGit struct {
+	wts   []gitx.Worktree
+	calls *[]string
+}
+
+func (g fakeGit) RepoRoot(string) (string, error) { return testRepo, nil }
+
+func (g fakeGit) ListWorktrees(string) ([]gitx.Worktree, error) { return g.wts, nil }
+
+func (g fakeGit) AddWorktree(_, path, _, _ string) error {
+	*g.calls = append(*g.calls, "add "+path)
+	return nil
+}
+
+func (g fakeGit) RemoveWorktree(_, path string, _ bool) error {
+	*g.calls = append(*g.calls, "remove "+path)
+	return nil
+}
+
+// scriptedPrompter answers questions in order and fails the test on any
+// question it has no answer for.
+type scriptedPrompter struct {
+	t       *testing.T
+	answers []string
+	asked   []string
+}
+
+func (p *scriptedPrompter) prompt(msg string) string {
+	p.asked = append(p.asked, msg)
+	if len(p.answers) == 0 {
+		p.t.Errorf("unexpected prompt %q", msg)
+		return ""
+	}
+	a := p.answers[0]
+	p.answers = p.answers[1:]
+	return a
+}
+
+// testEnv is a repo at testRepo with the worktrees /src/app-feat (number 2,
+// branch feat/a) and /src/app-fix (number 3, branch fix/b), all in memory.
+type testEnv struct {
+	t   *testing.T
+	fs  *memFS
+	cfg config.Config
+	wts []gitx.Worktree
+	p   *scriptedPrompter
+	// gitCalls are the worktree adds and removes of fakeGit.
+	gitCalls []string
+}
+
+func newTestEnv(t *testing.T) *testEnv {
+	e := &testEnv{
+		t:   t,
+		fs:  newMemFS(nil),
+		cfg: config.Default(),
+		wts: []gitx.Worktree{
+			{Path: testRepo, Branch: "refs/heads/main"},
+			{Path: "/src/app-feat", Branch: "refs/heads/feat/a"},
+			{Path: "/src/app-fix", Branch: "refs/heads/fix/b"},
+		},
+		p: &scriptedPrompter{t: t},
+	}
+	for _, wt := range e.wts {
+		if err := e.fs.MkdirAll(wt.Path, 0o755); err != nil {
+			t.Fatalf("mkdir: %v", err)
+		}
+	}
+	return e
+}
+
+func (e *testEnv) session() *session {
+	return &session{
+		fs:       e.fs,
+		prompter: e.p,
+		git:      fakeGit{wts: e.wts, calls: &e.gitCalls},
+		loadConfig: func(string) (config.Loaded, error) {
+			return config.Loaded{Config: e.cfg, Source: "test"}, nil
+		},
+		setRecipients: func(_ string, recipients []string) (string, error) {
+			e.cfg.Encryption.Recipients = recipients
+			return "test", nil
+		},
+	}
+}
+
+// answer queues answers for the next questions.
+func (e *testEnv) answer(answers ...string) {
+	e.p.answers = append(e.p.answers, answers...)
+}
+
+func (e *testEnv) sync(args ...string) error {
+	e.t.Helper()
+	err := e.session().sync(args)
+	if len(e.p.answers) > 0 {
+		e.t.Fatalf("unused answers %q", e.p.answers)
+	}
+	return err
+}
+
+func (e *testEnv) push(args ...string) error {
+	e.t.Helper()
+	err := e.session().push(args)
+	if len(e.p.answers) > 0 {
+		e.t.Fatalf("unused answers %q", e.p.answers)
+	}
+	return err
+}
+
+func (e *testEnv) write(path, content string) {
+	e.t.Helper()
+	if err := e.fs.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		e.t.Fatalf("mkdir: %v", err)
+	}
+	if err := e.fs.WriteFile(path, []byte(content), 0o644); err != nil {
+		e.t.Fatalf("write: %v", err)
+	}
+}
+
+func (e *testEnv) read(path string) string {
+	e.t.Helper()
+	b, err := e.fs.ReadFile(path)
+	if err != nil {
+		e.t.Fatalf("read: %v", err)
+	}
+	return string(b)
+}
+
+// age sets the modification time of path to d ago.
+func (e *testEnv) age(path string, d time.Duration) {
+	e.t.Helper()
+	old := time.Now().Add(-d)
+	if err := e.fs.Chtimes(path, old, old); err != nil {
+		e.t.Fatalf("chtimes: %v", err)
+	}
+}
+
+// store returns the store path of rel for worktree number n.
+func (e *testEnv) store(n int, rel string) string {
+	e.t.Helper()
+	root, err := storeRootPath(testRepo, e.wts[n-1], e.cfg.Store.Mode)
+	if err != nil {
+		e.t.Fatalf("store root: %v", err)
+	}
+	return filepath.Join(root, filepath.FromSlash(rel))
+}
+
+func (e *testEnv) wt(n int, rel string) string {
+	return filepath.Join(e.wts[n-1].Path, filepath.FromSlash(rel))
+}
+
+func (e *testEnv) repo(rel string) string {
+	return filepath.Join(testRepo, filepath.FromSlash(rel))
+}
+
+// wantLink fails unless the worktree file rel of worktree n is a symlink to
+// its store file.
+func (e *testEnv) wantLink(n int, rel string) {
+	e.t.Helper()
+	target, err := e.fs.Readlink(e.wt(n, rel))
+	if err != nil {
+		e.t.Fatalf("%s: %v", rel, err)
+	}
+	if target != e.store(n, rel) {
+		e.t.Fatalf("%s: expected a link to %s, got %s", rel, e.store(n, rel), target)
+	}
+}
+
+func wantExit(t *testing.T, err error, code int) {
+	t.Helper()
+	if code == 0 {
+		if err != nil {
+			t.Fatalf("expected success, got %v", err)
+		}
+		return
+	}
+	if err == nil || ExitCode(err) != code {
+		t.Fatalf("expected exit code %d, got %v (code %d)", code, err, ExitCode(err))
+	}
+}
+
+func TestSyncLinksMatchingFiles(t *testing.T) {
+	e := newTestEnv(t)
+	e.write(e.repo(".env"), "A=1\n")
+	e.write(e.repo("apps/api/.env.local"), "B=2\n")
+	e.write(e.repo(".env.example"), "A=\n")
+	e.write(e.repo("node_modules/pkg/.env"), "C=3\n")
+	e.write(e.repo("README"), "readme\n")
+
+	wantExit(t, e.sync("--worktree", "2", "--yes"), 0)
+
+	e.wantLink(2, ".env")
+	e.wantLink(2, "apps/api/.env.local")
+	if got := e.read(e.wt(2, "apps/api/.env.local")); got != "B=2\n" {
+		t.Fatalf("expected the repo content through the link, got %q", got)
+	}
+	for _, rel := range []string{".env.example", "node_modules/pkg/.env", "README"} {
+		if _, err := e.fs.Lstat(e.wt(2, rel)); !errors.Is(err, os.ErrNotExist) {
+			t.Fatalf("expected %s to be left out, got %v", rel, err)
+		}
+	}
+	if _, err := e.fs.Stat(e.store(2, manifestName)); err != nil {
+		t.Fatalf("expected a manifest: %v", err)
+	}
+	if _, err := e.fs.Lstat(e.wt(3, ".env")); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected the other worktree to be left alone, got %v", err)
+	}
+}
+
+func TestSyncTwiceChangesNothing(t *testing.T) {
+	e := newTestEnv(t)
+	e.write(e.repo(".env"), "A=1\n")
+	wantExit(t, e.sync("--worktree", "2", "--yes"), 0)
+
+	mark := len(e.fs.changes)
+	wantExit(t, e.sync("--worktree", "2", "--yes"), 0)
+	if e.fs.changedSince(mark, e.wt(2, ".env")) {
+		t.Fatal("expected the existing link to be kept")
+	}
+	e.wantLink(2, ".env")
+}
+
+func TestSyncUpdatesStoreFromRepo(t *testing.T) {
+	e := newTestEnv(t)
+	e.write(e.repo(".env"), "A=1\n")
+	wantExit(t, e.sync("--worktree", "2", "--yes"), 0)
+
+	e.write(e.repo(".env"), "A=2\n")
+	wantExit(t, e.sync("--worktree", "2", "--yes"), 0)
+	if got := e.read(e.wt(2, ".env")); got != "A=2\n" {
+		t.Fatalf("expected the new repo content, got %q", got)
+	}
+}
+
+func TestSyncAsksBeforeOverwriting(t *testing.T) {
+	e := newTestEnv(t)
+	e.write(e.repo(".env"), "A=1\n")
+	e.write(e.wt(2, ".env"), "A=local\n")
+
+	e.answer("n")
+	wantExit(t, e.sync("--worktree", "2", "--yes"), ExitPartial)
+	if got := e.read(e.wt(2, ".env")); got != "A=local\n" {
+		t.Fatalf("expected the local file to be kept, got %q", got)
+	}
+	if len(e.p.asked) != 1 || !strings.HasPrefix(e.p.asked[0], "Overwrite "+e.wt(2, ".env")) {
+		t.Fatalf("expected one overwrite question, got %q", e.p.asked)
+	}
+
+	e.answer("y")
+	wantExit(t, e.sync("--worktree", "2", "--yes"), 0)
+	e.wantLink(2, ".env")
+}
+
+func TestSyncForceOverwritesWithoutAsking(t *testing.T) {
+	e := newTestEnv(t)
+	e.write(e.repo(".env"), "A=1\n")
+	e.write(e.wt(2, ".env"), "A=local\n")
+
+	wantExit(t, e.sync("--worktree", "2", "--yes", "--force"), 0)
+	e.wantLink(2, ".env")
+}
+
+func TestSyncReplacesIdenticalFileWithoutAsking(t *testing.T) {
+	e := newTestEnv(t)
+	e.write(e.repo(".env"), "A=1\n")
+	e.write(e.wt(2, ".env"), "A=1\n")
+
+	wantExit(t, e.sync("--worktree", "2", "--yes"), 0)
+	e.wantLink(2, ".env")
+}
+
+func TestSyncAsksBeforeReplacingForeignLink(t *testing.T) {
+	e := newTestEnv(t)
+	e.write(e.repo(".env"), "A=1\n")
+	e.write("/elsewhere/.env", "A=1\n")
+	if err := e.fs.Symlink("/elsewhere/.env", e.wt(2, ".env")); err != nil {
+		t.Fatalf("symlink: %v", err)
+	}
+
+	e.answer("n")
+	wantExit(t, e.sync("--worktree", "2", "--yes"), ExitPartial)
+	if target, _ := e.fs.Readlink(e.wt(2, ".env")); target != "/elsewhere/.env" {
+		t.Fatalf("expected a foreign link to be kept, got %s", target)
+	}
+}
+
+func TestSyncLinkModes(t *testing.T) {
+	e := newTestEnv(t)
+	e.cfg.Link = config.LinkConfig{
+		Mode:  config.LinkSymlink,
+		Rules: []config.LinkRule{{Pattern: "apps/**", Mode: config.LinkCopy}, {Pattern: "web/**", Mode: config.LinkHardlink}},
+	}
+	e.write(e.repo(".env"), "A=1\n")
+	e.write(e.repo("apps/api/.env"), "B=2\n")
+	e.write(e.repo("web/.env"), "C=3\n")
+
+	wantExit(t, e.sync("--worktree", "2", "--yes"), 0)
+
+	e.wantLink(2, ".env")
+	info, err := e.fs.Lstat(e.wt(2, "apps/api/.env"))
+	if err != nil || !info.Mode().IsRegular() {
+		t.Fatalf("expected a copy, got %v, %v", info, err)
+	}
+	if got := e.read(e.wt(2, "apps/api/.env")); got != "B=2\n" {
+		t.Fatalf("expected the copied content, got %q", got)
+	}
+	a, err := e.fs.Lstat(e.wt(2, "web/.env"))
+	if err != nil {
+		t.Fatalf("lstat: %v", err)
+	}
+	b, err := e.fs.Lstat(e.store(2, "web/.env"))
+	if err != nil || !e.fs.SameFile(a, b) {
+		t.Fatalf("expected a hard link to the store file, got %v", err)
+	}
+}
+
+func TestSyncCopyModeRefreshesUntouchedCopy(t *testing.T) {
+	e := newTestEnv(t)
+	e.cfg.Link.Mode = config.LinkCopy
+	e.write(e.repo(".env"), "A=1\n")
+	wantExit(t, e.sync("--worktree", "2", "--yes"), 0)
+
+	// The copy still holds what sync wrote, so it is replaced silently.
+	e.write(e.repo(".env"), "A=2\n")
+	wantExit(t, e.sync("--worktree", "2", "--yes"), 0)
+	if got := e.read(e.wt(2, ".env")); got != "A=2\n" {
+		t.Fatalf("expected the refreshed copy, got %q", got)
+	}
+
+	// A copy edited in the worktree is only replaced after asking.
+	e.write(e.wt(2, ".env"), "A=local\n")
+	e.write(e.repo(".env"), "A=3\n")
+	e.answer("n")
+	wantExit(t, e.sync("--worktree", "2", "--yes"), ExitPartial)
+	if got := e.read(e.wt(2, ".env")); got != "A=local\n" {
+		t.Fatalf("expected the edited copy to be kept, got %q", got)
+	}
+}
+
+func TestSyncRelativeSymlinks(t *testing.T) {
+	e := newTestEnv(t)
+	e.cfg.Symlinks = config.SymlinksRelative
+	e.write(e.repo("apps/api/.env"), "A=1\n")
+
+	wantExit(t, e.sync("--worktree", "2", "--yes"), 0)
+	target, err := e.fs.Readlink(e.wt(2, "apps/api/.env"))
+	if err != nil {
+		t.Fatalf("readlink: %v", err)
+	}
+	if filepath.IsAbs(target) {
+		t.Fatalf("expected a relative link, got %s", target)
+	}
+	if got := e.read(e.wt(2, "apps/api/.env")); got != "A=1\n" {
+		t.Fatalf("expected the link to resolve, got %q", got)
+	}
+}
+
+func TestSyncSharedStore(t *testing.T) {
+	e := newTestEnv(t)
+	e.cfg.Store.Mode = config.StoreModeShared
+	e.write(e.repo(".env"), "A=1\n")
+
+	wantExit(t, e.sync("--all", "--yes"), 0)
+	if e.store(2, ".env") != e.store(3, ".env") {
+		t.Fatal("expected one store for every worktree")
+	}
+	e.wantLink(2, ".env")
+	e.wantLink(3, ".env")
+}
+
+func TestSyncSelectsEntriesAndConfirms(t *testing.T) {
+	e := newTestEnv(t)
+	e.write(e.repo(".env"), "A=1\n")
+	e.write(e.repo("apps/api/.env"), "B=2\n")
+
+	// The plan lists .env first; pick only the second entry.
+	e.answer("9", "2", "y")
+	wantExit(t, e.sync("--worktree", "2"), 0)
+	e.wantLink(2, "apps/api/.env")
+	if _, err := e.fs.Lstat(e.wt(2, ".env")); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected the unselected entry to be skipped, got %v", err)
+	}
+	if len(e.p.asked) != 3 {
+		t.Fatalf("expected the selection to be asked again after an invalid answer, got %q", e.p.asked)
+	}
+}
+
+func TestSyncAborted(t *testing.T) {
+	e := newTestEnv(t)
+	e.write(e.repo(".env"), "A=1\n")
+
+	e.answer("", "n")
+	wantExit(t, e.sync("--worktree", "2"), ExitAborted)
+	if _, err := e.fs.Lstat(e.store(2, ".env")); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected nothing to be written, got %v", err)
+	}
+}
+
+func TestSyncAsksForWorktree(t *testing.T) {
+	e := newTestEnv(t)
+	e.write(e.repo(".env"), "A=1\n")
+
+	e.answer("x", "3")
+	wantExit(t, e.sync("--yes"), 0)
+	e.wantLink(3, ".env")
+}
+
+func TestSyncNothingToDo(t *testing.T) {
+	e := newTestEnv(t)
+	e.write(e.repo("README"), "readme\n")
+
+	wantExit(t, e.sync("--worktree", "2", "--yes"), ExitNothingToDo)
+	wantExit(t, e.sync("--all", "--yes", "--branch", "release/*"), ExitNothingToDo)
+}
+
+func TestSyncAllFiltersByBranch(t *testing.T) {
+	e := newTestEnv(t)
+	e.write(e.repo(".env"), "A=1\n")
+
+	wantExit(t, e.sync("--all", "--yes", "--branch", "feat/*"), 0)
+	e.wantLink(2, ".env")
+	if _, err := e.fs.Lstat(e.wt(3, ".env")); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected fix/b to be skipped, got %v", err)
+	}
+}
+
+func TestSyncArgumentErrors(t *testing.T) {
+	e := newTestEnv(t)
+	e.write(e.repo(".env"), "A=1\n")
+
+	for _, args := range [][]string{
+		{"--all", "--worktree", "2"},
+		{"--branch", "[", "--all"},
+		{"--worktree", "2", "--output", "json"},
+		{"--worktree", "2", "--strategy", "ours"},
+		{"--worktree", "2", "--prefer", "worktree"},
+	} {
+		if err := e.sync(args...); err == nil || ExitCode(err) != 1 {
+			t.Fatalf("%q: expected an error, got %v", args, err)
+		}
+	}
+	if err := e.sync("--worktree", "9", "--yes"); err == nil {
+		t.Fatal("expected an out of range worktree to fail")
+	}
+	if err := e.sync("--worktree", "1", "--yes"); err == nil || !strings.Contains(err.Error(), "current repo root") {
+		t.Fatalf("expected syncing into the repo itself to fail, got %v", err)
+	}
+}
+
+func TestSyncReportsItemErrors(t *testing.T) {
+	e := newTestEnv(t)
+	e.write(e.repo(".env"), "A=1\n")
+	e.write(e.repo("apps/api/.env"), "B=2\n")
+	// A file where the store needs a directory.
+	e.write(e.store(2, "apps"), "in the way\n")
+
+	wantExit(t, e.sync("--worktree", "2", "--yes"), ExitPartial)
+	e.wantLink(2, ".env")
+	if _, err := e.fs.Lstat(e.wt(2, "apps/api/.env")); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected the failed entry to be left out, got %v", err)
+	}
+}
+
+func TestSyncDryRunChangesNothing(t *testing.T) {
+	e := newTestEnv(t)
+	e.write(e.repo(".env"), "A=1\n")
+	e.write(e.wt(2, ".env"), "A=local\n")
+	mark := len(e.fs.changes)
+
+	wantExit(t, e.sync("--all", "--dry-run"), 0)
+	if len(e.fs.changes) != mark {
+		t.Fatalf("dry run changed %q", e.fs.changes[mark:])
+	}
+}
+
+// captureStdout returns what fn wrote to os.Stdout, where commands print
+// their tables and --output records.
+func captureStdout(t *testing.T, fn func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("pipe: %v", err)
+	}
+	orig := os.Stdout
+	os.Stdout = w
+	done := make(chan []byte)
+	go func() {
+		b, _ := io.ReadAll(r)
+		done <- b
+	}()
+	fn()
+	os.Stdout = orig
+	w.Close()
+	return string(<-done)
+}
+
+// syncedEnv is a testEnv whose .env was synced into worktree 2.
+func syncedEnv(t *testing.T, content string) *testEnv {
+	e := newTestEnv(t)
+	e.write(e.repo(".env"), content)
+	wantExit(t, e.sync("--worktree", "2", "--yes"), 0)
+	return e
+}
+
+func TestSyncKeepsStoreEdits(t *testing.T) {
+	e := syncedEnv(t, "A=1\n")
+	// Writing through the worktree link edits the store.
+	e.write(e.wt(2, ".env"), "A=2\n")
+
+	wantExit(t, e.sync("--worktree", "2", "--yes"), 0)
+	if got := e.read(e.store(2, ".env")); got != "A=2\n" {
+		t.Fatalf("expected the store edit to be kept, got %q", got)
+	}
+	wantExit(t, e.push("--worktree", "2", "--yes"), 0)
+	if got := e.read(e.repo(".env")); got != "A=2\n" {
+		t.Fatalf("expected push to bring the kept edit over, got %q", got)
+	}
+}
+
+func TestSyncMergesStoreAndRepoEdits(t *testing.T) {
+	e := syncedEnv(t, "A=1\nB=1\n")
+	e.write(e.wt(2, ".env"), "A=2\nB=1\n")
+	e.write(e.repo(".env"), "A=1\nB=2\n")
+
+	wantExit(t, e.sync("--worktree", "2", "--yes"), 0)
+	if got := e.read(e.store(2, ".env")); got != "A=2\nB=2\n" {
+		t.Fatalf("expected both edits in the store, got %q", got)
+	}
+	// Only the store edit is left for push.
+	wantExit(t, e.push("--worktree", "2", "--yes"), 0)
+	if got := e.read(e.repo(".env")); got != "A=2\nB=2\n" {
+		t.Fatalf("expected push to bring the store edit over, got %q", got)
+	}
+}
+
+func TestSyncPreferDecidesConflicts(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		args    []string
+		answers []string
+		older   string // made an hour older
+		want    string
+	}{
+		{"prefer repo", []string{"--prefer", "repo"}, nil, "", "A=repo\n"},
+		{"prefer store", []string{"--prefer", "store"}, nil, "", "A=store\n"},
+		{"newest repo", []string{"--prefer", "newest"}, nil, "store", "A=repo\n"},
+		{"newest store", []string{"--prefer", "newest"}, nil, "repo", "A=store\n"},
+		{"ask yes", nil, []string{"y"}, "", "A=repo\n"},
+		{"ask no", nil, []string{"n"}, "", "A=store\n"},
+		{"force", []string{"--force"}, nil, "", "A=repo\n"},
+		{"force prefer store", []string{"--force", "--prefer", "store"}, nil, "", "A=store\n"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			e := syncedEnv(t, "A=1\n")
+			e.write(e.wt(2, ".env"), "A=store\n")
+			e.write(e.repo(".env"), "A=repo\n")
+			switch tc.older {
+			case "store":
+				e.age(e.store(2, ".env"), time.Hour)
+			case "repo":
+				e.age(e.repo(".env"), time.Hour)
+			}
+			e.answer(tc.answers...)
+
+			wantExit(t, e.sync(append([]string{"--worktree", "2", "--yes"}, tc.args...)...), 0)
+			if got := e.read(e.store(2, ".env")); got != tc.want {
+				t.Fatalf("expected %q, got %q", tc.want, got)
+			}
+			e.wantLink(2, ".env")
+		})
+	}
+}
+
+func TestSyncMovesLayeredEditsIntoOverlay(t *testing.T) {
+	e := newTestEnv(t)
+	e.cfg.Store.Mode = config.StoreModeLayered
+	e.write(e.repo(".env"), "A=1\nB=1\n")
+	wantExit(t, e.sync("--worktree", "2", "--yes"), 0)
+	overlay := filepath.Join(filepath.Dir(e.store(2, ".env")), overlayDirName, ".env")
+
+	e.write(e.wt(2, ".env"), "A=2\nB=1\nC=1\n")
+	e.write(e.repo(".env"), "A=1\nB=2\n")
+	wantExit(t, e.sync("--worktree", "2", "--yes"), 0)
+	if got := e.read(overlay); got != "A=2\nC=1\n" {
+		t.Fatalf("expected the edits in the overlay, got %q", got)
+	}
+	if got := e.read(e.store(2, ".env")); got != "A=2\nB=2\nC=1\n" {
+		t.Fatalf("expected the repo change rendered with the overlay, got %q", got)
+	}
+	e.wantLink(2, ".env")
+	wantHistory(t, e.history(2, overlayDirName+"/.env"),
+		[2]string{historyOverlay, "A=2\nC=1\n"},
+	)
+	wantHistory(t, e.history(2, ".env"),
+		[2]string{historySync, "A=1\nB=1\n"},
+		[2]string{historyEdited, "A=2\nB=1\nC=1\n"},
+		[2]string{historySync, "A=2\nB=2\nC=1\n"},
+	)
+
+	// An overlay cannot remove a variable, so that edit is refused.
+	e.write(e.wt(2, ".env"), "A=2\nC=1\n")
+	wantExit(t, e.sync("--worktree", "2", "--yes"), ExitPartial)
+	if got := e.read(e.store(2, ".env")); got != "A=2\nC=1\n" {
+		t.Fatalf("expected the refused edit left in place, got %q", got)
+	}
+}
+
+func TestPushCopiesStoreEdits(t *testing.T) {
+	e := syncedEnv(t, "A=1\n")
+	// Writing through the worktree link edits the store.
+	e.write(e.wt(2, ".env"), "A=2\n")
+
+	wantExit(t, e.push("--worktree", "2", "--yes"), 0)
+	if got := e.read(e.repo(".env")); got != "A=2\n" {
+		t.Fatalf("expected the store edit in the repo, got %q", got)
+	}
+}
+
+func TestPushCreatesMissingRepoFile(t *testing.T) {
+	e := syncedEnv(t, "A=1\n")
+	e.write(e.store(2, "apps/api/.env"), "B=2\n")
+
+	wantExit(t, e.push("--worktree", "2", "--yes"), 0)
+	if got := e.read(e.repo("apps/api/.env")); got != "B=2\n" {
+		t.Fatalf("expected the new file in the repo, got %q", got)
+	}
+}
+
+func TestPushKeepsNewerRepo(t *testing.T) {
+	e := syncedEnv(t, "A=1\n")
+	e.write(e.repo(".env"), "A=repo\n")
+
+	wantExit(t, e.push("--worktree", "2", "--yes"), 0)
+	if got := e.read(e.repo(".env")); got != "A=repo\n" {
+		t.Fatalf("expected the repo edit to survive, got %q", got)
+	}
+}
+
+func TestPushMergesDotenvKeys(t *testing.T) {
+	e := syncedEnv(t, "A=1\nB=1\n")
+	e.write(e.repo(".env"), "A=repo\nB=1\n")
+	e.write(e.store(2, ".env"), "A=1\nB=store\n")
+
+	wantExit(t, e.push("--worktree", "2", "--yes"), 0)
+	if got := e.read(e.repo(".env")); got != "A=repo\nB=store\n" {
+		t.Fatalf("expected both edits, got %q", got)
+	}
+}
+
+func TestPushResolvesKeyConflicts(t *testing.T) {
+	for _, tc := range []struct {
+		answer string
+		want   string
+		code   int
+	}{
+		{"o", "A=store\n", 0},
+		{"t", "A=repo\n", 0},
+		{"m", "<<<<<<< store\nA=store\n=======\nA=repo\n>>>>>>> repo\n", ExitPartial},
+	} {
+		t.Run(tc.answer, func(t *testing.T) {
+			e := syncedEnv(t, "A=1\n")
+			e.write(e.repo(".env"), "A=repo\n")
+			e.write(e.store(2, ".env"), "A=store\n")
+
+			e.answer(tc.answer)
+			wantExit(t, e.push("--worktree", "2", "--yes"), tc.code)
+			if got := e.read(e.repo(".env")); got != tc.want {
+				t.Fatalf("expected %q, got %q", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestPushStrategyAnswersConflicts(t *testing.T) {
+	for _, tc := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"--strategy", "theirs"}, "A=repo\n"},
+		{[]string{"--strategy", "ours"}, "A=store\n"},
+		{[]string{"--force"}, "A=store\n"},
+	} {
+		t.Run(strings.Join(tc.args, " "), func(t *testing.T) {
+			e := syncedEnv(t, "A=1\n")
+			e.write(e.repo(".env"), "A=repo\n")
+			e.write(e.store(2, ".env"), "A=store\n")
+
+			wantExit(t, e.push(append([]string{"--worktree", "2", "--yes"}, tc.args...)...), 0)
+			if got := e.read(e.repo(".env")); got != tc.want {
+				t.Fatalf("expected %q, got %q", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestPushAsksWithoutBase(t *testing.T) {
+	e := newTestEnv(t)
+	e.write(e.repo(".env"), "A=repo\n")
+	// A store written before manifests existed has no base to merge from.
+	e.write(e.store(2, ".env"), "A=store\n")
+
+	e.answer("d", "n")
+	wantExit(t, e.push("--worktree", "2", "--yes"), ExitPartial)
+	if got := e.read(e.repo(".env")); got != "A=repo\n" {
+		t.Fatalf("expected the repo file to be kept, got %q", got)
+	}
+	if len(e.p.asked) != 2 || e.p.asked[0] != e.p.asked[1] {
+		t.Fatalf("expected the question again after the diff, got %q", e.p.asked)
+	}
+
+	e.answer("y")
+	wantExit(t, e.push("--worktree", "2", "--yes"), 0)
+	if got := e.read(e.repo(".env")); got != "A=store\n" {
+		t.Fatalf("expected the store file, got %q", got)
+	}
+}
+
+func TestPushCapturesCopyEdits(t *testing.T) {
+	e := newTestEnv(t)
+	e.cfg.Link.Mode = config.LinkCopy
+	e.write(e.repo(".env"), "A=1\n")
+	wantExit(t, e.sync("--worktree", "2", "--yes"), 0)
+	e.write(e.wt(2, ".env"), "A=copy\n")
+
+	wantExit(t, e.push("--worktree", "2", "--yes"), 0)
+	if got := e.read(e.repo(".env")); got != "A=copy\n" {
+		t.Fatalf("expected the worktree edit in the repo, got %q", got)
+	}
+	if got := e.read(e.store(2, ".env")); got != "A=copy\n" {
+		t.Fatalf("expected the edit in the store, got %q", got)
+	}
+}
+
+func TestPushAborted(t *testing.T) {
+	e := syncedEnv(t, "A=1\n")
+	e.write(e.store(2, ".env"), "A=2\n")
+
+	e.answer("", "n")
+	wantExit(t, e.push("--worktree", "2"), ExitAborted)
+	if got := e.read(e.repo(".env")); got != "A=1\n" {
+		t.Fatalf("expected the repo file to be untouched, got %q", got)
+	}
+}
+
+func TestPushWithoutStore(t *testing.T) {
+	e := newTestEnv(t)
+	e.write(e.repo(".env"), "A=1\n")
+
+	err := e.push("--worktree", "2", "--yes")
+	if err == nil || !strings.Contains(err.Error(), "run \"wtm sync\" first") {
+		t.Fatalf("expected a missing store error, got %v", err)
+	}
+}
+
+func TestPushDryRunChangesNothing(t *testing.T) {
+	e := syncedEnv(t, "A=1\n")
+	e.write(e.repo(".env"), "A=repo\n")
+	e.write(e.store(2, ".env"), "A=store\n")
+	mark := len(e.fs.changes)
+
+	wantExit(t, e.push("--worktree", "2", "--dry-run"), 0)
+	if len(e.fs.changes) != mark {
+		t.Fatalf("dry run changed %q", e.fs.changes[mark:])
+	}
+}
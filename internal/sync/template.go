@@ -0,0 +1,293 @@
+package sync
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/aayushgautam/wtm/internal/config"
+	"github.com/aayushgautam/wtm/internal/gitx"
+)
+
+// Repo files ending in templateSuffix are rendered per worktree; allocated
+// ports are recorded in the ports file.
+const (
+	templateSuffix = ".wtmtpl"
+	portsFileName  = metaDirPrefix + "ports.json"
+	portsVersion   = 1
+)
+
+// Built-in template variables.
+const (
+	varBranch = "WTM_BRANCH" // branch name, empty when detached
+	varSlug   = "WTM_SLUG"   // worktree path as lower-case letters, digits and _
+	varIndex  = "WTM_INDEX"  // position in "git worktree list", as for --worktree
+	varHead   = "WTM_HEAD"   // short HEAD commit
+	varRepo   = "WTM_REPO"   // name of the repo's store directory
+)
+
+var placeholderPattern = regexp.MustCompile(`\{\{([^{}]*)\}\}`)
+
+// templateContext is what the templates of one worktree are rendered with.
+type templateContext struct {
+	repoRoot string
+	worktree gitx.Worktree
+	index    int // 0 for a --dest path git does not list
+	// live are the port keys of every worktree of the repo; ports recorded
+	// for any other worktree are released.
+	live map[string]bool
+	cfg  config.TemplateConfig
+}
+
+// templateRel returns the path rel renders to when it is a template.
+func templateRel(rel string) (string, bool) {
+	out := strings.TrimSuffix(rel, templateSuffix)
+	if out == rel || out == "" || strings.HasSuffix(out, "/") {
+		return rel, false
+	}
+	return out, true
+}
+
+// newTemplateContext looks worktreeRoot up among the worktrees of repoRoot.
+func (s *session) newTemplateContext(repoRoot, worktreeRoot string, cfg config.TemplateConfig) (*templateContext, error) {
+	wts, err := s.git.ListWorktrees(repoRoot)
+	if err != nil {
+		return nil, err
+	}
+	t := &templateContext{
+		repoRoot: repoRoot,
+		worktree: gitx.Worktree{Path: worktreeRoot},
+		live:     make(map[string]bool),
+		cfg:      cfg,
+	}
+	for i, wt := range wts {
+		if !wt.Prunable {
+			t.live[portKey(repoRoot, wt)] = true
+		}
+		if samePath(wt.Path, worktreeRoot) {
+			t.worktree, t.index = wt, i+1
+		}
+	}
+	t.live[portKey(repoRoot, t.worktree)] = true
+	return t, nil
+}
+
+// portKey names wt in the ports file: its store directory below the repo's.
+func portKey(repoRoot string, wt gitx.Worktree) string {
+	return strings.Join(worktreePathSegments(repoRoot, wt), "/")
+}
+
+// vars returns the variables templates of t can use: the configured ones
+// and the built-in ones, which take precedence.
+func (t *templateContext) vars() map[string]string {
+	vars := make(map[string]string, len(t.cfg.Vars)+5)
+	for k, v := range t.cfg.Vars {
+		vars[k] = v
+	}
+	head := t.worktree.Head
+	if len(head) > 7 {
+		head = head[:7]
+	}
+	vars[varBranch] = strings.TrimPrefix(t.worktree.Branch, "refs/heads/")
+	vars[varSlug] = templateSlug(portKey(t.repoRoot, t.worktree))
+	vars[varIndex] = strconv.Itoa(t.index)
+	vars[varHead] = head
+	vars[varRepo] = repoSlug(t.repoRoot)
+	return vars
+}
+
+// templateSlug lower-cases s and replaces other runs of characters with "_".
+func templateSlug(s string) string {
+	var b strings.Builder
+	sep := false
+	for _, r := range strings.ToLower(s) {
+		if r >= 'a' && r <= 'z' || r >= '0' && r <= '9' {
+			if sep && b.Len() > 0 {
+				b.WriteByte('_')
+			}
+			b.WriteRune(r)
+			sep = false
+			continue
+		}
+		sep = true
+	}
+	return b.String()
+}
+
+// renderTemplate writes the store file of it from its template, encrypting
+// it if configured. In layered mode the worktree overlay is applied on top.
+func (s *session) renderTemplate(it planItem) error {
+	content, err := s.templateContent(it, true)
+	if err != nil {
+		return err
+	}
+	info, err := s.fs.Stat(it.repoAbs)
+	if err != nil {
+		return fmt.Errorf("stat %s: %w", it.repoAbs, err)
+	}
+	return s.writeFile(it.storeAbs, content, info.Mode().Perm())
+}
+
+// templateContent renders the template of it. Ports allocated on the way
+// are only recorded with save set.
+func (s *session) templateContent(it planItem, save bool) ([]byte, error) {
+	src, err := s.fs.ReadFile(it.repoAbs)
+	if err != nil {
+		return nil, fmt.Errorf("read %s: %w", it.repoAbs, err)
+	}
+	t := it.template
+	vars := t.vars()
+	var ports *portTable
+
+	var out bytes.Buffer
+	last := 0
+	for _, m := range placeholderPattern.FindAllSubmatchIndex(src, -1) {
+		out.Write(src[last:m[0]])
+		last = m[1]
+		line := bytes.Count(src[:m[0]], []byte("\n")) + 1
+		fields := strings.Fields(string(src[m[2]:m[3]]))
+		switch {
+		case len(fields) == 1:
+			v, ok := vars[fields[0]]
+			if !ok {
+				return nil, fmt.Errorf("%s:%d: unknown variable %q", it.repoAbs, line, fields[0])
+			}
+			out.WriteString(v)
+		case len(fields) == 2 && fields[0] == "port":
+			if ports == nil {
+				if ports, err = s.loadPorts(t.repoRoot); err != nil {
+					return nil, err
+				}
+			}
+			p, err := ports.port(portKey(t.repoRoot, t.worktree), fields[1], t.cfg.Ports, t.live)
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %w", it.repoAbs, line, err)
+			}
+			out.WriteString(strconv.Itoa(p))
+		default:
+			return nil, fmt.Errorf("%s:%d: invalid placeholder %q (want {{ NAME }} or {{ port NAME }})", it.repoAbs, line, src[m[0]:m[1]])
+		}
+	}
+	out.Write(src[last:])
+	if ports != nil && save && ports.changed {
+		if err := ports.save(s.fs); err != nil {
+			return nil, err
+		}
+	}
+
+	if it.overlayAbs == "" {
+		return out.Bytes(), nil
+	}
+	overlay, err := s.fs.ReadFile(it.overlayAbs)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return out.Bytes(), nil
+		}
+		return nil, fmt.Errorf("read %s: %w", it.overlayAbs, err)
+	}
+	merged, err := mergeDotenv(out.Bytes(), overlay)
+	if err != nil {
+		return nil, fmt.Errorf("merge %s: %w", it.rel, err)
+	}
+	return merged, nil
+}
+
+// portTable records the ports allocated to every worktree of a repo.
+type portTable struct {
+	path    string
+	changed bool
+
+	Version int `json:"version"`
+	// Worktrees maps the port key of a worktree to its ports by name.
+	Worktrees map[string]map[string]int `json:"worktrees"`
+}
+
+func (s *session) loadPorts(repoRoot string) (*portTable, error) {
+	dir, err := repoStoreDir(repoRoot)
+	if err != nil {
+		return nil, err
+	}
+	t := &portTable{path: filepath.Join(dir, portsFileName), Version: portsVersion, Worktrees: map[string]map[string]int{}}
+	b, err := s.fs.ReadFile(t.path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return t, nil
+		}
+		return nil, fmt.Errorf("read %s: %w", t.path, err)
+	}
+	if err := json.Unmarshal(b, t); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", t.path, err)
+	}
+	if t.Version > portsVersion {
+		return nil, fmt.Errorf("%s was written by a newer wtm (version %d)", t.path, t.Version)
+	}
+	if t.Worktrees == nil {
+		t.Worktrees = map[string]map[string]int{}
+	}
+	return t, nil
+}
+
+// port returns the port name of the worktree at key, allocating a free
+// one from r.
+func (t *portTable) port(key, name string, r config.PortRange, live map[string]bool) (int, error) {
+	if p, ok := t.Worktrees[key][name]; ok && p >= r.From && p <= r.To {
+		return p, nil
+	}
+	used := make(map[int]bool)
+	for k, ports := range t.Worktrees {
+		if !live[k] {
+			delete(t.Worktrees, k)
+			t.changed = true
+			continue
+		}
+		for n, p := range ports {
+			if k != key || n != name {
+				used[p] = true
+			}
+		}
+	}
+	size := r.To - r.From + 1
+	h := fnv.New32a()
+	h.Write([]byte(key + "/" + name))
+	start := int(h.Sum32() % uint32(size))
+	for i := 0; i < size; i++ {
+		p := r.From + (start+i)%size
+		if used[p] {
+			continue
+		}
+		if t.Worktrees[key] == nil {
+			t.Worktrees[key] = map[string]int{}
+		}
+		t.Worktrees[key][name] = p
+		t.changed = true
+		return p, nil
+	}
+	return 0, fmt.Errorf("no free port left in %d-%d for %s", r.From, r.To, name)
+}
+
+func (t *portTable) save(fsys fileSystem) error {
+	b, err := json.MarshalIndent(t, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := fsys.MkdirAll(filepath.Dir(t.path), 0o755); err != nil {
+		return fmt.Errorf("mkdir %s: %w", filepath.Dir(t.path), err)
+	}
+	tmp := t.path + ".tmp"
+	if err := fsys.WriteFile(tmp, append(b, '\n'), 0o644); err != nil {
+		return fmt.Errorf("write %s: %w", tmp, err)
+	}
+	if err := fsys.Rename(tmp, t.path); err != nil {
+		_ = fsys.Remove(tmp)
+		return fmt.Errorf("rename %s: %w", t.path, err)
+	}
+	t.changed = false
+	return nil
+}
@@ -0,0 +1,132 @@
+package sync
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/aayushgautam/wtm/internal/config"
+)
+
+const testTemplate = "BRANCH={{ WTM_BRANCH }}\nCOMPOSE_PROJECT_NAME=app_{{WTM_SLUG}}\nINDEX={{ WTM_INDEX }}\nHEAD={{ WTM_HEAD }}\nDB_USER={{ DB_USER }}\nPORT={{ port web }}\n"
+
+// templateEnv is a testEnv whose repo has .env.wtmtpl and a plain .env,
+// with DB_USER set and two ports to allocate from.
+func templateEnv(t *testing.T) *testEnv {
+	e := newTestEnv(t)
+	e.wts[1].Head = "0123456789abcdef"
+	e.cfg.Templates = config.TemplateConfig{
+		Vars:  map[string]string{"DB_USER": "app"},
+		Ports: config.PortRange{From: 4000, To: 4001},
+	}
+	e.write(e.repo(".env"), "PLAIN=1\n")
+	e.write(e.repo(".env.wtmtpl"), testTemplate)
+	return e
+}
+
+// value returns the value of key in the store file of rel in worktree n.
+func (e *testEnv) value(n int, rel, key string) string {
+	e.t.Helper()
+	for _, line := range strings.Split(e.read(e.store(n, rel)), "\n") {
+		if k, v, ok := strings.Cut(line, "="); ok && k == key {
+			return v
+		}
+	}
+	e.t.Fatalf("%s has no %s:\n%s", e.store(n, rel), key, e.read(e.store(n, rel)))
+	return ""
+}
+
+func TestSyncRendersTemplates(t *testing.T) {
+	e := templateEnv(t)
+	wantExit(t, e.sync("--worktree", "2", "--yes"), 0)
+
+	e.wantLink(2, ".env")
+	for key, want := range map[string]string{
+		"BRANCH":               "feat/a",
+		"COMPOSE_PROJECT_NAME": "app_up_app_feat",
+		"INDEX":                "2",
+		"HEAD":                 "0123456",
+		"DB_USER":              "app",
+	} {
+		if got := e.value(2, ".env", key); got != want {
+			t.Fatalf("%s: expected %q, got %q", key, want, got)
+		}
+	}
+	if _, err := e.fs.Lstat(e.store(2, ".env.wtmtpl")); err == nil {
+		t.Fatal("expected the template itself to stay out of the store")
+	}
+	// Nothing changed, so nothing is rendered again.
+	wantExit(t, e.sync("--worktree", "2", "--yes"), 0)
+}
+
+func TestTemplatePortsAreStableAndDistinct(t *testing.T) {
+	e := templateEnv(t)
+	wantExit(t, e.sync("--worktree", "2", "--yes"), 0)
+	wantExit(t, e.sync("--worktree", "3", "--yes"), 0)
+	feat, fix := e.value(2, ".env", "PORT"), e.value(3, ".env", "PORT")
+	if feat == fix {
+		t.Fatalf("expected distinct ports, both got %s", feat)
+	}
+
+	// A worktree keeps its port when rendered again.
+	e.write(e.repo(".env.wtmtpl"), testTemplate+"EXTRA=1\n")
+	wantExit(t, e.sync("--all", "--yes"), 0)
+	if got := e.value(2, ".env", "PORT"); got != feat {
+		t.Fatalf("expected worktree 2 to keep port %s, got %s", feat, got)
+	}
+	if got := e.value(3, ".env", "PORT"); got != fix {
+		t.Fatalf("expected worktree 3 to keep port %s, got %s", fix, got)
+	}
+
+	// Both ports of the range are taken; a third worktree cannot get one.
+	e.wts = append(e.wts, e.wts[2])
+	e.wts[3].Path = "/src/app-docs"
+	if err := e.fs.MkdirAll("/src/app-docs", 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	wantExit(t, e.sync("--worktree", "4", "--yes"), ExitPartial)
+
+	// Once a worktree is gone, its port is given out again.
+	e.wts = append(e.wts[:2], e.wts[3])
+	wantExit(t, e.sync("--worktree", "3", "--yes"), 0)
+	if got := e.value(3, ".env", "PORT"); got != fix {
+		t.Fatalf("expected the released port %s, got %s", fix, got)
+	}
+}
+
+func TestPushSkipsRenderedTemplates(t *testing.T) {
+	e := templateEnv(t)
+	wantExit(t, e.sync("--worktree", "2", "--yes"), 0)
+	wantExit(t, e.push("--worktree", "2", "--yes"), ExitNothingToDo)
+	if got := e.read(e.repo(".env")); got != "PLAIN=1\n" {
+		t.Fatalf("expected the repo file untouched, got %q", got)
+	}
+}
+
+func TestTemplateErrors(t *testing.T) {
+	for _, c := range []struct {
+		name, template, mode string
+	}{
+		{"unknown variable", "A={{ NOPE }}\n", config.StoreModePerWorktree},
+		{"invalid placeholder", "A={{ port }}\n", config.StoreModePerWorktree},
+		{"shared store", "A=1\n", config.StoreModeShared},
+	} {
+		e := newTestEnv(t)
+		e.cfg.Store.Mode = c.mode
+		e.write(e.repo(".env.wtmtpl"), c.template)
+		if err := e.sync("--worktree", "2", "--yes"); err == nil {
+			t.Fatalf("%s: expected an error", c.name)
+		}
+	}
+}
+
+func TestTemplateSlug(t *testing.T) {
+	for in, want := range map[string]string{
+		"app-feat":       "app_feat",
+		"Feature/X--2":   "feature_x_2",
+		"--worktrees/a.": "worktrees_a",
+	} {
+		if got := templateSlug(in); got != want {
+			t.Fatalf("%q: expected %q, got %q", in, want, got)
+		}
+	}
+}
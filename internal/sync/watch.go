@@ -0,0 +1,407 @@
+package sync
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/aayushgautam/wtm/internal/config"
+	"github.com/aayushgautam/wtm/internal/gitx"
+	"github.com/aayushgautam/wtm/internal/watch"
+)
+
+const (
+	watchDirName    = "watch"
+	defaultDebounce = 500 * time.Millisecond
+)
+
+type watchOptions struct {
+	repoHint string
+	debounce time.Duration
+	daemon   bool
+	stop     bool
+	pidFile  string
+	logFile  string
+}
+
+// watchTarget is a worktree file that watch keeps attached to its store.
+type watchTarget struct {
+	it           planItem
+	worktreeRoot string
+	storeRoot    string
+	layered      bool
+}
+
+// Watch keeps the worktree files of a repo attached to their stores.
+func Watch(args []string) error {
+	opts, err := parseWatchOptions(args)
+	if err != nil {
+		return watchUsageError(err)
+	}
+
+	repoRoot, err := gitx.RepoRoot(opts.repoHint)
+	if err != nil {
+		return err
+	}
+	if opts.pidFile == "" {
+		if opts.pidFile, err = watchFile(repoRoot, ".pid"); err != nil {
+			return err
+		}
+	}
+
+	if opts.stop {
+		return stopWatch(repoRoot, opts.pidFile)
+	}
+	if pid := runningPID(opts.pidFile); pid != 0 {
+		return fmt.Errorf("already watching %s (pid %d); stop it with \"wtm watch --stop\"", repoRoot, pid)
+	}
+	if opts.daemon {
+		return startWatchDaemon(repoRoot, opts)
+	}
+	return newSession(nil).watch(repoRoot, opts)
+}
+
+// watchFile returns the path of the pid or log file (ext) of the watcher of
+// repoRoot.
+func watchFile(repoRoot, ext string) (string, error) {
+	home, err := wtmHome()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, watchDirName, repoSlug(repoRoot)+ext), nil
+}
+
+// runningPID returns the pid recorded in pidFile if that process is still
+// running and is not this one, else 0.
+func runningPID(pidFile string) int {
+	b, err := os.ReadFile(pidFile)
+	if err != nil {
+		return 0
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil || pid <= 0 || pid == os.Getpid() || !processAlive(pid) {
+		return 0
+	}
+	return pid
+}
+
+func writePIDFile(pidFile string, pid int) error {
+	if err := os.MkdirAll(filepath.Dir(pidFile), 0o755); err != nil {
+		return fmt.Errorf("mkdir %s: %w", filepath.Dir(pidFile), err)
+	}
+	if err := os.WriteFile(pidFile, []byte(strconv.Itoa(pid)+"\n"), 0o644); err != nil {
+		return fmt.Errorf("write %s: %w", pidFile, err)
+	}
+	return nil
+}
+
+// removePIDFile removes pidFile if it still names this process.
+func removePIDFile(pidFile string) {
+	b, err := os.ReadFile(pidFile)
+	if err == nil && strings.TrimSpace(string(b)) == strconv.Itoa(os.Getpid()) {
+		_ = os.Remove(pidFile)
+	}
+}
+
+// startWatchDaemon runs "wtm watch" for repoRoot in a new session with its
+// output going to the log file.
+func startWatchDaemon(repoRoot string, opts watchOptions) error {
+	logFile := opts.logFile
+	if logFile == "" {
+		var err error
+		if logFile, err = watchFile(repoRoot, ".log"); err != nil {
+			return err
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(logFile), 0o755); err != nil {
+		return fmt.Errorf("mkdir %s: %w", filepath.Dir(logFile), err)
+	}
+	logf, err := os.OpenFile(logFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("open %s: %w", logFile, err)
+	}
+	defer logf.Close()
+
+	exe, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("find wtm executable: %w", err)
+	}
+	cmd := exec.Command(exe, "watch", "--repo", repoRoot, "--debounce", opts.debounce.String(), "--pidfile", opts.pidFile)
+	cmd.Dir = repoRoot
+	cmd.Stdout = logf
+	cmd.Stderr = logf
+	cmd.SysProcAttr = detachedProcAttr()
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("start watcher: %w", err)
+	}
+	// Written here too so "wtm watch --stop" finds the watcher right away.
+	if err := writePIDFile(opts.pidFile, cmd.Process.Pid); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Watching %s in the background (pid %d).\n", repoRoot, cmd.Process.Pid)
+	fmt.Fprintln(os.Stderr, "Log:", logFile)
+	return cmd.Process.Release()
+}
+
+// stopWatch stops the watcher recorded in pidFile and waits for it to exit.
+func stopWatch(repoRoot, pidFile string) error {
+	pid := runningPID(pidFile)
+	if pid == 0 {
+		return exitError{code: ExitNothingToDo, msg: "no watcher is running for " + repoRoot}
+	}
+	if err := terminateProcess(pid); err != nil {
+		return fmt.Errorf("stop watcher (pid %d): %w", pid, err)
+	}
+	for i := 0; i < 50 && processAlive(pid); i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	if processAlive(pid) {
+		return fmt.Errorf("watcher (pid %d) did not exit", pid)
+	}
+	_ = os.Remove(pidFile)
+	fmt.Fprintf(os.Stderr, "Stopped watcher (pid %d).\n", pid)
+	return nil
+}
+
+// watch runs in the foreground until interrupted, logging every file it
+// reattaches to stderr.
+func (s *session) watch(repoRoot string, opts watchOptions) error {
+	wts, err := s.git.ListWorktrees(repoRoot)
+	if err != nil {
+		return err
+	}
+	loaded, err := s.loadConfig(repoRoot)
+	if err != nil {
+		return err
+	}
+	if s.cipher, err = newStoreCipher(loaded.Config); err != nil {
+		return err
+	}
+	s.historyKeep = loaded.Config.History.Keep
+	targets, worktrees, err := s.watchTargets(repoRoot, wts, loaded.Config)
+	if err != nil {
+		return err
+	}
+	if len(targets) == 0 {
+		fmt.Fprintln(os.Stderr, "No files matched; nothing to watch.")
+		return exitError{code: ExitNothingToDo}
+	}
+
+	if err := writePIDFile(opts.pidFile, os.Getpid()); err != nil {
+		return err
+	}
+	defer removePIDFile(opts.pidFile)
+
+	logger := log.New(os.Stderr, "", log.LstdFlags)
+	w, err := watch.New()
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+	dirs := make(map[string]bool)
+	for path := range targets {
+		dirs[filepath.Dir(path)] = true
+	}
+	watched := 0
+	for _, dir := range sortedKeys(dirs) {
+		if err := w.Add(dir); err != nil {
+			logger.Printf("Not watching %s: %v", dir, err)
+			continue
+		}
+		watched++
+	}
+	logger.Printf("Watching %d files in %d directories of %d worktrees of %s.", len(targets), watched, worktrees, repoRoot)
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(stop)
+	return s.watchLoop(w.Events, w.Errors, stop, targets, opts.debounce, logger)
+}
+
+// watchTargets returns the worktree files of every worktree of repoRoot by
+// path, and how many worktrees they are in.
+func (s *session) watchTargets(repoRoot string, wts []gitx.Worktree, cfg config.Config) (map[string]watchTarget, int, error) {
+	targets := make(map[string]watchTarget)
+	worktrees := 0
+	for _, wt := range wts {
+		if samePath(repoRoot, wt.Path) || wt.Prunable {
+			continue
+		}
+		storeRoot, err := storeRootPath(repoRoot, wt, cfg.Store.Mode)
+		if err != nil {
+			return nil, 0, err
+		}
+		plan, err := s.buildSyncPlan(repoRoot, wt.Path, storeRoot, cfg)
+		if err != nil {
+			return nil, 0, err
+		}
+		for _, it := range plan {
+			targets[it.worktreeAbs] = watchTarget{
+				it:           it,
+				worktreeRoot: wt.Path,
+				storeRoot:    storeRoot,
+				layered:      cfg.Store.Mode == config.StoreModeLayered,
+			}
+		}
+		if len(plan) > 0 {
+			worktrees++
+		}
+	}
+	return targets, worktrees, nil
+}
+
+// watchLoop reattaches changed targets once no event came for debounce.
+func (s *session) watchLoop(events <-chan string, errs <-chan error, stop <-chan os.Signal, targets map[string]watchTarget, debounce time.Duration, logger *log.Logger) error {
+	pending := make(map[string]bool)
+	var fire <-chan time.Time
+	for {
+		select {
+		case path, ok := <-events:
+			if !ok {
+				return errors.New("file watcher stopped")
+			}
+			if _, ok := targets[path]; ok {
+				pending[path] = true
+				fire = time.After(debounce)
+			}
+		case err, ok := <-errs:
+			if !ok {
+				errs = nil
+				continue
+			}
+			logger.Println("Error:", err)
+		case <-fire:
+			fire = nil
+			for _, path := range sortedKeys(pending) {
+				delete(pending, path)
+				msg, err := s.reattach(targets[path])
+				switch {
+				case err != nil:
+					logger.Printf("Error: %s: %v", path, err)
+				case msg != "":
+					logger.Printf("%s: %s", path, msg)
+				}
+			}
+		case <-stop:
+			logger.Println("Stopped.")
+			return nil
+		}
+	}
+}
+
+// reattach brings the worktree file of t back in step with its store and
+// says what it did, or returns "" when the file was fine.
+func (s *session) reattach(t watchTarget) (string, error) {
+	it := t.it
+	info, err := s.fs.Lstat(it.worktreeAbs)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		return "", fmt.Errorf("stat %s: %w", it.worktreeAbs, err)
+	}
+
+	if it.link == config.LinkSymlink {
+		if !info.Mode().IsRegular() {
+			return "", nil
+		}
+		content, err := s.fs.ReadFile(it.worktreeAbs)
+		if err != nil {
+			return "", fmt.Errorf("read %s: %w", it.worktreeAbs, err)
+		}
+		perm := info.Mode().Perm()
+		if storeInfo, err := s.fs.Stat(it.storeAbs); err == nil {
+			perm = storeInfo.Mode().Perm()
+		}
+		if err := s.fs.MkdirAll(filepath.Dir(it.storeAbs), 0o755); err != nil {
+			return "", fmt.Errorf("mkdir %s: %w", filepath.Dir(it.storeAbs), err)
+		}
+		if err := s.withHistory(it, it.storeAbs, historyWatch, func() error { return s.writeFile(it.storeAbs, content, perm) }); err != nil {
+			return "", err
+		}
+		if err := s.ensureWorktreeLink(it.storeAbs, it.worktreeAbs, it.relative, true); err != nil {
+			return "", err
+		}
+		return "link was replaced by a file; copied it into the store and restored the link", nil
+	}
+
+	// Like push, leave copies in a layered store alone: their store file is
+	// rendered from the shared base and the overlay.
+	if t.layered {
+		return "", nil
+	}
+	m, err := s.loadManifest(t.storeRoot)
+	if err != nil {
+		return "", err
+	}
+	captured, err := s.captureWorktreeCopy(m, it, t.worktreeRoot)
+	if err != nil || !captured {
+		return "", err
+	}
+	if err := m.save(); err != nil {
+		return "", err
+	}
+	if it.link == config.LinkHardlink {
+		return "hard link was broken; copied the file into the store and linked it again", nil
+	}
+	return "copied worktree edits into the store", nil
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func parseWatchOptions(args []string) (watchOptions, error) {
+	fsFlags := flag.NewFlagSet("watch", flag.ContinueOnError)
+	fsFlags.SetOutput(io.Discard)
+
+	var opts watchOptions
+	fsFlags.StringVar(&opts.repoHint, "repo", "", "repo path (defaults to current dir repo)")
+	fsFlags.DurationVar(&opts.debounce, "debounce", defaultDebounce, "wait this long after the last change to a file before handling it")
+	fsFlags.BoolVar(&opts.daemon, "daemon", false, "run in the background")
+	fsFlags.BoolVar(&opts.stop, "stop", false, "stop the background watcher")
+	fsFlags.StringVar(&opts.pidFile, "pidfile", "", "pid file (defaults to one per repo under the wtm home)")
+	fsFlags.StringVar(&opts.logFile, "log", "", "log file of --daemon (defaults to one per repo under the wtm home)")
+
+	if err := fsFlags.Parse(args); err != nil {
+		return watchOptions{}, err
+	}
+	if fsFlags.NArg() > 0 {
+		return watchOptions{}, fmt.Errorf("unexpected argument %q", fsFlags.Arg(0))
+	}
+	if opts.debounce < 0 {
+		return watchOptions{}, fmt.Errorf("--debounce must not be negative")
+	}
+	if opts.daemon && opts.stop {
+		return watchOptions{}, fmt.Errorf("--daemon cannot be combined with --stop")
+	}
+	if opts.logFile != "" && !opts.daemon {
+		return watchOptions{}, fmt.Errorf("--log needs --daemon")
+	}
+	return opts, nil
+}
+
+func watchUsageError(err error) error {
+	msg := strings.TrimSpace(err.Error())
+	if msg != "" {
+		fmt.Fprintln(os.Stderr, "Error:", msg)
+	}
+	fmt.Fprintln(os.Stderr, "usage: wtm watch [--repo PATH] [--debounce DURATION] [--daemon [--log PATH] | --stop] [--pidfile PATH]")
+	return fmt.Errorf("invalid arguments")
+}
@@ -0,0 +1,140 @@
+package sync
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aayushgautam/wtm/internal/config"
+)
+
+// watchedEnv is a testEnv synced into worktree 2, with its watch targets.
+func watchedEnv(t *testing.T, link string) (*testEnv, *session, map[string]watchTarget) {
+	e := newTestEnv(t)
+	e.cfg.Link.Mode = link
+	e.write(e.repo(".env"), "A=1\n")
+	wantExit(t, e.sync("--worktree", "2", "--yes"), 0)
+
+	s := e.session()
+	s.cipher = &storeCipher{}
+	targets, worktrees, err := s.watchTargets(testRepo, e.wts, e.cfg)
+	if err != nil {
+		t.Fatalf("targets: %v", err)
+	}
+	if worktrees != 2 || len(targets) != 2 {
+		t.Fatalf("expected .env in 2 worktrees, got %d targets in %d", len(targets), worktrees)
+	}
+	return e, s, targets
+}
+
+func TestReattachRestoresReplacedLink(t *testing.T) {
+	e, s, targets := watchedEnv(t, config.LinkSymlink)
+	// A tool saves atomically: the link is replaced by a new file.
+	if err := e.fs.Remove(e.wt(2, ".env")); err != nil {
+		t.Fatalf("remove: %v", err)
+	}
+	e.write(e.wt(2, ".env"), "A=2\n")
+
+	msg, err := s.reattach(targets[e.wt(2, ".env")])
+	if err != nil || msg == "" {
+		t.Fatalf("expected the link to be restored, got %q, %v", msg, err)
+	}
+	e.wantLink(2, ".env")
+	if got := e.read(e.store(2, ".env")); got != "A=2\n" {
+		t.Fatalf("expected the new content in the store, got %q", got)
+	}
+
+	msg, err = s.reattach(targets[e.wt(2, ".env")])
+	if err != nil || msg != "" {
+		t.Fatalf("expected an attached link to be left alone, got %q, %v", msg, err)
+	}
+	// Worktree 3 was never synced; a missing file is not created.
+	if msg, err := s.reattach(targets[e.wt(3, ".env")]); err != nil || msg != "" {
+		t.Fatalf("expected a missing file to be left alone, got %q, %v", msg, err)
+	}
+}
+
+func TestReattachCapturesCopyEdits(t *testing.T) {
+	e, s, targets := watchedEnv(t, config.LinkCopy)
+	e.write(e.wt(2, ".env"), "A=copy\n")
+
+	msg, err := s.reattach(targets[e.wt(2, ".env")])
+	if err != nil || msg == "" {
+		t.Fatalf("expected the edit to be captured, got %q, %v", msg, err)
+	}
+	if got := e.read(e.store(2, ".env")); got != "A=copy\n" {
+		t.Fatalf("expected the edit in the store, got %q", got)
+	}
+	// The copy is now what the manifest tracks, so sync leaves it alone.
+	wantExit(t, e.sync("--worktree", "2", "--yes"), 0)
+}
+
+func TestReattachRelinksBrokenHardlink(t *testing.T) {
+	e, s, targets := watchedEnv(t, config.LinkHardlink)
+	if err := e.fs.Remove(e.wt(2, ".env")); err != nil {
+		t.Fatalf("remove: %v", err)
+	}
+	e.write(e.wt(2, ".env"), "A=2\n")
+
+	if _, err := s.reattach(targets[e.wt(2, ".env")]); err != nil {
+		t.Fatalf("reattach: %v", err)
+	}
+	a, _ := e.fs.Stat(e.wt(2, ".env"))
+	b, _ := e.fs.Stat(e.store(2, ".env"))
+	if !e.fs.SameFile(a, b) {
+		t.Fatal("expected the hard link to be restored")
+	}
+	if got := e.read(e.store(2, ".env")); got != "A=2\n" {
+		t.Fatalf("expected the new content in the store, got %q", got)
+	}
+}
+
+func TestWatchLoopDebouncesBursts(t *testing.T) {
+	e, s, targets := watchedEnv(t, config.LinkSymlink)
+	if err := e.fs.Remove(e.wt(2, ".env")); err != nil {
+		t.Fatalf("remove: %v", err)
+	}
+	e.write(e.wt(2, ".env"), "A=2\n")
+
+	events := make(chan string)
+	stop := make(chan os.Signal)
+	var logBuf bytes.Buffer
+	done := make(chan error)
+	go func() {
+		done <- s.watchLoop(events, nil, stop, targets, 20*time.Millisecond, log.New(&logBuf, "", 0))
+	}()
+	for i := 0; i < 5; i++ {
+		events <- e.wt(2, ".env")
+	}
+	events <- "/src/app-feat/unrelated"
+	time.Sleep(200 * time.Millisecond)
+	stop <- os.Interrupt
+	if err := <-done; err != nil {
+		t.Fatalf("watch loop: %v", err)
+	}
+
+	e.wantLink(2, ".env")
+	if n := strings.Count(logBuf.String(), "restored the link"); n != 1 {
+		t.Fatalf("expected one reattach for the burst, got %d:\n%s", n, logBuf.String())
+	}
+}
+
+func TestParseWatchOptions(t *testing.T) {
+	opts, err := parseWatchOptions(nil)
+	if err != nil || opts.debounce != defaultDebounce {
+		t.Fatalf("expected the default debounce, got %v, %v", opts.debounce, err)
+	}
+	for _, args := range [][]string{
+		{"--daemon", "--stop"},
+		{"--log", "/tmp/w.log"},
+		{"--debounce", "-1s"},
+		{"extra"},
+	} {
+		if _, err := parseWatchOptions(args); err == nil {
+			t.Fatalf("%q: expected an error", args)
+		}
+	}
+}
@@ -0,0 +1,379 @@
+package sync
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/aayushgautam/wtm/internal/config"
+	"github.com/aayushgautam/wtm/internal/gitx"
+)
+
+const archiveSubDir = "archive"
+
+type worktreeOptions struct {
+	repoHint   string
+	branch     string
+	archive    bool
+	force      bool
+	positional []string
+}
+
+// Worktree dispatches "wtm worktree <add|remove>".
+func Worktree(args []string) error {
+	if len(args) == 0 {
+		return worktreeUsageError(fmt.Errorf("missing subcommand"))
+	}
+	sub := args[0]
+	opts, err := parseWorktreeOptions(sub, args[1:])
+	if err != nil {
+		return worktreeUsageError(err)
+	}
+	switch sub {
+	case "add":
+		if len(opts.positional) < 1 || len(opts.positional) > 2 {
+			return worktreeUsageError(fmt.Errorf("add takes <path> [base]"))
+		}
+		return newSession(nil).addWorktree(opts)
+	case "remove":
+		if len(opts.positional) != 1 {
+			return worktreeUsageError(fmt.Errorf("remove takes <path>"))
+		}
+		return newSession(nil).removeWorktree(opts)
+	default:
+		return worktreeUsageError(fmt.Errorf("unknown subcommand %q", sub))
+	}
+}
+
+func parseWorktreeOptions(sub string, args []string) (worktreeOptions, error) {
+	fsFlags := flag.NewFlagSet("worktree "+sub, flag.ContinueOnError)
+	fsFlags.SetOutput(io.Discard)
+
+	var opts worktreeOptions
+	fsFlags.StringVar(&opts.repoHint, "repo", "", "repo path (defaults to current dir repo)")
+	switch sub {
+	case "add":
+		fsFlags.StringVar(&opts.branch, "b", "", "create this branch for the new worktree")
+	case "remove":
+		fsFlags.BoolVar(&opts.archive, "archive", false, "archive the worktree's store and delete it")
+		fsFlags.BoolVar(&opts.force, "force", false, "pass --force to git worktree remove")
+	}
+
+	positional, err := parseInterspersed(fsFlags, args)
+	if err != nil {
+		return worktreeOptions{}, err
+	}
+	opts.positional = positional
+	return opts, nil
+}
+
+// parseInterspersed parses flags that may appear before, between or after
+// positional arguments, matching how git accepts them.
+func parseInterspersed(fsFlags *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := fsFlags.Parse(args); err != nil {
+			return nil, err
+		}
+		rest := fsFlags.Args()
+		if len(rest) == 0 {
+			return positional, nil
+		}
+		positional = append(positional, rest[0])
+		args = rest[1:]
+	}
+}
+
+func worktreeUsageError(err error) error {
+	msg := strings.TrimSpace(err.Error())
+	if msg != "" {
+		fmt.Fprintln(os.Stderr, "Error:", msg)
+	}
+	fmt.Fprintln(os.Stderr, "usage: wtm worktree add <path> [-b BRANCH] [BASE] [--repo PATH]")
+	fmt.Fprintln(os.Stderr, "       wtm worktree remove <path> [--archive] [--force] [--repo PATH]")
+	return fmt.Errorf("invalid arguments")
+}
+
+func (s *session) addWorktree(opts worktreeOptions) error {
+	repoRoot, err := s.git.RepoRoot(opts.repoHint)
+	if err != nil {
+		return err
+	}
+	path, err := filepath.Abs(opts.positional[0])
+	if err != nil {
+		return err
+	}
+	base := ""
+	if len(opts.positional) == 2 {
+		base = opts.positional[1]
+	}
+
+	if err := s.git.AddWorktree(repoRoot, path, opts.branch, base); err != nil {
+		return err
+	}
+	fmt.Fprintln(os.Stderr, "Created worktree", path)
+
+	wts, err := s.git.ListWorktrees(repoRoot)
+	if err != nil {
+		return err
+	}
+	wt, ok := findWorktree(wts, path)
+	if !ok {
+		return fmt.Errorf("git did not list new worktree %s", path)
+	}
+
+	return s.syncNewWorktree(repoRoot, wts, wt)
+}
+
+// syncNewWorktree syncs every entry into wt, one of wts, without asking.
+// Like sync, it ends with ExitPartial when some entries failed.
+func (s *session) syncNewWorktree(repoRoot string, wts []gitx.Worktree, wt gitx.Worktree) error {
+	loaded, err := s.loadConfig(repoRoot)
+	if err != nil {
+		return err
+	}
+	if err := s.moveLegacyStores(repoRoot, wts, loaded.Config.Store.Mode); err != nil {
+		return err
+	}
+	storeRoot, err := storeRootPath(repoRoot, wt, loaded.Config.Store.Mode)
+	if err != nil {
+		return err
+	}
+	if s.cipher, err = newStoreCipher(loaded.Config); err != nil {
+		return err
+	}
+	s.historyKeep = loaded.Config.History.Keep
+	plan, err := s.buildSyncPlan(repoRoot, wt.Path, storeRoot, loaded.Config)
+	if err != nil {
+		return err
+	}
+	printSyncPlan(repoRoot, wt.Path, storeRoot, loaded.Source, plan)
+
+	// The worktree is new, so nothing in it needs asking about, but edits
+	// already in the store are kept for push to bring over.
+	res := s.applySyncPlan(repoRoot, worktreePlan{worktree: wt, storeRoot: storeRoot, items: plan}, true, preferStore)
+	fmt.Fprintf(os.Stderr, "Done. Copied into store: %d, linked: %d, skipped: %d\n", res.copied, res.linked, res.skipped+res.failed)
+	if res.failed > 0 {
+		return outcomeError(outcomePartial, fmt.Sprintf("%d of %d entries failed", res.failed, len(plan)))
+	}
+	return nil
+}
+
+func (s *session) removeWorktree(opts worktreeOptions) error {
+	repoRoot, err := s.git.RepoRoot(opts.repoHint)
+	if err != nil {
+		return err
+	}
+	path, err := filepath.Abs(opts.positional[0])
+	if err != nil {
+		return err
+	}
+
+	wts, err := s.git.ListWorktrees(repoRoot)
+	if err != nil {
+		return err
+	}
+	wt, ok := findWorktree(wts, path)
+	if !ok {
+		return fmt.Errorf("%s is not a worktree of %s", path, repoRoot)
+	}
+	if samePath(wt.Path, wts[0].Path) || samePath(wt.Path, repoRoot) {
+		return fmt.Errorf("refusing to remove %s: it is the main checkout or the current repo", wt.Path)
+	}
+
+	loaded, err := s.loadConfig(repoRoot)
+	if err != nil {
+		return err
+	}
+	if opts.archive && loaded.Config.Store.Mode == config.StoreModeShared {
+		return fmt.Errorf("--archive is not available in %q store mode: other worktrees still use the store", config.StoreModeShared)
+	}
+
+	storeRoot, err := storeRootPath(repoRoot, wt, loaded.Config.Store.Mode)
+	if err != nil {
+		return err
+	}
+
+	removed, err := s.unlinkStore(storeRoot, wt.Path)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Removed %d links into %s\n", removed, storeRoot)
+
+	archivePath := ""
+	if opts.archive {
+		archivePath, err = s.archiveStore(repoRoot, wt, storeRoot)
+		if err != nil {
+			return err
+		}
+		if archivePath != "" {
+			fmt.Fprintln(os.Stderr, "Archived store to", archivePath)
+		}
+	}
+
+	if err := s.git.RemoveWorktree(repoRoot, wt.Path, opts.force); err != nil {
+		return err
+	}
+	fmt.Fprintln(os.Stderr, "Removed worktree", wt.Path)
+
+	if archivePath != "" {
+		if err := s.fs.RemoveAll(storeRoot); err != nil {
+			return fmt.Errorf("remove store %s: %w", storeRoot, err)
+		}
+	}
+	return nil
+}
+
+func findWorktree(wts []gitx.Worktree, path string) (gitx.Worktree, bool) {
+	for _, wt := range wts {
+		if samePath(wt.Path, path) {
+			return wt, true
+		}
+	}
+	// git reports resolved paths; retry with symlinks resolved on our side.
+	if resolved, err := filepath.EvalSymlinks(path); err == nil {
+		for _, wt := range wts {
+			if samePath(wt.Path, resolved) {
+				return wt, true
+			}
+		}
+	}
+	return gitx.Worktree{}, false
+}
+
+// unlinkStore removes every link in worktreeRoot into storeRoot.
+func (s *session) unlinkStore(storeRoot, worktreeRoot string) (int, error) {
+	removed := 0
+	err := walkDir(s.fs, storeRoot, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && path == storeRoot {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(storeRoot, path)
+		if err != nil {
+			return err
+		}
+		link := filepath.Join(worktreeRoot, rel)
+		info, err := s.fs.Lstat(link)
+		if err != nil {
+			return nil
+		}
+		if info.Mode().IsRegular() && s.sameFile(link, path) {
+			if err := s.fs.Remove(link); err != nil {
+				return fmt.Errorf("remove %s: %w", link, err)
+			}
+			removed++
+			return nil
+		}
+		if info.Mode()&os.ModeSymlink == 0 {
+			return nil
+		}
+		target, err := s.readLinkAbs(link)
+		if err != nil {
+			return nil
+		}
+		if !samePath(target, path) {
+			return nil
+		}
+		if err := s.fs.Remove(link); err != nil {
+			return fmt.Errorf("remove %s: %w", link, err)
+		}
+		removed++
+		return nil
+	})
+	return removed, err
+}
+
+// archiveStore writes storeRoot into a timestamped tar.gz under the wtm
+// archive directory. It returns "" when the store does not exist.
+func (s *session) archiveStore(repoRoot string, wt gitx.Worktree, storeRoot string) (string, error) {
+	if _, err := s.fs.Stat(storeRoot); err != nil {
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		return "", err
+	}
+	base, err := wtmHome()
+	if err != nil {
+		return "", err
+	}
+	dir := filepath.Join(base, archiveSubDir, repoSlug(repoRoot))
+	if err := s.fs.MkdirAll(dir, 0o700); err != nil {
+		return "", fmt.Errorf("mkdir %s: %w", dir, err)
+	}
+	name := strings.Join(worktreePathSegments(repoRoot, wt), "_")
+	if name == "" {
+		name = "worktree"
+	}
+	dst := filepath.Join(dir, name+"-"+time.Now().Format("20060102T150405")+".tar.gz")
+	if _, err := s.fs.Lstat(dst); err == nil {
+		return "", fmt.Errorf("create %s: %w", dst, fs.ErrExist)
+	}
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+
+	err = walkDir(s.fs, storeRoot, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(storeRoot, path)
+		if err != nil || rel == "." {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() && !info.Mode().IsRegular() {
+			return nil
+		}
+		hdr, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(rel)
+		if info.IsDir() {
+			hdr.Name += "/"
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		data, err := s.fs.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		_, err = tw.Write(data)
+		return err
+	})
+	if err == nil {
+		err = tw.Close()
+	}
+	if err == nil {
+		err = gz.Close()
+	}
+	if err == nil {
+		err = s.fs.WriteFile(dst, buf.Bytes(), 0o600)
+	}
+	if err != nil {
+		return "", fmt.Errorf("archive %s: %w", storeRoot, err)
+	}
+	return dst, nil
+}
@@ -0,0 +1,112 @@
+package sync
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"path/filepath"
+	"testing"
+)
+
+func TestSyncNewWorktreeLinksWithoutAsking(t *testing.T) {
+	e := newTestEnv(t)
+	e.write(e.repo(".env"), "A=1\n")
+	e.write(e.wt(2, ".env"), "A=stale\n")
+
+	wantExit(t, e.session().syncNewWorktree(testRepo, e.wts, e.wts[1]), 0)
+	e.wantLink(2, ".env")
+	if got := e.read(e.store(2, ".env")); got != "A=1\n" {
+		t.Fatalf("expected the repo content in the store, got %q", got)
+	}
+}
+
+func TestSyncNewWorktreeKeepsStoreEdits(t *testing.T) {
+	e := syncedEnv(t, "A=1\n")
+	e.write(e.wt(2, ".env"), "A=store\n")
+	e.write(e.repo(".env"), "A=repo\n")
+	_ = e.fs.Remove(e.wt(2, ".env"))
+
+	wantExit(t, e.session().syncNewWorktree(testRepo, e.wts, e.wts[1]), 0)
+	e.wantLink(2, ".env")
+	if got := e.read(e.store(2, ".env")); got != "A=store\n" {
+		t.Fatalf("expected the store edit to be kept, got %q", got)
+	}
+}
+
+func TestSyncNewWorktreeReportsFailures(t *testing.T) {
+	e := newTestEnv(t)
+	e.write(e.repo(".env"), "A=1\n")
+	e.write(e.repo("apps/api/.env"), "B=2\n")
+	// A file where the store needs a directory.
+	e.write(e.store(2, "apps"), "in the way\n")
+
+	wantExit(t, e.session().syncNewWorktree(testRepo, e.wts, e.wts[1]), ExitPartial)
+	e.wantLink(2, ".env")
+}
+
+func TestAddWorktreeMovesLegacyStore(t *testing.T) {
+	e := newTestEnv(t)
+	e.write(e.repo(".env"), "A=1\n")
+	old := "/wtm/configs/app/app-feat"
+	e.write(filepath.Join(old, ".env"), "A=1\n")
+	e.write(filepath.Join(old, ".env.local"), "B=2\n")
+	for _, rel := range []string{".env", ".env.local"} {
+		if err := e.fs.Symlink(filepath.Join(old, rel), e.wt(2, rel)); err != nil {
+			t.Fatalf("symlink: %v", err)
+		}
+	}
+
+	wantExit(t, e.session().addWorktree(worktreeOptions{positional: []string{e.wts[1].Path}}), 0)
+	if len(e.gitCalls) != 1 || e.gitCalls[0] != "add /src/app-feat" {
+		t.Fatalf("expected git to add the worktree, got %q", e.gitCalls)
+	}
+	if e.exists(old) {
+		t.Fatalf("expected %s to be moved", old)
+	}
+	e.wantLink(2, ".env.local")
+	if got := e.read(e.wt(2, ".env.local")); got != "B=2\n" {
+		t.Fatalf("expected the store file to move, got %q", got)
+	}
+}
+
+func TestRemoveWorktreeUnlinksAndArchivesStore(t *testing.T) {
+	e := newTestEnv(t)
+	e.write(e.repo(".env"), "A=1\n")
+	wantExit(t, e.sync("--worktree", "2", "--yes"), 0)
+	storeRoot := filepath.Dir(e.store(2, ".env"))
+
+	opts := worktreeOptions{archive: true, positional: []string{e.wts[1].Path}}
+	wantExit(t, e.session().removeWorktree(opts), 0)
+	if len(e.gitCalls) != 1 || e.gitCalls[0] != "remove /src/app-feat" {
+		t.Fatalf("expected git to remove the worktree, got %q", e.gitCalls)
+	}
+	if e.exists(e.wt(2, ".env")) || e.exists(storeRoot) {
+		t.Fatal("expected the link and the store to be gone")
+	}
+	archives, err := e.fs.ReadDir("/wtm/archive/app")
+	if err != nil || len(archives) != 1 {
+		t.Fatalf("expected one archive, got %v (%v)", archives, err)
+	}
+	data, err := e.fs.ReadFile(filepath.Join("/wtm/archive/app", archives[0].Name()))
+	if err != nil {
+		t.Fatalf("read archive: %v", err)
+	}
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("gzip: %v", err)
+	}
+	hdr, err := tar.NewReader(gz).Next()
+	if err != nil || hdr.Name != ".env" {
+		t.Fatalf("expected .env in the archive, got %v (%v)", hdr, err)
+	}
+}
+
+func TestRemoveWorktreeRefusesMainCheckout(t *testing.T) {
+	e := newTestEnv(t)
+	if err := e.session().removeWorktree(worktreeOptions{positional: []string{testRepo}}); err == nil {
+		t.Fatal("expected the main checkout to be refused")
+	}
+	if len(e.gitCalls) != 0 {
+		t.Fatalf("expected git to be left alone, got %q", e.gitCalls)
+	}
+}
@@ -0,0 +1,58 @@
+package textdiff
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestUnifiedIdentical(t *testing.T) {
+	if got := Unified("a", "b", []byte("x\n"), []byte("x\n"), DefaultContext); got != "" {
+		t.Fatalf("expected empty diff, got %q", got)
+	}
+}
+
+func TestUnifiedSingleHunk(t *testing.T) {
+	a := "A=1\nB=2\nC=3\n"
+	b := "A=1\nB=20\nC=3\nD=4\n"
+	want := `--- repo/.env
++++ store/.env
+@@ -1,3 +1,4 @@
+ A=1
+-B=2
++B=20
+ C=3
++D=4
+`
+	if got := Unified("repo/.env", "store/.env", []byte(a), []byte(b), DefaultContext); got != want {
+		t.Fatalf("want:\n%s\ngot:\n%s", want, got)
+	}
+}
+
+func TestUnifiedSeparateHunks(t *testing.T) {
+	var a, b []string
+	for i := 0; i < 20; i++ {
+		line := string(rune('a'+i)) + "\n"
+		a = append(a, line)
+		b = append(b, line)
+	}
+	b[1] = "changed-b\n"
+	b[18] = "changed-s\n"
+	got := Unified("a", "b", []byte(strings.Join(a, "")), []byte(strings.Join(b, "")), 2)
+	if n := strings.Count(got, "@@ -"); n != 2 {
+		t.Fatalf("expected 2 hunks, got %d:\n%s", n, got)
+	}
+	if !strings.Contains(got, "@@ -1,4 +1,4 @@\n a\n-b\n+changed-b\n c\n d\n") {
+		t.Fatalf("unexpected first hunk:\n%s", got)
+	}
+	if !strings.Contains(got, "@@ -17,4 +17,4 @@\n q\n r\n-s\n+changed-s\n t\n") {
+		t.Fatalf("unexpected second hunk:\n%s", got)
+	}
+}
+
+func TestUnifiedFromEmptyAndMissingNewline(t *testing.T) {
+	got := Unified("/dev/null", "b", nil, []byte("A=1\nB=2"), DefaultContext)
+	want := "--- /dev/null\n+++ b\n@@ -0,0 +1,2 @@\n+A=1\n+B=2\n\\ No newline at end of file\n"
+	if got != want {
+		t.Fatalf("want %q, got %q", want, got)
+	}
+}
@@ -0,0 +1,115 @@
+package watch
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// dirMask selects the inotify events reported for a watched directory.
+const dirMask = syscall.IN_CREATE | syscall.IN_CLOSE_WRITE | syscall.IN_MODIFY |
+	syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO | syscall.IN_DELETE | syscall.IN_ATTRIB |
+	syscall.IN_DELETE_SELF | syscall.IN_MOVE_SELF | syscall.IN_ONLYDIR
+
+type impl struct {
+	fd   int
+	f    *os.File
+	mu   sync.Mutex
+	dirs map[int32]string // by watch descriptor
+}
+
+// New starts a watcher with no directories.
+func New() (*Watcher, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, os.NewSyscallError("inotify_init1", err)
+	}
+	w := &Watcher{
+		Events: make(chan string),
+		Errors: make(chan error),
+		done:   make(chan struct{}),
+		// The descriptor is non-blocking, so reads wait in the runtime
+		// poller and Close interrupts them.
+		impl: impl{fd: fd, f: os.NewFile(uintptr(fd), "inotify"), dirs: make(map[int32]string)},
+	}
+	go w.read()
+	return w, nil
+}
+
+// Add watches the entries of dir.
+func (w *Watcher) Add(dir string) error {
+	dir = filepath.Clean(dir)
+	wd, err := syscall.InotifyAddWatch(w.fd, dir, dirMask)
+	if err != nil {
+		return &os.PathError{Op: "inotify_add_watch", Path: dir, Err: err}
+	}
+	w.mu.Lock()
+	w.dirs[int32(wd)] = dir
+	w.mu.Unlock()
+	return nil
+}
+
+// Close stops the watcher.
+func (w *Watcher) Close() error {
+	select {
+	case <-w.done:
+		return nil
+	default:
+	}
+	close(w.done)
+	return w.f.Close()
+}
+
+func (w *Watcher) read() {
+	defer close(w.Errors)
+	defer close(w.Events)
+	// Room for many events; a name is at most NAME_MAX+1 bytes.
+	buf := make([]byte, (syscall.SizeofInotifyEvent+syscall.NAME_MAX+1)*64)
+	for {
+		n, err := w.f.Read(buf)
+		if err != nil {
+			if errors.Is(err, os.ErrClosed) {
+				return
+			}
+			if !w.sendError(fmt.Errorf("read inotify events: %w", err)) {
+				return
+			}
+			continue
+		}
+		for off := 0; off+syscall.SizeofInotifyEvent <= n; {
+			wd := int32(binary.NativeEndian.Uint32(buf[off:]))
+			mask := binary.NativeEndian.Uint32(buf[off+4:])
+			nameLen := int(binary.NativeEndian.Uint32(buf[off+12:]))
+			name := strings.TrimRight(string(buf[off+syscall.SizeofInotifyEvent:off+syscall.SizeofInotifyEvent+nameLen]), "\x00")
+			off += syscall.SizeofInotifyEvent + nameLen
+
+			if mask&syscall.IN_Q_OVERFLOW != 0 {
+				if !w.sendError(errors.New("inotify event queue overflowed; some changes were missed")) {
+					return
+				}
+				continue
+			}
+			w.mu.Lock()
+			dir, ok := w.dirs[wd]
+			if mask&syscall.IN_IGNORED != 0 {
+				delete(w.dirs, wd)
+			}
+			w.mu.Unlock()
+			if !ok || mask&syscall.IN_IGNORED != 0 {
+				continue
+			}
+			path := dir
+			if name != "" {
+				path = filepath.Join(dir, name)
+			}
+			if !w.send(path) {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,133 @@
+//go:build !linux
+
+package watch
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// pollInterval is how often watched directories are listed.
+const pollInterval = time.Second
+
+type impl struct {
+	mu   sync.Mutex
+	dirs map[string]map[string]entryState // entries by name, by directory
+}
+
+// entryState is what a poll compares to tell that an entry changed.
+type entryState struct {
+	mode    fs.FileMode
+	size    int64
+	modTime time.Time
+}
+
+// New starts a watcher with no directories.
+func New() (*Watcher, error) {
+	w := &Watcher{
+		Events: make(chan string),
+		Errors: make(chan error),
+		done:   make(chan struct{}),
+		impl:   impl{dirs: make(map[string]map[string]entryState)},
+	}
+	go w.poll()
+	return w, nil
+}
+
+// Add watches the entries of dir.
+func (w *Watcher) Add(dir string) error {
+	dir = filepath.Clean(dir)
+	entries, err := list(dir)
+	if err != nil {
+		return err
+	}
+	w.mu.Lock()
+	w.dirs[dir] = entries
+	w.mu.Unlock()
+	return nil
+}
+
+// Close stops the watcher.
+func (w *Watcher) Close() error {
+	select {
+	case <-w.done:
+	default:
+		close(w.done)
+	}
+	return nil
+}
+
+func (w *Watcher) poll() {
+	defer close(w.Errors)
+	defer close(w.Events)
+	t := time.NewTicker(pollInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-w.done:
+			return
+		case <-t.C:
+		}
+		w.mu.Lock()
+		dirs := make([]string, 0, len(w.dirs))
+		for dir := range w.dirs {
+			dirs = append(dirs, dir)
+		}
+		w.mu.Unlock()
+		for _, dir := range dirs {
+			if !w.pollDir(dir) {
+				return
+			}
+		}
+	}
+}
+
+// pollDir reports the entries of dir that changed since the last poll.
+func (w *Watcher) pollDir(dir string) bool {
+	now, err := list(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return w.sendError(err)
+	}
+	w.mu.Lock()
+	before := w.dirs[dir]
+	w.dirs[dir] = now
+	w.mu.Unlock()
+	for name, st := range now {
+		if old, ok := before[name]; !ok || !old.same(st) {
+			if !w.send(filepath.Join(dir, name)) {
+				return false
+			}
+		}
+	}
+	for name := range before {
+		if _, ok := now[name]; !ok {
+			if !w.send(filepath.Join(dir, name)) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (e entryState) same(o entryState) bool {
+	return e.mode == o.mode && e.size == o.size && e.modTime.Equal(o.modTime)
+}
+
+func list(dir string) (map[string]entryState, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	out := make(map[string]entryState, len(entries))
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		out[e.Name()] = entryState{mode: info.Mode(), size: info.Size(), modTime: info.ModTime()}
+	}
+	return out, nil
+}
@@ -0,0 +1,31 @@
+// Package watch reports changes to the entries of directories: through
+// inotify on Linux, and by polling elsewhere.
+package watch
+
+// Watcher sends the path of every changed entry in the directories
+// passed to Add on Events.
+type Watcher struct {
+	Events chan string
+	Errors chan error
+	done   chan struct{}
+	impl
+}
+
+// send delivers path unless the watcher is closing.
+func (w *Watcher) send(path string) bool {
+	select {
+	case w.Events <- path:
+		return true
+	case <-w.done:
+		return false
+	}
+}
+
+func (w *Watcher) sendError(err error) bool {
+	select {
+	case w.Errors <- err:
+		return true
+	case <-w.done:
+		return false
+	}
+}
@@ -0,0 +1,88 @@
+package watch
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// waitFor returns once path is reported, failing the test after a timeout.
+func waitFor(t *testing.T, w *Watcher, path string) {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case got := <-w.Events:
+			if got == path {
+				return
+			}
+		case err := <-w.Errors:
+			t.Fatalf("watch error: %v", err)
+		case <-timeout:
+			t.Fatalf("no event for %s", path)
+		}
+	}
+}
+
+func TestWatcherReportsChanges(t *testing.T) {
+	dir := t.TempDir()
+	w, err := New()
+	if err != nil {
+		t.Fatalf("new: %v", err)
+	}
+	defer w.Close()
+	if err := w.Add(dir); err != nil {
+		t.Fatalf("add: %v", err)
+	}
+
+	path := filepath.Join(dir, ".env")
+	if err := os.WriteFile(path, []byte("A=1\n"), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	waitFor(t, w, path)
+
+	// Tools that save atomically rename a temporary file over the old one.
+	tmp := filepath.Join(dir, ".env.tmp")
+	if err := os.WriteFile(tmp, []byte("A=22\n"), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		t.Fatalf("rename: %v", err)
+	}
+	waitFor(t, w, path)
+
+	if err := os.Remove(path); err != nil {
+		t.Fatalf("remove: %v", err)
+	}
+	waitFor(t, w, path)
+}
+
+func TestWatcherAddMissingDir(t *testing.T) {
+	w, err := New()
+	if err != nil {
+		t.Fatalf("new: %v", err)
+	}
+	defer w.Close()
+	if err := w.Add(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Fatal("expected an error for a missing directory")
+	}
+}
+
+func TestWatcherCloseEndsEvents(t *testing.T) {
+	w, err := New()
+	if err != nil {
+		t.Fatalf("new: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	select {
+	case _, ok := <-w.Events:
+		if ok {
+			t.Fatal("expected Events to be closed")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Events not closed")
+	}
+}